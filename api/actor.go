@@ -0,0 +1,23 @@
+package api
+
+import (
+	"assignment/domain"
+	"net/http"
+)
+
+// Actor stores the name from the X-Actor header in the request context, it's
+// the person the changes are attributed to. The name is taken as is, callers
+// are trusted to have authenticated it: API keys only pick the tenant.
+func (c *Controller) Actor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		actor := req.Header.Get("X-Actor")
+		if err := domain.ValidateActor(actor); err != nil {
+			c.writeError(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		next.ServeHTTP(w, req.WithContext(domain.WithActor(ctx, actor)))
+	})
+}
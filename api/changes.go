@@ -0,0 +1,268 @@
+package api
+
+import (
+	"assignment/domain"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type change struct {
+	Seq     int64             `json:"seq"`
+	Type    domain.ChangeType `json:"type"`
+	Segment string            `json:"segment"`
+	UserId  *int              `json:"user_id,omitempty"`
+	Actor   string            `json:"actor,omitempty"`
+	At      time.Time         `json:"at"`
+}
+
+func newChange(ch domain.Change) change {
+	return change{
+		Seq:     ch.Seq,
+		Type:    ch.Type,
+		Segment: ch.Segment,
+		UserId:  ch.User,
+		Actor:   ch.Actor,
+		At:      ch.At,
+	}
+}
+
+func (c *Controller) GetChanges(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		After int64 `json:"after"`
+		Limit int   `json:"limit"`
+		// Wait is how many seconds to wait for changes if there are none.
+		Wait float64 `json:"wait"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	wait := time.Duration(body.Wait * float64(time.Second))
+	changes, cursor, err := c.SegmentService.GetChanges(ctx, body.After, body.Limit, wait)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrInvalidLimit):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidLimit)
+		case errors.Is(err, domain.ErrInvalidWait):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidWait)
+		case ctx.Err() != nil:
+			// The client went away while waiting.
+		default:
+			c.Log.ErrorContext(ctx, "failed to get changes", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp := struct {
+		Changes []change `json:"changes"`
+		// Cursor is the value of after to read the next changes.
+		Cursor int64 `json:"cursor"`
+	}{
+		Changes: make([]change, 0, len(changes)),
+		Cursor:  cursor,
+	}
+	for _, ch := range changes {
+		resp.Changes = append(resp.Changes, newChange(ch))
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, resp)
+}
+
+func (c *Controller) GetChangesCursor(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	cursor, err := c.SegmentService.GetChangesCursor(ctx)
+	if err != nil {
+		c.Log.ErrorContext(ctx, "failed to get changes cursor", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, map[string]int64{"cursor": cursor})
+}
+
+func (c *Controller) GetUserMemberships(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		UserId int `json:"user_id"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	segments, err := c.SegmentService.GetUserMemberships(ctx, body.UserId)
+	if err != nil {
+		c.Log.ErrorContext(ctx, "failed to get user memberships", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		UserId   int      `json:"user_id"`
+		Segments []string `json:"segments"`
+	}{
+		UserId:   body.UserId,
+		Segments: segments,
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, resp)
+}
+
+// WatchUserSegments streams the user's segments as server-sent events: a
+// "segments" event with all of them and then a "segment_added" or a
+// "segment_removed" event for every change.
+func (c *Controller) WatchUserSegments(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		UserId int `json:"user_id"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		c.Log.ErrorContext(ctx, "response writer doesn't support flushing")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	started := false
+	err := c.SegmentService.WatchUserSegments(ctx, body.UserId, func(e domain.UserSegmentsEvent) error {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			started = true
+
+			segments := e.Segments
+			if segments == nil {
+				segments = []string{}
+			}
+			if err := writeEvent(w, "segments", map[string]any{"user_id": body.UserId, "segments": segments}); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		if len(e.Added) == 0 && len(e.Removed) == 0 {
+			// Keeps proxies from closing the idle connection.
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return err
+			}
+		}
+		for _, segment := range e.Added {
+			if err := writeEvent(w, "segment_added", map[string]any{"user_id": body.UserId, "segment": segment}); err != nil {
+				return err
+			}
+		}
+		for _, segment := range e.Removed {
+			if err := writeEvent(w, "segment_removed", map[string]any{"user_id": body.UserId, "segment": segment}); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		c.Log.ErrorContext(ctx, "failed to watch user segments", slog.String("error", err.Error()))
+		if !started {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+func writeEvent(w io.Writer, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+type segmentChange struct {
+	Segment string    `json:"segment"`
+	Type    string    `json:"type"`
+	At      time.Time `json:"at"`
+	Actor   string    `json:"actor,omitempty"`
+}
+
+func newSegmentChanges(changes []domain.SegmentChange) []segmentChange {
+	resp := make([]segmentChange, 0, len(changes))
+	for _, sc := range changes {
+		typ := domain.ChangeMemberRemoved
+		if sc.Added {
+			typ = domain.ChangeMemberAdded
+		}
+		resp = append(resp, segmentChange{Segment: sc.Segment, Type: string(typ), At: sc.At, Actor: sc.Actor})
+	}
+	return resp
+}
+
+func (c *Controller) GetUserSegmentsDiff(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		UserId int       `json:"user_id"`
+		From   time.Time `json:"from"`
+		To     time.Time `json:"to"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	diff, err := c.SegmentService.GetUserSegmentsDiff(ctx, body.UserId, body.From, body.To)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidTimeRange) {
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidTimeRange)
+			return
+		}
+		c.Log.ErrorContext(ctx, "failed to get user segments diff", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, struct {
+		UserId  int             `json:"user_id"`
+		Gained  []segmentChange `json:"gained"`
+		Lost    []segmentChange `json:"lost"`
+		Changes []segmentChange `json:"changes"`
+	}{body.UserId, newSegmentChanges(diff.Gained), newSegmentChanges(diff.Lost), newSegmentChanges(diff.Changes)})
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// The admin UI gets a token in CSRFCookie and sends it back in CSRFHeader.
+const (
+	CSRFCookie = "csrf_token"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+var ErrInvalidCSRFToken = errors.New("csrf token is missing or invalid")
+
+// CSRF rejects state-changing requests made by browsers on behalf of other
+// sites. Requests that carry the CSRF cookie, i.e. ones made from the admin
+// UI, must repeat it in the CSRFHeader header. Requests without it are
+// only accepted if the browser doesn't mark them as cross-site, so that
+// API clients keep working as before.
+func (c *Controller) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.Header.Get("Sec-Fetch-Site") == "cross-site" || !sameOrigin(req) {
+			c.writeError(ctx, w, http.StatusForbidden, ErrInvalidCSRFToken)
+			return
+		}
+
+		if cookie, err := req.Cookie(CSRFCookie); err == nil {
+			header := req.Header.Get(CSRFHeader)
+			if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+				c.writeError(ctx, w, http.StatusForbidden, ErrInvalidCSRFToken)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// sameOrigin reports whether the Origin header, if any, points to the host
+// the request was sent to.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == req.Host
+}
+
+// SetCSRFCookie gives the browser a CSRF token unless it already has one.
+func SetCSRFCookie(w http.ResponseWriter, req *http.Request) error {
+	if _, err := req.Cookie(CSRFCookie); err == nil {
+		return nil
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    hex.EncodeToString(token),
+		Path:     "/",
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"assignment/domain"
+	"context"
+)
+
+type membership struct {
+	UserID  int    `json:"user_id"`
+	Segment string `json:"segment"`
+}
+
+// dryRunEffect is what a request made with dry_run would change. The lists
+// stop at domain.MaxDryRunChanges changes, Total counts all of them.
+type dryRunEffect struct {
+	DryRun          bool         `json:"dry_run"`
+	SegmentsCreated []string     `json:"segments_created"`
+	SegmentsDeleted []string     `json:"segments_deleted"`
+	MembersAdded    []membership `json:"members_added"`
+	MembersRemoved  []membership `json:"members_removed"`
+	Total           int          `json:"total"`
+	Errors          []string     `json:"errors,omitempty"`
+	// ApprovalRequired means the change would be stored as a change request
+	// instead of being applied, nothing else is listed then.
+	ApprovalRequired bool `json:"approval_required,omitempty"`
+}
+
+func newDryRunEffect(result domain.DryRunResult) dryRunEffect {
+	effect := dryRunEffect{
+		DryRun:           true,
+		SegmentsCreated:  []string{},
+		SegmentsDeleted:  []string{},
+		MembersAdded:     []membership{},
+		MembersRemoved:   []membership{},
+		Total:            result.Total,
+		ApprovalRequired: result.ApprovalRequired,
+	}
+	for _, ch := range result.Changes {
+		switch {
+		case ch.Type == domain.ChangeSegmentCreated:
+			effect.SegmentsCreated = append(effect.SegmentsCreated, ch.Segment)
+		case ch.Type == domain.ChangeSegmentDeleted:
+			effect.SegmentsDeleted = append(effect.SegmentsDeleted, ch.Segment)
+		case ch.Type == domain.ChangeMemberAdded && ch.User != nil:
+			effect.MembersAdded = append(effect.MembersAdded, membership{*ch.User, ch.Segment})
+		case ch.Type == domain.ChangeMemberRemoved && ch.User != nil:
+			effect.MembersRemoved = append(effect.MembersRemoved, membership{*ch.User, ch.Segment})
+		}
+	}
+	return effect
+}
+
+// apply runs f, in a dry run if dryRun is set.
+func (c *Controller) apply(ctx context.Context, dryRun bool, f func(ctx context.Context) error) (domain.DryRunResult, error) {
+	if !dryRun {
+		return domain.DryRunResult{}, f(ctx)
+	}
+	return c.SegmentService.DryRun(ctx, f)
+}
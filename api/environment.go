@@ -0,0 +1,27 @@
+package api
+
+import (
+	"assignment/domain"
+	"net/http"
+)
+
+// Environment stores the environment named by the X-Environment header in
+// the request context, requests without it work with
+// domain.DefaultEnvironment.
+func (c *Controller) Environment(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		environment := domain.DefaultEnvironment
+		if header := req.Header.Get("X-Environment"); header != "" {
+			environment = header
+		}
+
+		if err := domain.ValidateEnvironment(environment); err != nil {
+			c.writeError(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		next.ServeHTTP(w, req.WithContext(domain.WithEnvironment(ctx, environment)))
+	})
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"assignment/domain"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxUploadBytes limits the size of uploaded files.
+const maxUploadBytes = 64 << 20
+
+var ErrUploadTooLarge = errors.New("upload must be at most 64 MiB")
+
+type job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Environment string          `json:"environment"`
+	Actor       string          `json:"actor,omitempty"`
+	Status      string          `json:"status"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	// DownloadURL is set for done report jobs.
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+func newJob(j domain.Job) job {
+	return job{
+		ID:          j.ID,
+		Kind:        string(j.Kind),
+		Environment: j.Environment,
+		Actor:       j.Actor,
+		Status:      string(j.Status),
+		Result:      j.Result,
+		Error:       j.Error,
+		CreatedAt:   j.CreatedAt,
+		StartedAt:   j.StartedAt,
+		FinishedAt:  j.FinishedAt,
+	}
+}
+
+// jobResponse adds the download link to done report jobs. It links to
+// download_report unless the blob store gives out links itself.
+func (c *Controller) jobResponse(ctx context.Context, j domain.Job) (job, error) {
+	resp := newJob(j)
+	if j.Kind != domain.JobReport || j.Status != domain.JobDone {
+		return resp, nil
+	}
+
+	url, err := c.SegmentService.ReportURL(ctx, j)
+	if err != nil {
+		return job{}, err
+	}
+	if url == "" {
+		url = "/api/download_report?id=" + strconv.FormatInt(j.ID, 10)
+	}
+	resp.DownloadURL = url
+	return resp, nil
+}
+
+func (c *Controller) GetJob(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		ID int64 `json:"id"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	j, err := c.SegmentService.GetJob(ctx, body.ID)
+	if err != nil {
+		if errors.Is(err, domain.ErrJobNotFound) {
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrJobNotFound)
+			return
+		}
+		c.Log.ErrorContext(ctx, "failed to get job", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := c.jobResponse(ctx, j)
+	if err != nil {
+		c.Log.ErrorContext(ctx, "failed to get job", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	c.writeJSON(ctx, w, http.StatusOK, resp)
+}
+
+func (c *Controller) GetJobs(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Kind  domain.JobKind `json:"kind"`
+		Limit int            `json:"limit"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	jobs, err := c.SegmentService.GetJobs(ctx, body.Kind, body.Limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrInvalidJobKind):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidJobKind)
+		case errors.Is(err, domain.ErrInvalidLimit):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidLimit)
+		default:
+			c.Log.ErrorContext(ctx, "failed to get jobs", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp := make([]job, 0, len(jobs))
+	for _, j := range jobs {
+		r, err := c.jobResponse(ctx, j)
+		if err != nil {
+			c.Log.ErrorContext(ctx, "failed to get jobs", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp = append(resp, r)
+	}
+	c.writeJSON(ctx, w, http.StatusOK, map[string][]job{"jobs": resp})
+}
+
+// UploadSegmentMembers takes a CSV of user IDs either as the body or as the
+// "file" field of a multipart form. The segment and the mode come from the
+// query or from the form, the mode defaults to add. Small uploads are
+// applied right away and answered with 200, larger ones with 202 and a job
+// to follow with get_job.
+func (c *Controller) UploadSegmentMembers(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadBytes)
+
+	// Only multipart bodies are parsed as a form, a CSV body sent as
+	// application/x-www-form-urlencoded would be consumed otherwise.
+	form := req.URL.Query()
+	var file io.Reader = req.Body
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if err := req.ParseMultipartForm(10 << 20); err != nil {
+			c.writeUploadError(ctx, w, err)
+			return
+		}
+		defer req.MultipartForm.RemoveAll()
+		form = req.Form
+
+		f, _, err := req.FormFile("file")
+		if err != nil {
+			c.Log.ErrorContext(ctx, "failed reading uploaded file", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		file = f
+	}
+
+	mode := domain.UploadMode(form.Get("mode"))
+	if mode == "" {
+		mode = domain.UploadAdd
+	}
+
+	j, rows, err := c.SegmentService.UploadSegmentMembers(ctx, form.Get("segment"), mode, file)
+	if errors.Is(err, domain.ErrInvalidRows) {
+		type rowError struct {
+			Line   int    `json:"line"`
+			Value  string `json:"value"`
+			Reason string `json:"reason"`
+		}
+		resp := struct {
+			Error string     `json:"error"`
+			Rows  []rowError `json:"rows"`
+		}{Error: domain.ErrInvalidRows.Error(), Rows: make([]rowError, 0, len(rows))}
+		for _, row := range rows {
+			resp.Rows = append(resp.Rows, rowError(row))
+		}
+		c.writeJSON(ctx, w, http.StatusBadRequest, resp)
+		return
+	}
+	if err != nil {
+		c.writeUploadError(ctx, w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if j.Status == domain.JobPending || j.Status == domain.JobRunning {
+		status = http.StatusAccepted
+	}
+	c.writeJSON(ctx, w, status, newJob(j))
+}
+
+// writeUploadError responds to errors of reading an upload and of
+// UploadSegmentMembers.
+func (c *Controller) writeUploadError(ctx context.Context, w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		c.writeError(ctx, w, http.StatusRequestEntityTooLarge, ErrUploadTooLarge)
+	case errors.Is(err, domain.ErrInvalidUploadMode):
+		c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidUploadMode)
+	case errors.Is(err, domain.ErrInvalidCSV):
+		c.writeJSON(ctx, w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, domain.ErrTooManyRows):
+		c.writeError(ctx, w, http.StatusRequestEntityTooLarge, domain.ErrTooManyRows)
+	case errors.Is(err, domain.ErrSegmentNotFound):
+		c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+	case errors.Is(err, domain.ErrSegmentProtected):
+		c.writeError(ctx, w, http.StatusConflict, domain.ErrSegmentProtected)
+	case errors.Is(err, http.ErrNotMultipart) || errors.Is(err, http.ErrMissingBoundary):
+		c.writeError(ctx, w, http.StatusBadRequest, err)
+	default:
+		c.Log.ErrorContext(ctx, "failed to upload segment members", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// CreateReport starts a job that builds the report, it's followed with
+// get_job until the job gives a download link.
+func (c *Controller) CreateReport(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Report domain.ReportKind `json:"report"`
+		From   time.Time         `json:"from"`
+		To     time.Time         `json:"to"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	j, err := c.SegmentService.CreateReport(ctx, body.Report, body.From, body.To)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrInvalidReport):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidReport)
+		case errors.Is(err, domain.ErrInvalidTimeRange):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidTimeRange)
+		default:
+			c.Log.ErrorContext(ctx, "failed to create report", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusAccepted, newJob(j))
+}
+
+func (c *Controller) DownloadReport(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		ID int64 `json:"id"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	r, err := c.SegmentService.OpenReport(ctx, body.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrJobNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrJobNotFound)
+		case errors.Is(err, domain.ErrBlobNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrBlobNotFound)
+		case errors.Is(err, domain.ErrReportNotReady):
+			c.writeError(ctx, w, http.StatusConflict, domain.ErrReportNotReady)
+		default:
+			c.Log.ErrorContext(ctx, "failed to download report", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	defer r.Close()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="report-%d.csv"`, body.ID))
+	if _, err := io.Copy(w, r); err != nil {
+		c.Log.ErrorContext(ctx, "failed to send report", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"assignment/domain"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type operation struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"user_id"`
+	Actor     string    `json:"actor,omitempty"`
+	Added     []string  `json:"added"`
+	Removed   []string  `json:"removed"`
+	CreatedAt time.Time `json:"created_at"`
+	UndoneBy  *int64    `json:"undone_by,omitempty"`
+}
+
+func newOperation(op domain.Operation) operation {
+	resp := operation{
+		ID:        op.ID,
+		UserID:    op.User,
+		Actor:     op.Actor,
+		Added:     op.Added,
+		Removed:   op.Removed,
+		CreatedAt: op.CreatedAt,
+		UndoneBy:  op.UndoneBy,
+	}
+	if resp.Added == nil {
+		resp.Added = []string{}
+	}
+	if resp.Removed == nil {
+		resp.Removed = []string{}
+	}
+	return resp
+}
+
+func (c *Controller) GetOperation(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		ID int64 `json:"id"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	op, err := c.SegmentService.GetOperation(ctx, body.ID)
+	if err != nil {
+		if errors.Is(err, domain.ErrOperationNotFound) {
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrOperationNotFound)
+			return
+		}
+		c.Log.ErrorContext(ctx, "failed to get operation", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, newOperation(op))
+}
+
+// UndoOperation responds with the operation that reverted the given one.
+func (c *Controller) UndoOperation(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		ID int64 `json:"id"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	op, err := c.SegmentService.UndoOperation(ctx, body.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrOperationNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrOperationNotFound)
+		case errors.Is(err, domain.ErrOperationUndone):
+			c.writeError(ctx, w, http.StatusConflict, domain.ErrOperationUndone)
+		case errors.Is(err, domain.ErrUndoConflict):
+			c.writeError(ctx, w, http.StatusConflict, domain.ErrUndoConflict)
+		case errors.Is(err, domain.ErrSegmentIsFull):
+			c.writeError(ctx, w, http.StatusConflict, domain.ErrSegmentIsFull)
+		case errors.Is(err, domain.ErrSegmentProtected):
+			c.writeError(ctx, w, http.StatusConflict, domain.ErrSegmentProtected)
+		default:
+			c.Log.ErrorContext(ctx, "failed to undo operation", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, newOperation(op))
+}
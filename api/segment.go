@@ -2,16 +2,23 @@ package api
 
 import (
 	"assignment/domain"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Controller struct {
 	SegmentService domain.SegmentService
 	Log            *slog.Logger
+	// APIKeys maps API keys to the tenants they belong to, see Tenant.
+	APIKeys map[string]string
 }
 
 func New(service domain.SegmentService) *Controller {
@@ -37,6 +44,7 @@ func (c *Controller) CreateSegment(w http.ResponseWriter, req *http.Request) {
 
 	var body struct {
 		Segment string `json:"segment"`
+		DryRun  bool   `json:"dry_run"`
 	}
 
 	if err := json.Unmarshal(rawBody, &body); err != nil {
@@ -45,7 +53,9 @@ func (c *Controller) CreateSegment(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = c.SegmentService.CreateSegment(req.Context(), body.Segment)
+	effect, err := c.apply(ctx, body.DryRun, func(ctx context.Context) error {
+		return c.SegmentService.CreateSegment(ctx, body.Segment)
+	})
 	if err != nil {
 		var resp []byte
 		if errors.Is(err, domain.ErrSegmentAlreadyExists) {
@@ -63,11 +73,523 @@ func (c *Controller) CreateSegment(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if body.DryRun {
+		c.writeJSON(ctx, w, http.StatusOK, newDryRunEffect(effect))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (c *Controller) DeleteSegment(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rawBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		c.Log.ErrorContext(ctx, "failed reading body", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Segment string `json:"segment"`
+		DryRun  bool   `json:"dry_run"`
+	}
+
+	if err := json.Unmarshal(rawBody, &body); err != nil {
+		c.Log.ErrorContext(ctx, "failed unmarshaling body", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	effect, err := c.apply(ctx, body.DryRun, func(ctx context.Context) error {
+		return c.SegmentService.DeleteSegment(ctx, body.Segment)
+	})
+	if err != nil {
+		if c.writeApprovalRequired(ctx, w, err) {
+			return
+		}
+		if errors.Is(err, domain.ErrSegmentNotFound) {
+			var resp []byte
+			resp, _ = json.Marshal(map[string]string{"error": "can't find the segment"})
+			_, err = w.Write(resp)
+			if err != nil {
+				c.Log.ErrorContext(ctx, "failed to write response", slog.String("error", err.Error()))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			return
+		}
+		c.Log.ErrorContext(ctx, "failed to delete segment", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if body.DryRun {
+		c.writeJSON(ctx, w, http.StatusOK, newDryRunEffect(effect))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// CloneSegment creates a segment with the members of another one, or some
+// of them.
+func (c *Controller) CloneSegment(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Source      string     `json:"source"`
+		Segment     string     `json:"segment"`
+		SampleSize  int        `json:"sample_size"`
+		JoinedAfter *time.Time `json:"joined_after"`
+		DryRun      bool       `json:"dry_run"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	var members int
+	effect, err := c.apply(ctx, body.DryRun, func(ctx context.Context) error {
+		var err error
+		members, err = c.SegmentService.CloneSegment(ctx, body.Source, body.Segment,
+			domain.CloneOptions{SampleSize: body.SampleSize, JoinedAfter: body.JoinedAfter})
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrSegmentAlreadyExists):
+			c.writeError(ctx, w, http.StatusConflict, domain.ErrSegmentAlreadyExists)
+		case errors.Is(err, domain.ErrInvalidSampleSize):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidSampleSize)
+		default:
+			c.Log.ErrorContext(ctx, "failed to clone segment", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	if body.DryRun {
+		c.writeJSON(ctx, w, http.StatusOK, newDryRunEffect(effect))
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusCreated, struct {
+		Segment string `json:"segment"`
+		Members int    `json:"members"`
+	}{body.Segment, members})
+}
+
+func (c *Controller) SetSegmentSchedule(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Segment     string     `json:"segment"`
+		ActiveFrom  *time.Time `json:"active_from"`
+		ActiveUntil *time.Time `json:"active_until"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	err := c.SegmentService.SetSegmentSchedule(ctx, body.Segment, body.ActiveFrom, body.ActiveUntil)
+	if err != nil {
+		if c.writeApprovalRequired(ctx, w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrInvalidSchedule):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidSchedule)
+		default:
+			c.Log.ErrorContext(ctx, "failed to set segment schedule", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *Controller) SetSegmentMaxMembers(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Segment    string `json:"segment"`
+		MaxMembers *int   `json:"max_members"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	err := c.SegmentService.SetSegmentMaxMembers(ctx, body.Segment, body.MaxMembers)
+	if err != nil {
+		if c.writeApprovalRequired(ctx, w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrInvalidMaxMembers):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidMaxMembers)
+		default:
+			c.Log.ErrorContext(ctx, "failed to set segment max members", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *Controller) SetSegmentPercentage(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Segment    string `json:"segment"`
+		Percentage *int   `json:"percentage"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	err := c.SegmentService.SetSegmentPercentage(ctx, body.Segment, body.Percentage)
+	if err != nil {
+		if c.writeApprovalRequired(ctx, w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrInvalidPercentage):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidPercentage)
+		default:
+			c.Log.ErrorContext(ctx, "failed to set segment percentage", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *Controller) PromoteEnvironment(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		From           string   `json:"from"`
+		To             string   `json:"to"`
+		Segments       []string `json:"segments"`
+		IncludeMembers bool     `json:"include_members"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	err := c.SegmentService.PromoteEnvironment(ctx, body.From, body.To, body.Segments, body.IncludeMembers)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrInvalidEnvironment):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidEnvironment)
+		case errors.Is(err, domain.ErrSameEnvironment):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrSameEnvironment)
+		case errors.Is(err, domain.ErrSegmentProtected):
+			c.writeError(ctx, w, http.StatusConflict, domain.ErrSegmentProtected)
+		default:
+			c.Log.ErrorContext(ctx, "failed to promote environment", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *Controller) SetSegmentProtected(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Segment   string `json:"segment"`
+		Protected bool   `json:"protected"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	err := c.SegmentService.SetSegmentProtected(ctx, body.Segment, body.Protected)
+	if err != nil {
+		if c.writeApprovalRequired(ctx, w, err) {
+			return
+		}
+		if errors.Is(err, domain.ErrSegmentNotFound) {
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+			return
+		}
+		c.Log.ErrorContext(ctx, "failed to set segment protection", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *Controller) GetChangeRequests(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := domain.ChangeStatus(req.URL.Query().Get("status"))
+	if status == "" {
+		status = domain.ChangePending
+	}
+
+	requests, err := c.SegmentService.GetChangeRequests(ctx, status)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidChangeStatus) {
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidChangeStatus)
+			return
+		}
+		c.Log.ErrorContext(ctx, "failed to get change requests", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]changeRequest, 0, len(requests))
+	for _, cr := range requests {
+		resp = append(resp, newChangeRequest(cr))
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, map[string][]changeRequest{"change_requests": resp})
+}
+
+func (c *Controller) ApproveChangeRequest(w http.ResponseWriter, req *http.Request) {
+	c.reviewChangeRequest(w, req, c.SegmentService.ApproveChangeRequest)
+}
+
+func (c *Controller) RejectChangeRequest(w http.ResponseWriter, req *http.Request) {
+	c.reviewChangeRequest(w, req, c.SegmentService.RejectChangeRequest)
+}
+
+func (c *Controller) reviewChangeRequest(w http.ResponseWriter, req *http.Request, review func(context.Context, int64) (domain.ChangeRequest, error)) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		ID int64 `json:"id"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	cr, err := review(ctx, body.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrChangeRequestNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrChangeRequestNotFound)
+		case errors.Is(err, domain.ErrActorRequired):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrActorRequired)
+		case errors.Is(err, domain.ErrSelfApproval):
+			c.writeError(ctx, w, http.StatusForbidden, domain.ErrSelfApproval)
+		case errors.Is(err, domain.ErrChangeRequestNotPending):
+			c.writeError(ctx, w, http.StatusConflict, domain.ErrChangeRequestNotPending)
+		default:
+			// The change was approved but couldn't be applied, the request
+			// is marked as failed and the reason is reported back.
+			c.Log.WarnContext(ctx, "failed to apply change request", slog.Int64("id", body.ID), slog.String("error", err.Error()))
+			c.writeJSON(ctx, w, http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, newChangeRequest(cr))
+}
+
+func (c *Controller) GetSegment(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Segment string `json:"segment"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	segment, err := c.SegmentService.GetSegment(ctx, body.Segment)
+	if err != nil {
+		if errors.Is(err, domain.ErrSegmentNotFound) {
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+			return
+		}
+		c.Log.ErrorContext(ctx, "failed to get segment", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, newSegmentDetails(segment))
+}
+
+func (c *Controller) GetSegments(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	segments, err := c.SegmentService.GetSegments(ctx)
+	if err != nil {
+		c.Log.ErrorContext(ctx, "failed to get segments", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]segmentDetails, 0, len(segments))
+	for _, segment := range segments {
+		resp = append(resp, newSegmentDetails(segment))
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, map[string][]segmentDetails{"segments": resp})
+}
+
+func (c *Controller) GetSegmentMembers(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Segment string `json:"segment"`
+		After   int    `json:"after"`
+		Limit   int    `json:"limit"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	members, next, err := c.SegmentService.GetSegmentMembers(ctx, body.Segment, body.After, body.Limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrInvalidLimit):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidLimit)
+		default:
+			c.Log.ErrorContext(ctx, "failed to get segment members", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp := struct {
+		Segment string `json:"segment"`
+		Members []int  `json:"members"`
+		// After is the value to pass to get the next page, it's omitted on
+		// the last page.
+		After *int `json:"after,omitempty"`
+	}{
+		Segment: body.Segment,
+		Members: members,
+		After:   next,
+	}
+	if resp.Members == nil {
+		resp.Members = []int{}
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, resp)
+}
+
+func (c *Controller) AddSegmentPrerequisite(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Segment      string `json:"segment"`
+		Prerequisite string `json:"prerequisite"`
+		Cascade      bool   `json:"cascade"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	err := c.SegmentService.AddSegmentPrerequisite(ctx, domain.Prerequisite{
+		Segment:      body.Segment,
+		Prerequisite: body.Prerequisite,
+		Cascade:      body.Cascade,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrPrerequisiteCycle):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrPrerequisiteCycle)
+		default:
+			c.Log.ErrorContext(ctx, "failed to add segment prerequisite", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (c *Controller) DeleteSegment(w http.ResponseWriter, req *http.Request) {
+func (c *Controller) DeleteSegmentPrerequisite(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 
 	if req.Method != http.MethodPost {
@@ -75,43 +597,215 @@ func (c *Controller) DeleteSegment(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	rawBody, err := io.ReadAll(req.Body)
+	var body struct {
+		Segment      string `json:"segment"`
+		Prerequisite string `json:"prerequisite"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+
+	err := c.SegmentService.DeleteSegmentPrerequisite(ctx, body.Segment, body.Prerequisite)
 	if err != nil {
-		c.Log.ErrorContext(ctx, "failed reading body", slog.String("error", err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
+		if errors.Is(err, domain.ErrPrerequisiteNotFound) {
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrPrerequisiteNotFound)
+			return
+		}
+		c.Log.ErrorContext(ctx, "failed to delete segment prerequisite", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *Controller) GetSegmentsOverlap(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
 	var body struct {
-		Segment string `json:"segment"`
+		Segments []string `json:"segments"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
 	}
 
-	if err := json.Unmarshal(rawBody, &body); err != nil {
-		c.Log.ErrorContext(ctx, "failed unmarshaling body", slog.String("error", err.Error()))
-		w.WriteHeader(http.StatusBadRequest)
+	overlaps, err := c.SegmentService.GetSegmentsOverlap(ctx, body.Segments)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrNotEnoughSegments):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrNotEnoughSegments)
+		case errors.Is(err, domain.ErrTooManySegments):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrTooManySegments)
+		default:
+			c.Log.ErrorContext(ctx, "failed to get segments overlap", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	type segmentOverlap struct {
+		First         string  `json:"first"`
+		Second        string  `json:"second"`
+		FirstMembers  int     `json:"first_members"`
+		SecondMembers int     `json:"second_members"`
+		Both          int     `json:"both"`
+		Jaccard       float64 `json:"jaccard"`
+	}
+	resp := struct {
+		Overlaps []segmentOverlap `json:"overlaps"`
+	}{
+		Overlaps: make([]segmentOverlap, 0, len(overlaps)),
+	}
+	for _, o := range overlaps {
+		resp.Overlaps = append(resp.Overlaps, segmentOverlap(o))
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, resp)
+}
+
+func (c *Controller) GetSegmentSizeHistory(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Segment     string             `json:"segment"`
+		From        time.Time          `json:"from"`
+		To          time.Time          `json:"to"`
+		Granularity domain.Granularity `json:"granularity"`
+	}
+	if !c.readJSON(w, req, &body) {
 		return
 	}
 
-	err = c.SegmentService.DeleteSegment(req.Context(), body.Segment)
+	sizes, err := c.SegmentService.GetSegmentSizeHistory(ctx, body.Segment, body.From, body.To, body.Granularity)
 	if err != nil {
-		if errors.Is(err, domain.ErrSegmentNotFound) {
-			var resp []byte
-			resp, _ = json.Marshal(map[string]string{"error": "can't find the segment"})
-			_, err = w.Write(resp)
-			if err != nil {
-				c.Log.ErrorContext(ctx, "failed to write response", slog.String("error", err.Error()))
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		switch {
+		case errors.Is(err, domain.ErrSegmentNotFound):
+			c.writeError(ctx, w, http.StatusNotFound, domain.ErrSegmentNotFound)
+		case errors.Is(err, domain.ErrInvalidGranularity):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidGranularity)
+		case errors.Is(err, domain.ErrInvalidTimeRange):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidTimeRange)
+		default:
+			c.Log.ErrorContext(ctx, "failed to get segment size history", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	type segmentSize struct {
+		At      time.Time `json:"at"`
+		Members int       `json:"members"`
+	}
+	resp := struct {
+		Segment     string             `json:"segment"`
+		Granularity domain.Granularity `json:"granularity"`
+		Sizes       []segmentSize      `json:"sizes"`
+	}{
+		Segment:     body.Segment,
+		Granularity: body.Granularity,
+		Sizes:       make([]segmentSize, 0, len(sizes)),
+	}
+	for _, size := range sizes {
+		resp.Sizes = append(resp.Sizes, segmentSize(size))
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, resp)
+}
+
+func (c *Controller) ExportState(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	state, err := c.SegmentService.ExportState(ctx)
+	if err != nil {
+		c.Log.ErrorContext(ctx, "failed to export state", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="segments.jsonl"`)
+	if err := domain.WriteArchive(w, state, time.Now()); err != nil {
+		c.Log.ErrorContext(ctx, "failed to write archive", slog.String("error", err.Error()))
+	}
+}
+
+// ImportState applies an archive produced by ExportState. The mode is taken
+// from the "mode" query parameter and defaults to merge.
+func (c *Controller) ImportState(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := domain.ImportMode(req.URL.Query().Get("mode"))
+	if mode == "" {
+		mode = domain.ImportMerge
+	}
 
+	state, err := domain.ReadArchive(req.Body)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidArchive) || errors.Is(err, domain.ErrUnsupportedArchiveVersion) {
+			c.writeJSON(ctx, w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 			return
 		}
-		c.Log.ErrorContext(ctx, "failed to delete segment", slog.String("error", err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
+		c.Log.ErrorContext(ctx, "failed reading archive", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
+	conflicts, err := c.SegmentService.ImportState(ctx, state, mode)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrInvalidImportMode):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidImportMode)
+		case errors.Is(err, domain.ErrImportConflicts):
+			type importConflict struct {
+				Segment string `json:"segment,omitempty"`
+				User    *int   `json:"user_id,omitempty"`
+				Reason  string `json:"reason"`
+			}
+			resp := struct {
+				Error     string           `json:"error"`
+				Conflicts []importConflict `json:"conflicts"`
+			}{
+				Error:     domain.ErrImportConflicts.Error(),
+				Conflicts: make([]importConflict, 0, len(conflicts)),
+			}
+			for _, conflict := range conflicts {
+				resp.Conflicts = append(resp.Conflicts, importConflict(conflict))
+			}
+			c.writeJSON(ctx, w, http.StatusConflict, resp)
+		default:
+			c.Log.ErrorContext(ctx, "failed to import state", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.writeJSON(ctx, w, http.StatusOK, map[string]int{
+		"segments":      len(state.Segments),
+		"prerequisites": len(state.Prerequisites),
+		"memberships":   len(state.Memberships),
+	})
 }
 
 func (c *Controller) ChangeUserSegments(w http.ResponseWriter, req *http.Request) {
@@ -133,6 +827,7 @@ func (c *Controller) ChangeUserSegments(w http.ResponseWriter, req *http.Request
 		UserId           int      `json:"user_id"`
 		SegmentsToAdd    []string `json:"segments_to_add"`
 		SegmentsToDelete []string `json:"segments_to_delete"`
+		DryRun           bool     `json:"dry_run"`
 	}
 
 	if err := json.Unmarshal(rawBody, &body); err != nil {
@@ -141,9 +836,18 @@ func (c *Controller) ChangeUserSegments(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	err = c.SegmentService.ChangeUserSegments(req.Context(), body.UserId, body.SegmentsToAdd, body.SegmentsToDelete)
+	var operation int64
+	effect, err := c.apply(ctx, body.DryRun, func(ctx context.Context) error {
+		var err error
+		operation, err = c.SegmentService.ChangeUserSegments(ctx, body.UserId, body.SegmentsToAdd, body.SegmentsToDelete)
+		return err
+	})
 	if err != nil {
-		if errors.Is(err, domain.ErrSegmentNotFound) || errors.Is(err, domain.ErrUserHaveNotThisSegment) || errors.Is(err, domain.ErrUserIsAlreadyHasThisSegment) {
+		if c.writeApprovalRequired(ctx, w, err) {
+			return
+		}
+		if errors.Is(err, domain.ErrSegmentNotFound) || errors.Is(err, domain.ErrUserHaveNotThisSegment) || errors.Is(err, domain.ErrUserIsAlreadyHasThisSegment) ||
+			errors.Is(err, domain.ErrSegmentIsFull) || errors.Is(err, domain.ErrPrerequisiteMissing) {
 			errs := []string{}
 			if errors.Is(err, domain.ErrSegmentNotFound) {
 				errs = append(errs, "can't find the segment")
@@ -154,6 +858,20 @@ func (c *Controller) ChangeUserSegments(w http.ResponseWriter, req *http.Request
 			if errors.Is(err, domain.ErrUserIsAlreadyHasThisSegment) {
 				errs = append(errs, "user is already has this segment")
 			}
+			if errors.Is(err, domain.ErrSegmentIsFull) {
+				errs = append(errs, "segment has reached its members limit")
+			}
+			if errors.Is(err, domain.ErrPrerequisiteMissing) {
+				errs = append(errs, "user doesn't have a prerequisite segment")
+			}
+			// A dry run shows the part of the change that would still be
+			// applied.
+			if body.DryRun {
+				resp := newDryRunEffect(effect)
+				resp.Errors = errs
+				c.writeJSON(ctx, w, http.StatusOK, resp)
+				return
+			}
 			var resp []byte
 			j := map[string][]string{}
 			j["errors"] = errs
@@ -170,8 +888,182 @@ func (c *Controller) ChangeUserSegments(w http.ResponseWriter, req *http.Request
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if body.DryRun {
+		c.writeJSON(ctx, w, http.StatusOK, newDryRunEffect(effect))
+		return
+	}
 
-	w.WriteHeader(http.StatusCreated)
+	c.writeJSON(ctx, w, http.StatusCreated, struct {
+		OperationID int64 `json:"operation_id"`
+	}{operation})
+}
+
+// ChangeUsersSegments applies changes of many users at once and reports
+// the errors of every change in the order of the changes.
+func (c *Controller) ChangeUsersSegments(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Mode    domain.BulkMode `json:"mode"`
+		Changes []struct {
+			UserId           int      `json:"user_id"`
+			SegmentsToAdd    []string `json:"segments_to_add"`
+			SegmentsToDelete []string `json:"segments_to_delete"`
+		} `json:"changes"`
+		DryRun bool `json:"dry_run"`
+	}
+	if !c.readJSON(w, req, &body) {
+		return
+	}
+	if body.Mode == "" {
+		body.Mode = domain.BulkAtomic
+	}
+
+	changes := make([]domain.UserSegmentsChange, 0, len(body.Changes))
+	for _, change := range body.Changes {
+		changes = append(changes, domain.UserSegmentsChange{
+			User:             change.UserId,
+			SegmentsToAdd:    change.SegmentsToAdd,
+			SegmentsToDelete: change.SegmentsToDelete,
+		})
+	}
+
+	var errs []error
+	effect, err := c.apply(ctx, body.DryRun, func(ctx context.Context) error {
+		var err error
+		errs, err = c.SegmentService.ChangeUsersSegments(ctx, body.Mode, changes)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrInvalidBulkMode):
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidBulkMode)
+		case errors.Is(err, domain.ErrTooManyChanges):
+			c.writeError(ctx, w, http.StatusRequestEntityTooLarge, domain.ErrTooManyChanges)
+		default:
+			c.Log.ErrorContext(ctx, "failed to change users segments", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	type result struct {
+		UserId int      `json:"user_id"`
+		Errors []string `json:"errors,omitempty"`
+	}
+	resp := struct {
+		Applied int      `json:"applied"`
+		Failed  int      `json:"failed"`
+		Results []result `json:"results"`
+		*dryRunEffect
+	}{Results: make([]result, 0, len(changes))}
+	if body.DryRun {
+		effect := newDryRunEffect(effect)
+		resp.dryRunEffect = &effect
+	}
+	for i, change := range changes {
+		r := result{UserId: change.User}
+		if errs[i] == nil {
+			resp.Applied++
+		} else {
+			resp.Failed++
+			r.Errors = domain.ErrorMessages(errs[i])
+		}
+		resp.Results = append(resp.Results, r)
+	}
+	c.writeJSON(ctx, w, http.StatusOK, resp)
+}
+
+// ImportOperations applies newline-delimited JSON operations of the body as
+// they are read and streams back a JSON line for every operation that
+// failed, with its line number, and a summary line at the end. The mode and
+// the chunk size are taken from the "mode" and "chunk_size" query
+// parameters, the mode defaults to best_effort.
+func (c *Controller) ImportOperations(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := domain.BulkMode(req.URL.Query().Get("mode"))
+	if mode == "" {
+		mode = domain.BulkBestEffort
+	}
+	var chunkSize int
+	if v := req.URL.Query().Get("chunk_size"); v != "" {
+		var err error
+		if chunkSize, err = strconv.Atoi(v); err != nil {
+			c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidChunkSize)
+			return
+		}
+	}
+
+	// Results are written while the body is still being read.
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+
+	enc := json.NewEncoder(w)
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	type result struct {
+		Line   int      `json:"line"`
+		UserId *int     `json:"user_id,omitempty"`
+		Errors []string `json:"errors"`
+	}
+	summary, err := c.SegmentService.ImportOperations(ctx, req.Body, mode, chunkSize, func(r domain.OperationResult) error {
+		start()
+		if err := enc.Encode(result{Line: r.Line, UserId: r.User, Errors: domain.ErrorMessages(r.Err)}); err != nil {
+			return err
+		}
+		rc.Flush()
+		return nil
+	})
+	if err != nil {
+		if !started {
+			switch {
+			case errors.Is(err, domain.ErrInvalidBulkMode):
+				c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidBulkMode)
+				return
+			case errors.Is(err, domain.ErrInvalidChunkSize):
+				c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidChunkSize)
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		message := "import stopped by an internal error"
+		if errors.Is(err, domain.ErrInvalidOperation) {
+			message = err.Error()
+		} else {
+			c.Log.ErrorContext(ctx, "failed to import operations", slog.String("error", err.Error()))
+		}
+		start()
+		if err := enc.Encode(map[string]any{"applied": summary.Applied, "failed": summary.Failed, "error": message}); err != nil {
+			c.Log.ErrorContext(ctx, "failed to write response", slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	start()
+	if err := enc.Encode(map[string]int{"applied": summary.Applied, "failed": summary.Failed}); err != nil {
+		c.Log.ErrorContext(ctx, "failed to write response", slog.String("error", err.Error()))
+	}
 }
 
 func (c *Controller) GetUserSegments(w http.ResponseWriter, req *http.Request) {
@@ -182,7 +1074,7 @@ func (c *Controller) GetUserSegments(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	rawBody, err := io.ReadAll(req.Body)
+	rawBody, err := readBody(req)
 	if err != nil {
 		c.Log.ErrorContext(ctx, "failed reading body", slog.String("error", err.Error()))
 		w.WriteHeader(http.StatusBadRequest)
@@ -190,7 +1082,8 @@ func (c *Controller) GetUserSegments(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var body struct {
-		UserId int `json:"user_id"`
+		UserId int        `json:"user_id"`
+		AsOf   *time.Time `json:"as_of"`
 	}
 
 	if err := json.Unmarshal(rawBody, &body); err != nil {
@@ -199,12 +1092,59 @@ func (c *Controller) GetUserSegments(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	segmnets, err := c.SegmentService.GetUserSegments(req.Context(), body.UserId)
+	// Past segments come from the change feed, they never change and have
+	// no ETag.
+	if body.AsOf != nil {
+		segments, err := c.SegmentService.GetUserSegmentsAsOf(ctx, body.UserId, *body.AsOf)
+		if err != nil {
+			if errors.Is(err, domain.ErrInvalidAsOf) {
+				c.writeError(ctx, w, http.StatusBadRequest, domain.ErrInvalidAsOf)
+				return
+			}
+			c.Log.ErrorContext(ctx, "failed to get user segments", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		c.writeJSON(ctx, w, http.StatusOK, struct {
+			UserId       int       `json:"user_id"`
+			AsOf         time.Time `json:"as_of"`
+			UserSegments []string  `json:"user_segments"`
+		}{body.UserId, *body.AsOf, segments})
+		return
+	}
+
+	// Cache-Control: no-cache asks for the latest memberships.
+	if strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+		ctx = domain.WithCacheBypass(ctx)
+	}
+
+	// The same user has different segments in other tenants and
+	// environments.
+	w.Header().Set("Vary", "X-Tenant, X-Environment, X-Api-Key")
+
+	if etags := ifNoneMatch(req); len(etags) > 0 {
+		match, err := c.SegmentService.MatchUserSegmentsETag(ctx, body.UserId, etags)
+		if err != nil {
+			c.Log.ErrorContext(ctx, "failed to check user segments version", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if match != "" {
+			if match != "*" {
+				w.Header().Set("ETag", match)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	segmnets, etag, err := c.SegmentService.GetUserSegmentsWithETag(ctx, body.UserId)
 	if err != nil {
 		c.Log.ErrorContext(ctx, "failed to get user segments", slog.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", etag)
 
 	var resp []byte
 
@@ -231,3 +1171,181 @@ func (c *Controller) GetUserSegments(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 }
+
+// ifNoneMatch returns the ETags listed in the If-None-Match header.
+func ifNoneMatch(req *http.Request) []string {
+	var etags []string
+	for _, value := range req.Header.Values("If-None-Match") {
+		for _, etag := range strings.Split(value, ",") {
+			if etag = strings.TrimSpace(etag); etag != "" {
+				etags = append(etags, etag)
+			}
+		}
+	}
+	return etags
+}
+
+type segmentDetails struct {
+	Segment     string     `json:"segment"`
+	ActiveFrom  *time.Time `json:"active_from"`
+	ActiveUntil *time.Time `json:"active_until"`
+	MaxMembers  *int       `json:"max_members"`
+	Percentage  *int       `json:"percentage"`
+	Protected   bool       `json:"protected"`
+	Members     int        `json:"members"`
+	// FillLevel is the share of max_members that is taken, it's omitted
+	// for segments without a limit.
+	FillLevel *float64 `json:"fill_level,omitempty"`
+}
+
+func newSegmentDetails(segment domain.SegmentDetails) segmentDetails {
+	resp := segmentDetails{
+		Segment:     segment.Name,
+		ActiveFrom:  segment.ActiveFrom,
+		ActiveUntil: segment.ActiveUntil,
+		MaxMembers:  segment.MaxMembers,
+		Percentage:  segment.Percentage,
+		Protected:   segment.Protected,
+		Members:     segment.Members,
+	}
+	if segment.MaxMembers != nil {
+		fill := float64(segment.Members) / float64(*segment.MaxMembers)
+		resp.FillLevel = &fill
+	}
+	return resp
+}
+
+// changeRequest is the JSON form of domain.ChangeRequest.
+type changeRequest struct {
+	ID               int64      `json:"id"`
+	Kind             string     `json:"kind"`
+	Environment      string     `json:"environment"`
+	Segment          string     `json:"segment,omitempty"`
+	User             *int       `json:"user_id,omitempty"`
+	SegmentsToAdd    []string   `json:"segments_to_add,omitempty"`
+	SegmentsToDelete []string   `json:"segments_to_delete,omitempty"`
+	ActiveFrom       *time.Time `json:"active_from,omitempty"`
+	ActiveUntil      *time.Time `json:"active_until,omitempty"`
+	MaxMembers       *int       `json:"max_members,omitempty"`
+	Percentage       *int       `json:"percentage,omitempty"`
+	Author           string     `json:"author"`
+	Status           string     `json:"status"`
+	Reviewer         string     `json:"reviewer,omitempty"`
+	Error            string     `json:"error,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ReviewedAt       *time.Time `json:"reviewed_at,omitempty"`
+	Operation        *int64     `json:"operation_id,omitempty"`
+}
+
+func newChangeRequest(cr domain.ChangeRequest) changeRequest {
+	return changeRequest{
+		ID:               cr.ID,
+		Kind:             string(cr.Kind),
+		Environment:      cr.Environment,
+		Segment:          cr.Segment,
+		User:             cr.User,
+		SegmentsToAdd:    cr.SegmentsToAdd,
+		SegmentsToDelete: cr.SegmentsToDelete,
+		ActiveFrom:       cr.ActiveFrom,
+		ActiveUntil:      cr.ActiveUntil,
+		MaxMembers:       cr.MaxMembers,
+		Percentage:       cr.Percentage,
+		Author:           cr.Author,
+		Status:           string(cr.Status),
+		Reviewer:         cr.Reviewer,
+		Error:            cr.Error,
+		CreatedAt:        cr.CreatedAt,
+		ReviewedAt:       cr.ReviewedAt,
+		Operation:        cr.Operation,
+	}
+}
+
+// writeApprovalRequired responds with the change request created instead of
+// applying a change of a protected segment. It reports false for any other
+// error.
+func (c *Controller) writeApprovalRequired(ctx context.Context, w http.ResponseWriter, err error) bool {
+	var approvalErr *domain.ApprovalRequiredError
+	switch {
+	case errors.As(err, &approvalErr):
+		c.writeJSON(ctx, w, http.StatusAccepted, struct {
+			Error         string        `json:"error"`
+			ChangeRequest changeRequest `json:"change_request"`
+		}{
+			Error:         domain.ErrApprovalRequired.Error(),
+			ChangeRequest: newChangeRequest(approvalErr.ChangeRequest),
+		})
+		return true
+	case errors.Is(err, domain.ErrActorRequired):
+		c.writeError(ctx, w, http.StatusBadRequest, domain.ErrActorRequired)
+		return true
+	}
+	return false
+}
+
+// readJSON decodes the request body into v. On failure it writes
+// 400 Bad Request and returns false.
+func (c *Controller) readJSON(w http.ResponseWriter, req *http.Request, v any) bool {
+	ctx := req.Context()
+
+	rawBody, err := readBody(req)
+	if err != nil {
+		c.Log.ErrorContext(ctx, "failed reading body", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	if err := json.Unmarshal(rawBody, v); err != nil {
+		c.Log.ErrorContext(ctx, "failed unmarshaling body", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// readBody returns the request body. GET requests without a body may pass
+// the fields as query parameters instead, so that browsers can call them.
+// Each value is used as is if it's a JSON literal and as a string otherwise,
+// so numbers and lists are passed as user_id=1 or segments=["A","B"], and
+// a string that looks like a number has to be quoted: segment="2023".
+func readBody(req *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil || len(bytes.TrimSpace(body)) > 0 || req.Method != http.MethodGet || req.URL.RawQuery == "" {
+		return body, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	for key, values := range req.URL.Query() {
+		value := values[0]
+		if json.Valid([]byte(value)) {
+			fields[key] = json.RawMessage(value)
+			continue
+		}
+		quoted, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = quoted
+	}
+
+	return json.Marshal(fields)
+}
+
+func (c *Controller) writeJSON(ctx context.Context, w http.ResponseWriter, status int, v any) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		c.Log.ErrorContext(ctx, "failed to marshal response", slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(resp); err != nil {
+		c.Log.ErrorContext(ctx, "failed to write response", slog.String("error", err.Error()))
+	}
+}
+
+func (c *Controller) writeError(ctx context.Context, w http.ResponseWriter, status int, err error) {
+	c.writeJSON(ctx, w, status, map[string]string{"error": err.Error()})
+}
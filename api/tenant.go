@@ -0,0 +1,48 @@
+package api
+
+import (
+	"assignment/domain"
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrUnknownAPIKey  = errors.New("unknown api key")
+	ErrAPIKeyRequired = errors.New("api key is required")
+)
+
+// Tenant resolves the tenant of the request and stores it in the request
+// context. When APIKeys are configured every request must carry a known key
+// in the X-Api-Key header and the tenant is the one the key belongs to.
+// Otherwise the tenant is taken from the X-Tenant header, requests without it
+// belong to domain.DefaultTenant.
+func (c *Controller) Tenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		tenant := domain.DefaultTenant
+		if len(c.APIKeys) > 0 {
+			key := req.Header.Get("X-Api-Key")
+			if key == "" {
+				c.writeError(ctx, w, http.StatusUnauthorized, ErrAPIKeyRequired)
+				return
+			}
+
+			var ok bool
+			tenant, ok = c.APIKeys[key]
+			if !ok {
+				c.writeError(ctx, w, http.StatusUnauthorized, ErrUnknownAPIKey)
+				return
+			}
+		} else if header := req.Header.Get("X-Tenant"); header != "" {
+			tenant = header
+		}
+
+		if err := domain.ValidateTenant(tenant); err != nil {
+			c.writeError(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+
+		next.ServeHTTP(w, req.WithContext(domain.WithTenant(ctx, tenant)))
+	})
+}
@@ -0,0 +1,282 @@
+package client
+
+import (
+	"assignment/domain"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSyncWait = 30 * time.Second
+	// syncPageSize is the number of changes and members read per request.
+	syncPageSize = 1000
+	// syncRetryDelay is the pause after a failed background sync.
+	syncRetryDelay = time.Second
+)
+
+// Cache keeps memberships of a set of users or segments in memory and
+// answers GetUserSegments without calling the server. It loads a snapshot
+// on Start and then tails the change feed of the server, so changes reach
+// it shortly after they are committed.
+type Cache struct {
+	client   *Client
+	users    map[int]bool
+	segments map[string]bool
+	wait     time.Duration
+	onError  func(error)
+	now      func() time.Time
+
+	mu          sync.RWMutex
+	cursor      int64
+	definitions map[string]domain.SegmentDetails
+	members     map[int]map[string]bool
+}
+
+type CacheOption func(cc *Cache)
+
+// TrackUsers makes the cache keep all memberships of the users.
+func TrackUsers(users ...int) CacheOption {
+	return func(cc *Cache) {
+		for _, user := range users {
+			cc.users[user] = true
+		}
+	}
+}
+
+// TrackSegments makes the cache keep all members of the segments.
+func TrackSegments(segments ...string) CacheOption {
+	return func(cc *Cache) {
+		for _, segment := range segments {
+			cc.segments[segment] = true
+		}
+	}
+}
+
+// WithSyncWait sets how long each request of the background sync waits for
+// changes on the server.
+func WithSyncWait(wait time.Duration) CacheOption {
+	return func(cc *Cache) {
+		cc.wait = wait
+	}
+}
+
+// WithSyncErrorHandler is called with errors of background syncs. The cache
+// keeps answering from the data it has and retries after a second.
+func WithSyncErrorHandler(onError func(error)) CacheOption {
+	return func(cc *Cache) {
+		cc.onError = onError
+	}
+}
+
+// NewCache creates a cache that reads through c, so the tenant and the
+// environment of the cache are the ones of c.
+func NewCache(c *Client, opts ...CacheOption) *Cache {
+	cc := &Cache{
+		client:   c,
+		users:    map[int]bool{},
+		segments: map[string]bool{},
+		wait:     DefaultSyncWait,
+		onError:  func(error) {},
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(cc)
+	}
+	return cc
+}
+
+// Start loads the snapshot and keeps it in sync in the background until
+// ctx is done.
+func (cc *Cache) Start(ctx context.Context) error {
+	if err := cc.load(ctx); err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+
+	go func() {
+		for ctx.Err() == nil {
+			if err := cc.sync(ctx, cc.wait); err != nil && ctx.Err() == nil {
+				cc.onError(err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(syncRetryDelay):
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// GetUserSegments returns the names of the user's segments that are active
+// right now in alphabetical order, and false if the cache doesn't track the
+// user. When segments are tracked every user is answered for, but only
+// about the tracked segments.
+func (cc *Cache) GetUserSegments(user int) ([]string, bool) {
+	if !cc.users[user] && len(cc.segments) == 0 {
+		return nil, false
+	}
+
+	now := cc.now()
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	active := []string{}
+	for name := range cc.members[user] {
+		if s, ok := cc.definitions[name]; ok && s.IsActive(now) {
+			active = append(active, name)
+		}
+	}
+	for name, s := range cc.definitions {
+		if s.Percentage == nil || cc.members[user][name] || !cc.tracks(user, name) {
+			continue
+		}
+		if s.IsActive(now) && domain.InRollout(user, name, *s.Percentage) {
+			active = append(active, name)
+		}
+	}
+
+	sort.Strings(active)
+	return active, true
+}
+
+// Sync applies the changes made on the server since the last sync without
+// waiting for the background sync to pick them up.
+func (cc *Cache) Sync(ctx context.Context) error {
+	return cc.sync(ctx, 0)
+}
+
+// sync applies changes after the cursor, waiting up to wait for the first
+// ones. Syncs may run concurrently, each applies only the changes the other
+// hasn't applied yet.
+func (cc *Cache) sync(ctx context.Context, wait time.Duration) error {
+	cc.mu.RLock()
+	cursor := cc.cursor
+	cc.mu.RUnlock()
+
+	for {
+		changes, next, err := cc.client.GetChanges(ctx, cursor, syncPageSize, wait)
+		if err != nil {
+			return fmt.Errorf("getting changes: %w", err)
+		}
+
+		// Definitions are read before anything is applied, so that a failure
+		// leaves the cursor where it was.
+		var definitions map[string]domain.SegmentDetails
+		for _, ch := range changes {
+			if ch.User == nil {
+				definitions, err = cc.loadDefinitions(ctx)
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+
+		cc.mu.Lock()
+		if next <= cc.cursor {
+			cc.mu.Unlock()
+			return nil
+		}
+		for _, ch := range changes {
+			if ch.Seq <= cc.cursor || ch.User == nil || !cc.tracks(*ch.User, ch.Segment) {
+				continue
+			}
+			switch ch.Type {
+			case domain.ChangeMemberAdded:
+				addMember(cc.members, *ch.User, ch.Segment)
+			case domain.ChangeMemberRemoved:
+				delete(cc.members[*ch.User], ch.Segment)
+			}
+		}
+		if definitions != nil {
+			cc.definitions = definitions
+		}
+		cc.cursor = next
+		cc.mu.Unlock()
+
+		if len(changes) < syncPageSize {
+			return nil
+		}
+		cursor = next
+		wait = 0
+	}
+}
+
+func (cc *Cache) load(ctx context.Context) error {
+	// The cursor is taken first: changes made while the snapshot is read are
+	// applied again by the next sync, which does no harm.
+	cursor, err := cc.client.GetChangesCursor(ctx)
+	if err != nil {
+		return fmt.Errorf("getting changes cursor: %w", err)
+	}
+
+	definitions, err := cc.loadDefinitions(ctx)
+	if err != nil {
+		return err
+	}
+
+	members := map[int]map[string]bool{}
+	for user := range cc.users {
+		segments, err := cc.client.GetUserMemberships(ctx, user)
+		if err != nil {
+			return fmt.Errorf("getting memberships of user %d: %w", user, err)
+		}
+		for _, segment := range segments {
+			addMember(members, user, segment)
+		}
+	}
+	for segment := range cc.segments {
+		after := 0
+		for {
+			page, next, err := cc.client.GetSegmentMembers(ctx, segment, after, syncPageSize)
+			if errors.Is(err, domain.ErrSegmentNotFound) {
+				// Its members will come from the change feed once it's created.
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("getting members of segment %s: %w", segment, err)
+			}
+			for _, user := range page {
+				addMember(members, user, segment)
+			}
+			if next == nil {
+				break
+			}
+			after = *next
+		}
+	}
+
+	cc.mu.Lock()
+	cc.cursor = cursor
+	cc.definitions = definitions
+	cc.members = members
+	cc.mu.Unlock()
+	return nil
+}
+
+func (cc *Cache) loadDefinitions(ctx context.Context) (map[string]domain.SegmentDetails, error) {
+	segments, err := cc.client.GetSegments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting segments: %w", err)
+	}
+
+	definitions := make(map[string]domain.SegmentDetails, len(segments))
+	for _, s := range segments {
+		definitions[s.Name] = s
+	}
+	return definitions, nil
+}
+
+func (cc *Cache) tracks(user int, segment string) bool {
+	return cc.users[user] || cc.segments[segment]
+}
+
+func addMember(members map[int]map[string]bool, user int, segment string) {
+	if members[user] == nil {
+		members[user] = map[string]bool{}
+	}
+	members[user][segment] = true
+}
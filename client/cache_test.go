@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// feedServer serves the endpoints the cache reads. The change feed returns
+// changes once, and holds requests that wait for changes until they are
+// canceled, so that only Sync applies them.
+func feedServer(t *testing.T, segments, memberships, members, changes string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/get_changes_cursor", respond(http.StatusOK, `{"cursor":10}`))
+	mux.HandleFunc("/api/get_segments", func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, segments)
+	})
+	mux.Handle("/api/get_user_memberships", respond(http.StatusOK, memberships))
+	mux.Handle("/api/get_segment_members", respond(http.StatusOK, members))
+	mux.HandleFunc("/api/get_changes", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			After int64   `json:"after"`
+			Wait  float64 `json:"wait"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Wait > 0 {
+			<-req.Context().Done()
+			return
+		}
+		if body.After != 10 {
+			io.WriteString(w, `{"changes":[],"cursor":12}`)
+			return
+		}
+		io.WriteString(w, changes)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCache_TrackUsers(t *testing.T) {
+	srv := feedServer(t,
+		`{"segments":[{"segment":"A"},{"segment":"B"},{"segment":"OLD","active_until":"2000-01-01T00:00:00Z"}]}`,
+		`{"user_id":1000,"segments":["A","OLD"]}`,
+		`{"members":[]}`,
+		`{"changes":[
+			{"seq":11,"type":"member_added","segment":"B","user_id":1000},
+			{"seq":12,"type":"member_removed","segment":"A","user_id":1000}
+		],"cursor":12}`,
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := NewCache(New(srv.URL), TrackUsers(1000))
+	if err := cache.Start(ctx); err != nil {
+		t.Fatalf("Cache.Start() error = %v", err)
+	}
+
+	segments, ok := cache.GetUserSegments(1000)
+	if !ok || !slices.Equal(segments, []string{"A"}) {
+		t.Errorf("Expected active segments [A] of the snapshot, but got %v, %v", segments, ok)
+	}
+	if _, ok := cache.GetUserSegments(1001); ok {
+		t.Errorf("Expected untracked user not to be answered for")
+	}
+
+	if err := cache.Sync(ctx); err != nil {
+		t.Fatalf("Cache.Sync() error = %v", err)
+	}
+	segments, _ = cache.GetUserSegments(1000)
+	if !slices.Equal(segments, []string{"B"}) {
+		t.Errorf("Expected segments [B] after the sync, but got %v", segments)
+	}
+}
+
+func TestCache_TrackSegments(t *testing.T) {
+	srv := feedServer(t,
+		`{"segments":[{"segment":"A"},{"segment":"B","percentage":100},{"segment":"C","percentage":100}]}`,
+		`{"segments":[]}`,
+		`{"members":[1000,1001]}`,
+		`{"changes":[
+			{"seq":11,"type":"member_removed","segment":"A","user_id":1001},
+			{"seq":12,"type":"member_added","segment":"C","user_id":1001}
+		],"cursor":12}`,
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := NewCache(New(srv.URL), TrackSegments("A", "B"))
+	if err := cache.Start(ctx); err != nil {
+		t.Fatalf("Cache.Start() error = %v", err)
+	}
+
+	segments, ok := cache.GetUserSegments(1001)
+	if !ok || !slices.Equal(segments, []string{"A", "B"}) {
+		t.Errorf("Expected segments [A B] of the snapshot, but got %v, %v", segments, ok)
+	}
+	segments, ok = cache.GetUserSegments(2000)
+	if !ok || !slices.Equal(segments, []string{"B"}) {
+		t.Errorf("Expected only the tracked rollout [B], but got %v, %v", segments, ok)
+	}
+
+	if err := cache.Sync(ctx); err != nil {
+		t.Fatalf("Cache.Sync() error = %v", err)
+	}
+	segments, _ = cache.GetUserSegments(1001)
+	if !slices.Equal(segments, []string{"B"}) {
+		t.Errorf("Expected segments [B] after the sync, but got %v", segments)
+	}
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"assignment/domain"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type change struct {
+	Seq     int64             `json:"seq"`
+	Type    domain.ChangeType `json:"type"`
+	Segment string            `json:"segment"`
+	UserId  *int              `json:"user_id"`
+	Actor   string            `json:"actor"`
+	At      time.Time         `json:"at"`
+}
+
+func (ch change) toDomain() domain.Change {
+	return domain.Change{
+		Seq:     ch.Seq,
+		Type:    ch.Type,
+		Segment: ch.Segment,
+		User:    ch.UserId,
+		Actor:   ch.Actor,
+		At:      ch.At,
+	}
+}
+
+// GetChanges returns changes after the cursor, oldest first, and the cursor
+// to read the next changes from. If there are no changes yet, the server
+// waits up to wait for some to come, so that the feed can be tailed by
+// calling GetChanges in a loop.
+func (c *Client) GetChanges(ctx context.Context, after int64, limit int, wait time.Duration) ([]domain.Change, int64, error) {
+	in := struct {
+		After int64   `json:"after"`
+		Limit int     `json:"limit"`
+		Wait  float64 `json:"wait,omitempty"`
+	}{after, limit, wait.Seconds()}
+
+	var out struct {
+		Changes []change `json:"changes"`
+		Cursor  int64    `json:"cursor"`
+	}
+	// The server holds the request for up to wait, which isn't a timeout.
+	waiting := c
+	if wait > 0 && c.timeout > 0 {
+		longer := *c
+		longer.timeout += wait
+		waiting = &longer
+	}
+	if _, err := waiting.doJSON(ctx, http.MethodGet, "/api/get_changes", in, &out, http.StatusOK); err != nil {
+		return nil, 0, err
+	}
+
+	changes := make([]domain.Change, 0, len(out.Changes))
+	for _, ch := range out.Changes {
+		changes = append(changes, ch.toDomain())
+	}
+	return changes, out.Cursor, nil
+}
+
+func (c *Client) GetChangesCursor(ctx context.Context) (int64, error) {
+	var out struct {
+		Cursor int64 `json:"cursor"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_changes_cursor", nil, &out, http.StatusOK); err != nil {
+		return 0, err
+	}
+	return out.Cursor, nil
+}
+
+func (c *Client) GetUserMemberships(ctx context.Context, user int) ([]string, error) {
+	in := struct {
+		UserId int `json:"user_id"`
+	}{user}
+
+	var out struct {
+		Segments []string `json:"segments"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_user_memberships", in, &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return out.Segments, nil
+}
+
+// WatchUserSegments calls emit with the user's active segments and then with
+// every change of them, until ctx is done or emit fails. It returns nil when
+// the server ends the stream. The request isn't limited by the client's
+// timeout and isn't retried.
+func (c *Client) WatchUserSegments(ctx context.Context, user int, emit func(domain.UserSegmentsEvent) error) error {
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/watch_user_segments", fmt.Sprintf("user_id=%d", user), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("reading response: %w", err)
+		}
+		return errorFromResponse(response{status: resp.StatusCode, header: resp.Header, body: body})
+	}
+
+	var event string
+	var data []byte
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: ")...)
+		case line == "" && event != "":
+			var body struct {
+				Segments []string `json:"segments"`
+				Segment  string   `json:"segment"`
+			}
+			if err := json.Unmarshal(data, &body); err != nil {
+				return fmt.Errorf("unmarshaling %s event: %w", event, err)
+			}
+
+			var e domain.UserSegmentsEvent
+			switch event {
+			case "segments":
+				e.Segments = body.Segments
+			case "segment_added":
+				e.Added = []string{body.Segment}
+			case "segment_removed":
+				e.Removed = []string{body.Segment}
+			}
+			if err := emit(e); err != nil {
+				return err
+			}
+			event, data = "", nil
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("reading events: %w", err)
+	}
+	return ctx.Err()
+}
+
+// GetUserSegmentsDiff returns how the user's segments changed between from
+// and to, a zero to meaning now.
+func (c *Client) GetUserSegmentsDiff(ctx context.Context, user int, from, to time.Time) (domain.UserSegmentsDiff, error) {
+	in := struct {
+		UserId int        `json:"user_id"`
+		From   time.Time  `json:"from"`
+		To     *time.Time `json:"to,omitempty"`
+	}{UserId: user, From: from}
+	if !to.IsZero() {
+		in.To = &to
+	}
+
+	type segmentChange struct {
+		Segment string            `json:"segment"`
+		Type    domain.ChangeType `json:"type"`
+		At      time.Time         `json:"at"`
+		Actor   string            `json:"actor"`
+	}
+	var out struct {
+		Gained  []segmentChange `json:"gained"`
+		Lost    []segmentChange `json:"lost"`
+		Changes []segmentChange `json:"changes"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_user_segments_diff", in, &out, http.StatusOK); err != nil {
+		return domain.UserSegmentsDiff{}, err
+	}
+
+	toDomain := func(changes []segmentChange) []domain.SegmentChange {
+		var result []domain.SegmentChange
+		for _, sc := range changes {
+			result = append(result, domain.SegmentChange{Segment: sc.Segment, Added: sc.Type == domain.ChangeMemberAdded, At: sc.At, Actor: sc.Actor})
+		}
+		return result
+	}
+	return domain.UserSegmentsDiff{Gained: toDomain(out.Gained), Lost: toDomain(out.Lost), Changes: toDomain(out.Changes)}, nil
+}
@@ -0,0 +1,352 @@
+// Package client is a Go client of the segments service. Its methods mirror
+// domain.SegmentService and return the same domain sentinel errors, so
+// callers can use errors.Is the same way they would with the service.
+package client
+
+import (
+	"assignment/api"
+	"assignment/domain"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout      = 5 * time.Second
+	DefaultRetries      = 2
+	DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Error is an error response the client couldn't map to a known error.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected response status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected response status %d: %s", e.StatusCode, e.Message)
+}
+
+// knownErrors are the errors the server reports by their messages.
+var knownErrors = []error{
+	domain.ErrSegmentNotFound,
+	domain.ErrSegmentAlreadyExists,
+	domain.ErrUserIsAlreadyHasThisSegment,
+	domain.ErrUserHaveNotThisSegment,
+	domain.ErrInvalidSchedule,
+	domain.ErrInvalidMaxMembers,
+	domain.ErrSegmentIsFull,
+	domain.ErrInvalidLimit,
+	domain.ErrInvalidWait,
+	domain.ErrPrerequisiteNotFound,
+	domain.ErrPrerequisiteCycle,
+	domain.ErrPrerequisiteMissing,
+	domain.ErrNotEnoughSegments,
+	domain.ErrTooManySegments,
+	domain.ErrInvalidGranularity,
+	domain.ErrInvalidTimeRange,
+	domain.ErrInvalidArchive,
+	domain.ErrUnsupportedArchiveVersion,
+	domain.ErrInvalidImportMode,
+	domain.ErrImportConflicts,
+	domain.ErrInvalidTenant,
+	domain.ErrInvalidEnvironment,
+	domain.ErrInvalidPercentage,
+	domain.ErrSameEnvironment,
+	domain.ErrInvalidActor,
+	domain.ErrApprovalRequired,
+	domain.ErrActorRequired,
+	domain.ErrChangeRequestNotFound,
+	domain.ErrChangeRequestNotPending,
+	domain.ErrSelfApproval,
+	domain.ErrInvalidChangeStatus,
+	domain.ErrSegmentProtected,
+	domain.ErrInvalidBulkMode,
+	domain.ErrTooManyChanges,
+	domain.ErrDuplicateUser,
+	domain.ErrChangeAborted,
+	domain.ErrInvalidOperation,
+	domain.ErrInvalidChunkSize,
+	domain.ErrJobNotFound,
+	domain.ErrInvalidJobKind,
+	domain.ErrInvalidUploadMode,
+	domain.ErrInvalidCSV,
+	domain.ErrInvalidRows,
+	domain.ErrTooManyRows,
+	domain.ErrInvalidReport,
+	domain.ErrReportNotReady,
+	domain.ErrBlobNotFound,
+	domain.ErrInvalidAsOf,
+	domain.ErrOperationNotFound,
+	domain.ErrOperationUndone,
+	domain.ErrUndoConflict,
+	domain.ErrInvalidSampleSize,
+	api.ErrUnknownAPIKey,
+	api.ErrAPIKeyRequired,
+	api.ErrInvalidCSRFToken,
+	api.ErrUploadTooLarge,
+}
+
+// toError maps an error message of the server back to the error it came
+// from. Messages with details after the error, like "archive is malformed:
+// line 3", keep the details.
+func toError(status int, message string) error {
+	for _, known := range knownErrors {
+		if message == known.Error() {
+			return known
+		}
+		if details, ok := strings.CutPrefix(message, known.Error()+": "); ok {
+			return fmt.Errorf("%w: %s", known, details)
+		}
+	}
+	return &Error{StatusCode: status, Message: message}
+}
+
+type Client struct {
+	baseURL      string
+	httpClient   *http.Client
+	timeout      time.Duration
+	retries      int
+	retryBackoff time.Duration
+	headers      http.Header
+}
+
+type Option func(c *Client)
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout limits every attempt of a request, zero means no limit other
+// than the one of the context.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times requests that only read data are retried
+// after network errors and 5xx or 429 responses. The delay starts at backoff
+// and doubles after every attempt. Requests that change data are never
+// retried, as they may have been applied before the failure.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryBackoff = backoff
+	}
+}
+
+// WithAPIKey authenticates requests, the tenant is the one of the key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.headers.Set("X-Api-Key", key)
+	}
+}
+
+// WithTenant selects the tenant on servers that don't use API keys.
+func WithTenant(tenant string) Option {
+	return func(c *Client) {
+		c.headers.Set("X-Tenant", tenant)
+	}
+}
+
+func WithEnvironment(environment string) Option {
+	return func(c *Client) {
+		c.headers.Set("X-Environment", environment)
+	}
+}
+
+// WithActor attributes changes made by the client to the actor.
+func WithActor(actor string) Option {
+	return func(c *Client) {
+		c.headers.Set("X-Actor", actor)
+	}
+}
+
+// New creates a client of the service listening at baseURL, for example
+// "http://segments.internal:8000".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		httpClient:   http.DefaultClient,
+		timeout:      DefaultTimeout,
+		retries:      DefaultRetries,
+		retryBackoff: DefaultRetryBackoff,
+		headers:      http.Header{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// response is a response with its body already read.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// do sends the request, retrying reads, and returns the response if its
+// status is one of expected. Other responses are turned into errors.
+func (c *Client) do(ctx context.Context, method, path string, query string, body []byte, expected ...int) (response, error) {
+	attempts := 1
+	if method == http.MethodGet {
+		attempts += max(c.retries, 0)
+	}
+
+	backoff := c.retryBackoff
+	var resp response
+	var err error
+	for attempt := 1; ; attempt++ {
+		resp, err = c.attempt(ctx, method, path, query, body)
+		retryable := err != nil || resp.status >= http.StatusInternalServerError || resp.status == http.StatusTooManyRequests
+		if !retryable || attempt >= attempts || ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return response{}, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return response{}, err
+	}
+
+	for _, status := range expected {
+		if resp.status == status {
+			return resp, nil
+		}
+	}
+	return response{}, errorFromResponse(resp)
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, query string, body []byte) (response, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return response{}, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return response{}, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return response{}, fmt.Errorf("reading response: %w", err)
+	}
+
+	return response{status: resp.StatusCode, header: resp.Header, body: respBody}, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query string, body []byte) (*http.Request, error) {
+	url := c.baseURL + path
+	if query != "" {
+		url += "?" + query
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	for key, values := range c.headers {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// doJSON sends in as the JSON body, unless it's nil, and decodes the
+// response into out unless it's nil.
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out any, expected ...int) (response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return response{}, fmt.Errorf("marshaling request: %w", err)
+		}
+	}
+
+	resp, err := c.do(ctx, method, path, "", body, expected...)
+	if err != nil {
+		return response{}, err
+	}
+
+	// Some endpoints report errors in a successful response.
+	if err := errorFromBody(resp); err != nil {
+		return response{}, err
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(resp.body, out); err != nil {
+			return response{}, fmt.Errorf("unmarshaling response: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+type errorResponse struct {
+	Error  string   `json:"error"`
+	Errors []string `json:"errors"`
+	// ChangeRequest is set when a change of a protected segment was stored
+	// for approval instead of being applied.
+	ChangeRequest *changeRequest `json:"change_request"`
+}
+
+func errorFromResponse(resp response) error {
+	if err := errorFromBody(resp); err != nil {
+		return err
+	}
+	return &Error{StatusCode: resp.status, Message: strings.TrimSpace(string(resp.body))}
+}
+
+// errorFromBody returns the errors listed in the response body, if any.
+func errorFromBody(resp response) error {
+	var body errorResponse
+	if len(resp.body) == 0 || json.Unmarshal(resp.body, &body) != nil {
+		return nil
+	}
+
+	if body.ChangeRequest != nil {
+		return &domain.ApprovalRequiredError{ChangeRequest: body.ChangeRequest.toDomain()}
+	}
+
+	var errs []error
+	if body.Error != "" {
+		errs = append(errs, toError(resp.status, body.Error))
+	}
+	for _, message := range body.Errors {
+		errs = append(errs, toError(resp.status, message))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,359 @@
+package client
+
+import (
+	"assignment/domain"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// respond returns a handler that always writes the status and the body.
+func respond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		call    func(c *Client) error
+		wantErr error
+	}{
+		{
+			name:    "error response is mapped to the domain error",
+			handler: respond(http.StatusNotFound, `{"error":"can't find the segment"}`),
+			call: func(c *Client) error {
+				_, err := c.GetSegment(context.Background(), "MISSING")
+				return err
+			},
+			wantErr: domain.ErrSegmentNotFound,
+		},
+		{
+			name:    "error reported with 200 OK is still an error",
+			handler: respond(http.StatusOK, `{"error":"segment with this name is already exists"}`),
+			call: func(c *Client) error {
+				return c.CreateSegment(context.Background(), "TEST_SEGMENT")
+			},
+			wantErr: domain.ErrSegmentAlreadyExists,
+		},
+		{
+			name:    "every error of a list is kept",
+			handler: respond(http.StatusOK, `{"errors":["can't find the segment","segment has reached its members limit"]}`),
+			call: func(c *Client) error {
+				_, err := c.ChangeUserSegments(context.Background(), 1000, []string{"A", "B"}, nil)
+				return err
+			},
+			wantErr: domain.ErrSegmentIsFull,
+		},
+		{
+			name:    "details after the error message are kept",
+			handler: respond(http.StatusBadRequest, `{"error":"archive is malformed: line 3: unexpected end of JSON input"}`),
+			call: func(c *Client) error {
+				_, err := c.ImportState(context.Background(), domain.State{}, domain.ImportMerge)
+				return err
+			},
+			wantErr: domain.ErrInvalidArchive,
+		},
+		{
+			name:    "change of a protected segment reports approval",
+			handler: respond(http.StatusAccepted, `{"error":"change of a protected segment requires approval","change_request":{"id":7,"kind":"delete_segment","status":"pending"}}`),
+			call: func(c *Client) error {
+				return c.DeleteSegment(context.Background(), "TEST_SEGMENT")
+			},
+			wantErr: domain.ErrApprovalRequired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			err := tt.call(New(srv.URL))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected error %v, but got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestClient_UnknownError(t *testing.T) {
+	srv := httptest.NewServer(respond(http.StatusTeapot, `{"error":"something new"}`))
+	defer srv.Close()
+
+	err := New(srv.URL).CreateSegment(context.Background(), "TEST_SEGMENT")
+
+	var clientErr *Error
+	if !errors.As(err, &clientErr) {
+		t.Fatalf("Expected *client.Error, but got %T: %v", err, err)
+	}
+	if clientErr.StatusCode != http.StatusTeapot || clientErr.Message != "something new" {
+		t.Errorf("Unexpected error %+v", clientErr)
+	}
+}
+
+func TestClient_ApprovalRequired(t *testing.T) {
+	srv := httptest.NewServer(respond(http.StatusAccepted,
+		`{"error":"change of a protected segment requires approval","change_request":{"id":7,"kind":"change_user_segments","user_id":1000,"segments_to_add":["A"],"author":"alice","status":"pending"}}`))
+	defer srv.Close()
+
+	_, err := New(srv.URL).ChangeUserSegments(context.Background(), 1000, []string{"A"}, nil)
+
+	var approvalErr *domain.ApprovalRequiredError
+	if !errors.As(err, &approvalErr) {
+		t.Fatalf("Expected *domain.ApprovalRequiredError, but got %T: %v", err, err)
+	}
+	cr := approvalErr.ChangeRequest
+	if cr.ID != 7 || cr.Kind != domain.ChangeUserSegments || cr.User == nil || *cr.User != 1000 || cr.Author != "alice" {
+		t.Errorf("Unexpected change request %+v", cr)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		call         func(c *Client) error
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{
+			name: "reads are retried until they succeed",
+			call: func(c *Client) error {
+				_, err := c.GetUserSegments(context.Background(), 1000)
+				return err
+			},
+			wantAttempts: 3,
+		},
+		{
+			name: "changes are never retried",
+			call: func(c *Client) error {
+				_, err := c.ChangeUserSegments(context.Background(), 1000, []string{"A"}, nil)
+				return err
+			},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if attempts.Add(1) < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				io.WriteString(w, `{"user_id":1000,"user_segments":["A"]}`)
+			}))
+			defer srv.Close()
+
+			err := tt.call(New(srv.URL, WithRetries(2, time.Millisecond)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error = %v, but got %v", tt.wantErr, err)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("Expected %d attempts, but got %d", tt.wantAttempts, got)
+			}
+		})
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithTimeout(10*time.Millisecond), WithRetries(0, 0))
+	_, err := c.GetUserSegments(context.Background(), 1000)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error %v, but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestClient_Request(t *testing.T) {
+	var got struct {
+		method  string
+		path    string
+		headers http.Header
+		body    map[string]any
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got.method, got.path, got.headers = req.Method, req.URL.Path, req.Header
+		json.NewDecoder(req.Body).Decode(&got.body)
+		io.WriteString(w, `{"user_id":1000,"user_segments":["A","B"]}`)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL+"/", WithTenant("team_a"), WithEnvironment("staging"), WithActor("alice"), WithAPIKey("secret"))
+	segments, err := c.GetUserSegments(context.Background(), 1000)
+	if err != nil {
+		t.Fatalf("Client.GetUserSegments() error = %v", err)
+	}
+
+	if !slices.Equal(segments, []string{"A", "B"}) {
+		t.Errorf("Expected segments [A B], but got %v", segments)
+	}
+	if got.method != http.MethodGet || got.path != "/api/get_user_segments" {
+		t.Errorf("Expected GET /api/get_user_segments, but got %s %s", got.method, got.path)
+	}
+	if got.body["user_id"] != float64(1000) {
+		t.Errorf("Expected user_id 1000 in the body, but got %v", got.body)
+	}
+	for header, want := range map[string]string{
+		"X-Tenant":      "team_a",
+		"X-Environment": "staging",
+		"X-Actor":       "alice",
+		"X-Api-Key":     "secret",
+	} {
+		if v := got.headers.Get(header); v != want {
+			t.Errorf("Expected %s header %q, but got %q", header, want, v)
+		}
+	}
+}
+
+func TestClient_ImportState_Conflicts(t *testing.T) {
+	srv := httptest.NewServer(respond(http.StatusConflict,
+		`{"error":"archive conflicts with the current state","conflicts":[{"segment":"A","user_id":1000,"reason":"membership in an unknown segment"}]}`))
+	defer srv.Close()
+
+	conflicts, err := New(srv.URL).ImportState(context.Background(), domain.State{}, domain.ImportReplace)
+	if !errors.Is(err, domain.ErrImportConflicts) {
+		t.Fatalf("Expected error %v, but got %v", domain.ErrImportConflicts, err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Segment != "A" || conflicts[0].User == nil || *conflicts[0].User != 1000 {
+		t.Errorf("Unexpected conflicts %+v", conflicts)
+	}
+}
+
+func TestClient_ChangeUsersSegments(t *testing.T) {
+	srv := httptest.NewServer(respond(http.StatusOK,
+		`{"applied":1,"failed":1,"results":[{"user_id":1000},{"user_id":1001,"errors":["can't find the segment: A","segment has reached its members limit: B"]}]}`))
+	defer srv.Close()
+
+	errs, err := New(srv.URL).ChangeUsersSegments(context.Background(), domain.BulkBestEffort, []domain.UserSegmentsChange{
+		{User: 1000, SegmentsToAdd: []string{"C"}},
+		{User: 1001, SegmentsToAdd: []string{"A", "B"}},
+	})
+	if err != nil {
+		t.Fatalf("Client.ChangeUsersSegments() error = %v", err)
+	}
+	if errs[0] != nil {
+		t.Errorf("Expected first change to be applied, but got %v", errs[0])
+	}
+	if !errors.Is(errs[1], domain.ErrSegmentNotFound) || !errors.Is(errs[1], domain.ErrSegmentIsFull) {
+		t.Errorf("Expected second change to fail with %v and %v, but got %v", domain.ErrSegmentNotFound, domain.ErrSegmentIsFull, errs[1])
+	}
+}
+
+func TestClient_ImportOperations(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("mode") != "atomic" || req.URL.Query().Get("chunk_size") != "500" {
+			t.Errorf("Unexpected query %s", req.URL.RawQuery)
+		}
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != "{\"user_id\":1000}\n" {
+			t.Errorf("Unexpected body %q", body)
+		}
+		io.WriteString(w, `{"line":2,"user_id":1001,"errors":["can't find the segment: A"]}`+"\n"+`{"applied":1,"failed":1}`+"\n")
+	}))
+	defer srv.Close()
+
+	var failed []domain.OperationResult
+	summary, err := New(srv.URL).ImportOperations(context.Background(), strings.NewReader("{\"user_id\":1000}\n"), domain.BulkAtomic, 500,
+		func(r domain.OperationResult) error {
+			failed = append(failed, r)
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("Client.ImportOperations() error = %v", err)
+	}
+	if summary != (domain.ImportSummary{Applied: 1, Failed: 1}) {
+		t.Errorf("Expected 1 applied and 1 failed operation, but got %+v", summary)
+	}
+	if len(failed) != 1 || failed[0].Line != 2 || !errors.Is(failed[0].Err, domain.ErrSegmentNotFound) {
+		t.Errorf("Expected line 2 to fail with %v, but got %+v", domain.ErrSegmentNotFound, failed)
+	}
+}
+
+func TestClient_UploadSegmentMembers(t *testing.T) {
+	t.Run("given invalid rows, expect them to be returned", func(t *testing.T) {
+		srv := httptest.NewServer(respond(http.StatusBadRequest,
+			`{"error":"some rows don't have a valid user_id","rows":[{"line":3,"value":"abc","reason":"user_id must be an integer"}]}`))
+		defer srv.Close()
+
+		_, rows, err := New(srv.URL).UploadSegmentMembers(context.Background(), "A", domain.UploadAdd, strings.NewReader("1000\n1001\nabc\n"))
+		if !errors.Is(err, domain.ErrInvalidRows) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrInvalidRows, err)
+		}
+		if len(rows) != 1 || rows[0] != (domain.RowError{Line: 3, Value: "abc", Reason: "user_id must be an integer"}) {
+			t.Errorf("Expected line 3 to be invalid, but got %+v", rows)
+		}
+	})
+
+	t.Run("given large upload, expect pending job", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("segment") != "A" || req.URL.Query().Get("mode") != "replace" {
+				t.Errorf("Unexpected query %s", req.URL.RawQuery)
+			}
+			if req.Header.Get("Content-Type") != "text/csv" {
+				t.Errorf("Unexpected content type %s", req.Header.Get("Content-Type"))
+			}
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, `{"id":7,"kind":"segment_upload","environment":"production","status":"pending","result":{"segment":"A"},"created_at":"2023-08-01T00:00:00Z"}`)
+		}))
+		defer srv.Close()
+
+		job, _, err := New(srv.URL).UploadSegmentMembers(context.Background(), "A", domain.UploadReplace, strings.NewReader("user_id\n1000\n"))
+		if err != nil {
+			t.Fatalf("Client.UploadSegmentMembers() error = %v", err)
+		}
+		if job.ID != 7 || job.Kind != domain.JobSegmentUpload || job.Status != domain.JobPending {
+			t.Errorf("Expected pending job 7, but got %+v", job)
+		}
+	})
+}
+
+func TestClient_WatchUserSegments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.URL.Query().Get("user_id"); got != "1000" {
+			t.Errorf("Expected user_id 1000 in the query, but got %q", got)
+		}
+		io.WriteString(w, "event: segments\ndata: {\"user_id\":1000,\"segments\":[\"A\"]}\n\n"+
+			": keep-alive\n\n"+
+			"event: segment_added\ndata: {\"user_id\":1000,\"segment\":\"B\"}\n\n"+
+			"event: segment_removed\ndata: {\"user_id\":1000,\"segment\":\"A\"}\n\n")
+	}))
+	defer srv.Close()
+
+	var events []domain.UserSegmentsEvent
+	err := New(srv.URL).WatchUserSegments(context.Background(), 1000, func(e domain.UserSegmentsEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Client.WatchUserSegments() error = %v", err)
+	}
+
+	want := []domain.UserSegmentsEvent{
+		{Segments: []string{"A"}},
+		{Added: []string{"B"}},
+		{Removed: []string{"A"}},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Expected events %+v, but got %+v", want, events)
+	}
+}
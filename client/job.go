@@ -0,0 +1,176 @@
+package client
+
+import (
+	"assignment/domain"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Environment string          `json:"environment"`
+	Actor       string          `json:"actor"`
+	Status      string          `json:"status"`
+	Result      json.RawMessage `json:"result"`
+	Error       string          `json:"error"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at"`
+	FinishedAt  *time.Time      `json:"finished_at"`
+}
+
+func (j job) toDomain() domain.Job {
+	return domain.Job{
+		ID:          j.ID,
+		Kind:        domain.JobKind(j.Kind),
+		Environment: j.Environment,
+		Actor:       j.Actor,
+		Status:      domain.JobStatus(j.Status),
+		Result:      j.Result,
+		Error:       j.Error,
+		CreatedAt:   j.CreatedAt,
+		StartedAt:   j.StartedAt,
+		FinishedAt:  j.FinishedAt,
+	}
+}
+
+func (c *Client) GetJob(ctx context.Context, id int64) (domain.Job, error) {
+	in := struct {
+		ID int64 `json:"id"`
+	}{id}
+
+	var out job
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_job", in, &out, http.StatusOK); err != nil {
+		return domain.Job{}, err
+	}
+	return out.toDomain(), nil
+}
+
+// GetJobs returns up to limit jobs of the kind, newest first. An empty kind
+// means jobs of any kind and zero limit the server's default.
+func (c *Client) GetJobs(ctx context.Context, kind domain.JobKind, limit int) ([]domain.Job, error) {
+	in := struct {
+		Kind  domain.JobKind `json:"kind,omitempty"`
+		Limit int            `json:"limit,omitempty"`
+	}{kind, limit}
+
+	var out struct {
+		Jobs []job `json:"jobs"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_jobs", in, &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]domain.Job, 0, len(out.Jobs))
+	for _, j := range out.Jobs {
+		jobs = append(jobs, j.toDomain())
+	}
+	return jobs, nil
+}
+
+// UploadSegmentMembers sends CSV of user IDs from r to be added to the
+// segment. The returned job is done unless the upload is large, then it's
+// followed with GetJob. If some rows are invalid they are returned with
+// domain.ErrInvalidRows. The timeout of the client doesn't apply, as
+// uploads can take long.
+func (c *Client) UploadSegmentMembers(ctx context.Context, segment string, mode domain.UploadMode, r io.Reader) (domain.Job, []domain.RowError, error) {
+	query := url.Values{"segment": {segment}}
+	if mode != "" {
+		query.Set("mode", string(mode))
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/api/upload_segment_members", query.Encode(), nil)
+	if err != nil {
+		return domain.Job{}, nil, err
+	}
+	req.Body = io.NopCloser(r)
+	req.Header.Set("Content-Type", "text/csv")
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return domain.Job{}, nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return domain.Job{}, nil, fmt.Errorf("reading response: %w", err)
+	}
+	resp := response{status: httpResp.StatusCode, header: httpResp.Header, body: body}
+
+	if resp.status != http.StatusOK && resp.status != http.StatusAccepted {
+		err := errorFromResponse(resp)
+		if !errors.Is(err, domain.ErrInvalidRows) {
+			return domain.Job{}, nil, err
+		}
+
+		var out struct {
+			Rows []struct {
+				Line   int    `json:"line"`
+				Value  string `json:"value"`
+				Reason string `json:"reason"`
+			} `json:"rows"`
+		}
+		if err := json.Unmarshal(resp.body, &out); err != nil {
+			return domain.Job{}, nil, fmt.Errorf("unmarshaling response: %w", err)
+		}
+		rows := make([]domain.RowError, 0, len(out.Rows))
+		for _, row := range out.Rows {
+			rows = append(rows, domain.RowError(row))
+		}
+		return domain.Job{}, rows, err
+	}
+
+	var out job
+	if err := json.Unmarshal(resp.body, &out); err != nil {
+		return domain.Job{}, nil, fmt.Errorf("unmarshaling response: %w", err)
+	}
+	return out.toDomain(), nil, nil
+}
+
+// CreateReport starts a job that builds the report of changes in [from,
+// to), a zero to means up to now. Once GetJob reports the job done, the
+// report is read with DownloadReport.
+func (c *Client) CreateReport(ctx context.Context, report domain.ReportKind, from, to time.Time) (domain.Job, error) {
+	in := struct {
+		Report domain.ReportKind `json:"report"`
+		From   time.Time         `json:"from"`
+		To     time.Time         `json:"to"`
+	}{report, from, to}
+
+	var out job
+	if _, err := c.doJSON(ctx, http.MethodPost, "/api/create_report", in, &out, http.StatusAccepted); err != nil {
+		return domain.Job{}, err
+	}
+	return out.toDomain(), nil
+}
+
+// DownloadReport reads the report built by the job through the service.
+// The timeout of the client doesn't apply, as reports can be large.
+func (c *Client) DownloadReport(ctx context.Context, id int64) (io.ReadCloser, error) {
+	query := url.Values{"id": {strconv.FormatInt(id, 10)}}
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/download_report", query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading response: %w", err)
+		}
+		return nil, errorFromResponse(response{status: resp.StatusCode, header: resp.Header, body: body})
+	}
+	return resp.Body, nil
+}
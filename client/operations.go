@@ -0,0 +1,87 @@
+package client
+
+import (
+	"assignment/domain"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ImportOperations streams newline-delimited JSON operations from r to the
+// server, which applies them by chunks of chunkSize, zero meaning the
+// server's default. failed is called with every operation that wasn't
+// applied as the server reports it. The timeout of the client doesn't
+// apply, as imports can take long.
+func (c *Client) ImportOperations(ctx context.Context, r io.Reader, mode domain.BulkMode, chunkSize int, failed func(domain.OperationResult) error) (domain.ImportSummary, error) {
+	var summary domain.ImportSummary
+
+	query := url.Values{}
+	if mode != "" {
+		query.Set("mode", string(mode))
+	}
+	if chunkSize != 0 {
+		query.Set("chunk_size", strconv.Itoa(chunkSize))
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/api/import_operations", query.Encode(), nil)
+	if err != nil {
+		return summary, err
+	}
+	// Zero ContentLength makes the body chunked, so it's never read whole.
+	req.Body = io.NopCloser(r)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return summary, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return summary, fmt.Errorf("reading response: %w", err)
+		}
+		return summary, errorFromResponse(response{status: resp.StatusCode, header: resp.Header, body: body})
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line struct {
+			Line    *int     `json:"line"`
+			UserId  *int     `json:"user_id"`
+			Errors  []string `json:"errors"`
+			Applied int      `json:"applied"`
+			Failed  int      `json:"failed"`
+			Error   string   `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return summary, fmt.Errorf("unmarshaling result: %w", err)
+		}
+
+		if line.Line == nil {
+			summary = domain.ImportSummary{Applied: line.Applied, Failed: line.Failed}
+			if line.Error != "" {
+				return summary, toError(resp.StatusCode, line.Error)
+			}
+			return summary, nil
+		}
+
+		result := domain.OperationResult{Line: *line.Line, User: line.UserId}
+		for _, message := range line.Errors {
+			result.Err = errors.Join(result.Err, toError(resp.StatusCode, message))
+		}
+		if err := failed(result); err != nil {
+			return summary, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return summary, fmt.Errorf("reading response: %w", err)
+	}
+	return summary, errors.New("response ended without a summary")
+}
@@ -0,0 +1,516 @@
+package client
+
+import (
+	"assignment/domain"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type segmentDetails struct {
+	Segment     string     `json:"segment"`
+	ActiveFrom  *time.Time `json:"active_from"`
+	ActiveUntil *time.Time `json:"active_until"`
+	MaxMembers  *int       `json:"max_members"`
+	Percentage  *int       `json:"percentage"`
+	Protected   bool       `json:"protected"`
+	Members     int        `json:"members"`
+}
+
+func (s segmentDetails) toDomain() domain.SegmentDetails {
+	return domain.SegmentDetails{
+		Segment:    domain.Segment{Name: s.Segment, ActiveFrom: s.ActiveFrom, ActiveUntil: s.ActiveUntil},
+		MaxMembers: s.MaxMembers,
+		Percentage: s.Percentage,
+		Protected:  s.Protected,
+		Members:    s.Members,
+	}
+}
+
+type changeRequest struct {
+	ID               int64      `json:"id"`
+	Kind             string     `json:"kind"`
+	Environment      string     `json:"environment"`
+	Segment          string     `json:"segment"`
+	User             *int       `json:"user_id"`
+	SegmentsToAdd    []string   `json:"segments_to_add"`
+	SegmentsToDelete []string   `json:"segments_to_delete"`
+	ActiveFrom       *time.Time `json:"active_from"`
+	ActiveUntil      *time.Time `json:"active_until"`
+	MaxMembers       *int       `json:"max_members"`
+	Percentage       *int       `json:"percentage"`
+	Author           string     `json:"author"`
+	Status           string     `json:"status"`
+	Reviewer         string     `json:"reviewer"`
+	Error            string     `json:"error"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ReviewedAt       *time.Time `json:"reviewed_at"`
+	Operation        *int64     `json:"operation_id"`
+}
+
+func (cr changeRequest) toDomain() domain.ChangeRequest {
+	return domain.ChangeRequest{
+		ID:               cr.ID,
+		Kind:             domain.ChangeKind(cr.Kind),
+		Environment:      cr.Environment,
+		Segment:          cr.Segment,
+		User:             cr.User,
+		SegmentsToAdd:    cr.SegmentsToAdd,
+		SegmentsToDelete: cr.SegmentsToDelete,
+		ActiveFrom:       cr.ActiveFrom,
+		ActiveUntil:      cr.ActiveUntil,
+		MaxMembers:       cr.MaxMembers,
+		Percentage:       cr.Percentage,
+		Author:           cr.Author,
+		Status:           domain.ChangeStatus(cr.Status),
+		Reviewer:         cr.Reviewer,
+		Error:            cr.Error,
+		CreatedAt:        cr.CreatedAt,
+		ReviewedAt:       cr.ReviewedAt,
+		Operation:        cr.Operation,
+	}
+}
+
+func (c *Client) CreateSegment(ctx context.Context, name string) error {
+	body := struct {
+		Segment string `json:"segment"`
+	}{name}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/create_segment", body, nil, http.StatusOK, http.StatusCreated)
+	return err
+}
+
+// CloneSegment creates the segment with the members of source picked by
+// opts and returns how many were copied.
+func (c *Client) CloneSegment(ctx context.Context, source, name string, opts domain.CloneOptions) (int, error) {
+	in := struct {
+		Source      string     `json:"source"`
+		Segment     string     `json:"segment"`
+		SampleSize  int        `json:"sample_size,omitempty"`
+		JoinedAfter *time.Time `json:"joined_after,omitempty"`
+	}{source, name, opts.SampleSize, opts.JoinedAfter}
+
+	var out struct {
+		Members int `json:"members"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodPost, "/api/clone_segment", in, &out, http.StatusCreated); err != nil {
+		return 0, err
+	}
+	return out.Members, nil
+}
+
+// DeleteSegment returns *domain.ApprovalRequiredError if the segment is
+// protected and the deletion waits for approval.
+func (c *Client) DeleteSegment(ctx context.Context, name string) error {
+	body := struct {
+		Segment string `json:"segment"`
+	}{name}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/delete_segment", body, nil, http.StatusOK, http.StatusAccepted)
+	return err
+}
+
+// SetSegmentSchedule, SetSegmentMaxMembers and SetSegmentPercentage return
+// *domain.ApprovalRequiredError if the segment is protected and the change
+// waits for approval.
+func (c *Client) SetSegmentSchedule(ctx context.Context, name string, activeFrom, activeUntil *time.Time) error {
+	body := struct {
+		Segment     string     `json:"segment"`
+		ActiveFrom  *time.Time `json:"active_from"`
+		ActiveUntil *time.Time `json:"active_until"`
+	}{name, activeFrom, activeUntil}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/set_segment_schedule", body, nil, http.StatusAccepted)
+	return err
+}
+
+func (c *Client) SetSegmentMaxMembers(ctx context.Context, name string, maxMembers *int) error {
+	body := struct {
+		Segment    string `json:"segment"`
+		MaxMembers *int   `json:"max_members"`
+	}{name, maxMembers}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/set_segment_max_members", body, nil, http.StatusAccepted)
+	return err
+}
+
+// SetSegmentPercentage sets the percentage in the environment of the client.
+func (c *Client) SetSegmentPercentage(ctx context.Context, name string, percentage *int) error {
+	body := struct {
+		Segment    string `json:"segment"`
+		Percentage *int   `json:"percentage"`
+	}{name, percentage}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/set_segment_percentage", body, nil, http.StatusAccepted)
+	return err
+}
+
+func (c *Client) PromoteEnvironment(ctx context.Context, from, to string, segments []string, withMembers bool) error {
+	body := struct {
+		From           string   `json:"from"`
+		To             string   `json:"to"`
+		Segments       []string `json:"segments"`
+		IncludeMembers bool     `json:"include_members"`
+	}{from, to, segments, withMembers}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/promote_environment", body, nil, http.StatusAccepted)
+	return err
+}
+
+// SetSegmentProtected returns *domain.ApprovalRequiredError when removing
+// the protection waits for approval.
+func (c *Client) SetSegmentProtected(ctx context.Context, name string, protected bool) error {
+	body := struct {
+		Segment   string `json:"segment"`
+		Protected bool   `json:"protected"`
+	}{name, protected}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/set_segment_protected", body, nil, http.StatusAccepted)
+	return err
+}
+
+// GetChangeRequests returns change requests in the status, the server
+// defaults to pending ones.
+func (c *Client) GetChangeRequests(ctx context.Context, status domain.ChangeStatus) ([]domain.ChangeRequest, error) {
+	query := ""
+	if status != "" {
+		query = url.Values{"status": {string(status)}}.Encode()
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/api/get_change_requests", query, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		ChangeRequests []changeRequest `json:"change_requests"`
+	}
+	if err := json.Unmarshal(resp.body, &body); err != nil {
+		return nil, fmt.Errorf("unmarshaling response: %w", err)
+	}
+
+	requests := make([]domain.ChangeRequest, 0, len(body.ChangeRequests))
+	for _, cr := range body.ChangeRequests {
+		requests = append(requests, cr.toDomain())
+	}
+	return requests, nil
+}
+
+func (c *Client) ApproveChangeRequest(ctx context.Context, id int64) (domain.ChangeRequest, error) {
+	return c.reviewChangeRequest(ctx, "/api/approve_change_request", id)
+}
+
+func (c *Client) RejectChangeRequest(ctx context.Context, id int64) (domain.ChangeRequest, error) {
+	return c.reviewChangeRequest(ctx, "/api/reject_change_request", id)
+}
+
+func (c *Client) reviewChangeRequest(ctx context.Context, path string, id int64) (domain.ChangeRequest, error) {
+	body := struct {
+		ID int64 `json:"id"`
+	}{id}
+
+	var cr changeRequest
+	if _, err := c.doJSON(ctx, http.MethodPost, path, body, &cr, http.StatusOK); err != nil {
+		return domain.ChangeRequest{}, err
+	}
+	return cr.toDomain(), nil
+}
+
+func (c *Client) GetSegment(ctx context.Context, name string) (domain.SegmentDetails, error) {
+	body := struct {
+		Segment string `json:"segment"`
+	}{name}
+
+	var segment segmentDetails
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_segment", body, &segment, http.StatusOK); err != nil {
+		return domain.SegmentDetails{}, err
+	}
+	return segment.toDomain(), nil
+}
+
+func (c *Client) GetSegments(ctx context.Context) ([]domain.SegmentDetails, error) {
+	var body struct {
+		Segments []segmentDetails `json:"segments"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_segments", nil, &body, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	segments := make([]domain.SegmentDetails, 0, len(body.Segments))
+	for _, s := range body.Segments {
+		segments = append(segments, s.toDomain())
+	}
+	return segments, nil
+}
+
+// GetSegmentMembers returns a page of members and the value of after for
+// the next page, nil on the last page.
+func (c *Client) GetSegmentMembers(ctx context.Context, segment string, after, limit int) ([]int, *int, error) {
+	in := struct {
+		Segment string `json:"segment"`
+		After   int    `json:"after"`
+		Limit   int    `json:"limit"`
+	}{segment, after, limit}
+
+	var out struct {
+		Members []int `json:"members"`
+		After   *int  `json:"after"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_segment_members", in, &out, http.StatusOK); err != nil {
+		return nil, nil, err
+	}
+	return out.Members, out.After, nil
+}
+
+func (c *Client) AddSegmentPrerequisite(ctx context.Context, p domain.Prerequisite) error {
+	body := struct {
+		Segment      string `json:"segment"`
+		Prerequisite string `json:"prerequisite"`
+		Cascade      bool   `json:"cascade"`
+	}{p.Segment, p.Prerequisite, p.Cascade}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/add_segment_prerequisite", body, nil, http.StatusCreated)
+	return err
+}
+
+func (c *Client) DeleteSegmentPrerequisite(ctx context.Context, segment, prerequisite string) error {
+	body := struct {
+		Segment      string `json:"segment"`
+		Prerequisite string `json:"prerequisite"`
+	}{segment, prerequisite}
+	_, err := c.doJSON(ctx, http.MethodPost, "/api/delete_segment_prerequisite", body, nil, http.StatusAccepted)
+	return err
+}
+
+func (c *Client) GetSegmentsOverlap(ctx context.Context, segments []string) ([]domain.SegmentOverlap, error) {
+	in := struct {
+		Segments []string `json:"segments"`
+	}{segments}
+
+	var out struct {
+		Overlaps []struct {
+			First         string  `json:"first"`
+			Second        string  `json:"second"`
+			FirstMembers  int     `json:"first_members"`
+			SecondMembers int     `json:"second_members"`
+			Both          int     `json:"both"`
+			Jaccard       float64 `json:"jaccard"`
+		} `json:"overlaps"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_segments_overlap", in, &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	overlaps := make([]domain.SegmentOverlap, 0, len(out.Overlaps))
+	for _, o := range out.Overlaps {
+		overlaps = append(overlaps, domain.SegmentOverlap(o))
+	}
+	return overlaps, nil
+}
+
+func (c *Client) GetSegmentSizeHistory(ctx context.Context, segment string, from, to time.Time, granularity domain.Granularity) ([]domain.SegmentSize, error) {
+	in := struct {
+		Segment     string             `json:"segment"`
+		From        time.Time          `json:"from"`
+		To          time.Time          `json:"to"`
+		Granularity domain.Granularity `json:"granularity"`
+	}{segment, from, to, granularity}
+
+	var out struct {
+		Sizes []struct {
+			At      time.Time `json:"at"`
+			Members int       `json:"members"`
+		} `json:"sizes"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_segment_size_history", in, &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	sizes := make([]domain.SegmentSize, 0, len(out.Sizes))
+	for _, s := range out.Sizes {
+		sizes = append(sizes, domain.SegmentSize(s))
+	}
+	return sizes, nil
+}
+
+func (c *Client) ExportState(ctx context.Context) (domain.State, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/export_state", "", nil, http.StatusOK)
+	if err != nil {
+		return domain.State{}, err
+	}
+
+	state, err := domain.ReadArchive(bytes.NewReader(resp.body))
+	if err != nil {
+		return domain.State{}, fmt.Errorf("reading archive: %w", err)
+	}
+	return state, nil
+}
+
+// ImportState returns the conflicts along with domain.ErrImportConflicts
+// when the server refuses the archive.
+func (c *Client) ImportState(ctx context.Context, state domain.State, mode domain.ImportMode) ([]domain.ImportConflict, error) {
+	var archive bytes.Buffer
+	if err := domain.WriteArchive(&archive, state, time.Now()); err != nil {
+		return nil, fmt.Errorf("writing archive: %w", err)
+	}
+
+	query := url.Values{"mode": {string(mode)}}.Encode()
+	resp, err := c.do(ctx, http.MethodPost, "/api/import_state", query, archive.Bytes(), http.StatusOK, http.StatusConflict)
+	if err != nil {
+		return nil, err
+	}
+	if resp.status == http.StatusOK {
+		return nil, nil
+	}
+
+	var body struct {
+		Conflicts []struct {
+			Segment string `json:"segment"`
+			User    *int   `json:"user_id"`
+			Reason  string `json:"reason"`
+		} `json:"conflicts"`
+	}
+	if err := json.Unmarshal(resp.body, &body); err != nil {
+		return nil, fmt.Errorf("unmarshaling response: %w", err)
+	}
+
+	conflicts := make([]domain.ImportConflict, 0, len(body.Conflicts))
+	for _, conflict := range body.Conflicts {
+		conflicts = append(conflicts, domain.ImportConflict(conflict))
+	}
+	return conflicts, domain.ErrImportConflicts
+}
+
+// ChangeUserSegments returns the ID of the operation that made the change,
+// see UndoOperation. It returns *domain.ApprovalRequiredError if any of the
+// segments is protected and the change waits for approval.
+func (c *Client) ChangeUserSegments(ctx context.Context, user int, segmentsToAdd []string, segmentsToDelete []string) (int64, error) {
+	body := struct {
+		UserId           int      `json:"user_id"`
+		SegmentsToAdd    []string `json:"segments_to_add"`
+		SegmentsToDelete []string `json:"segments_to_delete"`
+	}{user, segmentsToAdd, segmentsToDelete}
+
+	var out struct {
+		OperationID int64 `json:"operation_id"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodPost, "/api/change_user_segments", body, &out, http.StatusOK, http.StatusCreated, http.StatusAccepted); err != nil {
+		return 0, err
+	}
+	return out.OperationID, nil
+}
+
+type operation struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"user_id"`
+	Actor     string    `json:"actor"`
+	Added     []string  `json:"added"`
+	Removed   []string  `json:"removed"`
+	CreatedAt time.Time `json:"created_at"`
+	UndoneBy  *int64    `json:"undone_by"`
+}
+
+func (op operation) toDomain() domain.Operation {
+	return domain.Operation{
+		ID:        op.ID,
+		User:      op.UserID,
+		Actor:     op.Actor,
+		Added:     op.Added,
+		Removed:   op.Removed,
+		CreatedAt: op.CreatedAt,
+		UndoneBy:  op.UndoneBy,
+	}
+}
+
+func (c *Client) GetOperation(ctx context.Context, id int64) (domain.Operation, error) {
+	in := struct {
+		ID int64 `json:"id"`
+	}{id}
+
+	var out operation
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_operation", in, &out, http.StatusOK); err != nil {
+		return domain.Operation{}, err
+	}
+	return out.toDomain(), nil
+}
+
+// UndoOperation reverts the operation and returns the operation that did
+// it. It fails with domain.ErrUndoConflict if the user's memberships were
+// changed since.
+func (c *Client) UndoOperation(ctx context.Context, id int64) (domain.Operation, error) {
+	in := struct {
+		ID int64 `json:"id"`
+	}{id}
+
+	var out operation
+	if _, err := c.doJSON(ctx, http.MethodPost, "/api/undo_operation", in, &out, http.StatusOK); err != nil {
+		return domain.Operation{}, err
+	}
+	return out.toDomain(), nil
+}
+
+// ChangeUsersSegments applies the changes in one request and returns the
+// error of every change, nil for the applied ones.
+func (c *Client) ChangeUsersSegments(ctx context.Context, mode domain.BulkMode, changes []domain.UserSegmentsChange) ([]error, error) {
+	type change struct {
+		UserId           int      `json:"user_id"`
+		SegmentsToAdd    []string `json:"segments_to_add"`
+		SegmentsToDelete []string `json:"segments_to_delete"`
+	}
+	in := struct {
+		Mode    domain.BulkMode `json:"mode"`
+		Changes []change        `json:"changes"`
+	}{Mode: mode, Changes: make([]change, 0, len(changes))}
+	for _, ch := range changes {
+		in.Changes = append(in.Changes, change{ch.User, ch.SegmentsToAdd, ch.SegmentsToDelete})
+	}
+
+	var out struct {
+		Results []struct {
+			Errors []string `json:"errors"`
+		} `json:"results"`
+	}
+	resp, err := c.doJSON(ctx, http.MethodPost, "/api/change_users_segments", in, &out, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Results) != len(changes) {
+		return nil, fmt.Errorf("expected %d results, but got %d", len(changes), len(out.Results))
+	}
+
+	errs := make([]error, len(changes))
+	for i, result := range out.Results {
+		for _, message := range result.Errors {
+			errs[i] = errors.Join(errs[i], toError(resp.status, message))
+		}
+	}
+	return errs, nil
+}
+
+func (c *Client) GetUserSegments(ctx context.Context, user int) ([]string, error) {
+	in := struct {
+		UserId int `json:"user_id"`
+	}{user}
+
+	var out struct {
+		UserSegments []string `json:"user_segments"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_user_segments", in, &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return out.UserSegments, nil
+}
+
+// GetUserSegmentsAsOf returns the segments the user was added to at the
+// moment, including deleted ones, without schedules and rollouts.
+func (c *Client) GetUserSegmentsAsOf(ctx context.Context, user int, at time.Time) ([]string, error) {
+	in := struct {
+		UserId int       `json:"user_id"`
+		AsOf   time.Time `json:"as_of"`
+	}{user, at}
+
+	var out struct {
+		UserSegments []string `json:"user_segments"`
+	}
+	if _, err := c.doJSON(ctx, http.MethodGet, "/api/get_user_segments", in, &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return out.UserSegments, nil
+}
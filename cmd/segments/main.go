@@ -0,0 +1,99 @@
+// Command segments calls the segments service from the command line.
+//
+//	segments import-operations [flags] [file]
+//
+// import-operations streams newline-delimited JSON operations, like
+// {"user_id":1000,"segments_to_add":["A"],"segments_to_delete":["B"]}, from
+// the file or the standard input to the service and prints a JSON line for
+// every operation that failed, with its line number, and a summary line.
+// It exits with status 1 if any operation failed.
+package main
+
+import (
+	"assignment/client"
+	"assignment/domain"
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "import-operations" {
+		fmt.Fprintln(os.Stderr, "usage: segments import-operations [flags] [file]")
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("import-operations", flag.ExitOnError)
+	url := flags.String("url", envOr("SEGMENTS_URL", "http://localhost:8000"), "address of the service")
+	apiKey := flags.String("api-key", os.Getenv("SEGMENTS_API_KEY"), "API key, selects the tenant")
+	tenant := flags.String("tenant", "", "tenant, on services without API keys")
+	environment := flags.String("environment", "", "environment, production by default")
+	actor := flags.String("actor", "", "name recorded as the author of the changes")
+	mode := flags.String("mode", string(domain.BulkBestEffort), "atomic or best_effort, applies to every chunk")
+	chunkSize := flags.Int("chunk-size", 0, "operations applied at once, the service's default if zero")
+	flags.Parse(os.Args[2:])
+
+	var opts []client.Option
+	if *apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*apiKey))
+	}
+	if *tenant != "" {
+		opts = append(opts, client.WithTenant(*tenant))
+	}
+	if *environment != "" {
+		opts = append(opts, client.WithEnvironment(*environment))
+	}
+	if *actor != "" {
+		opts = append(opts, client.WithActor(*actor))
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open operations: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	enc := json.NewEncoder(out)
+
+	type result struct {
+		Line   int      `json:"line"`
+		UserId *int     `json:"user_id,omitempty"`
+		Errors []string `json:"errors"`
+	}
+	c := client.New(*url, opts...)
+	summary, err := c.ImportOperations(ctx, in, domain.BulkMode(*mode), *chunkSize, func(r domain.OperationResult) error {
+		return enc.Encode(result{Line: r.Line, UserId: r.User, Errors: domain.ErrorMessages(r.Err)})
+	})
+	enc.Encode(map[string]int{"applied": summary.Applied, "failed": summary.Failed})
+	if err != nil {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		os.Exit(1)
+	}
+	if summary.Failed > 0 {
+		out.Flush()
+		os.Exit(1)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
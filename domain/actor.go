@@ -0,0 +1,30 @@
+package domain
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrInvalidActor = errors.New("actor name must be at most 200 characters long")
+
+type actorKey struct{}
+
+// WithActor makes changes done with the returned context attributed to the
+// actor, an arbitrary name of the person or service doing them.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set by WithActor or an empty string
+// when the change is anonymous.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+func ValidateActor(actor string) error {
+	if len(actor) > 200 {
+		return ErrInvalidActor
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// DefaultMaxOverlapSegments bounds how many segments can be compared in a
+// single overlap request, the number of pairs grows quadratically.
+const DefaultMaxOverlapSegments = 10
+
+var (
+	ErrNotEnoughSegments = errors.New("at least two segments are required")
+	ErrTooManySegments   = errors.New("too many segments requested")
+)
+
+// SegmentOverlap is the number of users shared by two segments.
+type SegmentOverlap struct {
+	First         string
+	Second        string
+	FirstMembers  int
+	SecondMembers int
+	Both          int
+	// Jaccard is |First ∩ Second| / |First ∪ Second|, zero when both
+	// segments are empty.
+	Jaccard float64
+}
+
+// WithMaxOverlapSegments overrides DefaultMaxOverlapSegments.
+func WithMaxOverlapSegments(n int) Option {
+	return func(ss *SegmentService) {
+		ss.maxOverlapSegments = n
+	}
+}
+
+// GetSegmentsOverlap returns the overlap of every pair of the given segments.
+func (ss *SegmentService) GetSegmentsOverlap(ctx context.Context, segments []string) ([]SegmentOverlap, error) {
+	segments = slices.Clone(segments)
+	slices.Sort(segments)
+	segments = slices.Compact(segments)
+
+	if len(segments) < 2 {
+		return nil, ErrNotEnoughSegments
+	}
+	if len(segments) > ss.maxOverlapSegments {
+		return nil, fmt.Errorf("%w: at most %d are allowed", ErrTooManySegments, ss.maxOverlapSegments)
+	}
+
+	overlaps, err := ss.storage.GetSegmentsOverlap(ctx, segments)
+	if err != nil {
+		return nil, fmt.Errorf("getting segments overlap: %w", err)
+	}
+
+	for i := range overlaps {
+		o := &overlaps[i]
+		if union := o.FirstMembers + o.SecondMembers - o.Both; union > 0 {
+			o.Jaccard = float64(o.Both) / float64(union)
+		}
+	}
+
+	return overlaps, nil
+}
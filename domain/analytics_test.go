@@ -0,0 +1,81 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSegmentService_GetSegmentsOverlap(t *testing.T) {
+	tests := []struct {
+		name         string
+		segments     []string
+		overlaps     []SegmentOverlap
+		wantErr      error
+		wantSegments []string
+		wantJaccard  []float64
+	}{
+		{
+			name:     "single segment is rejected",
+			segments: []string{"DISCOUNT_30", "DISCOUNT_30"},
+			wantErr:  ErrNotEnoughSegments,
+		},
+		{
+			name:     "more segments than allowed are rejected",
+			segments: []string{"A", "B", "C", "D"},
+			wantErr:  ErrTooManySegments,
+		},
+		{
+			name:         "jaccard similarity is computed from counts",
+			segments:     []string{"DISCOUNT_50", "DISCOUNT_30", "DISCOUNT_50"},
+			wantSegments: []string{"DISCOUNT_30", "DISCOUNT_50"},
+			overlaps: []SegmentOverlap{
+				{First: "DISCOUNT_30", Second: "DISCOUNT_50", FirstMembers: 30, SecondMembers: 20, Both: 10},
+			},
+			wantJaccard: []float64{0.25},
+		},
+		{
+			name:         "empty segments have zero similarity",
+			segments:     []string{"A", "B"},
+			wantSegments: []string{"A", "B"},
+			overlaps: []SegmentOverlap{
+				{First: "A", Second: "B"},
+			},
+			wantJaccard: []float64{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetSegmentsOverlapFunc: func(ctx context.Context, segments []string) ([]SegmentOverlap, error) {
+					return tt.overlaps, nil
+				},
+			}
+
+			ss := NewSegmentService(storage, WithMaxOverlapSegments(3))
+			got, err := ss.GetSegmentsOverlap(context.Background(), tt.segments)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SegmentService.GetSegmentsOverlap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(storage.GetSegmentsOverlapCalls) != 0 {
+					t.Errorf("Expected no calls to storage.GetSegmentsOverlap, but got %d", len(storage.GetSegmentsOverlapCalls))
+				}
+				return
+			}
+
+			if !slices.Equal(storage.GetSegmentsOverlapCalls[0].segments, tt.wantSegments) {
+				t.Errorf("Expected storage to be asked for %v, but got %v", tt.wantSegments, storage.GetSegmentsOverlapCalls[0].segments)
+			}
+
+			jaccard := make([]float64, 0, len(got))
+			for _, o := range got {
+				jaccard = append(jaccard, o.Jaccard)
+			}
+			if !slices.Equal(jaccard, tt.wantJaccard) {
+				t.Errorf("Expected jaccard similarity %v, but got %v", tt.wantJaccard, jaccard)
+			}
+		})
+	}
+}
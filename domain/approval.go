@@ -0,0 +1,279 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var (
+	ErrApprovalRequired        = errors.New("change of a protected segment requires approval")
+	ErrActorRequired           = errors.New("actor is required to change protected segments")
+	ErrChangeRequestNotFound   = errors.New("can't find the change request")
+	ErrChangeRequestNotPending = errors.New("change request is already reviewed")
+	ErrSelfApproval            = errors.New("change request must be approved by someone other than its author")
+	ErrInvalidChangeStatus     = errors.New("status must be one of pending, approved, rejected or failed")
+	ErrSegmentProtected        = errors.New("segment is protected")
+)
+
+type ChangeKind string
+
+const (
+	ChangeDeleteSegment     ChangeKind = "delete_segment"
+	ChangeUserSegments      ChangeKind = "change_user_segments"
+	ChangeUnprotectSegment  ChangeKind = "unprotect_segment"
+	ChangeSegmentSchedule   ChangeKind = "set_segment_schedule"
+	ChangeSegmentMaxMembers ChangeKind = "set_segment_max_members"
+	ChangeSegmentPercentage ChangeKind = "set_segment_percentage"
+)
+
+type ChangeStatus string
+
+const (
+	ChangePending  ChangeStatus = "pending"
+	ChangeApproved ChangeStatus = "approved"
+	ChangeRejected ChangeStatus = "rejected"
+	// ChangeFailed is an approved change that couldn't be applied, see
+	// ChangeRequest.Error.
+	ChangeFailed ChangeStatus = "failed"
+)
+
+// ChangeRequest is a change of protected segments waiting for a second
+// person to approve it. Segment is set for changes of a single segment,
+// User and the segment lists for ChangeUserSegments, and the settings of a
+// segment for the kinds that set them, where nil clears the setting.
+// Operation is set once an approved ChangeUserSegments is applied.
+type ChangeRequest struct {
+	ID               int64
+	Kind             ChangeKind
+	Environment      string
+	Segment          string
+	User             *int
+	SegmentsToAdd    []string
+	SegmentsToDelete []string
+	ActiveFrom       *time.Time
+	ActiveUntil      *time.Time
+	MaxMembers       *int
+	Percentage       *int
+	Author           string
+	Status           ChangeStatus
+	Reviewer         string
+	Error            string
+	CreatedAt        time.Time
+	ReviewedAt       *time.Time
+	Operation        *int64
+}
+
+// Review is the outcome of reviewing a change request, with the operation
+// that applied it if any.
+type Review struct {
+	Status    ChangeStatus
+	Reviewer  string
+	Error     string
+	At        time.Time
+	Operation *int64
+}
+
+// ApprovalRequiredError is returned instead of applying a change of
+// protected segments. The change is stored as ChangeRequest and is applied
+// once approved.
+type ApprovalRequiredError struct {
+	ChangeRequest ChangeRequest
+}
+
+func (e *ApprovalRequiredError) Error() string {
+	return fmt.Sprintf("%s: change request %d", ErrApprovalRequired, e.ChangeRequest.ID)
+}
+
+func (e *ApprovalRequiredError) Unwrap() error {
+	return ErrApprovalRequired
+}
+
+// SetSegmentProtected marks the segment as protected, after that deleting
+// it, changing its members or any of its settings has to be approved.
+// Removing the protection has to be approved too.
+func (ss *SegmentService) SetSegmentProtected(ctx context.Context, name string, protected bool) error {
+	if !protected {
+		touched, err := ss.protectedAmong(ctx, name)
+		if err != nil {
+			return err
+		}
+		if len(touched) > 0 {
+			return ss.propose(ctx, ChangeRequest{Kind: ChangeUnprotectSegment, Segment: name})
+		}
+	}
+
+	if err := ss.storage.SetSegmentProtected(ctx, name, protected); err != nil {
+		return fmt.Errorf("setting segment protection: %w", err)
+	}
+	return nil
+}
+
+func (ss *SegmentService) GetChangeRequests(ctx context.Context, status ChangeStatus) ([]ChangeRequest, error) {
+	switch status {
+	case "", ChangePending, ChangeApproved, ChangeRejected, ChangeFailed:
+	default:
+		return nil, ErrInvalidChangeStatus
+	}
+
+	requests, err := ss.storage.GetChangeRequests(ctx, status)
+	if err != nil {
+		return nil, fmt.Errorf("getting change requests: %w", err)
+	}
+	return requests, nil
+}
+
+// ApproveChangeRequest applies the change on behalf of the actor of ctx. If
+// the change can't be applied anymore the request is marked as failed and
+// the error is returned. Actors are names given by the callers, which are
+// trusted to have authenticated them, so it's up to them that an author
+// can't approve a change under another name.
+func (ss *SegmentService) ApproveChangeRequest(ctx context.Context, id int64) (ChangeRequest, error) {
+	reviewer := ActorFromContext(ctx)
+	if reviewer == "" {
+		return ChangeRequest{}, ErrActorRequired
+	}
+
+	cr, err := ss.storage.GetChangeRequest(ctx, id)
+	if err != nil {
+		return ChangeRequest{}, fmt.Errorf("getting change request: %w", err)
+	}
+	if cr.Status != ChangePending {
+		return ChangeRequest{}, ErrChangeRequestNotPending
+	}
+	if cr.Author == reviewer {
+		return ChangeRequest{}, ErrSelfApproval
+	}
+
+	review := Review{Status: ChangeApproved, Reviewer: reviewer, At: ss.now()}
+	if err := ss.storage.ReviewChangeRequest(ctx, id, ChangePending, review); err != nil {
+		return ChangeRequest{}, fmt.Errorf("approving change request: %w", err)
+	}
+
+	operation, applyErr := ss.applyChangeRequest(WithEnvironment(ctx, cr.Environment), cr)
+	if operation != 0 {
+		review.Operation = &operation
+	}
+	if applyErr != nil {
+		review.Status, review.Error = ChangeFailed, applyErr.Error()
+		if err := ss.storage.ReviewChangeRequest(ctx, id, ChangeApproved, review); err != nil {
+			return ChangeRequest{}, errors.Join(
+				fmt.Errorf("applying change request: %w", applyErr),
+				fmt.Errorf("marking change request as failed: %w", err),
+			)
+		}
+		return ChangeRequest{}, fmt.Errorf("applying change request: %w", applyErr)
+	}
+
+	if review.Operation != nil {
+		if err := ss.storage.ReviewChangeRequest(ctx, id, ChangeApproved, review); err != nil {
+			return ChangeRequest{}, fmt.Errorf("recording operation of change request: %w", err)
+		}
+	}
+
+	cr.Status, cr.Reviewer, cr.ReviewedAt, cr.Operation = review.Status, review.Reviewer, &review.At, review.Operation
+	return cr, nil
+}
+
+// RejectChangeRequest drops the change. Authors may reject their own
+// requests to withdraw them.
+func (ss *SegmentService) RejectChangeRequest(ctx context.Context, id int64) (ChangeRequest, error) {
+	reviewer := ActorFromContext(ctx)
+	if reviewer == "" {
+		return ChangeRequest{}, ErrActorRequired
+	}
+
+	cr, err := ss.storage.GetChangeRequest(ctx, id)
+	if err != nil {
+		return ChangeRequest{}, fmt.Errorf("getting change request: %w", err)
+	}
+	if cr.Status != ChangePending {
+		return ChangeRequest{}, ErrChangeRequestNotPending
+	}
+
+	review := Review{Status: ChangeRejected, Reviewer: reviewer, At: ss.now()}
+	if err := ss.storage.ReviewChangeRequest(ctx, id, ChangePending, review); err != nil {
+		return ChangeRequest{}, fmt.Errorf("rejecting change request: %w", err)
+	}
+
+	cr.Status, cr.Reviewer, cr.ReviewedAt = review.Status, review.Reviewer, &review.At
+	return cr, nil
+}
+
+// applyChangeRequest applies the approved change and returns the operation
+// of ChangeUserSegments changes, zero for the other kinds.
+func (ss *SegmentService) applyChangeRequest(ctx context.Context, cr ChangeRequest) (int64, error) {
+	switch cr.Kind {
+	case ChangeDeleteSegment:
+		if err := ss.storage.DeleteSegment(ctx, cr.Segment); err != nil {
+			return 0, fmt.Errorf("deleting segment: %w", err)
+		}
+	case ChangeUserSegments:
+		if cr.User == nil {
+			return 0, fmt.Errorf("change request %d has no user", cr.ID)
+		}
+		return ss.changeUserSegments(ctx, *cr.User, cr.SegmentsToAdd, cr.SegmentsToDelete)
+	case ChangeUnprotectSegment:
+		if err := ss.storage.SetSegmentProtected(ctx, cr.Segment, false); err != nil {
+			return 0, fmt.Errorf("setting segment protection: %w", err)
+		}
+	case ChangeSegmentSchedule:
+		if err := ss.storage.SetSegmentSchedule(ctx, cr.Segment, cr.ActiveFrom, cr.ActiveUntil); err != nil {
+			return 0, fmt.Errorf("setting segment schedule: %w", err)
+		}
+	case ChangeSegmentMaxMembers:
+		if err := ss.storage.SetSegmentMaxMembers(ctx, cr.Segment, cr.MaxMembers); err != nil {
+			return 0, fmt.Errorf("setting segment max members: %w", err)
+		}
+	case ChangeSegmentPercentage:
+		if err := ss.storage.SetSegmentPercentage(ctx, cr.Segment, cr.Percentage); err != nil {
+			return 0, fmt.Errorf("setting segment percentage: %w", err)
+		}
+	default:
+		return 0, fmt.Errorf("unknown change kind %q", cr.Kind)
+	}
+	return 0, nil
+}
+
+// propose stores the change as a pending change request authored by the
+// actor of ctx and returns ApprovalRequiredError describing it.
+func (ss *SegmentService) propose(ctx context.Context, cr ChangeRequest) error {
+	cr.Author = ActorFromContext(ctx)
+	if cr.Author == "" {
+		return ErrActorRequired
+	}
+	cr.Environment = EnvironmentFromContext(ctx)
+	cr.Status = ChangePending
+	cr.CreatedAt = ss.now()
+	// A dry run only tells that approval would be required, a request
+	// stored in its transaction would be rolled back anyway.
+	if inDryRun(ctx) {
+		return &ApprovalRequiredError{ChangeRequest: cr}
+	}
+
+	id, err := ss.storage.CreateChangeRequest(ctx, cr)
+	if err != nil {
+		return fmt.Errorf("creating change request: %w", err)
+	}
+	cr.ID = id
+
+	return &ApprovalRequiredError{ChangeRequest: cr}
+}
+
+// protectedAmong returns which of the segments are protected.
+func (ss *SegmentService) protectedAmong(ctx context.Context, segments ...string) ([]string, error) {
+	protected, err := ss.storage.GetProtectedSegments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting protected segments: %w", err)
+	}
+
+	var touched []string
+	for _, s := range segments {
+		if slices.Contains(protected, s) && !slices.Contains(touched, s) {
+			touched = append(touched, s)
+		}
+	}
+	return touched, nil
+}
@@ -0,0 +1,264 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSegmentService_DeleteSegment_Protected(t *testing.T) {
+	tests := []struct {
+		name        string
+		actor       string
+		wantErr     error
+		wantDeletes int
+		wantCreates int
+	}{
+		{
+			name:        "deleting a protected segment creates a change request",
+			actor:       "alice",
+			wantErr:     ErrApprovalRequired,
+			wantCreates: 1,
+		},
+		{
+			name:    "anonymous change of a protected segment is rejected",
+			wantErr: ErrActorRequired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return []string{"TEST_SEGMENT"}, nil
+				},
+				CreateChangeRequestFunc: func(ctx context.Context, cr ChangeRequest) (int64, error) {
+					return 42, nil
+				},
+				DeleteSegmentFunc: func(ctx context.Context, name string) error {
+					return nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			err := ss.DeleteSegment(WithActor(context.Background(), tt.actor), "TEST_SEGMENT")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SegmentService.DeleteSegment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(storage.DeleteSegmentCalls) != tt.wantDeletes {
+				t.Errorf("Expected %d calls to storage.DeleteSegment, but got %d", tt.wantDeletes, len(storage.DeleteSegmentCalls))
+			}
+			if len(storage.CreateChangeRequestCalls) != tt.wantCreates {
+				t.Errorf("Expected %d calls to storage.CreateChangeRequest, but got %d", tt.wantCreates, len(storage.CreateChangeRequestCalls))
+			}
+
+			var approvalErr *ApprovalRequiredError
+			if errors.As(err, &approvalErr) {
+				cr := approvalErr.ChangeRequest
+				if cr.ID != 42 || cr.Kind != ChangeDeleteSegment || cr.Author != tt.actor || cr.Status != ChangePending {
+					t.Errorf("Unexpected change request %+v", cr)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentService_ChangeUserSegments_Protected(t *testing.T) {
+	storage := &storageMock{
+		GetPrerequisitesFunc: func(ctx context.Context) ([]Prerequisite, error) {
+			return nil, nil
+		},
+		GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+			return []string{"PROTECTED"}, nil
+		},
+		CreateChangeRequestFunc: func(ctx context.Context, cr ChangeRequest) (int64, error) {
+			return 1, nil
+		},
+	}
+
+	ss := NewSegmentService(storage)
+	_, err := ss.ChangeUserSegments(WithActor(context.Background(), "alice"), 1000, []string{"REGULAR", "PROTECTED"}, nil)
+	if !errors.Is(err, ErrApprovalRequired) {
+		t.Fatalf("SegmentService.ChangeUserSegments() error = %v, wantErr %v", err, ErrApprovalRequired)
+	}
+	if len(storage.AddUserToSegmentCalls) != 0 {
+		t.Errorf("Expected no calls to storage.AddUserToSegment, but got %d", len(storage.AddUserToSegmentCalls))
+	}
+
+	cr := storage.CreateChangeRequestCalls[0].cr
+	if cr.Kind != ChangeUserSegments || cr.User == nil || *cr.User != 1000 || len(cr.SegmentsToAdd) != 2 {
+		t.Errorf("Expected the whole change to be proposed, but got %+v", cr)
+	}
+}
+
+func TestSegmentService_ApproveChangeRequest(t *testing.T) {
+	pending := ChangeRequest{ID: 1, Kind: ChangeDeleteSegment, Segment: "TEST_SEGMENT", Author: "alice", Status: ChangePending}
+	rejected := pending
+	rejected.Status = ChangeRejected
+
+	tests := []struct {
+		name        string
+		reviewer    string
+		request     ChangeRequest
+		deleteErr   error
+		wantErr     error
+		wantReviews []ChangeStatus
+	}{
+		{
+			name:        "approval by another person applies the change",
+			reviewer:    "bob",
+			request:     pending,
+			wantReviews: []ChangeStatus{ChangeApproved},
+		},
+		{
+			name:     "author can't approve their own change",
+			reviewer: "alice",
+			request:  pending,
+			wantErr:  ErrSelfApproval,
+		},
+		{
+			name:    "anonymous approval is rejected",
+			request: pending,
+			wantErr: ErrActorRequired,
+		},
+		{
+			name:     "reviewed change can't be approved",
+			reviewer: "bob",
+			request:  rejected,
+			wantErr:  ErrChangeRequestNotPending,
+		},
+		{
+			name:        "change that can't be applied is marked as failed",
+			reviewer:    "bob",
+			request:     pending,
+			deleteErr:   ErrSegmentNotFound,
+			wantErr:     ErrSegmentNotFound,
+			wantReviews: []ChangeStatus{ChangeApproved, ChangeFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetChangeRequestFunc: func(ctx context.Context, id int64) (ChangeRequest, error) {
+					return tt.request, nil
+				},
+				ReviewChangeRequestFunc: func(ctx context.Context, id int64, from ChangeStatus, review Review) error {
+					return nil
+				},
+				DeleteSegmentFunc: func(ctx context.Context, name string) error {
+					return tt.deleteErr
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			_, err := ss.ApproveChangeRequest(WithActor(context.Background(), tt.reviewer), 1)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SegmentService.ApproveChangeRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var reviews []ChangeStatus
+			for _, call := range storage.ReviewChangeRequestCalls {
+				reviews = append(reviews, call.review.Status)
+			}
+			if len(reviews) != len(tt.wantReviews) {
+				t.Fatalf("Expected reviews %v, but got %v", tt.wantReviews, reviews)
+			}
+			for i := range reviews {
+				if reviews[i] != tt.wantReviews[i] {
+					t.Errorf("Expected reviews %v, but got %v", tt.wantReviews, reviews)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentService_ApproveChangeRequest_Operation(t *testing.T) {
+	user := 1000
+	request := ChangeRequest{ID: 1, Kind: ChangeUserSegments, User: &user, SegmentsToAdd: []string{"PROTECTED"}, Author: "alice", Status: ChangePending}
+	storage := &storageMock{
+		GetChangeRequestFunc: func(ctx context.Context, id int64) (ChangeRequest, error) {
+			return request, nil
+		},
+		ReviewChangeRequestFunc: func(ctx context.Context, id int64, from ChangeStatus, review Review) error {
+			return nil
+		},
+		GetPrerequisitesFunc: func(ctx context.Context) ([]Prerequisite, error) {
+			return nil, nil
+		},
+		CreateOperationFunc: func(ctx context.Context, user int) (int64, error) {
+			return 7, nil
+		},
+		AddUserToSegmentFunc: func(ctx context.Context, user int, segments []string) error {
+			return nil
+		},
+	}
+
+	ss := NewSegmentService(storage)
+	cr, err := ss.ApproveChangeRequest(WithActor(context.Background(), "bob"), 1)
+	if err != nil {
+		t.Fatalf("SegmentService.ApproveChangeRequest() error = %v", err)
+	}
+	if cr.Operation == nil || *cr.Operation != 7 {
+		t.Errorf("Expected operation 7, but got %v", cr.Operation)
+	}
+
+	last := storage.ReviewChangeRequestCalls[len(storage.ReviewChangeRequestCalls)-1]
+	if last.review.Operation == nil || *last.review.Operation != 7 {
+		t.Errorf("Expected operation 7 to be stored with the review, but got %v", last.review.Operation)
+	}
+}
+
+func TestSegmentService_SetSegmentSettings_Protected(t *testing.T) {
+	limit, percentage := 10, 50
+	tests := []struct {
+		name string
+		set  func(ss SegmentService, ctx context.Context) error
+		want ChangeRequest
+	}{
+		{
+			name: "schedule",
+			set: func(ss SegmentService, ctx context.Context) error {
+				return ss.SetSegmentSchedule(ctx, "TEST_SEGMENT", nil, nil)
+			},
+			want: ChangeRequest{Kind: ChangeSegmentSchedule, Segment: "TEST_SEGMENT"},
+		},
+		{
+			name: "max members",
+			set: func(ss SegmentService, ctx context.Context) error {
+				return ss.SetSegmentMaxMembers(ctx, "TEST_SEGMENT", &limit)
+			},
+			want: ChangeRequest{Kind: ChangeSegmentMaxMembers, Segment: "TEST_SEGMENT", MaxMembers: &limit},
+		},
+		{
+			name: "percentage",
+			set: func(ss SegmentService, ctx context.Context) error {
+				return ss.SetSegmentPercentage(ctx, "TEST_SEGMENT", &percentage)
+			},
+			want: ChangeRequest{Kind: ChangeSegmentPercentage, Segment: "TEST_SEGMENT", Percentage: &percentage},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("change of "+tt.name+" of a protected segment creates a change request", func(t *testing.T) {
+			storage := &storageMock{
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return []string{"TEST_SEGMENT"}, nil
+				},
+				CreateChangeRequestFunc: func(ctx context.Context, cr ChangeRequest) (int64, error) {
+					return 42, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			err := tt.set(ss, WithActor(context.Background(), "alice"))
+			if !errors.Is(err, ErrApprovalRequired) {
+				t.Fatalf("Expected error %v, but got %v", ErrApprovalRequired, err)
+			}
+			if len(storage.CreateChangeRequestCalls) != 1 {
+				t.Fatalf("Expected a change request, but got %d", len(storage.CreateChangeRequestCalls))
+			}
+			cr := storage.CreateChangeRequestCalls[0].cr
+			if cr.Kind != tt.want.Kind || cr.Segment != tt.want.Segment || cr.MaxMembers != tt.want.MaxMembers || cr.Percentage != tt.want.Percentage {
+				t.Errorf("Expected change request %+v, but got %+v", tt.want, cr)
+			}
+		})
+	}
+}
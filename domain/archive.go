@@ -0,0 +1,364 @@
+package domain
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// ArchiveVersion is the version of the export format written by WriteArchive.
+const ArchiveVersion = 1
+
+var (
+	ErrInvalidArchive            = errors.New("archive is malformed")
+	ErrUnsupportedArchiveVersion = errors.New("archive version is not supported")
+	ErrInvalidImportMode         = errors.New("import mode must be either merge or replace")
+	ErrImportConflicts           = errors.New("archive conflicts with the current state")
+)
+
+// Membership is a single user being in a single segment.
+type Membership struct {
+	User    int
+	Segment string
+}
+
+// State is everything needed to recreate segments and their members
+// elsewhere. Members of SegmentDetails is ignored on import.
+type State struct {
+	Segments      []SegmentDetails
+	Prerequisites []Prerequisite
+	Memberships   []Membership
+}
+
+type ImportMode string
+
+const (
+	// ImportMerge keeps the existing state and adds the archive on top of it.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace makes the state exactly the same as in the archive.
+	ImportReplace ImportMode = "replace"
+)
+
+// ImportConflict is a reason why an archive can't be imported.
+type ImportConflict struct {
+	Segment string
+	// User is set for conflicts caused by a membership.
+	User   *int
+	Reason string
+}
+
+// archiveRecord is a single line of the archive. The first line is always
+// the header, the rest are segments, then prerequisites, then memberships.
+type archiveRecord struct {
+	Type string `json:"type"`
+
+	Version    int        `json:"version,omitempty"`
+	ExportedAt *time.Time `json:"exported_at,omitempty"`
+
+	Name        string     `json:"name,omitempty"`
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+	MaxMembers  *int       `json:"max_members,omitempty"`
+	Percentage  *int       `json:"percentage,omitempty"`
+
+	Segment      string `json:"segment,omitempty"`
+	Prerequisite string `json:"prerequisite,omitempty"`
+	Cascade      bool   `json:"cascade,omitempty"`
+
+	User *int `json:"user_id,omitempty"`
+}
+
+// WriteArchive writes the state as JSON lines.
+func WriteArchive(w io.Writer, state State, exportedAt time.Time) error {
+	enc := json.NewEncoder(w)
+
+	if err := enc.Encode(archiveRecord{Type: "header", Version: ArchiveVersion, ExportedAt: &exportedAt}); err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+	for _, s := range state.Segments {
+		err := enc.Encode(archiveRecord{
+			Type:        "segment",
+			Name:        s.Name,
+			ActiveFrom:  s.ActiveFrom,
+			ActiveUntil: s.ActiveUntil,
+			MaxMembers:  s.MaxMembers,
+			Percentage:  s.Percentage,
+		})
+		if err != nil {
+			return fmt.Errorf("writing segment: %w", err)
+		}
+	}
+	for _, p := range state.Prerequisites {
+		err := enc.Encode(archiveRecord{
+			Type:         "prerequisite",
+			Segment:      p.Segment,
+			Prerequisite: p.Prerequisite,
+			Cascade:      p.Cascade,
+		})
+		if err != nil {
+			return fmt.Errorf("writing prerequisite: %w", err)
+		}
+	}
+	for _, m := range state.Memberships {
+		if err := enc.Encode(archiveRecord{Type: "membership", User: &m.User, Segment: m.Segment}); err != nil {
+			return fmt.Errorf("writing membership: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ReadArchive parses an archive written by WriteArchive.
+func ReadArchive(r io.Reader) (State, error) {
+	var state State
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec archiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return State{}, fmt.Errorf("%w: line %d: %v", ErrInvalidArchive, line, err)
+		}
+
+		if line == 1 {
+			if rec.Type != "header" {
+				return State{}, fmt.Errorf("%w: line 1: expected header", ErrInvalidArchive)
+			}
+			if rec.Version != ArchiveVersion {
+				return State{}, fmt.Errorf("%w: %d", ErrUnsupportedArchiveVersion, rec.Version)
+			}
+			continue
+		}
+
+		switch rec.Type {
+		case "segment":
+			state.Segments = append(state.Segments, SegmentDetails{
+				Segment:    Segment{Name: rec.Name, ActiveFrom: rec.ActiveFrom, ActiveUntil: rec.ActiveUntil},
+				MaxMembers: rec.MaxMembers,
+				Percentage: rec.Percentage,
+			})
+		case "prerequisite":
+			state.Prerequisites = append(state.Prerequisites, Prerequisite{
+				Segment:      rec.Segment,
+				Prerequisite: rec.Prerequisite,
+				Cascade:      rec.Cascade,
+			})
+		case "membership":
+			if rec.User == nil {
+				return State{}, fmt.Errorf("%w: line %d: membership without user_id", ErrInvalidArchive, line)
+			}
+			state.Memberships = append(state.Memberships, Membership{User: *rec.User, Segment: rec.Segment})
+		default:
+			return State{}, fmt.Errorf("%w: line %d: unknown record type %q", ErrInvalidArchive, line, rec.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return State{}, fmt.Errorf("reading archive: %w", err)
+	}
+	if line == 0 {
+		return State{}, fmt.Errorf("%w: archive is empty", ErrInvalidArchive)
+	}
+
+	return state, nil
+}
+
+func (ss *SegmentService) ExportState(ctx context.Context) (State, error) {
+	state, err := ss.storage.ExportState(ctx)
+	if err != nil {
+		return State{}, fmt.Errorf("exporting state: %w", err)
+	}
+	return state, nil
+}
+
+// ImportState validates the archive against the current state and applies it
+// only if there are no conflicts. Otherwise ErrImportConflicts is returned
+// along with the list of conflicts and nothing is changed. The storage runs
+// the validation in the transaction that writes the archive, so the state
+// can't change in between.
+func (ss *SegmentService) ImportState(ctx context.Context, state State, mode ImportMode) ([]ImportConflict, error) {
+	if mode != ImportMerge && mode != ImportReplace {
+		return nil, ErrInvalidImportMode
+	}
+
+	var conflicts []ImportConflict
+	err := ss.storage.ImportState(ctx, state, mode == ImportReplace, func(current State, protected []string) error {
+		conflicts = importConflicts(current, state)
+		conflicts = append(conflicts, protectedConflicts(protected, state, mode)...)
+		if len(conflicts) > 0 {
+			sortConflicts(conflicts)
+			return ErrImportConflicts
+		}
+		return nil
+	})
+	if len(conflicts) > 0 {
+		return conflicts, ErrImportConflicts
+	}
+	if err != nil {
+		return nil, fmt.Errorf("importing state: %w", err)
+	}
+	return nil, nil
+}
+
+// importConflicts checks that merging the archive into the current state
+// gives a consistent result. For ImportReplace current is empty.
+func importConflicts(current, archive State) []ImportConflict {
+	var conflicts []ImportConflict
+
+	segments := make(map[string]SegmentDetails, len(current.Segments)+len(archive.Segments))
+	for _, s := range current.Segments {
+		segments[s.Name] = s
+	}
+	inArchive := make(map[string]bool, len(archive.Segments))
+	for _, s := range archive.Segments {
+		if s.Name == "" {
+			conflicts = append(conflicts, ImportConflict{Reason: "segment without a name"})
+			continue
+		}
+		if inArchive[s.Name] {
+			conflicts = append(conflicts, ImportConflict{Segment: s.Name, Reason: "segment is listed twice"})
+			continue
+		}
+		inArchive[s.Name] = true
+
+		if existing, ok := segments[s.Name]; ok && !sameSettings(existing, s) {
+			conflicts = append(conflicts, ImportConflict{Segment: s.Name, Reason: "segment already exists with different settings"})
+			continue
+		}
+		if s.ActiveFrom != nil && s.ActiveUntil != nil && !s.ActiveFrom.Before(*s.ActiveUntil) {
+			conflicts = append(conflicts, ImportConflict{Segment: s.Name, Reason: ErrInvalidSchedule.Error()})
+		}
+		if s.MaxMembers != nil && *s.MaxMembers <= 0 {
+			conflicts = append(conflicts, ImportConflict{Segment: s.Name, Reason: ErrInvalidMaxMembers.Error()})
+		}
+		if s.Percentage != nil && (*s.Percentage < 0 || *s.Percentage > 100) {
+			conflicts = append(conflicts, ImportConflict{Segment: s.Name, Reason: ErrInvalidPercentage.Error()})
+		}
+		segments[s.Name] = s
+	}
+
+	var prerequisites prerequisiteGraph
+	seen := make(map[[2]string]bool)
+	for _, p := range append(slices.Clone(current.Prerequisites), archive.Prerequisites...) {
+		if _, ok := segments[p.Segment]; !ok {
+			conflicts = append(conflicts, ImportConflict{Segment: p.Segment, Reason: "prerequisite of an unknown segment"})
+			continue
+		}
+		if _, ok := segments[p.Prerequisite]; !ok {
+			conflicts = append(conflicts, ImportConflict{Segment: p.Segment, Reason: fmt.Sprintf("unknown prerequisite %s", p.Prerequisite)})
+			continue
+		}
+		if seen[[2]string{p.Segment, p.Prerequisite}] {
+			continue
+		}
+		if p.Segment == p.Prerequisite || prerequisites.reaches(p.Prerequisite, p.Segment) {
+			conflicts = append(conflicts, ImportConflict{Segment: p.Segment, Reason: ErrPrerequisiteCycle.Error()})
+			continue
+		}
+		seen[[2]string{p.Segment, p.Prerequisite}] = true
+		prerequisites = append(prerequisites, p)
+	}
+
+	members := make(map[string]int)
+	userSegments := make(map[int]map[string]bool)
+	for _, m := range append(slices.Clone(current.Memberships), archive.Memberships...) {
+		if _, ok := segments[m.Segment]; !ok {
+			user := m.User
+			conflicts = append(conflicts, ImportConflict{Segment: m.Segment, User: &user, Reason: "membership in an unknown segment"})
+			continue
+		}
+		if userSegments[m.User] == nil {
+			userSegments[m.User] = make(map[string]bool)
+		}
+		if userSegments[m.User][m.Segment] {
+			continue
+		}
+		userSegments[m.User][m.Segment] = true
+		members[m.Segment]++
+	}
+
+	for name, count := range members {
+		if limit := segments[name].MaxMembers; limit != nil && count > *limit {
+			conflicts = append(conflicts, ImportConflict{
+				Segment: name,
+				Reason:  fmt.Sprintf("%d members exceed the limit of %d", count, *limit),
+			})
+		}
+	}
+
+	for user, has := range userSegments {
+		for _, p := range prerequisites {
+			if has[p.Segment] && !has[p.Prerequisite] {
+				user := user
+				conflicts = append(conflicts, ImportConflict{
+					Segment: p.Segment,
+					User:    &user,
+					Reason:  fmt.Sprintf("%s: %s requires %s", ErrPrerequisiteMissing, p.Segment, p.Prerequisite),
+				})
+			}
+		}
+	}
+
+	sortConflicts(conflicts)
+
+	return conflicts
+}
+
+// protectedConflicts rejects imports that would change members of protected
+// segments, as those changes have to be approved. Replacing the state
+// touches every protected segment, merging only the ones with memberships
+// in the archive.
+func protectedConflicts(protected []string, archive State, mode ImportMode) []ImportConflict {
+	var conflicts []ImportConflict
+	for _, s := range protected {
+		touched := mode == ImportReplace || slices.ContainsFunc(archive.Memberships, func(m Membership) bool {
+			return m.Segment == s
+		})
+		if touched {
+			conflicts = append(conflicts, ImportConflict{Segment: s, Reason: ErrSegmentProtected.Error()})
+		}
+	}
+	return conflicts
+}
+
+func sortConflicts(conflicts []ImportConflict) {
+	slices.SortStableFunc(conflicts, func(a, b ImportConflict) int {
+		if c := cmp.Compare(a.Segment, b.Segment); c != 0 {
+			return c
+		}
+		return cmp.Compare(ptrOr(a.User, -1), ptrOr(b.User, -1))
+	})
+}
+
+func ptrOr[T any](p *T, fallback T) T {
+	if p == nil {
+		return fallback
+	}
+	return *p
+}
+
+func sameSettings(a, b SegmentDetails) bool {
+	return equalPtr(a.ActiveFrom, b.ActiveFrom, func(x, y time.Time) bool { return x.Equal(y) }) &&
+		equalPtr(a.ActiveUntil, b.ActiveUntil, func(x, y time.Time) bool { return x.Equal(y) }) &&
+		equalPtr(a.MaxMembers, b.MaxMembers, func(x, y int) bool { return x == y }) &&
+		equalPtr(a.Percentage, b.Percentage, func(x, y int) bool { return x == y })
+}
+
+func equalPtr[T any](a, b *T, eq func(T, T) bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return eq(*a, *b)
+}
@@ -0,0 +1,193 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchive_RoundTrip(t *testing.T) {
+	from := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+	limit := 100
+	state := State{
+		Segments: []SegmentDetails{
+			{Segment: Segment{Name: "VOICE_MESSAGES", ActiveFrom: &from}, MaxMembers: &limit},
+			{Segment: Segment{Name: "VOICE_MESSAGES_BETA"}},
+		},
+		Prerequisites: []Prerequisite{
+			{Segment: "VOICE_MESSAGES_BETA", Prerequisite: "VOICE_MESSAGES", Cascade: true},
+		},
+		Memberships: []Membership{
+			{User: 1000, Segment: "VOICE_MESSAGES"},
+			{User: 1000, Segment: "VOICE_MESSAGES_BETA"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, state, from); err != nil {
+		t.Fatalf("WriteArchive() error = %v", err)
+	}
+
+	got, err := ReadArchive(&buf)
+	if err != nil {
+		t.Fatalf("ReadArchive() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Errorf("ReadArchive() = %+v, want %+v", got, state)
+	}
+}
+
+func TestReadArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+		wantErr error
+	}{
+		{
+			name:    "empty archive",
+			archive: "",
+			wantErr: ErrInvalidArchive,
+		},
+		{
+			name:    "archive without header",
+			archive: `{"type":"segment","name":"TEST_SEGMENT"}`,
+			wantErr: ErrInvalidArchive,
+		},
+		{
+			name:    "archive from the future",
+			archive: `{"type":"header","version":2}`,
+			wantErr: ErrUnsupportedArchiveVersion,
+		},
+		{
+			name:    "unknown record",
+			archive: "{\"type\":\"header\",\"version\":1}\n{\"type\":\"user\"}",
+			wantErr: ErrInvalidArchive,
+		},
+		{
+			name:    "membership without user",
+			archive: "{\"type\":\"header\",\"version\":1}\n{\"type\":\"membership\",\"segment\":\"TEST_SEGMENT\"}",
+			wantErr: ErrInvalidArchive,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadArchive(strings.NewReader(tt.archive))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReadArchive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSegmentService_ImportState(t *testing.T) {
+	limit := 1
+	current := State{
+		Segments: []SegmentDetails{
+			{Segment: Segment{Name: "VOICE_MESSAGES"}},
+			{Segment: Segment{Name: "LIMITED"}, MaxMembers: &limit},
+		},
+		Memberships: []Membership{
+			{User: 1000, Segment: "LIMITED"},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		mode          ImportMode
+		archive       State
+		wantErr       error
+		wantConflicts []string
+	}{
+		{
+			name: "merge of a consistent archive is applied",
+			mode: ImportMerge,
+			archive: State{
+				Segments:      []SegmentDetails{{Segment: Segment{Name: "VOICE_MESSAGES_BETA"}}},
+				Prerequisites: []Prerequisite{{Segment: "VOICE_MESSAGES_BETA", Prerequisite: "VOICE_MESSAGES"}},
+				Memberships: []Membership{
+					{User: 1001, Segment: "VOICE_MESSAGES"},
+					{User: 1001, Segment: "VOICE_MESSAGES_BETA"},
+				},
+			},
+		},
+		{
+			name: "merge reports every conflict",
+			mode: ImportMerge,
+			archive: State{
+				Segments: []SegmentDetails{
+					{Segment: Segment{Name: "VOICE_MESSAGES"}, MaxMembers: &limit},
+					{Segment: Segment{Name: "VOICE_MESSAGES_BETA"}},
+				},
+				Prerequisites: []Prerequisite{{Segment: "VOICE_MESSAGES_BETA", Prerequisite: "VOICE_MESSAGES"}},
+				Memberships: []Membership{
+					{User: 1001, Segment: "LIMITED"},
+					{User: 1001, Segment: "VOICE_MESSAGES_BETA"},
+					{User: 1001, Segment: "DIFFERENT_SEGMENT"},
+				},
+			},
+			wantErr: ErrImportConflicts,
+			wantConflicts: []string{
+				"DIFFERENT_SEGMENT",
+				"LIMITED",
+				"VOICE_MESSAGES",
+				"VOICE_MESSAGES_BETA",
+			},
+		},
+		{
+			name: "replace ignores the current state",
+			mode: ImportReplace,
+			archive: State{
+				Segments:    []SegmentDetails{{Segment: Segment{Name: "VOICE_MESSAGES"}, MaxMembers: &limit}},
+				Memberships: []Membership{{User: 1001, Segment: "VOICE_MESSAGES"}},
+			},
+		},
+		{
+			name:    "unknown mode is rejected",
+			mode:    "append",
+			wantErr: ErrInvalidImportMode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied := false
+			storage := &storageMock{
+				ImportStateFunc: func(ctx context.Context, state State, replace bool, validate func(current State, protected []string) error) error {
+					var existing State
+					if !replace {
+						existing = current
+					}
+					if err := validate(existing, nil); err != nil {
+						return err
+					}
+					applied = true
+					return nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			conflicts, err := ss.ImportState(context.Background(), tt.archive, tt.mode)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SegmentService.ImportState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var segments []string
+			for _, c := range conflicts {
+				segments = append(segments, c.Segment)
+			}
+			if !reflect.DeepEqual(segments, tt.wantConflicts) {
+				t.Errorf("Expected conflicts in %v, but got %+v", tt.wantConflicts, conflicts)
+			}
+
+			if applied != (tt.wantErr == nil) {
+				t.Errorf("Expected the archive to be applied: %v, but got %v", tt.wantErr == nil, applied)
+			}
+			if len(storage.ImportStateCalls) == 1 && storage.ImportStateCalls[0].replace != (tt.mode == ImportReplace) {
+				t.Errorf("Expected storage.ImportState to be called with replace=%v", tt.mode == ImportReplace)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// MaxBulkChanges is the most changes ChangeUsersSegments applies at once.
+const MaxBulkChanges = 10000
+
+var (
+	ErrInvalidBulkMode = errors.New("mode must be either atomic or best_effort")
+	ErrTooManyChanges  = errors.New("at most 10000 changes can be applied at once")
+	ErrDuplicateUser   = errors.New("user is already changed by another entry")
+	ErrChangeAborted   = errors.New("change isn't applied as another one failed")
+)
+
+// BulkMode is what ChangeUsersSegments does when some of the changes fail.
+type BulkMode string
+
+const (
+	// BulkAtomic applies either all the changes or none of them.
+	BulkAtomic BulkMode = "atomic"
+	// BulkBestEffort applies the changes that don't fail.
+	BulkBestEffort BulkMode = "best_effort"
+)
+
+// UserSegmentsChange is one change of ChangeUsersSegments, the same as the
+// arguments of ChangeUserSegments.
+type UserSegmentsChange struct {
+	User             int
+	SegmentsToAdd    []string
+	SegmentsToDelete []string
+}
+
+// ChangeUsersSegments applies many changes of users' segments in a single
+// transaction and returns the error of every change, which is nil for the
+// applied ones. Every change is checked as ChangeUserSegments checks it,
+// except that changes of protected segments fail with ErrSegmentProtected
+// instead of being proposed for approval. A user can be changed by only one
+// entry. In BulkAtomic mode nothing is applied if any change fails, and
+// the changes that didn't fail by themselves fail with ErrChangeAborted.
+func (ss *SegmentService) ChangeUsersSegments(ctx context.Context, mode BulkMode, changes []UserSegmentsChange) ([]error, error) {
+	if mode != BulkAtomic && mode != BulkBestEffort {
+		return nil, ErrInvalidBulkMode
+	}
+	if len(changes) > MaxBulkChanges {
+		return nil, ErrTooManyChanges
+	}
+
+	prerequisites, err := ss.storage.GetPrerequisites(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting prerequisites: %w", err)
+	}
+	protected, err := ss.storage.GetProtectedSegments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting protected segments: %w", err)
+	}
+
+	// Memberships are only read when there are prerequisites to check, for
+	// all the users at once. The storage checks them again as it applies
+	// the changes.
+	var current map[int][]Segment
+	if len(prerequisites) > 0 {
+		users := make([]int, 0, len(changes))
+		for _, change := range changes {
+			users = append(users, change.User)
+		}
+		current, err = ss.storage.GetUsersSegments(ctx, users)
+		if err != nil {
+			return nil, fmt.Errorf("getting segments: %w", err)
+		}
+	}
+
+	errs := make([]error, len(changes))
+	valid := make([]UserSegmentsChange, 0, len(changes))
+	// validIndex maps changes passed to the storage back to their entries.
+	validIndex := make([]int, 0, len(changes))
+	seen := make(map[int]bool, len(changes))
+	for i, change := range changes {
+		if seen[change.User] {
+			errs[i] = ErrDuplicateUser
+			continue
+		}
+		seen[change.User] = true
+
+		change.SegmentsToAdd = distinct(change.SegmentsToAdd)
+		change.SegmentsToDelete = distinct(change.SegmentsToDelete)
+
+		if len(prerequisites) > 0 {
+			cascaded, err := cascadePrerequisites(prerequisites, current[change.User], change.SegmentsToAdd, change.SegmentsToDelete)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			change.SegmentsToDelete = distinct(cascaded)
+		}
+
+		var protectedErrs error
+		for _, s := range append(slices.Clone(change.SegmentsToAdd), change.SegmentsToDelete...) {
+			if slices.Contains(protected, s) {
+				protectedErrs = errors.Join(protectedErrs, fmt.Errorf("%w: %s", ErrSegmentProtected, s))
+			}
+		}
+		if protectedErrs != nil {
+			errs[i] = protectedErrs
+			continue
+		}
+
+		valid = append(valid, change)
+		validIndex = append(validIndex, i)
+	}
+
+	if mode == BulkAtomic && len(valid) < len(changes) {
+		return abortRest(errs), nil
+	}
+
+	storageErrs, err := ss.storage.ChangeUsersSegments(ctx, valid, mode == BulkAtomic)
+	if err != nil {
+		return nil, fmt.Errorf("changing users segments: %w", err)
+	}
+	for j, err := range storageErrs {
+		errs[validIndex[j]] = err
+	}
+	if mode == BulkAtomic && slices.ContainsFunc(errs, func(err error) bool { return err != nil }) {
+		return abortRest(errs), nil
+	}
+
+	return errs, nil
+}
+
+// abortRest fails the changes that have no errors with ErrChangeAborted.
+func abortRest(errs []error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrChangeAborted
+		}
+	}
+	return errs
+}
+
+// distinct returns the segments without repetitions, in their order.
+func distinct(segments []string) []string {
+	var unique []string
+	for _, s := range segments {
+		if !slices.Contains(unique, s) {
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
+
+// ErrorMessages splits errors joined by errors.Join into their messages.
+func ErrorMessages(err error) []string {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var messages []string
+		for _, err := range joined.Unwrap() {
+			messages = append(messages, ErrorMessages(err)...)
+		}
+		return messages
+	}
+	return []string{err.Error()}
+}
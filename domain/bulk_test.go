@@ -0,0 +1,101 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSegmentService_ChangeUsersSegments(t *testing.T) {
+	changes := []UserSegmentsChange{
+		{User: 1000, SegmentsToAdd: []string{"DISCOUNT_50"}},
+		{User: 1001, SegmentsToAdd: []string{"VOICE_MESSAGES_BETA"}},
+		{User: 1002, SegmentsToAdd: []string{"PROTECTED"}},
+		{User: 1000, SegmentsToDelete: []string{"DISCOUNT_50"}},
+		{User: 1003, SegmentsToAdd: []string{"VOICE_MESSAGES", "VOICE_MESSAGES_BETA"}},
+	}
+
+	tests := []struct {
+		name       string
+		mode       BulkMode
+		storageErr error
+		wantErrs   []error
+		wantStored []int
+	}{
+		{
+			name:       "best effort applies the changes that pass the checks",
+			mode:       BulkBestEffort,
+			wantErrs:   []error{nil, ErrPrerequisiteMissing, ErrSegmentProtected, ErrDuplicateUser, nil},
+			wantStored: []int{1000, 1003},
+		},
+		{
+			name:     "atomic doesn't apply anything if a check fails",
+			mode:     BulkAtomic,
+			wantErrs: []error{ErrChangeAborted, ErrPrerequisiteMissing, ErrSegmentProtected, ErrDuplicateUser, ErrChangeAborted},
+		},
+		{
+			name:       "best effort reports errors of the storage",
+			mode:       BulkBestEffort,
+			storageErr: ErrSegmentIsFull,
+			wantErrs:   []error{ErrSegmentIsFull, ErrPrerequisiteMissing, ErrSegmentProtected, ErrDuplicateUser, nil},
+			wantStored: []int{1000, 1003},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored []int
+			storage := &storageMock{
+				GetPrerequisitesFunc: func(ctx context.Context) ([]Prerequisite, error) {
+					return []Prerequisite{{Segment: "VOICE_MESSAGES_BETA", Prerequisite: "VOICE_MESSAGES"}}, nil
+				},
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return []string{"PROTECTED"}, nil
+				},
+				GetUsersSegmentsFunc: func(ctx context.Context, users []int) (map[int][]Segment, error) {
+					return map[int][]Segment{}, nil
+				},
+				ChangeUsersSegmentsFunc: func(ctx context.Context, changes []UserSegmentsChange, atomic bool) ([]error, error) {
+					errs := make([]error, len(changes))
+					for i, change := range changes {
+						stored = append(stored, change.User)
+						if i == 0 {
+							errs[i] = tt.storageErr
+						}
+					}
+					return errs, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			errs, err := ss.ChangeUsersSegments(context.Background(), tt.mode, changes)
+			if err != nil {
+				t.Fatalf("SegmentService.ChangeUsersSegments() error = %v", err)
+			}
+
+			for i, want := range tt.wantErrs {
+				if want == nil && errs[i] != nil || !errors.Is(errs[i], want) {
+					t.Errorf("Expected change %d to fail with %v, but got %v", i, want, errs[i])
+				}
+			}
+			if len(storage.GetUsersSegmentsCalls) != 1 {
+				t.Errorf("Expected memberships of all users to be read at once, but got %d reads", len(storage.GetUsersSegmentsCalls))
+			}
+			if len(stored) != len(tt.wantStored) {
+				t.Fatalf("Expected changes of users %v to be stored, but got %v", tt.wantStored, stored)
+			}
+			for i := range stored {
+				if stored[i] != tt.wantStored[i] {
+					t.Errorf("Expected changes of users %v to be stored, but got %v", tt.wantStored, stored)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentService_ChangeUsersSegments_InvalidMode(t *testing.T) {
+	ss := NewSegmentService(&storageMock{})
+	_, err := ss.ChangeUsersSegments(context.Background(), "all", nil)
+	if !errors.Is(err, ErrInvalidBulkMode) {
+		t.Errorf("Expected error %v, but got %v", ErrInvalidBulkMode, err)
+	}
+}
@@ -0,0 +1,17 @@
+package domain
+
+import "context"
+
+type cacheBypassKey struct{}
+
+// WithCacheBypass makes reads with the returned context skip caches in
+// front of the storage, for callers that must see the latest writes.
+func WithCacheBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheBypassKey{}, true)
+}
+
+// CacheBypassed reports whether the context was made by WithCacheBypass.
+func CacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(cacheBypassKey{}).(bool)
+	return bypass
+}
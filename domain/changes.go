@@ -0,0 +1,132 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxChangesWait is the longest GetChanges waits for changes to come.
+const MaxChangesWait = time.Minute
+
+var ErrInvalidWait = errors.New("wait must be between 0 and 60 seconds")
+
+// ChangeType is what happened to a segment or to its members.
+type ChangeType string
+
+const (
+	ChangeMemberAdded    ChangeType = "member_added"
+	ChangeMemberRemoved  ChangeType = "member_removed"
+	ChangeSegmentCreated ChangeType = "segment_created"
+	// ChangeSegmentUpdated means settings of the segment changed: its
+	// schedule, members limit, protection or percentage.
+	ChangeSegmentUpdated ChangeType = "segment_updated"
+	ChangeSegmentDeleted ChangeType = "segment_deleted"
+)
+
+const (
+	// DefaultChangesPageSize is the number of changes returned by GetChanges
+	// when no limit is given.
+	DefaultChangesPageSize = 100
+	maxChangesPageSize     = 1000
+)
+
+// Change is an entry of the change feed. Seq grows with every change of the
+// tenant, so the Seq of the last change seen is the cursor to read the feed
+// from. User is only set for changes of members. Actor is who made the
+// change, if it was known.
+type Change struct {
+	Seq     int64
+	Type    ChangeType
+	Segment string
+	User    *int
+	Actor   string
+	At      time.Time
+}
+
+// GetChanges returns up to limit changes of the environment of ctx that
+// came after the cursor, oldest first, together with the cursor to read the
+// next changes from. Changes of segment definitions are shared by all
+// environments. Zero limit means DefaultChangesPageSize. If there are no
+// changes yet, GetChanges waits up to wait for some to come and returns no
+// changes if none did.
+func (ss *SegmentService) GetChanges(ctx context.Context, after int64, limit int, wait time.Duration) ([]Change, int64, error) {
+	if limit == 0 {
+		limit = DefaultChangesPageSize
+	}
+	if limit < 0 || limit > maxChangesPageSize {
+		return nil, 0, ErrInvalidLimit
+	}
+	if wait < 0 || wait > MaxChangesWait {
+		return nil, 0, ErrInvalidWait
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	for {
+		// The channel is taken before reading the changes, so that changes
+		// committed in between aren't missed.
+		var notified <-chan struct{}
+		if wait > 0 {
+			var err error
+			notified, err = ss.storage.NotifyChanges(waitCtx)
+			if err != nil {
+				if waitCtx.Err() != nil && ctx.Err() == nil {
+					return nil, after, nil
+				}
+				return nil, 0, fmt.Errorf("waiting for changes: %w", err)
+			}
+		}
+
+		changes, err := ss.storage.GetChanges(ctx, after, limit)
+		if err != nil {
+			return nil, 0, fmt.Errorf("getting changes: %w", err)
+		}
+		if len(changes) > 0 {
+			return changes, changes[len(changes)-1].Seq, nil
+		}
+		if wait == 0 {
+			return nil, after, nil
+		}
+
+		select {
+		case <-notified:
+		case <-waitCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+			return nil, after, nil
+		}
+	}
+}
+
+// GetChangesCursor returns the cursor of the latest change, reading the feed
+// from it skips everything that happened so far.
+func (ss *SegmentService) GetChangesCursor(ctx context.Context) (int64, error) {
+	cursor, err := ss.storage.GetChangesCursor(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("getting changes cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+// GetUserMemberships returns the names of all segments the user was added
+// to, whether they are active or not. Unlike GetUserSegments it leaves out
+// percentage rollouts, which is what clients keeping their own copy of the
+// memberships need. It reads past the cache, as clients follow up with the
+// change feed from a cursor taken before, and a stale snapshot would miss
+// changes for good.
+func (ss *SegmentService) GetUserMemberships(ctx context.Context, user int) ([]string, error) {
+	segments, err := ss.storage.GetUserSegments(WithCacheBypass(ctx), user)
+	if err != nil {
+		return nil, fmt.Errorf("getting segments: %w", err)
+	}
+
+	names := make([]string, 0, len(segments))
+	for _, s := range segments {
+		names = append(names, s.Name)
+	}
+	return names, nil
+}
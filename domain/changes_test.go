@@ -0,0 +1,138 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSegmentService_GetChanges(t *testing.T) {
+	tests := []struct {
+		name       string
+		after      int64
+		limit      int
+		stored     []Change
+		wait       time.Duration
+		wantLimit  int
+		wantCursor int64
+		wantErr    error
+	}{
+		{
+			name:       "cursor moves to the last change",
+			after:      10,
+			stored:     []Change{{Seq: 11}, {Seq: 14}},
+			wantLimit:  DefaultChangesPageSize,
+			wantCursor: 14,
+		},
+		{
+			name:       "cursor stays without new changes",
+			after:      10,
+			limit:      5,
+			wantLimit:  5,
+			wantCursor: 10,
+		},
+		{
+			name:    "too long wait is rejected",
+			wait:    2 * time.Minute,
+			wantErr: ErrInvalidWait,
+		},
+		{
+			name:    "too big limit is rejected",
+			limit:   1001,
+			wantErr: ErrInvalidLimit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetChangesFunc: func(ctx context.Context, after int64, limit int) ([]Change, error) {
+					return tt.stored, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			_, cursor, err := ss.GetChanges(context.Background(), tt.after, tt.limit, tt.wait)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SegmentService.GetChanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if got := storage.GetChangesCalls[0].limit; got != tt.wantLimit {
+				t.Errorf("Expected storage to be asked for %d changes, but got %d", tt.wantLimit, got)
+			}
+			if cursor != tt.wantCursor {
+				t.Errorf("Expected cursor %d, but got %d", tt.wantCursor, cursor)
+			}
+		})
+	}
+}
+
+func TestSegmentService_GetChanges_Wait(t *testing.T) {
+	t.Run("returns changes committed while waiting", func(t *testing.T) {
+		notified := make(chan struct{})
+		storage := &storageMock{
+			NotifyChangesFunc: func(ctx context.Context) (<-chan struct{}, error) {
+				return notified, nil
+			},
+		}
+		storage.GetChangesFunc = func(ctx context.Context, after int64, limit int) ([]Change, error) {
+			if len(storage.GetChangesCalls) == 1 {
+				close(notified)
+				return nil, nil
+			}
+			return []Change{{Seq: 11}}, nil
+		}
+
+		ss := NewSegmentService(storage)
+		changes, cursor, err := ss.GetChanges(context.Background(), 10, 0, time.Minute)
+		if err != nil {
+			t.Fatalf("SegmentService.GetChanges() error = %v", err)
+		}
+		if len(changes) != 1 || cursor != 11 {
+			t.Errorf("Expected change 11, but got %+v with cursor %d", changes, cursor)
+		}
+	})
+
+	t.Run("returns no changes when none came in time", func(t *testing.T) {
+		storage := &storageMock{
+			NotifyChangesFunc: func(ctx context.Context) (<-chan struct{}, error) {
+				return make(chan struct{}), nil
+			},
+			GetChangesFunc: func(ctx context.Context, after int64, limit int) ([]Change, error) {
+				return nil, nil
+			},
+		}
+
+		ss := NewSegmentService(storage)
+		changes, cursor, err := ss.GetChanges(context.Background(), 10, 0, 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("SegmentService.GetChanges() error = %v", err)
+		}
+		if len(changes) != 0 || cursor != 10 {
+			t.Errorf("Expected no changes and cursor 10, but got %+v with cursor %d", changes, cursor)
+		}
+	})
+}
+
+func TestSegmentService_GetUserMemberships(t *testing.T) {
+	storage := &storageMock{
+		GetUserSegmentsFunc: func(ctx context.Context, user int) ([]Segment, error) {
+			if !CacheBypassed(ctx) {
+				t.Errorf("Expected memberships to be read past the cache")
+			}
+			return []Segment{{Name: "A"}, {Name: "B"}}, nil
+		},
+	}
+	ss := NewSegmentService(storage)
+
+	memberships, err := ss.GetUserMemberships(context.Background(), 1000)
+	if err != nil {
+		t.Fatalf("SegmentService.GetUserMemberships() error = %v", err)
+	}
+	if len(memberships) != 2 {
+		t.Errorf("Expected 2 memberships, but got %v", memberships)
+	}
+}
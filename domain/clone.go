@@ -0,0 +1,38 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidSampleSize = errors.New("sample_size must not be negative")
+
+// CloneOptions pick which members of the segment are cloned, all of them by
+// default.
+type CloneOptions struct {
+	// SampleSize, if positive, is how many of the members are picked at
+	// random.
+	SampleSize int
+	// JoinedAfter, if set, leaves out members added to the segment before
+	// it. Members added before the join time was recorded joined when the
+	// change feed last recorded them added.
+	JoinedAfter *time.Time
+}
+
+// CloneSegment creates the segment name with the members of source in the
+// environment of ctx, in a single transaction, and returns how many members
+// were copied. Only members are copied, the new segment has no schedule,
+// limit, rollout, prerequisites or protection.
+func (ss *SegmentService) CloneSegment(ctx context.Context, source, name string, opts CloneOptions) (int, error) {
+	if opts.SampleSize < 0 {
+		return 0, ErrInvalidSampleSize
+	}
+
+	members, err := ss.storage.CloneSegment(ctx, source, name, opts)
+	if err != nil {
+		return 0, fmt.Errorf("cloning segment: %w", err)
+	}
+	return members, nil
+}
@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSegmentService_CloneSegment(t *testing.T) {
+	t.Run("given negative sample size, expect error", func(t *testing.T) {
+		storage := &storageMock{}
+		ss := NewSegmentService(storage)
+
+		if _, err := ss.CloneSegment(context.Background(), "A", "B", CloneOptions{SampleSize: -1}); !errors.Is(err, ErrInvalidSampleSize) {
+			t.Errorf("Expected error %v, but got %v", ErrInvalidSampleSize, err)
+		}
+		if len(storage.CloneSegmentCalls) != 0 {
+			t.Errorf("Expected no calls to storage.CloneSegment, but got %d", len(storage.CloneSegmentCalls))
+		}
+	})
+
+	t.Run("given options, expect them passed to storage", func(t *testing.T) {
+		storage := &storageMock{
+			CloneSegmentFunc: func(ctx context.Context, source, name string, opts CloneOptions) (int, error) {
+				return 10, nil
+			},
+		}
+		ss := NewSegmentService(storage)
+
+		after := time.Date(2023, time.March, 1, 0, 0, 0, 0, time.UTC)
+		members, err := ss.CloneSegment(context.Background(), "A", "B", CloneOptions{SampleSize: 10, JoinedAfter: &after})
+		if err != nil {
+			t.Fatalf("SegmentService.CloneSegment() error = %v", err)
+		}
+		if members != 10 {
+			t.Errorf("Expected 10 members cloned, but got %d", members)
+		}
+		call := storage.CloneSegmentCalls[0]
+		if call.source != "A" || call.name != "B" || call.opts.SampleSize != 10 || !call.opts.JoinedAfter.Equal(after) {
+			t.Errorf("Unexpected call to storage.CloneSegment %+v", call)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package domain
+
+import (
+	"context"
+	"errors"
+)
+
+// MaxDryRunChanges is the number of changes a dry run lists at most, the
+// rest are only counted.
+const MaxDryRunChanges = 10000
+
+// DryRunResult is the would-be effect of a dry run.
+type DryRunResult struct {
+	// Changes are the changes of segments and their members that would be
+	// recorded in the change feed, in order and without a Seq.
+	Changes []Change
+	// Total is the number of all the changes.
+	Total int
+	// ApprovalRequired is set when the change touches a protected segment
+	// and would be stored as a change request instead of being applied.
+	ApprovalRequired bool
+}
+
+type dryRunKey struct{}
+
+// inDryRun reports whether ctx is the context of a dry run.
+func inDryRun(ctx context.Context) bool {
+	return ctx.Value(dryRunKey{}) != nil
+}
+
+// DryRun runs f with a context whose changes are all validated and made in
+// a transaction that is rolled back, and returns what they would change
+// together with the error of f. Changes made before f fails are returned
+// too, as a call that changes several things may fail only in part. Reads
+// within the dry run go past the cache, so that it never keeps what was
+// rolled back. A change that requires approval isn't an error of a dry
+// run, no change request is created and ApprovalRequired is set instead.
+func (ss *SegmentService) DryRun(ctx context.Context, f func(ctx context.Context) error) (DryRunResult, error) {
+	ctx = context.WithValue(WithCacheBypass(ctx), dryRunKey{}, true)
+	result, err := ss.storage.DryRun(ctx, f)
+	if errors.Is(err, ErrApprovalRequired) {
+		result.ApprovalRequired = true
+		return result, nil
+	}
+	return result, err
+}
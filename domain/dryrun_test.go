@@ -0,0 +1,57 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSegmentService_DryRun(t *testing.T) {
+	user := 1000
+	storage := &storageMock{
+		DryRunFunc: func(ctx context.Context, f func(ctx context.Context) error) (DryRunResult, error) {
+			result := DryRunResult{Changes: []Change{{Type: ChangeMemberRemoved, Segment: "A", User: &user}}, Total: 1}
+			return result, f(ctx)
+		},
+	}
+	ss := NewSegmentService(storage)
+
+	wantErr := errors.New("fail")
+	result, err := ss.DryRun(context.Background(), func(ctx context.Context) error {
+		if !CacheBypassed(ctx) {
+			t.Errorf("Expected reads of a dry run to bypass the cache")
+		}
+		return wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Errorf("Expected error %v, but got %v", wantErr, err)
+	}
+	if result.Total != 1 {
+		t.Errorf("Expected the changes made before the error, but got %+v", result)
+	}
+}
+
+func TestSegmentService_DryRun_ApprovalRequired(t *testing.T) {
+	storage := &storageMock{
+		DryRunFunc: func(ctx context.Context, f func(ctx context.Context) error) (DryRunResult, error) {
+			return DryRunResult{}, f(ctx)
+		},
+		GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+			return []string{"A"}, nil
+		},
+	}
+	ss := NewSegmentService(storage)
+
+	result, err := ss.DryRun(context.Background(), func(ctx context.Context) error {
+		return ss.DeleteSegment(WithActor(ctx, "alice"), "A")
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !result.ApprovalRequired {
+		t.Errorf("Expected approval to be required, but got %+v", result)
+	}
+	if len(storage.CreateChangeRequestCalls) != 0 {
+		t.Errorf("Expected no change request to be created in a dry run, but got %d", len(storage.CreateChangeRequestCalls))
+	}
+}
@@ -0,0 +1,115 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+)
+
+// DefaultEnvironment is used by requests that don't name an environment.
+const DefaultEnvironment = "production"
+
+var (
+	ErrInvalidEnvironment = errors.New("environment name must be 1 to 200 characters long")
+	ErrInvalidPercentage  = errors.New("percentage must be between 0 and 100")
+	ErrSameEnvironment    = errors.New("can't promote environment to itself")
+)
+
+type environmentKey struct{}
+
+// WithEnvironment makes memberships and percentages read and written with
+// the returned context belong to the environment. Segment definitions are
+// shared by all environments of a tenant.
+func WithEnvironment(ctx context.Context, environment string) context.Context {
+	return context.WithValue(ctx, environmentKey{}, environment)
+}
+
+// EnvironmentFromContext returns the environment set by WithEnvironment or
+// DefaultEnvironment.
+func EnvironmentFromContext(ctx context.Context) string {
+	if environment, ok := ctx.Value(environmentKey{}).(string); ok {
+		return environment
+	}
+	return DefaultEnvironment
+}
+
+func ValidateEnvironment(environment string) error {
+	if environment == "" || len(environment) > 200 {
+		return ErrInvalidEnvironment
+	}
+	return nil
+}
+
+// RolloutSegment is a segment that includes a percentage of all users in
+// the environment on top of its explicit members.
+type RolloutSegment struct {
+	Segment
+	Percentage int
+}
+
+// InRollout deterministically puts the user into one of 100 buckets of the
+// segment, so that the same users stay in the segment while its percentage
+// grows. It's exported for clients that evaluate rollouts on their side.
+func InRollout(user int, segment string, percentage int) bool {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d", segment, user)
+	return int(h.Sum32()%100) < percentage
+}
+
+// SetSegmentPercentage makes the segment include the percentage of all users
+// in the environment of ctx, nil turns it off. Percentages of protected
+// segments are changed through change requests.
+func (ss *SegmentService) SetSegmentPercentage(ctx context.Context, name string, percentage *int) error {
+	if percentage != nil && (*percentage < 0 || *percentage > 100) {
+		return ErrInvalidPercentage
+	}
+
+	protected, err := ss.protectedAmong(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(protected) > 0 {
+		return ss.propose(ctx, ChangeRequest{Kind: ChangeSegmentPercentage, Segment: name, Percentage: percentage})
+	}
+
+	if err := ss.storage.SetSegmentPercentage(ctx, name, percentage); err != nil {
+		return fmt.Errorf("setting segment percentage: %w", err)
+	}
+	return nil
+}
+
+// PromoteEnvironment copies percentages of the segments from one environment
+// to another, and with withMembers replaces their members as well. Empty
+// segments means all segments of the tenant. Protected segments can't be
+// promoted.
+func (ss *SegmentService) PromoteEnvironment(ctx context.Context, from, to string, segments []string, withMembers bool) error {
+	if err := ValidateEnvironment(from); err != nil {
+		return err
+	}
+	if err := ValidateEnvironment(to); err != nil {
+		return err
+	}
+	if from == to {
+		return ErrSameEnvironment
+	}
+
+	// Replacing the percentage or the members of protected segments would
+	// sidestep approvals, so it has to be done segment by segment with
+	// SetSegmentPercentage and ChangeUserSegments.
+	protected, err := ss.storage.GetProtectedSegments(ctx)
+	if err != nil {
+		return fmt.Errorf("getting protected segments: %w", err)
+	}
+	for _, s := range protected {
+		if len(segments) == 0 || slices.Contains(segments, s) {
+			return fmt.Errorf("%w: %s", ErrSegmentProtected, s)
+		}
+	}
+
+	if err := ss.storage.PromoteEnvironment(ctx, from, to, segments, withMembers); err != nil {
+		return fmt.Errorf("promoting environment: %w", err)
+	}
+	return nil
+}
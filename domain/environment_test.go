@@ -0,0 +1,171 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSegmentService_GetUserSegments_Rollout(t *testing.T) {
+	storage := &storageMock{
+		GetUserSegmentsFunc: func(ctx context.Context, user int) ([]Segment, error) {
+			if user == 1 {
+				return []Segment{{Name: "EVERYONE"}}, nil
+			}
+			return nil, nil
+		},
+		GetRolloutSegmentsFunc: func(ctx context.Context) ([]RolloutSegment, error) {
+			return []RolloutSegment{
+				{Segment: Segment{Name: "EVERYONE"}, Percentage: 100},
+				{Segment: Segment{Name: "HALF"}, Percentage: 50},
+			}, nil
+		},
+	}
+	ss := NewSegmentService(storage)
+
+	inHalf := 0
+	for user := 1; user <= 1000; user++ {
+		segments, err := ss.GetUserSegments(context.Background(), user)
+		if err != nil {
+			t.Fatalf("SegmentService.GetUserSegments() error = %v", err)
+		}
+
+		names := make(map[string]int)
+		for _, s := range segments {
+			names[s]++
+		}
+		if names["EVERYONE"] != 1 {
+			t.Fatalf("Expected user %d to be in EVERYONE exactly once, but got %v", user, segments)
+		}
+		if names["HALF"] == 1 {
+			inHalf++
+		}
+
+		again, _ := ss.GetUserSegments(context.Background(), user)
+		if len(again) != len(segments) {
+			t.Fatalf("Expected rollout to be stable for user %d, but got %v and then %v", user, segments, again)
+		}
+	}
+
+	if inHalf < 400 || inHalf > 600 {
+		t.Errorf("Expected about half of users to be in HALF, but got %d of 1000", inHalf)
+	}
+}
+
+func TestSegmentService_SetSegmentPercentage(t *testing.T) {
+	valid, negative, tooBig := 30, -1, 101
+
+	tests := []struct {
+		name       string
+		percentage *int
+		wantErr    error
+		wantCalls  int
+	}{
+		{
+			name:       "valid percentage is saved",
+			percentage: &valid,
+			wantCalls:  1,
+		},
+		{
+			name:      "percentage is removed",
+			wantCalls: 1,
+		},
+		{
+			name:       "negative percentage is rejected",
+			percentage: &negative,
+			wantErr:    ErrInvalidPercentage,
+		},
+		{
+			name:       "percentage above 100 is rejected",
+			percentage: &tooBig,
+			wantErr:    ErrInvalidPercentage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				SetSegmentPercentageFunc: func(ctx context.Context, name string, percentage *int) error {
+					return nil
+				},
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return nil, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			err := ss.SetSegmentPercentage(context.Background(), "TEST_SEGMENT", tt.percentage)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SegmentService.SetSegmentPercentage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(storage.SetSegmentPercentageCalls) != tt.wantCalls {
+				t.Errorf("Expected %d calls to storage.SetSegmentPercentage, but got %d", tt.wantCalls, len(storage.SetSegmentPercentageCalls))
+			}
+		})
+	}
+}
+
+func TestSegmentService_PromoteEnvironment(t *testing.T) {
+	tests := []struct {
+		name        string
+		from, to    string
+		protected   []string
+		withMembers bool
+		wantErr     error
+		wantCalls   int
+	}{
+		{
+			name:        "promotion between environments is passed to storage",
+			from:        "staging",
+			to:          "production",
+			withMembers: true,
+			wantCalls:   1,
+		},
+		{
+			name:        "promotion of protected segment members is rejected",
+			from:        "staging",
+			to:          "production",
+			protected:   []string{"TEST_SEGMENT"},
+			withMembers: true,
+			wantErr:     ErrSegmentProtected,
+		},
+		{
+			name:      "promotion of protected segment percentage is rejected",
+			from:      "staging",
+			to:        "production",
+			protected: []string{"TEST_SEGMENT"},
+			wantErr:   ErrSegmentProtected,
+		},
+		{
+			name:    "promotion to the same environment is rejected",
+			from:    "staging",
+			to:      "staging",
+			wantErr: ErrSameEnvironment,
+		},
+		{
+			name:    "empty environment is rejected",
+			from:    "staging",
+			wantErr: ErrInvalidEnvironment,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				PromoteEnvironmentFunc: func(ctx context.Context, from, to string, segments []string, withMembers bool) error {
+					return nil
+				},
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return tt.protected, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			err := ss.PromoteEnvironment(context.Background(), tt.from, tt.to, nil, tt.withMembers)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SegmentService.PromoteEnvironment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(storage.PromoteEnvironmentCalls) != tt.wantCalls {
+				t.Errorf("Expected %d calls to storage.PromoteEnvironment, but got %d", tt.wantCalls, len(storage.PromoteEnvironmentCalls))
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidAsOf = errors.New("as_of must not be in the future")
+
+// GetUserSegmentsAsOf returns the names of the segments the user was added
+// to at the moment, as recorded by the change feed, including segments that
+// were deleted since. Like GetUserMemberships it leaves out schedules and
+// percentage rollouts, which aren't recorded. Changes made before the feed
+// was introduced aren't known.
+func (ss *SegmentService) GetUserSegmentsAsOf(ctx context.Context, user int, at time.Time) ([]string, error) {
+	if at.After(ss.now()) {
+		return nil, ErrInvalidAsOf
+	}
+
+	segments, err := ss.storage.GetUserSegmentsAsOf(ctx, user, at)
+	if err != nil {
+		return nil, fmt.Errorf("getting segments as of %s: %w", at.Format(time.RFC3339), err)
+	}
+	return segments, nil
+}
+
+// SegmentChange is a change of a user's membership in a segment.
+type SegmentChange struct {
+	Segment string
+	Added   bool
+	At      time.Time
+	Actor   string
+}
+
+// UserSegmentsDiff is how a user's segments changed between two moments.
+type UserSegmentsDiff struct {
+	// Gained are the segments the user was added to by the end and wasn't in
+	// at the start, with the change that added the user last.
+	Gained []SegmentChange
+	// Lost are the segments the user was in at the start and was removed
+	// from by the end, with the change that removed the user last.
+	Lost []SegmentChange
+	// Changes are all the changes in between, oldest first, including ones
+	// undone before the end.
+	Changes []SegmentChange
+}
+
+// GetUserSegmentsDiff compares the segments the user was added to at from
+// and at to, see GetUserSegmentsAsOf. A zero to means now.
+func (ss *SegmentService) GetUserSegmentsDiff(ctx context.Context, user int, from, to time.Time) (UserSegmentsDiff, error) {
+	if to.IsZero() {
+		to = ss.now()
+	}
+	if !from.Before(to) {
+		return UserSegmentsDiff{}, ErrInvalidTimeRange
+	}
+
+	before, err := ss.storage.GetUserSegmentsAsOf(ctx, user, from)
+	if err != nil {
+		return UserSegmentsDiff{}, fmt.Errorf("getting segments as of %s: %w", from.Format(time.RFC3339), err)
+	}
+	changes, err := ss.storage.GetUserChanges(ctx, user, from, to)
+	if err != nil {
+		return UserSegmentsDiff{}, fmt.Errorf("getting changes: %w", err)
+	}
+
+	initial := make(map[string]bool, len(before))
+	for _, segment := range before {
+		initial[segment] = true
+	}
+
+	diff := UserSegmentsDiff{Changes: make([]SegmentChange, 0, len(changes))}
+	last := map[string]SegmentChange{}
+	for _, c := range changes {
+		sc := SegmentChange{Segment: c.Segment, Added: c.Type == ChangeMemberAdded, At: c.At, Actor: c.Actor}
+		diff.Changes = append(diff.Changes, sc)
+		last[c.Segment] = sc
+	}
+
+	for segment, sc := range last {
+		switch {
+		case sc.Added && !initial[segment]:
+			diff.Gained = append(diff.Gained, sc)
+		case !sc.Added && initial[segment]:
+			diff.Lost = append(diff.Lost, sc)
+		}
+	}
+	bySegment := func(a, b SegmentChange) int { return strings.Compare(a.Segment, b.Segment) }
+	slices.SortFunc(diff.Gained, bySegment)
+	slices.SortFunc(diff.Lost, bySegment)
+	return diff, nil
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSegmentService_GetUserSegmentsAsOf(t *testing.T) {
+	now := time.Date(2023, time.March, 10, 12, 0, 0, 0, time.UTC)
+	storage := &storageMock{
+		GetUserSegmentsAsOfFunc: func(ctx context.Context, user int, at time.Time) ([]string, error) {
+			return []string{"DELETED_SEGMENT"}, nil
+		},
+	}
+	ss := NewSegmentService(storage, WithClock(func() time.Time { return now }))
+
+	if _, err := ss.GetUserSegmentsAsOf(context.Background(), 1000, now.Add(time.Hour)); !errors.Is(err, ErrInvalidAsOf) {
+		t.Errorf("Expected error %v for a future moment, but got %v", ErrInvalidAsOf, err)
+	}
+
+	segments, err := ss.GetUserSegmentsAsOf(context.Background(), 1000, now.AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatalf("SegmentService.GetUserSegmentsAsOf() error = %v", err)
+	}
+	if len(segments) != 1 || segments[0] != "DELETED_SEGMENT" {
+		t.Errorf("Expected the recorded segments, but got %v", segments)
+	}
+}
+
+func TestSegmentService_GetUserSegmentsDiff(t *testing.T) {
+	from := time.Date(2023, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, time.March, 10, 0, 0, 0, 0, time.UTC)
+	at := func(day int) time.Time { return time.Date(2023, time.March, day, 12, 0, 0, 0, time.UTC) }
+
+	storage := &storageMock{
+		GetUserSegmentsAsOfFunc: func(ctx context.Context, user int, at time.Time) ([]string, error) {
+			return []string{"KEPT", "LOST", "READDED"}, nil
+		},
+		GetUserChangesFunc: func(ctx context.Context, user int, from, to time.Time) ([]Change, error) {
+			return []Change{
+				{Seq: 1, Type: ChangeMemberRemoved, Segment: "LOST", Actor: "alice", At: at(2)},
+				{Seq: 2, Type: ChangeMemberAdded, Segment: "GAINED", Actor: "bob", At: at(3)},
+				{Seq: 3, Type: ChangeMemberRemoved, Segment: "READDED", At: at(4)},
+				{Seq: 4, Type: ChangeMemberAdded, Segment: "READDED", At: at(5)},
+				{Seq: 5, Type: ChangeMemberAdded, Segment: "TEMPORARY", At: at(6)},
+				{Seq: 6, Type: ChangeMemberRemoved, Segment: "TEMPORARY", At: at(7)},
+			}, nil
+		},
+	}
+	ss := NewSegmentService(storage)
+
+	if _, err := ss.GetUserSegmentsDiff(context.Background(), 1000, to, from); !errors.Is(err, ErrInvalidTimeRange) {
+		t.Errorf("Expected error %v, but got %v", ErrInvalidTimeRange, err)
+	}
+
+	diff, err := ss.GetUserSegmentsDiff(context.Background(), 1000, from, to)
+	if err != nil {
+		t.Fatalf("SegmentService.GetUserSegmentsDiff() error = %v", err)
+	}
+	wantGained := []SegmentChange{{Segment: "GAINED", Added: true, At: at(3), Actor: "bob"}}
+	if !slices.Equal(diff.Gained, wantGained) {
+		t.Errorf("Expected gained %+v, but got %+v", wantGained, diff.Gained)
+	}
+	wantLost := []SegmentChange{{Segment: "LOST", At: at(2), Actor: "alice"}}
+	if !slices.Equal(diff.Lost, wantLost) {
+		t.Errorf("Expected lost %+v, but got %+v", wantLost, diff.Lost)
+	}
+	if len(diff.Changes) != 6 {
+		t.Errorf("Expected all 6 changes, but got %+v", diff.Changes)
+	}
+}
@@ -0,0 +1,195 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultJobsPageSize is the number of jobs returned by GetJobs when no
+	// limit is given.
+	DefaultJobsPageSize = 100
+	maxJobsPageSize     = 1000
+)
+
+// JobLease is how long a job stays with the worker that claimed it without
+// saving progress. Once it passes, another worker resumes the job.
+const JobLease = time.Minute
+
+var (
+	ErrJobNotFound = errors.New("can't find the job")
+	// ErrJobLost is returned when saving a job that another worker took
+	// over after the lease passed.
+	ErrJobLost        = errors.New("job was taken over by another worker")
+	ErrInvalidJobKind = errors.New("unknown job kind")
+)
+
+type JobKind string
+
+const (
+	JobSegmentUpload JobKind = "segment_upload"
+	JobReport        JobKind = "report"
+)
+
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is work done in the background by any replica. Input is what the job
+// was created with and State is the progress it saved, both are only read
+// by the job itself. Result is what the job reports, it's updated as the
+// job goes.
+type Job struct {
+	ID          int64
+	Kind        JobKind
+	Tenant      string
+	Environment string
+	Actor       string
+	Status      JobStatus
+	Input       json.RawMessage
+	State       json.RawMessage
+	Result      json.RawMessage
+	Error       string
+	// Attempt grows every time the job is claimed, saving the job fails
+	// with ErrJobLost once it's claimed again.
+	Attempt    int
+	CreatedAt  time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+// jobRunner does a job of some kind. It calls save with the job after
+// changing its state and result, so that the job can be resumed from there.
+type jobRunner func(ss *SegmentService, ctx context.Context, job *Job, save func() error) error
+
+var jobRunners = map[JobKind]jobRunner{
+	JobSegmentUpload: (*SegmentService).runSegmentUpload,
+	JobReport:        (*SegmentService).runReport,
+}
+
+// createJob stores a pending job of the tenant, environment and actor of
+// ctx. If runNow is set the job is run right away unless a worker claims it
+// first.
+func (ss *SegmentService) createJob(ctx context.Context, kind JobKind, input any, result any, runNow bool) (Job, error) {
+	job := Job{
+		Kind:        kind,
+		Tenant:      TenantFromContext(ctx),
+		Environment: EnvironmentFromContext(ctx),
+		Actor:       ActorFromContext(ctx),
+		Status:      JobPending,
+		CreatedAt:   ss.now(),
+	}
+	var err error
+	if job.Input, err = json.Marshal(input); err != nil {
+		return Job{}, fmt.Errorf("marshaling job input: %w", err)
+	}
+	if job.Result, err = json.Marshal(result); err != nil {
+		return Job{}, fmt.Errorf("marshaling job result: %w", err)
+	}
+
+	job.ID, err = ss.storage.CreateJob(ctx, job)
+	if err != nil {
+		return Job{}, fmt.Errorf("creating job: %w", err)
+	}
+	if !runNow {
+		return job, nil
+	}
+
+	claimed, err := ss.storage.ClaimJob(ctx, job.ID, JobLease)
+	if err != nil {
+		return Job{}, fmt.Errorf("claiming job: %w", err)
+	}
+	if claimed == nil {
+		return job, nil
+	}
+	// The job is finished even if the caller goes away meanwhile.
+	return ss.runJob(context.WithoutCancel(ctx), *claimed)
+}
+
+// GetJob returns a job of the tenant of ctx.
+func (ss *SegmentService) GetJob(ctx context.Context, id int64) (Job, error) {
+	job, err := ss.storage.GetJob(ctx, id)
+	if err != nil {
+		return Job{}, fmt.Errorf("getting job: %w", err)
+	}
+	return job, nil
+}
+
+// GetJobs returns up to limit jobs of the kind of the tenant of ctx, newest
+// first. An empty kind means jobs of any kind.
+func (ss *SegmentService) GetJobs(ctx context.Context, kind JobKind, limit int) ([]Job, error) {
+	if _, ok := jobRunners[kind]; kind != "" && !ok {
+		return nil, ErrInvalidJobKind
+	}
+	if limit == 0 {
+		limit = DefaultJobsPageSize
+	}
+	if limit < 0 || limit > maxJobsPageSize {
+		return nil, ErrInvalidLimit
+	}
+
+	jobs, err := ss.storage.GetJobs(ctx, kind, limit)
+	if err != nil {
+		return nil, fmt.Errorf("getting jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// RunNextJob claims a pending job of any tenant, or one whose worker
+// stopped saving it, and runs it. It reports whether there was a job.
+func (ss *SegmentService) RunNextJob(ctx context.Context) (bool, error) {
+	job, err := ss.storage.ClaimJob(ctx, 0, JobLease)
+	if err != nil {
+		return false, fmt.Errorf("claiming job: %w", err)
+	}
+	if job == nil {
+		return false, nil
+	}
+
+	if _, err := ss.runJob(ctx, *job); err != nil {
+		return true, fmt.Errorf("job %d: %w", job.ID, err)
+	}
+	return true, nil
+}
+
+// runJob runs a claimed job in its scope and stores how it ended. Errors
+// of the job fail it, only errors of storing it are returned.
+func (ss *SegmentService) runJob(ctx context.Context, job Job) (Job, error) {
+	ctx = WithActor(WithEnvironment(WithTenant(ctx, job.Tenant), job.Environment), job.Actor)
+	save := func() error {
+		return ss.storage.SaveJob(ctx, job, JobLease)
+	}
+
+	run, ok := jobRunners[job.Kind]
+	var runErr error
+	if !ok {
+		runErr = fmt.Errorf("%w: %s", ErrInvalidJobKind, job.Kind)
+	} else {
+		runErr = run(ss, ctx, &job, save)
+	}
+	if errors.Is(runErr, ErrJobLost) {
+		return job, runErr
+	}
+	if ctx.Err() != nil {
+		// The lease passes and another worker resumes the job.
+		return job, ctx.Err()
+	}
+
+	now := ss.now()
+	job.Status, job.FinishedAt = JobDone, &now
+	if runErr != nil {
+		job.Status, job.Error = JobFailed, runErr.Error()
+	}
+	if err := save(); err != nil {
+		return job, fmt.Errorf("saving job: %w", err)
+	}
+	return job, nil
+}
@@ -0,0 +1,127 @@
+package domain
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultOperationsChunkSize is the number of operations ImportOperations
+// applies at once when no chunk size is given.
+const DefaultOperationsChunkSize = 1000
+
+var (
+	ErrInvalidOperation = errors.New("operation is malformed")
+	ErrInvalidChunkSize = errors.New("chunk size must be between 1 and 10000")
+)
+
+// OperationResult is the outcome of an operation of ImportOperations. User
+// is nil if the line couldn't be parsed.
+type OperationResult struct {
+	Line int
+	User *int
+	Err  error
+}
+
+// ImportSummary counts operations applied and failed by ImportOperations.
+type ImportSummary struct {
+	Applied int
+	Failed  int
+}
+
+type operation struct {
+	User             *int     `json:"user_id"`
+	SegmentsToAdd    []string `json:"segments_to_add"`
+	SegmentsToDelete []string `json:"segments_to_delete"`
+}
+
+// ImportOperations reads newline-delimited JSON operations, each of them
+// the arguments of ChangeUserSegments, and applies them by chunks of up to
+// chunkSize with ChangeUsersSegments, so that only one chunk is in memory
+// at a time. The mode applies to every chunk on its own. A chunk ends early
+// when a user comes again, so that operations of a user are applied in
+// order. failed is called with every operation that wasn't applied:
+// malformed lines as they are read, the others once their chunk is
+// applied. Blank lines are skipped.
+func (ss *SegmentService) ImportOperations(ctx context.Context, r io.Reader, mode BulkMode, chunkSize int, failed func(OperationResult) error) (ImportSummary, error) {
+	var summary ImportSummary
+	if mode != BulkAtomic && mode != BulkBestEffort {
+		return summary, ErrInvalidBulkMode
+	}
+	if chunkSize == 0 {
+		chunkSize = DefaultOperationsChunkSize
+	}
+	if chunkSize < 0 || chunkSize > MaxBulkChanges {
+		return summary, ErrInvalidChunkSize
+	}
+
+	var changes []UserSegmentsChange
+	var lines []int
+	users := make(map[int]bool, chunkSize)
+	apply := func() error {
+		if len(changes) == 0 {
+			return nil
+		}
+		errs, err := ss.ChangeUsersSegments(ctx, mode, changes)
+		if err != nil {
+			return err
+		}
+		for i, err := range errs {
+			if err == nil {
+				summary.Applied++
+				continue
+			}
+			summary.Failed++
+			user := changes[i].User
+			if err := failed(OperationResult{Line: lines[i], User: &user, Err: err}); err != nil {
+				return err
+			}
+		}
+		changes, lines = nil, nil
+		clear(users)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var op operation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil || op.User == nil {
+			if err == nil {
+				err = errors.New("user_id is required")
+			}
+			summary.Failed++
+			if err := failed(OperationResult{Line: line, Err: fmt.Errorf("%w: %v", ErrInvalidOperation, err)}); err != nil {
+				return summary, err
+			}
+			continue
+		}
+
+		if users[*op.User] || len(changes) == chunkSize {
+			if err := apply(); err != nil {
+				return summary, err
+			}
+		}
+		users[*op.User] = true
+		changes = append(changes, UserSegmentsChange{User: *op.User, SegmentsToAdd: op.SegmentsToAdd, SegmentsToDelete: op.SegmentsToDelete})
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return summary, fmt.Errorf("%w: line %d is longer than 1 MiB", ErrInvalidOperation, line+1)
+		}
+		return summary, fmt.Errorf("reading operations: %w", err)
+	}
+
+	return summary, apply()
+}
@@ -0,0 +1,85 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSegmentService_ImportOperations(t *testing.T) {
+	input := strings.Join([]string{
+		`{"user_id":1000,"segments_to_add":["A"]}`,
+		`{"user_id":1001,"segments_to_add":["UNKNOWN"]}`,
+		``,
+		`not json`,
+		`{"segments_to_add":["A"]}`,
+		`{"user_id":1002,"segments_to_delete":["A"]}`,
+		`{"user_id":1000,"segments_to_delete":["A"]}`,
+	}, "\n")
+
+	var chunks [][]int
+	storage := &storageMock{
+		GetPrerequisitesFunc: func(ctx context.Context) ([]Prerequisite, error) {
+			return nil, nil
+		},
+		GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+			return nil, nil
+		},
+		ChangeUsersSegmentsFunc: func(ctx context.Context, changes []UserSegmentsChange, atomic bool) ([]error, error) {
+			var users []int
+			errs := make([]error, len(changes))
+			for i, change := range changes {
+				users = append(users, change.User)
+				if change.User == 1001 {
+					errs[i] = ErrSegmentNotFound
+				}
+			}
+			chunks = append(chunks, users)
+			return errs, nil
+		},
+	}
+
+	var failed []OperationResult
+	ss := NewSegmentService(storage)
+	summary, err := ss.ImportOperations(context.Background(), strings.NewReader(input), BulkBestEffort, 10, func(r OperationResult) error {
+		failed = append(failed, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("SegmentService.ImportOperations() error = %v", err)
+	}
+
+	if summary != (ImportSummary{Applied: 3, Failed: 3}) {
+		t.Errorf("Expected 3 applied and 3 failed operations, but got %+v", summary)
+	}
+
+	// The malformed lines are reported as they are read, before the chunk
+	// they are in is applied.
+	wantLines := []int{4, 5, 2}
+	if len(failed) != len(wantLines) {
+		t.Fatalf("Expected failed lines %v, but got %+v", wantLines, failed)
+	}
+	for i, line := range wantLines {
+		if failed[i].Line != line {
+			t.Errorf("Expected failed lines %v, but got %+v", wantLines, failed)
+		}
+	}
+	if !errors.Is(failed[0].Err, ErrInvalidOperation) || failed[0].User != nil {
+		t.Errorf("Expected line 4 to be malformed, but got %+v", failed[0])
+	}
+	if !errors.Is(failed[2].Err, ErrSegmentNotFound) || failed[2].User == nil || *failed[2].User != 1001 {
+		t.Errorf("Expected line 2 to fail with %v, but got %+v", ErrSegmentNotFound, failed[2])
+	}
+
+	// User 1000 comes again, so the chunk is applied before it's full.
+	wantChunks := [][]int{{1000, 1001, 1002}, {1000}}
+	if len(chunks) != len(wantChunks) {
+		t.Fatalf("Expected chunks %v, but got %v", wantChunks, chunks)
+	}
+	for i := range chunks {
+		if len(chunks[i]) != len(wantChunks[i]) || chunks[i][0] != wantChunks[i][0] {
+			t.Errorf("Expected chunks %v, but got %v", wantChunks, chunks)
+		}
+	}
+}
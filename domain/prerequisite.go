@@ -0,0 +1,145 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	ErrPrerequisiteNotFound = errors.New("segment doesn't have this prerequisite")
+	ErrPrerequisiteCycle    = errors.New("prerequisites can't form a cycle")
+	ErrPrerequisiteMissing  = errors.New("user doesn't have a prerequisite segment")
+)
+
+// Prerequisite declares that a user can be added to Segment only if they are
+// already in Prerequisite. With Cascade set, removing the user from
+// Prerequisite removes them from Segment as well.
+type Prerequisite struct {
+	Segment      string
+	Prerequisite string
+	Cascade      bool
+}
+
+func (ss *SegmentService) AddSegmentPrerequisite(ctx context.Context, p Prerequisite) error {
+	if p.Segment == p.Prerequisite {
+		return ErrPrerequisiteCycle
+	}
+
+	prerequisites, err := ss.storage.GetPrerequisites(ctx)
+	if err != nil {
+		return fmt.Errorf("getting prerequisites: %w", err)
+	}
+
+	// The new edge closes a cycle if the segment is already a (transitive)
+	// prerequisite of its new prerequisite.
+	requires := prerequisiteGraph(prerequisites)
+	if requires.reaches(p.Prerequisite, p.Segment) {
+		return ErrPrerequisiteCycle
+	}
+
+	if err := ss.storage.AddSegmentPrerequisite(ctx, p); err != nil {
+		return fmt.Errorf("adding prerequisite: %w", err)
+	}
+	return nil
+}
+
+func (ss *SegmentService) DeleteSegmentPrerequisite(ctx context.Context, segment, prerequisite string) error {
+	if err := ss.storage.DeleteSegmentPrerequisite(ctx, segment, prerequisite); err != nil {
+		return fmt.Errorf("deleting prerequisite: %w", err)
+	}
+	return nil
+}
+
+// applyPrerequisites checks that every segment the user is being added to has
+// its prerequisites satisfied once the change is applied, and extends
+// segmentsToDelete with the dependents that cascade from removed segments.
+// The memberships may change before the write, so the storage checks the
+// prerequisites and cascades the removals again inside its transaction.
+func (ss *SegmentService) applyPrerequisites(ctx context.Context, user int, segmentsToAdd, segmentsToDelete []string) ([]string, error) {
+	prerequisites, err := ss.storage.GetPrerequisites(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting prerequisites: %w", err)
+	}
+	if len(prerequisites) == 0 {
+		return segmentsToDelete, nil
+	}
+
+	// Validation must see the latest writes, not what the cache has.
+	current, err := ss.storage.GetUserSegments(WithCacheBypass(ctx), user)
+	if err != nil {
+		return nil, fmt.Errorf("getting segments: %w", err)
+	}
+
+	return cascadePrerequisites(prerequisites, current, segmentsToAdd, segmentsToDelete)
+}
+
+// cascadePrerequisites is applyPrerequisites for a user who has the current
+// segments.
+func cascadePrerequisites(prerequisites []Prerequisite, current []Segment, segmentsToAdd, segmentsToDelete []string) ([]string, error) {
+	has := make(map[string]bool, len(current)+len(segmentsToAdd))
+	for _, s := range current {
+		has[s.Name] = true
+	}
+
+	segmentsToDelete = slices.Clone(segmentsToDelete)
+	removed := make(map[string]bool, len(segmentsToDelete))
+	queue := make([]string, 0, len(segmentsToDelete))
+	for _, s := range segmentsToDelete {
+		removed[s] = true
+		queue = append(queue, s)
+	}
+	for len(queue) > 0 {
+		segment := queue[0]
+		queue = queue[1:]
+		for _, p := range prerequisites {
+			if p.Prerequisite != segment || !p.Cascade || removed[p.Segment] || !has[p.Segment] {
+				continue
+			}
+			removed[p.Segment] = true
+			queue = append(queue, p.Segment)
+			segmentsToDelete = append(segmentsToDelete, p.Segment)
+		}
+	}
+
+	for _, s := range segmentsToAdd {
+		has[s] = true
+	}
+
+	var errs error
+	for _, segment := range segmentsToAdd {
+		for _, p := range prerequisites {
+			if p.Segment == segment && (!has[p.Prerequisite] || removed[p.Prerequisite]) {
+				errs = errors.Join(errs, fmt.Errorf("%w: %s requires %s", ErrPrerequisiteMissing, p.Segment, p.Prerequisite))
+			}
+		}
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	return segmentsToDelete, nil
+}
+
+type prerequisiteGraph []Prerequisite
+
+// reaches reports whether to is a transitive prerequisite of from.
+func (g prerequisiteGraph) reaches(from, to string) bool {
+	visited := map[string]bool{from: true}
+	queue := []string{from}
+	for len(queue) > 0 {
+		segment := queue[0]
+		queue = queue[1:]
+		if segment == to {
+			return true
+		}
+		for _, p := range g {
+			if p.Segment == segment && !visited[p.Prerequisite] {
+				visited[p.Prerequisite] = true
+				queue = append(queue, p.Prerequisite)
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSegmentService_ChangeUserSegments_Prerequisites(t *testing.T) {
+	prerequisites := []Prerequisite{
+		{Segment: "VOICE_MESSAGES_BETA", Prerequisite: "VOICE_MESSAGES", Cascade: true},
+		{Segment: "VOICE_MESSAGES_ALPHA", Prerequisite: "VOICE_MESSAGES_BETA", Cascade: true},
+		{Segment: "DISCOUNT_50", Prerequisite: "VOICE_MESSAGES"},
+	}
+
+	tests := []struct {
+		name             string
+		current          []string
+		segmentsToAdd    []string
+		segmentsToDelete []string
+		wantErr          error
+		wantAdded        []string
+		wantDeleted      []string
+	}{
+		{
+			name:          "adding a segment without its prerequisite is rejected",
+			segmentsToAdd: []string{"VOICE_MESSAGES_BETA"},
+			wantErr:       ErrPrerequisiteMissing,
+		},
+		{
+			name:          "adding a segment together with its prerequisite is allowed",
+			segmentsToAdd: []string{"VOICE_MESSAGES", "VOICE_MESSAGES_BETA"},
+			wantAdded:     []string{"VOICE_MESSAGES", "VOICE_MESSAGES_BETA"},
+		},
+		{
+			name:          "adding a segment when user already has its prerequisite is allowed",
+			current:       []string{"VOICE_MESSAGES"},
+			segmentsToAdd: []string{"VOICE_MESSAGES_BETA"},
+			wantAdded:     []string{"VOICE_MESSAGES_BETA"},
+		},
+		{
+			name:             "adding a segment while removing its prerequisite is rejected",
+			current:          []string{"VOICE_MESSAGES"},
+			segmentsToAdd:    []string{"VOICE_MESSAGES_BETA"},
+			segmentsToDelete: []string{"VOICE_MESSAGES"},
+			wantErr:          ErrPrerequisiteMissing,
+		},
+		{
+			name:             "removing a prerequisite cascades to dependents transitively",
+			current:          []string{"VOICE_MESSAGES", "VOICE_MESSAGES_BETA", "VOICE_MESSAGES_ALPHA", "DISCOUNT_50"},
+			segmentsToDelete: []string{"VOICE_MESSAGES"},
+			wantDeleted:      []string{"VOICE_MESSAGES", "VOICE_MESSAGES_BETA", "VOICE_MESSAGES_ALPHA"},
+		},
+		{
+			name:             "cascade skips dependents the user isn't in",
+			current:          []string{"VOICE_MESSAGES"},
+			segmentsToDelete: []string{"VOICE_MESSAGES"},
+			wantDeleted:      []string{"VOICE_MESSAGES"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetPrerequisitesFunc: func(ctx context.Context) ([]Prerequisite, error) {
+					return prerequisites, nil
+				},
+				GetUserSegmentsFunc: func(ctx context.Context, user int) ([]Segment, error) {
+					segments := make([]Segment, 0, len(tt.current))
+					for _, name := range tt.current {
+						segments = append(segments, Segment{Name: name})
+					}
+					return segments, nil
+				},
+				AddUserToSegmentFunc: func(ctx context.Context, user int, segments []string) error {
+					return nil
+				},
+				DeleteUserFromSegmentFunc: func(ctx context.Context, user int, segments []string) error {
+					return nil
+				},
+				CreateOperationFunc: func(ctx context.Context, user int) (int64, error) {
+					return 1, nil
+				},
+				DeleteOperationFunc: func(ctx context.Context, id int64) error {
+					return nil
+				},
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return nil, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			_, err := ss.ChangeUserSegments(context.Background(), 1000, tt.segmentsToAdd, tt.segmentsToDelete)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SegmentService.ChangeUserSegments() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var added, deleted []string
+			for _, call := range storage.AddUserToSegmentCalls {
+				added = append(added, call.segments...)
+			}
+			for _, call := range storage.DeleteUserFromSegmentCalls {
+				deleted = append(deleted, call.segments...)
+			}
+
+			if !slices.Equal(added, tt.wantAdded) {
+				t.Errorf("Expected user to be added to %v, but got %v", tt.wantAdded, added)
+			}
+			if !slices.Equal(deleted, tt.wantDeleted) {
+				t.Errorf("Expected user to be removed from %v, but got %v", tt.wantDeleted, deleted)
+			}
+			for _, call := range storage.GetUserSegmentsCalls {
+				if !CacheBypassed(call.ctx) {
+					t.Errorf("Expected prerequisites to be checked past the cache")
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentService_AddSegmentPrerequisite(t *testing.T) {
+	existing := []Prerequisite{
+		{Segment: "B", Prerequisite: "A"},
+		{Segment: "C", Prerequisite: "B"},
+	}
+
+	tests := []struct {
+		name    string
+		p       Prerequisite
+		wantErr error
+	}{
+		{
+			name: "new independent prerequisite is added",
+			p:    Prerequisite{Segment: "D", Prerequisite: "C"},
+		},
+		{
+			name:    "segment can't require itself",
+			p:       Prerequisite{Segment: "A", Prerequisite: "A"},
+			wantErr: ErrPrerequisiteCycle,
+		},
+		{
+			name:    "transitive cycle is rejected",
+			p:       Prerequisite{Segment: "A", Prerequisite: "C"},
+			wantErr: ErrPrerequisiteCycle,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetPrerequisitesFunc: func(ctx context.Context) ([]Prerequisite, error) {
+					return existing, nil
+				},
+				AddSegmentPrerequisiteFunc: func(ctx context.Context, p Prerequisite) error {
+					return nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			err := ss.AddSegmentPrerequisite(context.Background(), tt.p)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SegmentService.AddSegmentPrerequisite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			wantCalls := 1
+			if tt.wantErr != nil {
+				wantCalls = 0
+			}
+			if len(storage.AddSegmentPrerequisiteCalls) != wantCalls {
+				t.Errorf("Expected %d calls to storage.AddSegmentPrerequisite, but got %d", wantCalls, len(storage.AddSegmentPrerequisiteCalls))
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package domain
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ReportLinkTTL is how long a download link of a report is valid, if the
+// blob store gives out links.
+const ReportLinkTTL = 15 * time.Minute
+
+// reportPageSize is the number of changes written to a report at once, the
+// job is saved after every page to keep its lease.
+const reportPageSize = 1000
+
+var (
+	ErrInvalidReport  = errors.New("report must be history")
+	ErrReportNotReady = errors.New("report isn't ready yet")
+	ErrBlobNotFound   = errors.New("can't find the file")
+	errNoBlobStore    = errors.New("reports need a blob store")
+)
+
+// BlobStore keeps files built by jobs, like reports.
+type BlobStore interface {
+	// PutBlob stores size bytes read from r under the key, replacing the
+	// blob that was there.
+	PutBlob(ctx context.Context, key string, r io.Reader, size int64) error
+	// OpenBlob reads the blob, it fails with ErrBlobNotFound if there's none.
+	OpenBlob(ctx context.Context, key string) (io.ReadCloser, error)
+	// BlobURL returns a link to download the blob straight from the store,
+	// valid for ttl, or "" if the store doesn't give out links and blobs are
+	// downloaded through the service.
+	BlobURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// WithBlobStore sets the store reports are written to.
+func WithBlobStore(blobs BlobStore) Option {
+	return func(ss *SegmentService) {
+		ss.blobs = blobs
+	}
+}
+
+// ReportKind is what a report lists.
+type ReportKind string
+
+// ReportHistory lists the changes of segments and their members, see
+// GetChanges, as CSV.
+const ReportHistory ReportKind = "history"
+
+// ReportResult is the Result of a JobReport job.
+type ReportResult struct {
+	Report ReportKind `json:"report"`
+	From   time.Time  `json:"from"`
+	To     time.Time  `json:"to"`
+	// Rows is the number of rows written so far.
+	Rows int   `json:"rows"`
+	Size int64 `json:"size"`
+}
+
+type reportInput struct {
+	Report ReportKind `json:"report"`
+	From   time.Time  `json:"from"`
+	To     time.Time  `json:"to"`
+}
+
+// reportKey is the key of the blob of the report built by the job.
+func reportKey(id int64) string {
+	return fmt.Sprintf("reports/%d.csv", id)
+}
+
+// CreateReport starts a JobReport job that writes the report of the changes
+// in [from, to) of the tenant and environment of ctx to the blob store. A
+// zero to means up to now. Once the job is done, the report is downloaded
+// with ReportURL or OpenReport.
+func (ss *SegmentService) CreateReport(ctx context.Context, report ReportKind, from, to time.Time) (Job, error) {
+	if report != ReportHistory {
+		return Job{}, ErrInvalidReport
+	}
+	if to.IsZero() {
+		to = ss.now()
+	}
+	if !from.Before(to) {
+		return Job{}, ErrInvalidTimeRange
+	}
+	if ss.blobs == nil {
+		return Job{}, errNoBlobStore
+	}
+
+	input := reportInput{Report: report, From: from, To: to}
+	result := ReportResult{Report: report, From: from, To: to}
+	return ss.createJob(ctx, JobReport, input, result, false)
+}
+
+// ReportURL returns a link to download the report of a done JobReport job
+// straight from the blob store, or "" if the store doesn't give out links.
+func (ss *SegmentService) ReportURL(ctx context.Context, job Job) (string, error) {
+	if job.Kind != JobReport {
+		return "", ErrJobNotFound
+	}
+	if job.Status != JobDone {
+		return "", ErrReportNotReady
+	}
+	if ss.blobs == nil {
+		return "", errNoBlobStore
+	}
+
+	url, err := ss.blobs.BlobURL(ctx, reportKey(job.ID), ReportLinkTTL)
+	if err != nil {
+		return "", fmt.Errorf("getting report link: %w", err)
+	}
+	return url, nil
+}
+
+// OpenReport reads the CSV report built by the job of the tenant of ctx.
+func (ss *SegmentService) OpenReport(ctx context.Context, id int64) (io.ReadCloser, error) {
+	job, err := ss.GetJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Kind != JobReport {
+		return nil, ErrJobNotFound
+	}
+	if job.Status != JobDone {
+		return nil, ErrReportNotReady
+	}
+	if ss.blobs == nil {
+		return nil, errNoBlobStore
+	}
+
+	r, err := ss.blobs.OpenBlob(ctx, reportKey(job.ID))
+	if err != nil {
+		return nil, fmt.Errorf("opening report: %w", err)
+	}
+	return r, nil
+}
+
+// runReport writes the report to a temporary file first, as blob stores
+// need to know the size upfront, and then puts it to the blob store. A job
+// taken over by another worker starts over.
+func (ss *SegmentService) runReport(ctx context.Context, job *Job, save func() error) error {
+	var input reportInput
+	if err := json.Unmarshal(job.Input, &input); err != nil {
+		return fmt.Errorf("unmarshaling input: %w", err)
+	}
+	if ss.blobs == nil {
+		return errNoBlobStore
+	}
+	result := ReportResult{Report: input.Report, From: input.From, To: input.To}
+
+	f, err := os.CreateTemp("", "report-*.csv")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"seq", "at", "type", "segment", "user_id"}); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+	var after int64
+	for {
+		changes, err := ss.storage.GetChangesBetween(ctx, input.From, input.To, after, reportPageSize)
+		if err != nil {
+			return fmt.Errorf("getting changes: %w", err)
+		}
+		for _, c := range changes {
+			user := ""
+			if c.User != nil {
+				user = strconv.Itoa(*c.User)
+			}
+			record := []string{strconv.FormatInt(c.Seq, 10), c.At.UTC().Format(time.RFC3339Nano), string(c.Type), c.Segment, user}
+			if err := w.Write(record); err != nil {
+				return fmt.Errorf("writing report: %w", err)
+			}
+		}
+		result.Rows += len(changes)
+		if len(changes) < reportPageSize {
+			break
+		}
+		after = changes[len(changes)-1].Seq
+
+		if job.Result, err = json.Marshal(result); err != nil {
+			return fmt.Errorf("marshaling result: %w", err)
+		}
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+
+	if result.Size, err = f.Seek(0, io.SeekCurrent); err != nil {
+		return fmt.Errorf("sizing report: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("rewinding report: %w", err)
+	}
+	if err := ss.blobs.PutBlob(ctx, reportKey(job.ID), f, result.Size); err != nil {
+		return fmt.Errorf("storing report: %w", err)
+	}
+
+	if job.Result, err = json.Marshal(result); err != nil {
+		return fmt.Errorf("marshaling result: %w", err)
+	}
+	return nil
+}
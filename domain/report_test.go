@@ -0,0 +1,119 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// memoryBlobs is a BlobStore that keeps blobs in memory.
+type memoryBlobs map[string][]byte
+
+func (mb memoryBlobs) PutBlob(ctx context.Context, key string, r io.Reader, size int64) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return errors.New("size doesn't match")
+	}
+	mb[key] = b
+	return nil
+}
+
+func (mb memoryBlobs) OpenBlob(ctx context.Context, key string) (io.ReadCloser, error) {
+	b, ok := mb[key]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (mb memoryBlobs) BlobURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", nil
+}
+
+func TestSegmentService_CreateReport(t *testing.T) {
+	from := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("given invalid time range, expect error", func(t *testing.T) {
+		ss := NewSegmentService(&storageMock{}, WithBlobStore(memoryBlobs{}))
+		if _, err := ss.CreateReport(context.Background(), ReportHistory, to, from); !errors.Is(err, ErrInvalidTimeRange) {
+			t.Errorf("Expected error %v, but got %v", ErrInvalidTimeRange, err)
+		}
+	})
+
+	t.Run("given history report, expect worker to store the changes as CSV", func(t *testing.T) {
+		user := 1000
+		var created, saved Job
+		storage := &storageMock{
+			CreateJobFunc: func(ctx context.Context, job Job) (int64, error) {
+				created = job
+				return 1, nil
+			},
+			ClaimJobFunc: func(ctx context.Context, id int64, lease time.Duration) (*Job, error) {
+				job := created
+				job.ID, job.Status, job.Attempt = 1, JobRunning, 1
+				return &job, nil
+			},
+			SaveJobFunc: func(ctx context.Context, job Job, lease time.Duration) error {
+				saved = job
+				return nil
+			},
+			GetJobFunc: func(ctx context.Context, id int64) (Job, error) {
+				return saved, nil
+			},
+			GetChangesBetweenFunc: func(ctx context.Context, from, to time.Time, after int64, limit int) ([]Change, error) {
+				if after > 0 {
+					return nil, nil
+				}
+				return []Change{
+					{Seq: 1, Type: ChangeSegmentCreated, Segment: "A", At: from},
+					{Seq: 2, Type: ChangeMemberAdded, Segment: "A", User: &user, At: from.Add(time.Hour)},
+				}, nil
+			},
+		}
+		blobs := memoryBlobs{}
+		ss := NewSegmentService(storage, WithBlobStore(blobs))
+
+		job, err := ss.CreateReport(context.Background(), ReportHistory, from, to)
+		if err != nil {
+			t.Fatalf("SegmentService.CreateReport() error = %v", err)
+		}
+		if job.Status != JobPending {
+			t.Errorf("Expected job to be pending, but got %s", job.Status)
+		}
+		if ran, err := ss.RunNextJob(context.Background()); !ran || err != nil {
+			t.Fatalf("Expected to run job, but got %v, %v", ran, err)
+		}
+		if saved.Status != JobDone {
+			t.Fatalf("Expected job to be done, but got %s: %s", saved.Status, saved.Error)
+		}
+
+		var result ReportResult
+		if err := json.Unmarshal(saved.Result, &result); err != nil {
+			t.Fatalf("Unable to unmarshal result: %v", err)
+		}
+		if result.Rows != 2 {
+			t.Errorf("Expected 2 rows, but got %d", result.Rows)
+		}
+
+		r, err := ss.OpenReport(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("SegmentService.OpenReport() error = %v", err)
+		}
+		defer r.Close()
+		got, _ := io.ReadAll(r)
+		want := "seq,at,type,segment,user_id\n" +
+			"1,2023-01-01T00:00:00Z,segment_created,A,\n" +
+			"2,2023-01-01T01:00:00Z,member_added,A,1000\n"
+		if string(got) != want {
+			t.Errorf("Expected report %q, but got %q", want, got)
+		}
+	})
+}
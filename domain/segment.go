@@ -4,14 +4,60 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"time"
 )
 
 type SegmentStorage interface {
 	CreateSegment(ctx context.Context, name string) error
 	DeleteSegment(ctx context.Context, name string) error
+	CloneSegment(ctx context.Context, source, name string, opts CloneOptions) (int, error)
+	SetSegmentSchedule(ctx context.Context, name string, activeFrom, activeUntil *time.Time) error
+	SetSegmentMaxMembers(ctx context.Context, name string, maxMembers *int) error
+	GetSegment(ctx context.Context, name string) (SegmentDetails, error)
+	GetSegments(ctx context.Context) ([]SegmentDetails, error)
+	GetSegmentMembers(ctx context.Context, segment string, after, limit int) ([]int, error)
 	AddUserToSegment(ctx context.Context, user int, segments []string) error
 	DeleteUserFromSegment(ctx context.Context, user int, segments []string) error
-	GetUserSegments(ctx context.Context, user int) ([]string, error)
+	ChangeUsersSegments(ctx context.Context, changes []UserSegmentsChange, atomic bool) ([]error, error)
+	GetUserSegments(ctx context.Context, user int) ([]Segment, error)
+	GetUsersSegments(ctx context.Context, users []int) (map[int][]Segment, error)
+	AddSegmentPrerequisite(ctx context.Context, p Prerequisite) error
+	DeleteSegmentPrerequisite(ctx context.Context, segment, prerequisite string) error
+	GetPrerequisites(ctx context.Context) ([]Prerequisite, error)
+	GetSegmentsOverlap(ctx context.Context, segments []string) ([]SegmentOverlap, error)
+	SnapshotSegmentSizes(ctx context.Context, at time.Time) error
+	GetSegmentSizeHistory(ctx context.Context, segment string, from, to time.Time, granularity Granularity) ([]SegmentSize, error)
+	ExportState(ctx context.Context) (State, error)
+	ImportState(ctx context.Context, state State, replace bool, validate func(current State, protected []string) error) error
+	SetSegmentPercentage(ctx context.Context, name string, percentage *int) error
+	GetRolloutSegments(ctx context.Context) ([]RolloutSegment, error)
+	PromoteEnvironment(ctx context.Context, from, to string, segments []string, withMembers bool) error
+	SetSegmentProtected(ctx context.Context, name string, protected bool) error
+	GetProtectedSegments(ctx context.Context) ([]string, error)
+	CreateChangeRequest(ctx context.Context, cr ChangeRequest) (int64, error)
+	GetChangeRequest(ctx context.Context, id int64) (ChangeRequest, error)
+	GetChangeRequests(ctx context.Context, status ChangeStatus) ([]ChangeRequest, error)
+	ReviewChangeRequest(ctx context.Context, id int64, from ChangeStatus, review Review) error
+	GetChanges(ctx context.Context, after int64, limit int) ([]Change, error)
+	GetChangesBetween(ctx context.Context, from, to time.Time, after int64, limit int) ([]Change, error)
+	GetUserSegmentsAsOf(ctx context.Context, user int, at time.Time) ([]string, error)
+	GetUserChanges(ctx context.Context, user int, from, to time.Time) ([]Change, error)
+	GetChangesCursor(ctx context.Context) (int64, error)
+	NotifyChanges(ctx context.Context) (<-chan struct{}, error)
+	GetUserVersion(ctx context.Context, user int) (UserVersion, error)
+	CreateJob(ctx context.Context, job Job) (int64, error)
+	GetJob(ctx context.Context, id int64) (Job, error)
+	GetJobs(ctx context.Context, kind JobKind, limit int) ([]Job, error)
+	ClaimJob(ctx context.Context, id int64, lease time.Duration) (*Job, error)
+	SaveJob(ctx context.Context, job Job, lease time.Duration) error
+	SetJobUsers(ctx context.Context, job int64, users []int) error
+	GetJobUsers(ctx context.Context, job int64, offset, limit int) ([]int, error)
+	CreateOperation(ctx context.Context, user int) (int64, error)
+	DeleteOperation(ctx context.Context, id int64) error
+	GetOperation(ctx context.Context, id int64) (Operation, error)
+	UndoOperation(ctx context.Context, op Operation) (int64, error)
+	DryRun(ctx context.Context, f func(ctx context.Context) error) (DryRunResult, error)
 }
 
 var (
@@ -21,16 +67,75 @@ var (
 	ErrUserIsAlreadyHasThisSegment = errors.New("user is already has this segment")
 	//для этой ошибки выводить какого семента не было у пользователя
 	ErrUserHaveNotThisSegment = errors.New("user doesn't have this segment")
+	ErrInvalidSchedule        = errors.New("active_from must be before active_until")
+	ErrInvalidMaxMembers      = errors.New("max_members must be positive")
+	ErrSegmentIsFull          = errors.New("segment has reached its members limit")
+	ErrInvalidLimit           = errors.New("limit must be between 1 and 1000")
 )
 
+const (
+	// DefaultMembersPageSize is the number of members returned by
+	// GetSegmentMembers when no limit is given.
+	DefaultMembersPageSize = 100
+	maxMembersPageSize     = 1000
+)
+
+// Segment is a segment the user is in, together with the window in which
+// it is active. Nil bounds mean the window is open on that side.
+type Segment struct {
+	Name        string
+	ActiveFrom  *time.Time
+	ActiveUntil *time.Time
+}
+
+// IsActive reports whether the segment is active at the given moment.
+func (s Segment) IsActive(at time.Time) bool {
+	if s.ActiveFrom != nil && at.Before(*s.ActiveFrom) {
+		return false
+	}
+	if s.ActiveUntil != nil && !at.Before(*s.ActiveUntil) {
+		return false
+	}
+	return true
+}
+
+// SegmentDetails describes a segment's settings and how many users are in it.
+// A nil MaxMembers means the segment has no members limit. Percentage and
+// Members are the ones of the environment the segment was read in.
+type SegmentDetails struct {
+	Segment
+	MaxMembers *int
+	Percentage *int
+	Protected  bool
+	Members    int
+}
+
 type SegmentService struct {
-	storage SegmentStorage
+	storage            SegmentStorage
+	now                func() time.Time
+	maxOverlapSegments int
+	blobs              BlobStore
+}
+
+type Option func(ss *SegmentService)
+
+// WithClock replaces time.Now as the source of the current time.
+func WithClock(now func() time.Time) Option {
+	return func(ss *SegmentService) {
+		ss.now = now
+	}
 }
 
-func NewSegmentService(storage SegmentStorage) (ss SegmentService) {
-	return SegmentService{
-		storage: storage,
+func NewSegmentService(storage SegmentStorage, opts ...Option) (ss SegmentService) {
+	ss = SegmentService{
+		storage:            storage,
+		now:                time.Now,
+		maxOverlapSegments: DefaultMaxOverlapSegments,
+	}
+	for _, opt := range opts {
+		opt(&ss)
 	}
+	return ss
 }
 
 func (ss *SegmentService) CreateSegment(ctx context.Context, name string) error {
@@ -41,20 +146,172 @@ func (ss *SegmentService) CreateSegment(ctx context.Context, name string) error
 	return nil
 }
 
+// DeleteSegment deletes the segment right away unless it's protected, then
+// a change request is created and ApprovalRequiredError is returned.
 func (ss *SegmentService) DeleteSegment(ctx context.Context, name string) error {
-	err := ss.storage.DeleteSegment(ctx, name)
+	protected, err := ss.protectedAmong(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(protected) > 0 {
+		return ss.propose(ctx, ChangeRequest{Kind: ChangeDeleteSegment, Segment: name})
+	}
+
+	err = ss.storage.DeleteSegment(ctx, name)
 	if err != nil {
 		return fmt.Errorf("deleting segment: %w", err)
 	}
 	return nil
 }
 
-func (ss *SegmentService) ChangeUserSegments(ctx context.Context, user int, segmentsToAdd []string, segmentsToDelete []string) error {
+// SetSegmentSchedule sets when the segment is active, nil leaves that end
+// open. Changes of protected segments are stored as change requests, see
+// DeleteSegment.
+func (ss *SegmentService) SetSegmentSchedule(ctx context.Context, name string, activeFrom, activeUntil *time.Time) error {
+	if activeFrom != nil && activeUntil != nil && !activeFrom.Before(*activeUntil) {
+		return ErrInvalidSchedule
+	}
+
+	protected, err := ss.protectedAmong(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(protected) > 0 {
+		return ss.propose(ctx, ChangeRequest{Kind: ChangeSegmentSchedule, Segment: name, ActiveFrom: activeFrom, ActiveUntil: activeUntil})
+	}
+
+	err = ss.storage.SetSegmentSchedule(ctx, name, activeFrom, activeUntil)
+	if err != nil {
+		return fmt.Errorf("setting segment schedule: %w", err)
+	}
+	return nil
+}
+
+// SetSegmentMaxMembers limits how many users the segment may contain, nil
+// removes the limit. Lowering the limit below the current number of members
+// doesn't evict anybody, it only blocks further additions. Limits of
+// protected segments are changed through change requests.
+func (ss *SegmentService) SetSegmentMaxMembers(ctx context.Context, name string, maxMembers *int) error {
+	if maxMembers != nil && *maxMembers <= 0 {
+		return ErrInvalidMaxMembers
+	}
+
+	protected, err := ss.protectedAmong(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(protected) > 0 {
+		return ss.propose(ctx, ChangeRequest{Kind: ChangeSegmentMaxMembers, Segment: name, MaxMembers: maxMembers})
+	}
+
+	err = ss.storage.SetSegmentMaxMembers(ctx, name, maxMembers)
+	if err != nil {
+		return fmt.Errorf("setting segment max members: %w", err)
+	}
+	return nil
+}
+
+func (ss *SegmentService) GetSegment(ctx context.Context, name string) (SegmentDetails, error) {
+	segment, err := ss.storage.GetSegment(ctx, name)
+	if err != nil {
+		return SegmentDetails{}, fmt.Errorf("getting segment: %w", err)
+	}
+	return segment, nil
+}
+
+// GetSegments returns all segments of the tenant ordered by name.
+func (ss *SegmentService) GetSegments(ctx context.Context) ([]SegmentDetails, error) {
+	segments, err := ss.storage.GetSegments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting segments: %w", err)
+	}
+	return segments, nil
+}
+
+// GetSegmentMembers returns up to limit members of the segment with ids
+// greater than after in ascending order, together with the value of after
+// for the next page, which is nil on the last one. Zero limit means
+// DefaultMembersPageSize.
+func (ss *SegmentService) GetSegmentMembers(ctx context.Context, segment string, after, limit int) ([]int, *int, error) {
+	if limit == 0 {
+		limit = DefaultMembersPageSize
+	}
+	if limit < 0 || limit > maxMembersPageSize {
+		return nil, nil, ErrInvalidLimit
+	}
+
+	// One extra member tells whether there is a next page.
+	members, err := ss.storage.GetSegmentMembers(ctx, segment, after, limit+1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting segment members: %w", err)
+	}
+	if len(members) <= limit {
+		return members, nil, nil
+	}
+
+	members = members[:limit]
+	next := members[limit-1]
+	return members, &next, nil
+}
+
+// ChangeUserSegments adds the user to segmentsToAdd and removes them from
+// segmentsToDelete. Additions that break segment prerequisites are rejected
+// before anything is changed. If any of the segments, including the ones
+// removed by cascade, is protected, the whole change is stored as a change
+// request and ApprovalRequiredError is returned. Otherwise the change is
+// recorded as an operation, whose ID is returned to undo it later with
+// UndoOperation.
+func (ss *SegmentService) ChangeUserSegments(ctx context.Context, user int, segmentsToAdd []string, segmentsToDelete []string) (int64, error) {
+	cascaded, err := ss.applyPrerequisites(ctx, user, segmentsToAdd, segmentsToDelete)
+	if err != nil {
+		return 0, fmt.Errorf("checking prerequisites: %w", err)
+	}
+
+	protected, err := ss.protectedAmong(ctx, append(slices.Clone(segmentsToAdd), cascaded...)...)
+	if err != nil {
+		return 0, err
+	}
+	if len(protected) > 0 {
+		return 0, ss.propose(ctx, ChangeRequest{
+			Kind:             ChangeUserSegments,
+			User:             &user,
+			SegmentsToAdd:    segmentsToAdd,
+			SegmentsToDelete: segmentsToDelete,
+		})
+	}
+
+	return ss.writeUserSegments(ctx, user, segmentsToAdd, cascaded)
+}
+
+// changeUserSegments is ChangeUserSegments without the protection check,
+// it's used to apply approved change requests.
+func (ss *SegmentService) changeUserSegments(ctx context.Context, user int, segmentsToAdd []string, segmentsToDelete []string) (int64, error) {
+	segmentsToDelete, err := ss.applyPrerequisites(ctx, user, segmentsToAdd, segmentsToDelete)
+	if err != nil {
+		return 0, fmt.Errorf("checking prerequisites: %w", err)
+	}
+	return ss.writeUserSegments(ctx, user, segmentsToAdd, segmentsToDelete)
+}
+
+// writeUserSegments applies the change as a new operation. Additions and
+// removals are written in a transaction each, so the change may fail half
+// way, then the operation is kept with the memberships that were changed.
+// If nothing was changed the operation is deleted and zero is returned.
+func (ss *SegmentService) writeUserSegments(ctx context.Context, user int, segmentsToAdd []string, segmentsToDelete []string) (int64, error) {
+	id, err := ss.storage.CreateOperation(ctx, user)
+	if err != nil {
+		return 0, fmt.Errorf("creating operation: %w", err)
+	}
+	ctx = WithOperation(ctx, id)
+
 	var errs error
+	applied := false
 	if len(segmentsToAdd) != 0 {
 		err := ss.storage.AddUserToSegment(ctx, user, segmentsToAdd)
 		if err != nil {
 			errs = errors.Join(errs, fmt.Errorf("adding user to segments: %w", err))
+		} else {
+			applied = true
 		}
 	}
 
@@ -62,17 +319,73 @@ func (ss *SegmentService) ChangeUserSegments(ctx context.Context, user int, segm
 		err := ss.storage.DeleteUserFromSegment(ctx, user, segmentsToDelete)
 		if err != nil {
 			errs = errors.Join(errs, fmt.Errorf("deleting user from segments: %w", err))
+		} else {
+			applied = true
 		}
 	}
 
-	return errs
+	if errs != nil && !applied {
+		if err := ss.storage.DeleteOperation(ctx, id); err != nil {
+			return 0, errors.Join(errs, fmt.Errorf("deleting operation: %w", err))
+		}
+		return 0, errs
+	}
+	return id, errs
 }
 
+// GetUserSegments returns the names of the user's segments that are active
+// right now, both the ones the user was added to and the ones that include
+// the user by percentage.
 func (ss *SegmentService) GetUserSegments(ctx context.Context, user int) (segmnets []string, err error) {
+	active, _, err := ss.activeUserSegments(ctx, user, ss.now())
+	if err != nil {
+		return []string{}, err
+	}
+	return active, nil
+}
+
+// activeUserSegments returns the user's segments active at the moment and
+// the next moment one of them may turn on or off by its schedule, which is
+// zero if none will.
+func (ss *SegmentService) activeUserSegments(ctx context.Context, user int, now time.Time) ([]string, time.Time, error) {
 	segments, err := ss.storage.GetUserSegments(ctx, user)
 	if err != nil {
-		return []string{}, fmt.Errorf("getting segments: %w", err)
+		return nil, time.Time{}, fmt.Errorf("getting segments: %w", err)
 	}
 
-	return segments, nil
+	rollouts, err := ss.storage.GetRolloutSegments(ctx)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("getting rollout segments: %w", err)
+	}
+
+	var next time.Time
+	scheduled := func(s Segment) {
+		for _, bound := range []*time.Time{s.ActiveFrom, s.ActiveUntil} {
+			if bound != nil && bound.After(now) && (next.IsZero() || bound.Before(next)) {
+				next = *bound
+			}
+		}
+	}
+
+	active := make([]string, 0, len(segments))
+	seen := make(map[string]bool, len(segments))
+	for _, s := range segments {
+		scheduled(s)
+		if s.IsActive(now) {
+			active = append(active, s.Name)
+			seen[s.Name] = true
+		}
+	}
+	for _, s := range rollouts {
+		if seen[s.Name] || !InRollout(user, s.Name, s.Percentage) {
+			continue
+		}
+		scheduled(s.Segment)
+		if s.IsActive(now) {
+			active = append(active, s.Name)
+			seen[s.Name] = true
+		}
+	}
+
+	return active, next, nil
 }
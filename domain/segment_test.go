@@ -3,7 +3,9 @@ package domain
 import (
 	"context"
 	"errors"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestSegmentService_ChangeUserSegments(t *testing.T) {
@@ -40,6 +42,9 @@ func TestSegmentService_ChangeUserSegments(t *testing.T) {
 				if len(f.storage.AddUserToSegmentCalls) != 1 {
 					t.Errorf("Expected 1 call to storage.AddUserToSegment, but got %d", len(f.storage.AddUserToSegmentCalls))
 				}
+				if len(f.storage.DeleteOperationCalls) != 1 {
+					t.Errorf("Expected the operation that changed nothing to be deleted, but got %d calls", len(f.storage.DeleteOperationCalls))
+				}
 			},
 			wantErr: true,
 		},
@@ -61,6 +66,29 @@ func TestSegmentService_ChangeUserSegments(t *testing.T) {
 				if len(f.storage.DeleteUserFromSegmentCalls) != 1 {
 					t.Errorf("Expected 1 call to storage.DeleteUserFromSegment, but got %d", len(f.storage.DeleteUserFromSegmentCalls))
 				}
+				if len(f.storage.DeleteOperationCalls) != 1 {
+					t.Errorf("Expected the operation that changed nothing to be deleted, but got %d calls", len(f.storage.DeleteOperationCalls))
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "given error after a part of the change is applied keep the operation",
+			args: args{
+				ctx:              context.Background(),
+				user:             0,
+				segmentsToAdd:    []string{"TEST_SEGMENT"},
+				segmentsToDelete: []string{"OTHER_SEGMENT"},
+			},
+			beforeTest: func(t *testing.T, f *fields) {
+				f.storage.DeleteUserFromSegmentFunc = func(ctx context.Context, user int, segments []string) error {
+					return errors.New("fail")
+				}
+			},
+			afterTest: func(t *testing.T, f *fields) {
+				if len(f.storage.DeleteOperationCalls) != 0 {
+					t.Errorf("Expected the operation to be kept, but got %d calls to storage.DeleteOperation", len(f.storage.DeleteOperationCalls))
+				}
 			},
 			wantErr: true,
 		},
@@ -87,6 +115,11 @@ func TestSegmentService_ChangeUserSegments(t *testing.T) {
 				if len(f.storage.DeleteUserFromSegmentCalls) != 1 {
 					t.Errorf("Expected 1 call to storage.DeleteUserFromSegment, but got %d", len(f.storage.DeleteUserFromSegmentCalls))
 				}
+				for _, call := range f.storage.AddUserToSegmentCalls {
+					if op := OperationFromContext(call.ctx); op != 1 {
+						t.Errorf("Expected changes to be a part of operation 1, but got %d", op)
+					}
+				}
 			},
 			wantErr: false,
 		},
@@ -101,6 +134,18 @@ func TestSegmentService_ChangeUserSegments(t *testing.T) {
 					DeleteUserFromSegmentFunc: func(ctx context.Context, user int, segments []string) error {
 						return nil
 					},
+					GetPrerequisitesFunc: func(ctx context.Context) ([]Prerequisite, error) {
+						return nil, nil
+					},
+					GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+						return nil, nil
+					},
+					CreateOperationFunc: func(ctx context.Context, user int) (int64, error) {
+						return 1, nil
+					},
+					DeleteOperationFunc: func(ctx context.Context, id int64) error {
+						return nil
+					},
 				},
 			}
 
@@ -109,7 +154,7 @@ func TestSegmentService_ChangeUserSegments(t *testing.T) {
 			}
 
 			ss := NewSegmentService(f.storage)
-			if err := ss.ChangeUserSegments(tt.args.ctx, tt.args.user, tt.args.segmentsToAdd, tt.args.segmentsToDelete); (err != nil) != tt.wantErr {
+			if _, err := ss.ChangeUserSegments(tt.args.ctx, tt.args.user, tt.args.segmentsToAdd, tt.args.segmentsToDelete); (err != nil) != tt.wantErr {
 				t.Errorf("SegmentService.ChangeUserSegments() error = %v, wantErr %v", err, tt.wantErr)
 			}
 
@@ -119,3 +164,221 @@ func TestSegmentService_ChangeUserSegments(t *testing.T) {
 		})
 	}
 }
+
+func TestSegmentService_GetUserSegments(t *testing.T) {
+	now := time.Date(2023, time.August, 31, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		segments []Segment
+		want     []string
+	}{
+		{
+			name:     "segment without schedule is always active",
+			segments: []Segment{{Name: "TEST_SEGMENT"}},
+			want:     []string{"TEST_SEGMENT"},
+		},
+		{
+			name: "segment inside its window is active",
+			segments: []Segment{
+				{Name: "TEST_SEGMENT", ActiveFrom: &past, ActiveUntil: &future},
+			},
+			want: []string{"TEST_SEGMENT"},
+		},
+		{
+			name: "segment that is not started yet or already ended is filtered out",
+			segments: []Segment{
+				{Name: "NOT_STARTED", ActiveFrom: &future},
+				{Name: "ENDED", ActiveUntil: &past},
+				{Name: "ENDS_NOW", ActiveUntil: &now},
+				{Name: "STARTS_NOW", ActiveFrom: &now},
+			},
+			want: []string{"STARTS_NOW"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetUserSegmentsFunc: func(ctx context.Context, user int) ([]Segment, error) {
+					return tt.segments, nil
+				},
+				GetRolloutSegmentsFunc: func(ctx context.Context) ([]RolloutSegment, error) {
+					return nil, nil
+				},
+			}
+
+			ss := NewSegmentService(storage, WithClock(func() time.Time { return now }))
+			got, err := ss.GetUserSegments(context.Background(), 1000)
+			if err != nil {
+				t.Fatalf("SegmentService.GetUserSegments() error = %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("SegmentService.GetUserSegments() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSegmentService_SetSegmentSchedule(t *testing.T) {
+	from := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+	until := from.Add(24 * time.Hour)
+
+	tests := []struct {
+		name        string
+		activeFrom  *time.Time
+		activeUntil *time.Time
+		wantErr     error
+		wantCalls   int
+	}{
+		{
+			name:        "valid window is saved",
+			activeFrom:  &from,
+			activeUntil: &until,
+			wantCalls:   1,
+		},
+		{
+			name:       "open-ended window is saved",
+			activeFrom: &from,
+			wantCalls:  1,
+		},
+		{
+			name:        "window ending before it starts is rejected",
+			activeFrom:  &until,
+			activeUntil: &from,
+			wantErr:     ErrInvalidSchedule,
+		},
+		{
+			name:        "empty window is rejected",
+			activeFrom:  &from,
+			activeUntil: &from,
+			wantErr:     ErrInvalidSchedule,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				SetSegmentScheduleFunc: func(ctx context.Context, name string, activeFrom, activeUntil *time.Time) error {
+					return nil
+				},
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return nil, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			err := ss.SetSegmentSchedule(context.Background(), "TEST_SEGMENT", tt.activeFrom, tt.activeUntil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SegmentService.SetSegmentSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(storage.SetSegmentScheduleCalls) != tt.wantCalls {
+				t.Errorf("Expected %d calls to storage.SetSegmentSchedule, but got %d", tt.wantCalls, len(storage.SetSegmentScheduleCalls))
+			}
+		})
+	}
+}
+
+func TestSegmentService_SetSegmentMaxMembers(t *testing.T) {
+	positive, zero := 10, 0
+
+	tests := []struct {
+		name       string
+		maxMembers *int
+		wantErr    error
+		wantCalls  int
+	}{
+		{
+			name:       "positive limit is saved",
+			maxMembers: &positive,
+			wantCalls:  1,
+		},
+		{
+			name:      "limit is removed",
+			wantCalls: 1,
+		},
+		{
+			name:       "zero limit is rejected",
+			maxMembers: &zero,
+			wantErr:    ErrInvalidMaxMembers,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				SetSegmentMaxMembersFunc: func(ctx context.Context, name string, maxMembers *int) error {
+					return nil
+				},
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return nil, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			err := ss.SetSegmentMaxMembers(context.Background(), "TEST_SEGMENT", tt.maxMembers)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SegmentService.SetSegmentMaxMembers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(storage.SetSegmentMaxMembersCalls) != tt.wantCalls {
+				t.Errorf("Expected %d calls to storage.SetSegmentMaxMembers, but got %d", tt.wantCalls, len(storage.SetSegmentMaxMembersCalls))
+			}
+		})
+	}
+}
+
+func TestSegmentService_GetSegmentMembers(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		stored    []int
+		wantLimit int
+		wantNext  *int
+		wantErr   error
+	}{
+		{
+			name:      "zero limit means the default page size",
+			stored:    []int{1, 2, 3},
+			wantLimit: DefaultMembersPageSize + 1,
+		},
+		{
+			name:      "full page points to the next one",
+			limit:     2,
+			stored:    []int{1, 2, 3},
+			wantLimit: 3,
+			wantNext:  func() *int { v := 2; return &v }(),
+		},
+		{
+			name:    "too big limit is rejected",
+			limit:   1001,
+			wantErr: ErrInvalidLimit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetSegmentMembersFunc: func(ctx context.Context, segment string, after, limit int) ([]int, error) {
+					return tt.stored, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			members, next, err := ss.GetSegmentMembers(context.Background(), "TEST_SEGMENT", 0, tt.limit)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SegmentService.GetSegmentMembers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if got := storage.GetSegmentMembersCalls[0].limit; got != tt.wantLimit {
+				t.Errorf("Expected storage to be asked for %d members, but got %d", tt.wantLimit, got)
+			}
+			if (next == nil) != (tt.wantNext == nil) || (next != nil && *next != *tt.wantNext) {
+				t.Errorf("Expected next page after %v, but got %v", tt.wantNext, next)
+			}
+			if tt.wantNext != nil && len(members) != tt.limit {
+				t.Errorf("Expected %d members on a full page, but got %v", tt.limit, members)
+			}
+		})
+	}
+}
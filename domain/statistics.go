@@ -0,0 +1,53 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrInvalidGranularity = errors.New("granularity must be either hour or day")
+	ErrInvalidTimeRange   = errors.New("from must be before to")
+)
+
+type Granularity string
+
+const (
+	GranularityHour Granularity = "hour"
+	GranularityDay  Granularity = "day"
+)
+
+// SegmentSize is the number of segment members at a moment of time.
+type SegmentSize struct {
+	At      time.Time
+	Members int
+}
+
+// SnapshotSegmentSizes records the current number of members of every
+// segment. It's meant to be called periodically.
+func (ss *SegmentService) SnapshotSegmentSizes(ctx context.Context) error {
+	if err := ss.storage.SnapshotSegmentSizes(ctx, ss.now()); err != nil {
+		return fmt.Errorf("snapshotting segment sizes: %w", err)
+	}
+	return nil
+}
+
+// GetSegmentSizeHistory returns the recorded sizes of the segment in
+// [from, to), one point per hour or day. Each point holds the last snapshot
+// taken within its bucket.
+func (ss *SegmentService) GetSegmentSizeHistory(ctx context.Context, segment string, from, to time.Time, granularity Granularity) ([]SegmentSize, error) {
+	if granularity != GranularityHour && granularity != GranularityDay {
+		return nil, ErrInvalidGranularity
+	}
+	if !from.Before(to) {
+		return nil, ErrInvalidTimeRange
+	}
+
+	sizes, err := ss.storage.GetSegmentSizeHistory(ctx, segment, from, to, granularity)
+	if err != nil {
+		return nil, fmt.Errorf("getting segment size history: %w", err)
+	}
+	return sizes, nil
+}
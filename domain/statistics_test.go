@@ -0,0 +1,86 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSegmentService_SnapshotSegmentSizes(t *testing.T) {
+	now := time.Date(2023, time.August, 31, 12, 0, 0, 0, time.UTC)
+	storage := &storageMock{
+		SnapshotSegmentSizesFunc: func(ctx context.Context, at time.Time) error {
+			return nil
+		},
+	}
+
+	ss := NewSegmentService(storage, WithClock(func() time.Time { return now }))
+	if err := ss.SnapshotSegmentSizes(context.Background()); err != nil {
+		t.Fatalf("SegmentService.SnapshotSegmentSizes() error = %v", err)
+	}
+
+	if len(storage.SnapshotSegmentSizesCalls) != 1 {
+		t.Fatalf("Expected 1 call to storage.SnapshotSegmentSizes, but got %d", len(storage.SnapshotSegmentSizesCalls))
+	}
+	if at := storage.SnapshotSegmentSizesCalls[0].at; !at.Equal(now) {
+		t.Errorf("Expected snapshot to be taken at %s, but got %s", now, at)
+	}
+}
+
+func TestSegmentService_GetSegmentSizeHistory(t *testing.T) {
+	from := time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(7 * 24 * time.Hour)
+
+	tests := []struct {
+		name        string
+		from        time.Time
+		to          time.Time
+		granularity Granularity
+		wantErr     error
+	}{
+		{
+			name:        "daily history is requested",
+			from:        from,
+			to:          to,
+			granularity: GranularityDay,
+		},
+		{
+			name:        "unknown granularity is rejected",
+			from:        from,
+			to:          to,
+			granularity: "week",
+			wantErr:     ErrInvalidGranularity,
+		},
+		{
+			name:        "reversed range is rejected",
+			from:        to,
+			to:          from,
+			granularity: GranularityHour,
+			wantErr:     ErrInvalidTimeRange,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetSegmentSizeHistoryFunc: func(ctx context.Context, segment string, from, to time.Time, granularity Granularity) ([]SegmentSize, error) {
+					return nil, nil
+				},
+			}
+
+			ss := NewSegmentService(storage)
+			_, err := ss.GetSegmentSizeHistory(context.Background(), "TEST_SEGMENT", tt.from, tt.to, tt.granularity)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SegmentService.GetSegmentSizeHistory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			wantCalls := 1
+			if tt.wantErr != nil {
+				wantCalls = 0
+			}
+			if len(storage.GetSegmentSizeHistoryCalls) != wantCalls {
+				t.Errorf("Expected %d calls to storage.GetSegmentSizeHistory, but got %d", wantCalls, len(storage.GetSegmentSizeHistoryCalls))
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type storageMock struct {
 	CreateSegmentFunc  func(ctx context.Context, name string) error
@@ -15,6 +18,27 @@ type storageMock struct {
 		name string
 	}
 
+	SetSegmentScheduleFunc  func(ctx context.Context, name string, activeFrom, activeUntil *time.Time) error
+	SetSegmentScheduleCalls []struct {
+		ctx         context.Context
+		name        string
+		activeFrom  *time.Time
+		activeUntil *time.Time
+	}
+
+	SetSegmentMaxMembersFunc  func(ctx context.Context, name string, maxMembers *int) error
+	SetSegmentMaxMembersCalls []struct {
+		ctx        context.Context
+		name       string
+		maxMembers *int
+	}
+
+	GetSegmentFunc  func(ctx context.Context, name string) (SegmentDetails, error)
+	GetSegmentCalls []struct {
+		ctx  context.Context
+		name string
+	}
+
 	AddUserToSegmentFunc  func(ctx context.Context, user int, segments []string) error
 	AddUserToSegmentCalls []struct {
 		ctx      context.Context
@@ -29,11 +53,281 @@ type storageMock struct {
 		segments []string
 	}
 
-	GetUserSegmentsFunc  func(ctx context.Context, user int) ([]string, error)
+	GetUserSegmentsFunc  func(ctx context.Context, user int) ([]Segment, error)
 	GetUserSegmentsCalls []struct {
 		ctx  context.Context
 		user int
 	}
+
+	AddSegmentPrerequisiteFunc  func(ctx context.Context, p Prerequisite) error
+	AddSegmentPrerequisiteCalls []struct {
+		ctx context.Context
+		p   Prerequisite
+	}
+
+	DeleteSegmentPrerequisiteFunc  func(ctx context.Context, segment, prerequisite string) error
+	DeleteSegmentPrerequisiteCalls []struct {
+		ctx          context.Context
+		segment      string
+		prerequisite string
+	}
+
+	GetPrerequisitesFunc  func(ctx context.Context) ([]Prerequisite, error)
+	GetPrerequisitesCalls []struct {
+		ctx context.Context
+	}
+
+	GetSegmentsOverlapFunc  func(ctx context.Context, segments []string) ([]SegmentOverlap, error)
+	GetSegmentsOverlapCalls []struct {
+		ctx      context.Context
+		segments []string
+	}
+
+	SnapshotSegmentSizesFunc  func(ctx context.Context, at time.Time) error
+	SnapshotSegmentSizesCalls []struct {
+		ctx context.Context
+		at  time.Time
+	}
+
+	ExportStateFunc  func(ctx context.Context) (State, error)
+	ExportStateCalls []struct {
+		ctx context.Context
+	}
+
+	ImportStateFunc  func(ctx context.Context, state State, replace bool, validate func(current State, protected []string) error) error
+	ImportStateCalls []struct {
+		ctx      context.Context
+		state    State
+		replace  bool
+		validate func(current State, protected []string) error
+	}
+
+	SetSegmentPercentageFunc  func(ctx context.Context, name string, percentage *int) error
+	SetSegmentPercentageCalls []struct {
+		ctx        context.Context
+		name       string
+		percentage *int
+	}
+
+	GetRolloutSegmentsFunc  func(ctx context.Context) ([]RolloutSegment, error)
+	GetRolloutSegmentsCalls []struct {
+		ctx context.Context
+	}
+
+	PromoteEnvironmentFunc  func(ctx context.Context, from, to string, segments []string, withMembers bool) error
+	PromoteEnvironmentCalls []struct {
+		ctx         context.Context
+		from        string
+		to          string
+		segments    []string
+		withMembers bool
+	}
+
+	GetSegmentSizeHistoryFunc  func(ctx context.Context, segment string, from, to time.Time, granularity Granularity) ([]SegmentSize, error)
+	GetSegmentSizeHistoryCalls []struct {
+		ctx         context.Context
+		segment     string
+		from        time.Time
+		to          time.Time
+		granularity Granularity
+	}
+
+	SetSegmentProtectedFunc  func(ctx context.Context, name string, protected bool) error
+	SetSegmentProtectedCalls []struct {
+		ctx       context.Context
+		name      string
+		protected bool
+	}
+
+	GetProtectedSegmentsFunc  func(ctx context.Context) ([]string, error)
+	GetProtectedSegmentsCalls []struct {
+		ctx context.Context
+	}
+
+	CreateChangeRequestFunc  func(ctx context.Context, cr ChangeRequest) (int64, error)
+	CreateChangeRequestCalls []struct {
+		ctx context.Context
+		cr  ChangeRequest
+	}
+
+	GetChangeRequestFunc  func(ctx context.Context, id int64) (ChangeRequest, error)
+	GetChangeRequestCalls []struct {
+		ctx context.Context
+		id  int64
+	}
+
+	GetChangeRequestsFunc  func(ctx context.Context, status ChangeStatus) ([]ChangeRequest, error)
+	GetChangeRequestsCalls []struct {
+		ctx    context.Context
+		status ChangeStatus
+	}
+
+	ReviewChangeRequestFunc  func(ctx context.Context, id int64, from ChangeStatus, review Review) error
+	ReviewChangeRequestCalls []struct {
+		ctx    context.Context
+		id     int64
+		from   ChangeStatus
+		review Review
+	}
+
+	GetSegmentsFunc  func(ctx context.Context) ([]SegmentDetails, error)
+	GetSegmentsCalls []struct {
+		ctx context.Context
+	}
+
+	GetSegmentMembersFunc  func(ctx context.Context, segment string, after, limit int) ([]int, error)
+	GetSegmentMembersCalls []struct {
+		ctx     context.Context
+		segment string
+		after   int
+		limit   int
+	}
+
+	GetChangesFunc  func(ctx context.Context, after int64, limit int) ([]Change, error)
+	GetChangesCalls []struct {
+		ctx   context.Context
+		after int64
+		limit int
+	}
+
+	GetChangesCursorFunc  func(ctx context.Context) (int64, error)
+	GetChangesCursorCalls []struct {
+		ctx context.Context
+	}
+
+	NotifyChangesFunc  func(ctx context.Context) (<-chan struct{}, error)
+	NotifyChangesCalls []struct {
+		ctx context.Context
+	}
+
+	GetUserVersionFunc  func(ctx context.Context, user int) (UserVersion, error)
+	GetUserVersionCalls []struct {
+		ctx  context.Context
+		user int
+	}
+
+	ChangeUsersSegmentsFunc  func(ctx context.Context, changes []UserSegmentsChange, atomic bool) ([]error, error)
+	ChangeUsersSegmentsCalls []struct {
+		ctx     context.Context
+		changes []UserSegmentsChange
+		atomic  bool
+	}
+
+	CreateJobFunc  func(ctx context.Context, job Job) (int64, error)
+	CreateJobCalls []struct {
+		ctx context.Context
+		job Job
+	}
+
+	GetJobFunc  func(ctx context.Context, id int64) (Job, error)
+	GetJobCalls []struct {
+		ctx context.Context
+		id  int64
+	}
+
+	GetJobsFunc  func(ctx context.Context, kind JobKind, limit int) ([]Job, error)
+	GetJobsCalls []struct {
+		ctx   context.Context
+		kind  JobKind
+		limit int
+	}
+
+	ClaimJobFunc  func(ctx context.Context, id int64, lease time.Duration) (*Job, error)
+	ClaimJobCalls []struct {
+		ctx   context.Context
+		id    int64
+		lease time.Duration
+	}
+
+	SaveJobFunc  func(ctx context.Context, job Job, lease time.Duration) error
+	SaveJobCalls []struct {
+		ctx   context.Context
+		job   Job
+		lease time.Duration
+	}
+
+	GetChangesBetweenFunc  func(ctx context.Context, from, to time.Time, after int64, limit int) ([]Change, error)
+	GetChangesBetweenCalls []struct {
+		ctx   context.Context
+		from  time.Time
+		to    time.Time
+		after int64
+		limit int
+	}
+
+	GetUserSegmentsAsOfFunc  func(ctx context.Context, user int, at time.Time) ([]string, error)
+	GetUserSegmentsAsOfCalls []struct {
+		ctx  context.Context
+		user int
+		at   time.Time
+	}
+
+	GetUserChangesFunc  func(ctx context.Context, user int, from, to time.Time) ([]Change, error)
+	GetUserChangesCalls []struct {
+		ctx  context.Context
+		user int
+		from time.Time
+		to   time.Time
+	}
+
+	CreateOperationFunc  func(ctx context.Context, user int) (int64, error)
+	CreateOperationCalls []struct {
+		ctx  context.Context
+		user int
+	}
+
+	GetOperationFunc  func(ctx context.Context, id int64) (Operation, error)
+	GetOperationCalls []struct {
+		ctx context.Context
+		id  int64
+	}
+
+	UndoOperationFunc  func(ctx context.Context, op Operation) (int64, error)
+	UndoOperationCalls []struct {
+		ctx context.Context
+		op  Operation
+	}
+
+	DryRunFunc  func(ctx context.Context, f func(ctx context.Context) error) (DryRunResult, error)
+	DryRunCalls []struct {
+		ctx context.Context
+		f   func(ctx context.Context) error
+	}
+
+	CloneSegmentFunc  func(ctx context.Context, source, name string, opts CloneOptions) (int, error)
+	CloneSegmentCalls []struct {
+		ctx    context.Context
+		source string
+		name   string
+		opts   CloneOptions
+	}
+
+	SetJobUsersFunc  func(ctx context.Context, job int64, users []int) error
+	SetJobUsersCalls []struct {
+		ctx   context.Context
+		job   int64
+		users []int
+	}
+
+	GetJobUsersFunc  func(ctx context.Context, job int64, offset, limit int) ([]int, error)
+	GetJobUsersCalls []struct {
+		ctx    context.Context
+		job    int64
+		offset int
+		limit  int
+	}
+
+	DeleteOperationFunc  func(ctx context.Context, id int64) error
+	DeleteOperationCalls []struct {
+		ctx context.Context
+		id  int64
+	}
+
+	GetUsersSegmentsFunc  func(ctx context.Context, users []int) (map[int][]Segment, error)
+	GetUsersSegmentsCalls []struct {
+		ctx   context.Context
+		users []int
+	}
 }
 
 func (m *storageMock) CreateSegment(ctx context.Context, name string) error {
@@ -56,6 +350,42 @@ func (m *storageMock) DeleteSegment(ctx context.Context, name string) error {
 	})
 	return m.DeleteSegmentFunc(ctx, name)
 }
+func (m *storageMock) SetSegmentSchedule(ctx context.Context, name string, activeFrom, activeUntil *time.Time) error {
+	m.SetSegmentScheduleCalls = append(m.SetSegmentScheduleCalls, struct {
+		ctx         context.Context
+		name        string
+		activeFrom  *time.Time
+		activeUntil *time.Time
+	}{
+		ctx:         ctx,
+		name:        name,
+		activeFrom:  activeFrom,
+		activeUntil: activeUntil,
+	})
+	return m.SetSegmentScheduleFunc(ctx, name, activeFrom, activeUntil)
+}
+func (m *storageMock) SetSegmentMaxMembers(ctx context.Context, name string, maxMembers *int) error {
+	m.SetSegmentMaxMembersCalls = append(m.SetSegmentMaxMembersCalls, struct {
+		ctx        context.Context
+		name       string
+		maxMembers *int
+	}{
+		ctx:        ctx,
+		name:       name,
+		maxMembers: maxMembers,
+	})
+	return m.SetSegmentMaxMembersFunc(ctx, name, maxMembers)
+}
+func (m *storageMock) GetSegment(ctx context.Context, name string) (SegmentDetails, error) {
+	m.GetSegmentCalls = append(m.GetSegmentCalls, struct {
+		ctx  context.Context
+		name string
+	}{
+		ctx:  ctx,
+		name: name,
+	})
+	return m.GetSegmentFunc(ctx, name)
+}
 func (m *storageMock) AddUserToSegment(ctx context.Context, user int, segments []string) error {
 	m.AddUserToSegmentCalls = append(m.AddUserToSegmentCalls, struct {
 		ctx      context.Context
@@ -80,7 +410,7 @@ func (m *storageMock) DeleteUserFromSegment(ctx context.Context, user int, segme
 	})
 	return m.DeleteUserFromSegmentFunc(ctx, user, segments)
 }
-func (m *storageMock) GetUserSegments(ctx context.Context, user int) ([]string, error) {
+func (m *storageMock) GetUserSegments(ctx context.Context, user int) ([]Segment, error) {
 	m.GetUserSegmentsCalls = append(m.GetUserSegmentsCalls, struct {
 		ctx  context.Context
 		user int
@@ -90,3 +420,461 @@ func (m *storageMock) GetUserSegments(ctx context.Context, user int) ([]string,
 	})
 	return m.GetUserSegmentsFunc(ctx, user)
 }
+func (m *storageMock) AddSegmentPrerequisite(ctx context.Context, p Prerequisite) error {
+	m.AddSegmentPrerequisiteCalls = append(m.AddSegmentPrerequisiteCalls, struct {
+		ctx context.Context
+		p   Prerequisite
+	}{
+		ctx: ctx,
+		p:   p,
+	})
+	return m.AddSegmentPrerequisiteFunc(ctx, p)
+}
+func (m *storageMock) DeleteSegmentPrerequisite(ctx context.Context, segment, prerequisite string) error {
+	m.DeleteSegmentPrerequisiteCalls = append(m.DeleteSegmentPrerequisiteCalls, struct {
+		ctx          context.Context
+		segment      string
+		prerequisite string
+	}{
+		ctx:          ctx,
+		segment:      segment,
+		prerequisite: prerequisite,
+	})
+	return m.DeleteSegmentPrerequisiteFunc(ctx, segment, prerequisite)
+}
+func (m *storageMock) GetPrerequisites(ctx context.Context) ([]Prerequisite, error) {
+	m.GetPrerequisitesCalls = append(m.GetPrerequisitesCalls, struct {
+		ctx context.Context
+	}{
+		ctx: ctx,
+	})
+	return m.GetPrerequisitesFunc(ctx)
+}
+func (m *storageMock) GetSegmentsOverlap(ctx context.Context, segments []string) ([]SegmentOverlap, error) {
+	m.GetSegmentsOverlapCalls = append(m.GetSegmentsOverlapCalls, struct {
+		ctx      context.Context
+		segments []string
+	}{
+		ctx:      ctx,
+		segments: segments,
+	})
+	return m.GetSegmentsOverlapFunc(ctx, segments)
+}
+func (m *storageMock) SnapshotSegmentSizes(ctx context.Context, at time.Time) error {
+	m.SnapshotSegmentSizesCalls = append(m.SnapshotSegmentSizesCalls, struct {
+		ctx context.Context
+		at  time.Time
+	}{
+		ctx: ctx,
+		at:  at,
+	})
+	return m.SnapshotSegmentSizesFunc(ctx, at)
+}
+func (m *storageMock) GetSegmentSizeHistory(ctx context.Context, segment string, from, to time.Time, granularity Granularity) ([]SegmentSize, error) {
+	m.GetSegmentSizeHistoryCalls = append(m.GetSegmentSizeHistoryCalls, struct {
+		ctx         context.Context
+		segment     string
+		from        time.Time
+		to          time.Time
+		granularity Granularity
+	}{
+		ctx:         ctx,
+		segment:     segment,
+		from:        from,
+		to:          to,
+		granularity: granularity,
+	})
+	return m.GetSegmentSizeHistoryFunc(ctx, segment, from, to, granularity)
+}
+func (m *storageMock) ExportState(ctx context.Context) (State, error) {
+	m.ExportStateCalls = append(m.ExportStateCalls, struct {
+		ctx context.Context
+	}{
+		ctx: ctx,
+	})
+	return m.ExportStateFunc(ctx)
+}
+func (m *storageMock) ImportState(ctx context.Context, state State, replace bool, validate func(current State, protected []string) error) error {
+	m.ImportStateCalls = append(m.ImportStateCalls, struct {
+		ctx      context.Context
+		state    State
+		replace  bool
+		validate func(current State, protected []string) error
+	}{
+		ctx:      ctx,
+		state:    state,
+		replace:  replace,
+		validate: validate,
+	})
+	return m.ImportStateFunc(ctx, state, replace, validate)
+}
+func (m *storageMock) SetSegmentPercentage(ctx context.Context, name string, percentage *int) error {
+	m.SetSegmentPercentageCalls = append(m.SetSegmentPercentageCalls, struct {
+		ctx        context.Context
+		name       string
+		percentage *int
+	}{
+		ctx:        ctx,
+		name:       name,
+		percentage: percentage,
+	})
+	return m.SetSegmentPercentageFunc(ctx, name, percentage)
+}
+func (m *storageMock) GetRolloutSegments(ctx context.Context) ([]RolloutSegment, error) {
+	m.GetRolloutSegmentsCalls = append(m.GetRolloutSegmentsCalls, struct {
+		ctx context.Context
+	}{
+		ctx: ctx,
+	})
+	return m.GetRolloutSegmentsFunc(ctx)
+}
+func (m *storageMock) PromoteEnvironment(ctx context.Context, from, to string, segments []string, withMembers bool) error {
+	m.PromoteEnvironmentCalls = append(m.PromoteEnvironmentCalls, struct {
+		ctx         context.Context
+		from        string
+		to          string
+		segments    []string
+		withMembers bool
+	}{
+		ctx:         ctx,
+		from:        from,
+		to:          to,
+		segments:    segments,
+		withMembers: withMembers,
+	})
+	return m.PromoteEnvironmentFunc(ctx, from, to, segments, withMembers)
+}
+func (m *storageMock) SetSegmentProtected(ctx context.Context, name string, protected bool) error {
+	m.SetSegmentProtectedCalls = append(m.SetSegmentProtectedCalls, struct {
+		ctx       context.Context
+		name      string
+		protected bool
+	}{
+		ctx:       ctx,
+		name:      name,
+		protected: protected,
+	})
+	return m.SetSegmentProtectedFunc(ctx, name, protected)
+}
+func (m *storageMock) GetProtectedSegments(ctx context.Context) ([]string, error) {
+	m.GetProtectedSegmentsCalls = append(m.GetProtectedSegmentsCalls, struct {
+		ctx context.Context
+	}{
+		ctx: ctx,
+	})
+	return m.GetProtectedSegmentsFunc(ctx)
+}
+func (m *storageMock) CreateChangeRequest(ctx context.Context, cr ChangeRequest) (int64, error) {
+	m.CreateChangeRequestCalls = append(m.CreateChangeRequestCalls, struct {
+		ctx context.Context
+		cr  ChangeRequest
+	}{
+		ctx: ctx,
+		cr:  cr,
+	})
+	return m.CreateChangeRequestFunc(ctx, cr)
+}
+func (m *storageMock) GetChangeRequest(ctx context.Context, id int64) (ChangeRequest, error) {
+	m.GetChangeRequestCalls = append(m.GetChangeRequestCalls, struct {
+		ctx context.Context
+		id  int64
+	}{
+		ctx: ctx,
+		id:  id,
+	})
+	return m.GetChangeRequestFunc(ctx, id)
+}
+func (m *storageMock) GetChangeRequests(ctx context.Context, status ChangeStatus) ([]ChangeRequest, error) {
+	m.GetChangeRequestsCalls = append(m.GetChangeRequestsCalls, struct {
+		ctx    context.Context
+		status ChangeStatus
+	}{
+		ctx:    ctx,
+		status: status,
+	})
+	return m.GetChangeRequestsFunc(ctx, status)
+}
+func (m *storageMock) ReviewChangeRequest(ctx context.Context, id int64, from ChangeStatus, review Review) error {
+	m.ReviewChangeRequestCalls = append(m.ReviewChangeRequestCalls, struct {
+		ctx    context.Context
+		id     int64
+		from   ChangeStatus
+		review Review
+	}{
+		ctx:    ctx,
+		id:     id,
+		from:   from,
+		review: review,
+	})
+	return m.ReviewChangeRequestFunc(ctx, id, from, review)
+}
+func (m *storageMock) GetSegments(ctx context.Context) ([]SegmentDetails, error) {
+	m.GetSegmentsCalls = append(m.GetSegmentsCalls, struct {
+		ctx context.Context
+	}{
+		ctx: ctx,
+	})
+	return m.GetSegmentsFunc(ctx)
+}
+func (m *storageMock) GetSegmentMembers(ctx context.Context, segment string, after, limit int) ([]int, error) {
+	m.GetSegmentMembersCalls = append(m.GetSegmentMembersCalls, struct {
+		ctx     context.Context
+		segment string
+		after   int
+		limit   int
+	}{
+		ctx:     ctx,
+		segment: segment,
+		after:   after,
+		limit:   limit,
+	})
+	return m.GetSegmentMembersFunc(ctx, segment, after, limit)
+}
+func (m *storageMock) GetChanges(ctx context.Context, after int64, limit int) ([]Change, error) {
+	m.GetChangesCalls = append(m.GetChangesCalls, struct {
+		ctx   context.Context
+		after int64
+		limit int
+	}{
+		ctx:   ctx,
+		after: after,
+		limit: limit,
+	})
+	return m.GetChangesFunc(ctx, after, limit)
+}
+func (m *storageMock) GetChangesCursor(ctx context.Context) (int64, error) {
+	m.GetChangesCursorCalls = append(m.GetChangesCursorCalls, struct {
+		ctx context.Context
+	}{
+		ctx: ctx,
+	})
+	return m.GetChangesCursorFunc(ctx)
+}
+func (m *storageMock) NotifyChanges(ctx context.Context) (<-chan struct{}, error) {
+	m.NotifyChangesCalls = append(m.NotifyChangesCalls, struct {
+		ctx context.Context
+	}{
+		ctx: ctx,
+	})
+	return m.NotifyChangesFunc(ctx)
+}
+func (m *storageMock) GetUserVersion(ctx context.Context, user int) (UserVersion, error) {
+	m.GetUserVersionCalls = append(m.GetUserVersionCalls, struct {
+		ctx  context.Context
+		user int
+	}{
+		ctx:  ctx,
+		user: user,
+	})
+	return m.GetUserVersionFunc(ctx, user)
+}
+func (m *storageMock) ChangeUsersSegments(ctx context.Context, changes []UserSegmentsChange, atomic bool) ([]error, error) {
+	m.ChangeUsersSegmentsCalls = append(m.ChangeUsersSegmentsCalls, struct {
+		ctx     context.Context
+		changes []UserSegmentsChange
+		atomic  bool
+	}{
+		ctx:     ctx,
+		changes: changes,
+		atomic:  atomic,
+	})
+	return m.ChangeUsersSegmentsFunc(ctx, changes, atomic)
+}
+func (m *storageMock) CreateJob(ctx context.Context, job Job) (int64, error) {
+	m.CreateJobCalls = append(m.CreateJobCalls, struct {
+		ctx context.Context
+		job Job
+	}{
+		ctx: ctx,
+		job: job,
+	})
+	return m.CreateJobFunc(ctx, job)
+}
+func (m *storageMock) GetJob(ctx context.Context, id int64) (Job, error) {
+	m.GetJobCalls = append(m.GetJobCalls, struct {
+		ctx context.Context
+		id  int64
+	}{
+		ctx: ctx,
+		id:  id,
+	})
+	return m.GetJobFunc(ctx, id)
+}
+func (m *storageMock) GetJobs(ctx context.Context, kind JobKind, limit int) ([]Job, error) {
+	m.GetJobsCalls = append(m.GetJobsCalls, struct {
+		ctx   context.Context
+		kind  JobKind
+		limit int
+	}{
+		ctx:   ctx,
+		kind:  kind,
+		limit: limit,
+	})
+	return m.GetJobsFunc(ctx, kind, limit)
+}
+func (m *storageMock) ClaimJob(ctx context.Context, id int64, lease time.Duration) (*Job, error) {
+	m.ClaimJobCalls = append(m.ClaimJobCalls, struct {
+		ctx   context.Context
+		id    int64
+		lease time.Duration
+	}{
+		ctx:   ctx,
+		id:    id,
+		lease: lease,
+	})
+	return m.ClaimJobFunc(ctx, id, lease)
+}
+func (m *storageMock) SaveJob(ctx context.Context, job Job, lease time.Duration) error {
+	m.SaveJobCalls = append(m.SaveJobCalls, struct {
+		ctx   context.Context
+		job   Job
+		lease time.Duration
+	}{
+		ctx:   ctx,
+		job:   job,
+		lease: lease,
+	})
+	return m.SaveJobFunc(ctx, job, lease)
+}
+func (m *storageMock) GetChangesBetween(ctx context.Context, from, to time.Time, after int64, limit int) ([]Change, error) {
+	m.GetChangesBetweenCalls = append(m.GetChangesBetweenCalls, struct {
+		ctx   context.Context
+		from  time.Time
+		to    time.Time
+		after int64
+		limit int
+	}{
+		ctx:   ctx,
+		from:  from,
+		to:    to,
+		after: after,
+		limit: limit,
+	})
+	return m.GetChangesBetweenFunc(ctx, from, to, after, limit)
+}
+func (m *storageMock) GetUserSegmentsAsOf(ctx context.Context, user int, at time.Time) ([]string, error) {
+	m.GetUserSegmentsAsOfCalls = append(m.GetUserSegmentsAsOfCalls, struct {
+		ctx  context.Context
+		user int
+		at   time.Time
+	}{
+		ctx:  ctx,
+		user: user,
+		at:   at,
+	})
+	return m.GetUserSegmentsAsOfFunc(ctx, user, at)
+}
+func (m *storageMock) GetUserChanges(ctx context.Context, user int, from, to time.Time) ([]Change, error) {
+	m.GetUserChangesCalls = append(m.GetUserChangesCalls, struct {
+		ctx  context.Context
+		user int
+		from time.Time
+		to   time.Time
+	}{
+		ctx:  ctx,
+		user: user,
+		from: from,
+		to:   to,
+	})
+	return m.GetUserChangesFunc(ctx, user, from, to)
+}
+func (m *storageMock) CreateOperation(ctx context.Context, user int) (int64, error) {
+	m.CreateOperationCalls = append(m.CreateOperationCalls, struct {
+		ctx  context.Context
+		user int
+	}{
+		ctx:  ctx,
+		user: user,
+	})
+	return m.CreateOperationFunc(ctx, user)
+}
+func (m *storageMock) GetOperation(ctx context.Context, id int64) (Operation, error) {
+	m.GetOperationCalls = append(m.GetOperationCalls, struct {
+		ctx context.Context
+		id  int64
+	}{
+		ctx: ctx,
+		id:  id,
+	})
+	return m.GetOperationFunc(ctx, id)
+}
+func (m *storageMock) UndoOperation(ctx context.Context, op Operation) (int64, error) {
+	m.UndoOperationCalls = append(m.UndoOperationCalls, struct {
+		ctx context.Context
+		op  Operation
+	}{
+		ctx: ctx,
+		op:  op,
+	})
+	return m.UndoOperationFunc(ctx, op)
+}
+func (m *storageMock) DryRun(ctx context.Context, f func(ctx context.Context) error) (DryRunResult, error) {
+	m.DryRunCalls = append(m.DryRunCalls, struct {
+		ctx context.Context
+		f   func(ctx context.Context) error
+	}{
+		ctx: ctx,
+		f:   f,
+	})
+	return m.DryRunFunc(ctx, f)
+}
+func (m *storageMock) CloneSegment(ctx context.Context, source, name string, opts CloneOptions) (int, error) {
+	m.CloneSegmentCalls = append(m.CloneSegmentCalls, struct {
+		ctx    context.Context
+		source string
+		name   string
+		opts   CloneOptions
+	}{
+		ctx:    ctx,
+		source: source,
+		name:   name,
+		opts:   opts,
+	})
+	return m.CloneSegmentFunc(ctx, source, name, opts)
+}
+func (m *storageMock) SetJobUsers(ctx context.Context, job int64, users []int) error {
+	m.SetJobUsersCalls = append(m.SetJobUsersCalls, struct {
+		ctx   context.Context
+		job   int64
+		users []int
+	}{
+		ctx:   ctx,
+		job:   job,
+		users: users,
+	})
+	return m.SetJobUsersFunc(ctx, job, users)
+}
+func (m *storageMock) GetJobUsers(ctx context.Context, job int64, offset, limit int) ([]int, error) {
+	m.GetJobUsersCalls = append(m.GetJobUsersCalls, struct {
+		ctx    context.Context
+		job    int64
+		offset int
+		limit  int
+	}{
+		ctx:    ctx,
+		job:    job,
+		offset: offset,
+		limit:  limit,
+	})
+	return m.GetJobUsersFunc(ctx, job, offset, limit)
+}
+func (m *storageMock) DeleteOperation(ctx context.Context, id int64) error {
+	m.DeleteOperationCalls = append(m.DeleteOperationCalls, struct {
+		ctx context.Context
+		id  int64
+	}{
+		ctx: ctx,
+		id:  id,
+	})
+	return m.DeleteOperationFunc(ctx, id)
+}
+func (m *storageMock) GetUsersSegments(ctx context.Context, users []int) (map[int][]Segment, error) {
+	m.GetUsersSegmentsCalls = append(m.GetUsersSegmentsCalls, struct {
+		ctx   context.Context
+		users []int
+	}{
+		ctx:   ctx,
+		users: users,
+	})
+	return m.GetUsersSegmentsFunc(ctx, users)
+}
@@ -0,0 +1,34 @@
+package domain
+
+import (
+	"context"
+	"errors"
+)
+
+// DefaultTenant owns every request that doesn't name a tenant.
+const DefaultTenant = "default"
+
+var ErrInvalidTenant = errors.New("tenant name must be 1 to 200 characters long")
+
+type tenantKey struct{}
+
+// WithTenant scopes everything done with the returned context to the tenant.
+// Segment names and memberships of different tenants never mix.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set by WithTenant or DefaultTenant.
+func TenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+func ValidateTenant(tenant string) error {
+	if tenant == "" || len(tenant) > 200 {
+		return ErrInvalidTenant
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package domain
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTenantFromContext(t *testing.T) {
+	if got := TenantFromContext(context.Background()); got != DefaultTenant {
+		t.Errorf("Expected context without tenant to belong to %q, but got %q", DefaultTenant, got)
+	}
+
+	if got := TenantFromContext(WithTenant(context.Background(), "team_a")); got != "team_a" {
+		t.Errorf("Expected context to belong to %q, but got %q", "team_a", got)
+	}
+}
@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var (
+	ErrOperationNotFound = errors.New("can't find the operation")
+	ErrOperationUndone   = errors.New("operation is already undone")
+	ErrUndoConflict      = errors.New("segments of the operation were changed after it")
+)
+
+// Operation is a change of a user's segments made by ChangeUserSegments.
+// Added and Removed are the memberships it actually changed, including the
+// ones removed by cascade, as recorded in the change feed.
+type Operation struct {
+	ID        int64
+	User      int
+	Actor     string
+	Added     []string
+	Removed   []string
+	CreatedAt time.Time
+	// UndoneBy is the operation that reverted this one, if any.
+	UndoneBy *int64
+}
+
+type operationKey struct{}
+
+// WithOperation makes changes of memberships done with the returned context
+// recorded as a part of the operation.
+func WithOperation(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, operationKey{}, id)
+}
+
+// OperationFromContext returns the operation set by WithOperation or zero
+// when the changes aren't a part of one.
+func OperationFromContext(ctx context.Context) int64 {
+	id, _ := ctx.Value(operationKey{}).(int64)
+	return id
+}
+
+func (ss *SegmentService) GetOperation(ctx context.Context, id int64) (Operation, error) {
+	op, err := ss.storage.GetOperation(ctx, id)
+	if err != nil {
+		return Operation{}, fmt.Errorf("getting operation: %w", err)
+	}
+	return op, nil
+}
+
+// UndoOperation reverts the memberships changed by the operation with a new
+// operation, which is returned and can be undone in turn. Nothing is
+// changed and ErrUndoConflict is returned if any of the memberships was
+// changed after the operation or can't be restored, for example when the
+// segment has been deleted or the user would be left in a segment without
+// its prerequisite. Operations of protected segments can't be
+// undone, as that would bypass approval.
+func (ss *SegmentService) UndoOperation(ctx context.Context, id int64) (Operation, error) {
+	op, err := ss.GetOperation(ctx, id)
+	if err != nil {
+		return Operation{}, err
+	}
+	if op.UndoneBy != nil {
+		return Operation{}, ErrOperationUndone
+	}
+
+	protected, err := ss.protectedAmong(ctx, append(slices.Clone(op.Added), op.Removed...)...)
+	if err != nil {
+		return Operation{}, err
+	}
+	if len(protected) > 0 {
+		return Operation{}, fmt.Errorf("%w: %s", ErrSegmentProtected, protected[0])
+	}
+
+	undo, err := ss.storage.UndoOperation(ctx, op)
+	if err != nil {
+		return Operation{}, fmt.Errorf("undoing operation: %w", err)
+	}
+	return ss.GetOperation(ctx, undo)
+}
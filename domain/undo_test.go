@@ -0,0 +1,69 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSegmentService_UndoOperation(t *testing.T) {
+	undone := int64(2)
+	tests := []struct {
+		name      string
+		operation Operation
+		protected []string
+		wantErr   error
+	}{
+		{
+			name:      "given operation already undone, expect error",
+			operation: Operation{ID: 1, User: 1000, Added: []string{"A"}, UndoneBy: &undone},
+			wantErr:   ErrOperationUndone,
+		},
+		{
+			name:      "given operation of a protected segment, expect error",
+			operation: Operation{ID: 1, User: 1000, Added: []string{"A"}, Removed: []string{"PROTECTED"}},
+			protected: []string{"PROTECTED"},
+			wantErr:   ErrSegmentProtected,
+		},
+		{
+			name:      "given operation, expect it reverted by a new one",
+			operation: Operation{ID: 1, User: 1000, Added: []string{"A"}, Removed: []string{"B"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &storageMock{
+				GetOperationFunc: func(ctx context.Context, id int64) (Operation, error) {
+					if id == tt.operation.ID {
+						return tt.operation, nil
+					}
+					return Operation{ID: id, User: 1000, Added: tt.operation.Removed, Removed: tt.operation.Added}, nil
+				},
+				GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+					return tt.protected, nil
+				},
+				UndoOperationFunc: func(ctx context.Context, op Operation) (int64, error) {
+					return 3, nil
+				},
+			}
+			ss := NewSegmentService(storage)
+
+			undo, err := ss.UndoOperation(context.Background(), tt.operation.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SegmentService.UndoOperation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(storage.UndoOperationCalls) != 0 {
+					t.Errorf("Expected no calls to storage.UndoOperation, but got %d", len(storage.UndoOperationCalls))
+				}
+				return
+			}
+			if len(storage.UndoOperationCalls) != 1 || storage.UndoOperationCalls[0].op.ID != tt.operation.ID {
+				t.Errorf("Expected operation %d to be undone, but got %+v", tt.operation.ID, storage.UndoOperationCalls)
+			}
+			if undo.ID != 3 {
+				t.Errorf("Expected the undoing operation 3, but got %+v", undo)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package domain
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxUploadRows is the most user IDs an upload can have.
+	MaxUploadRows = 1000000
+	// syncUploadRows is the most user IDs applied in the request that
+	// uploads them, larger uploads are applied by a worker.
+	syncUploadRows = 1000
+	// uploadChunkSize is the number of users changed at once, the job is
+	// saved after every chunk.
+	uploadChunkSize = 1000
+	// maxReportedRows limits the invalid rows and failed users reported.
+	maxReportedRows = 100
+)
+
+var (
+	ErrInvalidUploadMode = errors.New("mode must be either add or replace")
+	ErrInvalidCSV        = errors.New("csv is malformed")
+	ErrInvalidRows       = errors.New("some rows don't have a valid user_id")
+	ErrTooManyRows       = errors.New("at most 1000000 user IDs can be uploaded")
+)
+
+// UploadMode is what UploadSegmentMembers does with the members of the
+// segment that aren't in the upload.
+type UploadMode string
+
+const (
+	// UploadAdd keeps them.
+	UploadAdd UploadMode = "add"
+	// UploadReplace removes them.
+	UploadReplace UploadMode = "replace"
+)
+
+// RowError is a row of an upload that doesn't have a valid user ID.
+type RowError struct {
+	Line   int
+	Value  string
+	Reason string
+}
+
+// SegmentUploadResult is the Result of a JobSegmentUpload job.
+type SegmentUploadResult struct {
+	Segment string     `json:"segment"`
+	Mode    UploadMode `json:"mode"`
+	// Users is the number of distinct user IDs uploaded.
+	Users   int `json:"users"`
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	// Unchanged counts users who were already members, or were already
+	// removed, when the job got to them.
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+	// Failures has up to 100 of the failed users.
+	Failures []SegmentUploadFailure `json:"failures,omitempty"`
+}
+
+type SegmentUploadFailure struct {
+	User   int      `json:"user_id"`
+	Errors []string `json:"errors"`
+}
+
+type segmentUploadInput struct {
+	Segment string     `json:"segment"`
+	Mode    UploadMode `json:"mode"`
+	Users   []int      `json:"users"`
+}
+
+// segmentUploadState is saved after every chunk, so it only counts the
+// progress. The members to remove are found before anything is changed and
+// are stored once as the users of the job.
+type segmentUploadState struct {
+	Removals      int  `json:"removals"`
+	RemovalsFound bool `json:"removals_found"`
+	RemovalsDone  int  `json:"removals_done"`
+	AdditionsDone int  `json:"additions_done"`
+}
+
+// ReadUserIDs reads user IDs from CSV, one per row. If the first row has a
+// user_id column, it's the header and the IDs are taken from that column,
+// otherwise from the first one. Repeated IDs and blank rows are skipped.
+// Rows without a valid ID are returned as RowError, up to 100 of them.
+func ReadUserIDs(r io.Reader) ([]int, []RowError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	var users []int
+	var invalid []RowError
+	seen := map[int]bool{}
+	column := 0
+	first := true
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidCSV, err)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading csv: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		if first {
+			first = false
+			// Spreadsheets often start the file with a byte order mark.
+			record[0] = strings.TrimPrefix(record[0], "\ufeff")
+			if i := slices.IndexFunc(record, func(field string) bool {
+				return strings.EqualFold(strings.TrimSpace(field), "user_id")
+			}); i >= 0 {
+				column = i
+				continue
+			}
+		}
+
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		var value string
+		if column < len(record) {
+			value = strings.TrimSpace(record[column])
+		}
+		user, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			if len(invalid) < maxReportedRows {
+				invalid = append(invalid, RowError{Line: line, Value: value, Reason: "user_id must be an integer"})
+			}
+			continue
+		}
+		if seen[int(user)] {
+			continue
+		}
+		seen[int(user)] = true
+		users = append(users, int(user))
+		if len(users) > MaxUploadRows {
+			return nil, nil, ErrTooManyRows
+		}
+	}
+
+	return users, invalid, nil
+}
+
+// UploadSegmentMembers adds the users listed in CSV to the segment, see
+// ReadUserIDs, and in UploadReplace mode removes the other members. Nothing
+// is changed if any row is invalid, the rows are returned together with
+// ErrInvalidRows. The change is done by a JobSegmentUpload job, which is
+// already done when UploadSegmentMembers returns unless the upload is
+// large. The users are changed as by ChangeUsersSegments, in chunks, so
+// prerequisites and the members limit are checked for every user. Uploads
+// to protected segments fail with ErrSegmentProtected, as they can't be
+// approved.
+func (ss *SegmentService) UploadSegmentMembers(ctx context.Context, segment string, mode UploadMode, r io.Reader) (Job, []RowError, error) {
+	if mode != UploadAdd && mode != UploadReplace {
+		return Job{}, nil, ErrInvalidUploadMode
+	}
+
+	details, err := ss.storage.GetSegment(ctx, segment)
+	if err != nil {
+		return Job{}, nil, fmt.Errorf("getting segment: %w", err)
+	}
+	if details.Protected {
+		return Job{}, nil, fmt.Errorf("%w: %s", ErrSegmentProtected, segment)
+	}
+
+	users, invalid, err := ReadUserIDs(r)
+	if err != nil {
+		return Job{}, nil, err
+	}
+	if len(invalid) > 0 {
+		return Job{}, invalid, ErrInvalidRows
+	}
+
+	input := segmentUploadInput{Segment: segment, Mode: mode, Users: users}
+	result := SegmentUploadResult{Segment: segment, Mode: mode, Users: len(users)}
+	job, err := ss.createJob(ctx, JobSegmentUpload, input, result, len(users) <= syncUploadRows)
+	return job, nil, err
+}
+
+func (ss *SegmentService) runSegmentUpload(ctx context.Context, job *Job, save func() error) error {
+	var input segmentUploadInput
+	if err := json.Unmarshal(job.Input, &input); err != nil {
+		return fmt.Errorf("unmarshaling input: %w", err)
+	}
+	var result SegmentUploadResult
+	if err := json.Unmarshal(job.Result, &result); err != nil {
+		return fmt.Errorf("unmarshaling result: %w", err)
+	}
+	var state segmentUploadState
+	if len(job.State) > 0 {
+		if err := json.Unmarshal(job.State, &state); err != nil {
+			return fmt.Errorf("unmarshaling state: %w", err)
+		}
+	}
+
+	saveState := func() error {
+		var err error
+		if job.State, err = json.Marshal(state); err != nil {
+			return fmt.Errorf("marshaling state: %w", err)
+		}
+		if job.Result, err = json.Marshal(result); err != nil {
+			return fmt.Errorf("marshaling result: %w", err)
+		}
+		return save()
+	}
+
+	if input.Mode == UploadReplace && !state.RemovalsFound {
+		uploaded := make(map[int]bool, len(input.Users))
+		for _, user := range input.Users {
+			uploaded[user] = true
+		}
+		var removals []int
+		after := math.MinInt32
+		for {
+			members, err := ss.storage.GetSegmentMembers(ctx, input.Segment, after, maxMembersPageSize)
+			if err != nil {
+				return fmt.Errorf("getting segment members: %w", err)
+			}
+			for _, member := range members {
+				if !uploaded[member] {
+					removals = append(removals, member)
+				}
+			}
+			if len(members) < maxMembersPageSize {
+				break
+			}
+			after = members[len(members)-1]
+		}
+		if err := ss.storage.SetJobUsers(ctx, job.ID, removals); err != nil {
+			return fmt.Errorf("storing removals: %w", err)
+		}
+		state.Removals = len(removals)
+		state.RemovalsFound = true
+		if err := saveState(); err != nil {
+			return err
+		}
+	}
+
+	// Members are removed first, so that they make room for the new ones
+	// in a limited segment.
+	apply := func(total int, users func(offset int) ([]int, error), done *int, remove bool) error {
+		for *done < total {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			chunk, err := users(*done)
+			if err != nil {
+				return err
+			}
+			if len(chunk) == 0 {
+				return fmt.Errorf("users of the job end at %d of %d", *done, total)
+			}
+			changes := make([]UserSegmentsChange, 0, len(chunk))
+			for _, user := range chunk {
+				change := UserSegmentsChange{User: user}
+				if remove {
+					change.SegmentsToDelete = []string{input.Segment}
+				} else {
+					change.SegmentsToAdd = []string{input.Segment}
+				}
+				changes = append(changes, change)
+			}
+
+			errs, err := ss.ChangeUsersSegments(ctx, BulkBestEffort, changes)
+			if err != nil {
+				return err
+			}
+			for i, err := range errs {
+				switch {
+				case err == nil && remove:
+					result.Removed++
+				case err == nil:
+					result.Added++
+				case errors.Is(err, ErrUserHaveNotThisSegment) || errors.Is(err, ErrUserIsAlreadyHasThisSegment):
+					result.Unchanged++
+				default:
+					result.Failed++
+					if len(result.Failures) < maxReportedRows {
+						result.Failures = append(result.Failures, SegmentUploadFailure{User: chunk[i], Errors: ErrorMessages(err)})
+					}
+				}
+			}
+
+			*done += len(chunk)
+			if err := saveState(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	removals := func(offset int) ([]int, error) {
+		users, err := ss.storage.GetJobUsers(ctx, job.ID, offset, uploadChunkSize)
+		if err != nil {
+			return nil, fmt.Errorf("getting removals: %w", err)
+		}
+		return users, nil
+	}
+	additions := func(offset int) ([]int, error) {
+		return input.Users[offset:min(offset+uploadChunkSize, len(input.Users))], nil
+	}
+
+	if err := apply(state.Removals, removals, &state.RemovalsDone, true); err != nil {
+		return err
+	}
+	return apply(len(input.Users), additions, &state.AdditionsDone, false)
+}
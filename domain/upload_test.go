@@ -0,0 +1,170 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadUserIDs(t *testing.T) {
+	tests := []struct {
+		name        string
+		csv         string
+		wantUsers   []int
+		wantInvalid []RowError
+		wantErr     error
+	}{
+		{
+			name:      "IDs without header",
+			csv:       "1000\n1001\n\n1000\n",
+			wantUsers: []int{1000, 1001},
+		},
+		{
+			name:      "IDs in the user_id column",
+			csv:       "\ufeffname,user_id\nAlice,1000\nBob, 1001\n",
+			wantUsers: []int{1000, 1001},
+		},
+		{
+			name:        "invalid rows",
+			csv:         "user_id\n1000\nabc\n99999999999\n",
+			wantUsers:   []int{1000},
+			wantInvalid: []RowError{{3, "abc", "user_id must be an integer"}, {4, "99999999999", "user_id must be an integer"}},
+		},
+		{
+			name:    "malformed csv",
+			csv:     "1000\n\"1001\n",
+			wantErr: ErrInvalidCSV,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, invalid, err := ReadUserIDs(strings.NewReader(tt.csv))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadUserIDs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(users, tt.wantUsers) {
+				t.Errorf("Expected users %v, but got %v", tt.wantUsers, users)
+			}
+			if !slices.Equal(invalid, tt.wantInvalid) {
+				t.Errorf("Expected invalid rows %v, but got %v", tt.wantInvalid, invalid)
+			}
+		})
+	}
+}
+
+func TestSegmentService_UploadSegmentMembers(t *testing.T) {
+	t.Run("given invalid rows, expect nothing to change", func(t *testing.T) {
+		storage := &storageMock{
+			GetSegmentFunc: func(ctx context.Context, segment string) (SegmentDetails, error) {
+				return SegmentDetails{Segment: Segment{Name: segment}}, nil
+			},
+		}
+
+		ss := NewSegmentService(storage)
+		_, rows, err := ss.UploadSegmentMembers(context.Background(), "A", UploadAdd, strings.NewReader("1000\nabc\n"))
+		if !errors.Is(err, ErrInvalidRows) {
+			t.Errorf("Expected error %v, but got %v", ErrInvalidRows, err)
+		}
+		if len(rows) != 1 || rows[0].Line != 2 {
+			t.Errorf("Expected line 2 to be invalid, but got %+v", rows)
+		}
+		if len(storage.CreateJobCalls) != 0 {
+			t.Errorf("Expected no job, but got %d", len(storage.CreateJobCalls))
+		}
+	})
+
+	t.Run("given replace, expect other members to be removed", func(t *testing.T) {
+		var created, saved Job
+		var changes []UserSegmentsChange
+		var removals []int
+		storage := &storageMock{
+			GetSegmentFunc: func(ctx context.Context, segment string) (SegmentDetails, error) {
+				return SegmentDetails{Segment: Segment{Name: segment}}, nil
+			},
+			CreateJobFunc: func(ctx context.Context, job Job) (int64, error) {
+				created = job
+				return 1, nil
+			},
+			ClaimJobFunc: func(ctx context.Context, id int64, lease time.Duration) (*Job, error) {
+				job := created
+				job.ID, job.Status, job.Attempt = id, JobRunning, 1
+				return &job, nil
+			},
+			SaveJobFunc: func(ctx context.Context, job Job, lease time.Duration) error {
+				saved = job
+				return nil
+			},
+			GetSegmentMembersFunc: func(ctx context.Context, segment string, after, limit int) ([]int, error) {
+				return []int{1000, 1002}, nil
+			},
+			SetJobUsersFunc: func(ctx context.Context, job int64, users []int) error {
+				removals = users
+				return nil
+			},
+			GetJobUsersFunc: func(ctx context.Context, job int64, offset, limit int) ([]int, error) {
+				return removals[offset:min(offset+limit, len(removals))], nil
+			},
+			GetPrerequisitesFunc: func(ctx context.Context) ([]Prerequisite, error) {
+				return nil, nil
+			},
+			GetProtectedSegmentsFunc: func(ctx context.Context) ([]string, error) {
+				return nil, nil
+			},
+			ChangeUsersSegmentsFunc: func(ctx context.Context, chunk []UserSegmentsChange, atomic bool) ([]error, error) {
+				changes = append(changes, chunk...)
+				errs := make([]error, len(chunk))
+				for i, change := range chunk {
+					if change.User == 1000 {
+						errs[i] = ErrUserIsAlreadyHasThisSegment
+					}
+					if change.User == 1003 {
+						errs[i] = ErrSegmentIsFull
+					}
+				}
+				return errs, nil
+			},
+		}
+
+		ss := NewSegmentService(storage)
+		job, _, err := ss.UploadSegmentMembers(context.Background(), "A", UploadReplace, strings.NewReader("1000\n1001\n1003\n"))
+		if err != nil {
+			t.Fatalf("SegmentService.UploadSegmentMembers() error = %v", err)
+		}
+		if job.Status != JobDone || saved.Status != JobDone {
+			t.Errorf("Expected job to be done, but got %s", job.Status)
+		}
+
+		want := []UserSegmentsChange{
+			{User: 1002, SegmentsToDelete: []string{"A"}},
+			{User: 1000, SegmentsToAdd: []string{"A"}},
+			{User: 1001, SegmentsToAdd: []string{"A"}},
+			{User: 1003, SegmentsToAdd: []string{"A"}},
+		}
+		if !slices.EqualFunc(changes, want, func(a, b UserSegmentsChange) bool {
+			return a.User == b.User && slices.Equal(a.SegmentsToAdd, b.SegmentsToAdd) && slices.Equal(a.SegmentsToDelete, b.SegmentsToDelete)
+		}) {
+			t.Errorf("Expected changes %+v, but got %+v", want, changes)
+		}
+
+		var result SegmentUploadResult
+		if err := json.Unmarshal(job.Result, &result); err != nil {
+			t.Fatalf("Unable to unmarshal result: %v", err)
+		}
+		if result.Users != 3 || result.Added != 1 || result.Removed != 1 || result.Unchanged != 1 || result.Failed != 1 {
+			t.Errorf("Expected 1 user added, removed, unchanged and failed, but got %+v", result)
+		}
+		if len(result.Failures) != 1 || result.Failures[0].User != 1003 {
+			t.Errorf("Expected user 1003 to fail, but got %+v", result.Failures)
+		}
+		if len(storage.SetJobUsersCalls) != 1 {
+			t.Errorf("Expected removals to be stored once, but got %d", len(storage.SetJobUsersCalls))
+		}
+		if want := `{"removals":1,"removals_found":true,"removals_done":1,"additions_done":3}`; string(saved.State) != want {
+			t.Errorf("Expected state %s, but got %s", want, saved.State)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// UserVersion counts changes that affect the segments of a user: changes of
+// the user's memberships in the environment and changes of segment
+// settings of the tenant.
+type UserVersion struct {
+	Memberships int64
+	Segments    int64
+}
+
+// userSegmentsETag identifies a result of GetUserSegments. Besides the
+// versions it has the moment a schedule changes the result, so that the
+// tag changes then as well. The user is hashed in too, as versions of
+// different users are counted apart and often equal.
+func userSegmentsETag(ctx context.Context, user int, version UserVersion, validUntil time.Time) string {
+	tenant, environment := TenantFromContext(ctx), EnvironmentFromContext(ctx)
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", tenant, environment, user)
+
+	var until int64
+	if !validUntil.IsZero() {
+		until = validUntil.UnixNano()
+	}
+	return fmt.Sprintf(`"%08x-%d-%d-%d"`, h.Sum32(), version.Memberships, version.Segments, until)
+}
+
+// GetUserSegmentsWithETag returns the same segments as GetUserSegments and
+// a strong ETag of them.
+func (ss *SegmentService) GetUserSegmentsWithETag(ctx context.Context, user int) ([]string, string, error) {
+	// The version is read first, so that a change made meanwhile makes the
+	// tag stale rather than the segments.
+	version, err := ss.storage.GetUserVersion(ctx, user)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting user version: %w", err)
+	}
+
+	active, next, err := ss.activeUserSegments(ctx, user, ss.now())
+	if err != nil {
+		return nil, "", err
+	}
+	return active, userSegmentsETag(ctx, user, version, next), nil
+}
+
+// MatchUserSegmentsETag returns the first of the ETags returned by
+// GetUserSegmentsWithETag that is still current, without reading the
+// segments, or an empty string if none is.
+func (ss *SegmentService) MatchUserSegmentsETag(ctx context.Context, user int, etags []string) (string, error) {
+	version, err := ss.storage.GetUserVersion(ctx, user)
+	if err != nil {
+		return "", fmt.Errorf("getting user version: %w", err)
+	}
+
+	now := ss.now()
+	for _, etag := range etags {
+		// Segments of any user always exist.
+		if etag == "*" {
+			return etag, nil
+		}
+
+		var hash uint32
+		var memberships, segments, until int64
+		if _, err := fmt.Sscanf(etag, `"%08x-%d-%d-%d"`, &hash, &memberships, &segments, &until); err != nil {
+			continue
+		}
+		if until != 0 && !now.Before(time.Unix(0, until)) {
+			continue
+		}
+		validUntil := time.Time{}
+		if until != 0 {
+			validUntil = time.Unix(0, until)
+		}
+		if userSegmentsETag(ctx, user, version, validUntil) == etag {
+			return etag, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSegmentService_MatchUserSegmentsETag(t *testing.T) {
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	until := now.Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		user      int
+		version   UserVersion
+		now       time.Time
+		wantMatch bool
+	}{
+		{
+			name:      "nothing changed",
+			ctx:       context.Background(),
+			version:   UserVersion{Memberships: 3, Segments: 7},
+			now:       now,
+			wantMatch: true,
+		},
+		{
+			name:    "memberships changed",
+			ctx:     context.Background(),
+			version: UserVersion{Memberships: 4, Segments: 7},
+			now:     now,
+		},
+		{
+			name:    "segment settings changed",
+			ctx:     context.Background(),
+			version: UserVersion{Memberships: 3, Segments: 8},
+			now:     now,
+		},
+		{
+			name:    "schedule ended a segment",
+			ctx:     context.Background(),
+			version: UserVersion{Memberships: 3, Segments: 7},
+			now:     until,
+		},
+		{
+			name:    "another user at the same version",
+			ctx:     context.Background(),
+			user:    1001,
+			version: UserVersion{Memberships: 3, Segments: 7},
+			now:     now,
+		},
+		{
+			name:    "another environment",
+			ctx:     WithEnvironment(context.Background(), "staging"),
+			version: UserVersion{Memberships: 3, Segments: 7},
+			now:     now,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := now
+			version := UserVersion{Memberships: 3, Segments: 7}
+			storage := &storageMock{
+				GetUserVersionFunc: func(ctx context.Context, user int) (UserVersion, error) {
+					return version, nil
+				},
+				GetUserSegmentsFunc: func(ctx context.Context, user int) ([]Segment, error) {
+					return []Segment{{Name: "A", ActiveUntil: &until}}, nil
+				},
+				GetRolloutSegmentsFunc: func(ctx context.Context) ([]RolloutSegment, error) {
+					return nil, nil
+				},
+			}
+
+			ss := NewSegmentService(storage, WithClock(func() time.Time { return clock }))
+			_, etag, err := ss.GetUserSegmentsWithETag(context.Background(), 1000)
+			if err != nil {
+				t.Fatalf("SegmentService.GetUserSegmentsWithETag() error = %v", err)
+			}
+
+			user := 1000
+			if tt.user != 0 {
+				user = tt.user
+			}
+			clock, version = tt.now, tt.version
+			match, err := ss.MatchUserSegmentsETag(tt.ctx, user, []string{`"other"`, etag})
+			if err != nil {
+				t.Fatalf("SegmentService.MatchUserSegmentsETag() error = %v", err)
+			}
+			if (match == etag) != tt.wantMatch {
+				t.Errorf("Expected ETag %s to match = %v, but got %v", etag, tt.wantMatch, match)
+			}
+		})
+	}
+}
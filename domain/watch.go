@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// watchWait is the longest WatchUserSegments waits for changes before it
+// reports that nothing changed.
+const watchWait = 30 * time.Second
+
+// UserSegmentsEvent is reported by WatchUserSegments. The first event has
+// all active segments of the user in Segments, the following ones have the
+// segments the user got into in Added and the ones the user left in
+// Removed. Events with neither mean nothing changed for a while.
+type UserSegmentsEvent struct {
+	Segments []string
+	Added    []string
+	Removed  []string
+}
+
+// WatchUserSegments calls emit with the segments of the user that are active
+// right now and then every time they change, whether it's by a change of the
+// user's memberships, a schedule, a percentage or a deletion of a segment.
+// It returns when ctx is done or emit fails.
+func (ss *SegmentService) WatchUserSegments(ctx context.Context, user int, emit func(UserSegmentsEvent) error) error {
+	// The cursor is taken first, so that changes made while the segments are
+	// read show up as changes.
+	cursor, err := ss.GetChangesCursor(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Segments are read past the cache: an entry it hasn't dropped yet would
+	// hide a change the feed has already reported, and it wouldn't be
+	// reported again.
+	fresh := WithCacheBypass(ctx)
+
+	current, next, err := ss.activeUserSegments(fresh, user, ss.now())
+	if err != nil {
+		return err
+	}
+	if err := emit(UserSegmentsEvent{Segments: current}); err != nil {
+		return err
+	}
+
+	for {
+		wait := watchWait
+		if !next.IsZero() {
+			wait = min(wait, max(next.Sub(ss.now()), 0))
+		}
+
+		changed := false
+		for {
+			var changes []Change
+			changes, cursor, err = ss.GetChanges(ctx, cursor, maxChangesPageSize, wait)
+			if err != nil {
+				return err
+			}
+			for _, c := range changes {
+				if c.User == nil || *c.User == user {
+					changed = true
+				}
+			}
+			if len(changes) < maxChangesPageSize {
+				break
+			}
+			wait = 0
+		}
+
+		now := ss.now()
+		if !changed && (next.IsZero() || now.Before(next)) {
+			if err := emit(UserSegmentsEvent{}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var active []string
+		active, next, err = ss.activeUserSegments(fresh, user, now)
+		if err != nil {
+			return fmt.Errorf("getting user segments: %w", err)
+		}
+		event := UserSegmentsEvent{
+			Added:   missingFrom(current, active),
+			Removed: missingFrom(active, current),
+		}
+		current = active
+		if err := emit(event); err != nil {
+			return err
+		}
+	}
+}
+
+// missingFrom returns the names of b that aren't in a.
+func missingFrom(a, b []string) []string {
+	var missing []string
+	for _, name := range b {
+		if !slices.Contains(a, name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
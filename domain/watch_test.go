@@ -0,0 +1,72 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSegmentService_WatchUserSegments(t *testing.T) {
+	start := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	until := start.Add(time.Hour)
+	calls := 0
+	clock := func() time.Time {
+		calls++
+		if calls == 1 {
+			return start
+		}
+		return until.Add(time.Hour)
+	}
+
+	user := 1000
+	storage := &storageMock{
+		GetChangesCursorFunc: func(ctx context.Context) (int64, error) {
+			return 10, nil
+		},
+		GetRolloutSegmentsFunc: func(ctx context.Context) ([]RolloutSegment, error) {
+			return nil, nil
+		},
+		GetChangesFunc: func(ctx context.Context, after int64, limit int) ([]Change, error) {
+			return []Change{{Seq: 11, Type: ChangeMemberAdded, Segment: "C", User: &user}}, nil
+		},
+	}
+	storage.GetUserSegmentsFunc = func(ctx context.Context, user int) ([]Segment, error) {
+		segments := []Segment{{Name: "A"}, {Name: "B", ActiveUntil: &until}}
+		if len(storage.GetUserSegmentsCalls) > 1 {
+			segments = append(segments, Segment{Name: "C"})
+		}
+		return segments, nil
+	}
+
+	stop := errors.New("stop")
+	var events []UserSegmentsEvent
+	ss := NewSegmentService(storage, WithClock(clock))
+	err := ss.WatchUserSegments(context.Background(), user, func(e UserSegmentsEvent) error {
+		events = append(events, e)
+		if len(events) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("SegmentService.WatchUserSegments() error = %v, want %v", err, stop)
+	}
+
+	want := []UserSegmentsEvent{
+		{Segments: []string{"A", "B"}},
+		{Added: []string{"C"}, Removed: []string{"B"}},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Expected events %+v, but got %+v", want, events)
+	}
+	if got := storage.GetChangesCalls[0].after; got != 10 {
+		t.Errorf("Expected changes to be read after cursor 10, but got %d", got)
+	}
+	for _, call := range storage.GetUserSegmentsCalls {
+		if !CacheBypassed(call.ctx) {
+			t.Errorf("Expected user segments to be read past the cache")
+		}
+	}
+}
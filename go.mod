@@ -2,7 +2,10 @@ module assignment
 
 go 1.21
 
-require github.com/jackc/pgx/v5 v5.4.3
+require (
+	github.com/jackc/pgx/v5 v5.4.3
+	github.com/ory/dockertest v3.3.5+incompatible
+)
 
 require (
 	github.com/Azure/go-ansiterm v0.0.0-20230124172434-306776ec8161 // indirect
@@ -18,7 +21,6 @@ require (
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.0.2 // indirect
 	github.com/opencontainers/runc v1.1.9 // indirect
-	github.com/ory/dockertest v3.3.5+incompatible // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	golang.org/x/crypto v0.12.0 // indirect
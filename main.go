@@ -4,13 +4,18 @@ import (
 	"assignment/api"
 	"assignment/domain"
 	"assignment/storage"
+	"assignment/web"
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -20,10 +25,50 @@ func serveHttp(exitCh <-chan os.Signal, log *slog.Logger, c api.Controller) {
 
 	mux.HandleFunc("/api/create_segment", c.CreateSegment)
 	mux.HandleFunc("/api/delete_segment", c.DeleteSegment)
+	mux.HandleFunc("/api/clone_segment", c.CloneSegment)
+	mux.HandleFunc("/api/set_segment_schedule", c.SetSegmentSchedule)
+	mux.HandleFunc("/api/set_segment_max_members", c.SetSegmentMaxMembers)
+	mux.HandleFunc("/api/set_segment_percentage", c.SetSegmentPercentage)
+	mux.HandleFunc("/api/promote_environment", c.PromoteEnvironment)
+	mux.HandleFunc("/api/set_segment_protected", c.SetSegmentProtected)
+	mux.HandleFunc("/api/get_change_requests", c.GetChangeRequests)
+	mux.HandleFunc("/api/approve_change_request", c.ApproveChangeRequest)
+	mux.HandleFunc("/api/reject_change_request", c.RejectChangeRequest)
+	mux.HandleFunc("/api/get_segment", c.GetSegment)
+	mux.HandleFunc("/api/get_segments", c.GetSegments)
+	mux.HandleFunc("/api/get_segment_members", c.GetSegmentMembers)
+	mux.HandleFunc("/api/add_segment_prerequisite", c.AddSegmentPrerequisite)
+	mux.HandleFunc("/api/delete_segment_prerequisite", c.DeleteSegmentPrerequisite)
+	mux.HandleFunc("/api/get_segments_overlap", c.GetSegmentsOverlap)
+	mux.HandleFunc("/api/get_segment_size_history", c.GetSegmentSizeHistory)
+	mux.HandleFunc("/api/export_state", c.ExportState)
+	mux.HandleFunc("/api/import_state", c.ImportState)
 	mux.HandleFunc("/api/change_user_segments", c.ChangeUserSegments)
+	mux.HandleFunc("/api/get_operation", c.GetOperation)
+	mux.HandleFunc("/api/undo_operation", c.UndoOperation)
+	mux.HandleFunc("/api/change_users_segments", c.ChangeUsersSegments)
+	mux.HandleFunc("/api/import_operations", c.ImportOperations)
+	mux.HandleFunc("/api/upload_segment_members", c.UploadSegmentMembers)
+	mux.HandleFunc("/api/get_job", c.GetJob)
+	mux.HandleFunc("/api/get_jobs", c.GetJobs)
+	mux.HandleFunc("/api/create_report", c.CreateReport)
+	mux.HandleFunc("/api/download_report", c.DownloadReport)
 	mux.HandleFunc("/api/get_user_segments", c.GetUserSegments)
+	mux.HandleFunc("/api/watch_user_segments", c.WatchUserSegments)
+	mux.HandleFunc("/api/get_user_memberships", c.GetUserMemberships)
+	mux.HandleFunc("/api/get_user_segments_diff", c.GetUserSegmentsDiff)
+	mux.HandleFunc("/api/get_changes", c.GetChanges)
+	mux.HandleFunc("/api/get_changes_cursor", c.GetChangesCursor)
 
-	srv := &http.Server{Addr: "0.0.0.0:80", Handler: mux}
+	// The admin UI is served without the API middlewares, so that the page
+	// loads before the user enters their API key. The debug variables need
+	// an API key as the API does.
+	root := http.NewServeMux()
+	root.Handle("/debug/vars", c.Tenant(expvar.Handler()))
+	root.Handle("/admin/", http.StripPrefix("/admin/", web.Handler(log)))
+	root.Handle("/", c.Tenant(c.Environment(c.Actor(c.CSRF(mux)))))
+
+	srv := &http.Server{Addr: "0.0.0.0:80", Handler: root}
 
 	go func() {
 		<-exitCh
@@ -39,6 +84,85 @@ func serveHttp(exitCh <-chan os.Signal, log *slog.Logger, c api.Controller) {
 	}
 }
 
+// snapshotSegmentSizes records segment sizes right away and then every
+// interval until ctx is done.
+func snapshotSegmentSizes(ctx context.Context, log *slog.Logger, ss *domain.SegmentService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := ss.SnapshotSegmentSizes(ctx); err != nil {
+			log.Error("failed to snapshot segment sizes", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runJobs runs background jobs one after another until ctx is done, looking
+// for new ones every interval when there are none.
+func runJobs(ctx context.Context, log *slog.Logger, ss *domain.SegmentService, interval time.Duration) {
+	for ctx.Err() == nil {
+		ran, err := ss.RunNextJob(ctx)
+		if err != nil {
+			log.Error("failed to run job", slog.String("error", err.Error()))
+		}
+		if ran && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+}
+
+// newBlobStore returns the store of reports: an S3-compatible bucket if
+// REPORTS_S3_ENDPOINT is set, the REPORTS_DIR directory otherwise.
+func newBlobStore() (domain.BlobStore, error) {
+	endpoint := os.Getenv("REPORTS_S3_ENDPOINT")
+	if endpoint == "" {
+		dir := os.Getenv("REPORTS_DIR")
+		if dir == "" {
+			dir = "reports"
+		}
+		return storage.NewFileBlobStore(dir), nil
+	}
+
+	region := os.Getenv("REPORTS_S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return storage.NewS3BlobStore(endpoint, region, os.Getenv("REPORTS_S3_BUCKET"),
+		os.Getenv("REPORTS_S3_ACCESS_KEY"), os.Getenv("REPORTS_S3_SECRET_KEY"))
+}
+
+// parseAPIKeys parses a comma-separated list of key=tenant pairs.
+func parseAPIKeys(s string) (map[string]string, error) {
+	keys := map[string]string{}
+	if s == "" {
+		return keys, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		key, tenant, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=tenant, got %q", pair)
+		}
+		if err := domain.ValidateTenant(tenant); err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		keys[key] = tenant
+	}
+
+	return keys, nil
+}
+
 func main() {
 	dbpool, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
 	if err != nil {
@@ -58,9 +182,55 @@ func main() {
 		os.Exit(1)
 	}
 
+	snapshotInterval := time.Hour
+	if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+		snapshotInterval, err = time.ParseDuration(v)
+		if err != nil || snapshotInterval <= 0 {
+			log.Error("invalid SNAPSHOT_INTERVAL", slog.String("value", v))
+			os.Exit(1)
+		}
+	}
+
+	cacheSize := storage.DefaultCacheSize
+	if v := os.Getenv("USER_SEGMENTS_CACHE_SIZE"); v != "" {
+		cacheSize, err = strconv.Atoi(v)
+		if err != nil || cacheSize < 0 {
+			log.Error("invalid USER_SEGMENTS_CACHE_SIZE", slog.String("value", v))
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var segmentStorage domain.SegmentStorage = sqlStore
+	if cacheSize > 0 {
+		cached := storage.NewCachedStorage(ctx, dbpool, sqlStore, cacheSize)
+		expvar.Publish("user_segments_cache", expvar.Func(func() any { return cached.Stats() }))
+		segmentStorage = cached
+	}
+
+	blobs, err := newBlobStore()
+	if err != nil {
+		log.Error("invalid reports storage", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	ss := domain.NewSegmentService(segmentStorage, domain.WithBlobStore(blobs))
+
+	go snapshotSegmentSizes(ctx, log, &ss, snapshotInterval)
+	go runJobs(ctx, log, &ss, time.Second)
+
+	apiKeys, err := parseAPIKeys(os.Getenv("API_KEYS"))
+	if err != nil {
+		log.Error("invalid API_KEYS", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
 	c := api.Controller{
-		SegmentService: domain.NewSegmentService(sqlStore),
+		SegmentService: ss,
 		Log:            log,
+		APIKeys:        apiKeys,
 	}
 
 	serveHttp(exitCh, log, c)
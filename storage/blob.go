@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"assignment/domain"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileBlobStore keeps blobs as files in a directory. Replicas have to share
+// the directory to download blobs put by each other.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) *FileBlobStore {
+	return &FileBlobStore{dir: dir}
+}
+
+func (fb *FileBlobStore) path(key string) string {
+	return filepath.Join(fb.dir, filepath.FromSlash(key))
+}
+
+// PutBlob writes the blob next to its place first and then renames it, so
+// that readers never see a part of it.
+func (fb *FileBlobStore) PutBlob(ctx context.Context, key string, r io.Reader, size int64) error {
+	path := fb.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating directory: %v", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return fmt.Errorf("creating file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("writing file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing file: %v", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("renaming file: %v", err)
+	}
+
+	return nil
+}
+
+func (fb *FileBlobStore) OpenBlob(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(fb.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, domain.ErrBlobNotFound
+		}
+		return nil, fmt.Errorf("opening file: %v", err)
+	}
+
+	return f, nil
+}
+
+// BlobURL returns "", files are downloaded through the service.
+func (fb *FileBlobStore) BlobURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"assignment/domain"
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultCacheSize is the number of users whose segments CachedStorage
+// keeps by default.
+const DefaultCacheSize = 10000
+
+// CacheStats counts how CachedStorage served GetUserSegments.
+type CacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Bypasses      int64 `json:"bypasses"`
+	Invalidations int64 `json:"invalidations"`
+	Evictions     int64 `json:"evictions"`
+	Size          int   `json:"size"`
+}
+
+type cacheKey struct {
+	tenant      string
+	environment string
+	user        int
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	version  domain.UserVersion
+	segments []domain.Segment
+}
+
+// CachedStorage is a domain.SegmentStorage that keeps the segments of the
+// most recently read users in memory. Every replica drops users from its
+// cache when their memberships change, as it's notified by Postgres, so
+// reads see writes made through any replica shortly after they commit.
+// Reads with a context made by domain.WithCacheBypass go to the storage.
+// Only the public get_user_segments read is meant to be served from the
+// cache: validations, watchers and snapshots bypass it, as they can't bear
+// a stale answer.
+//
+// Hits are served from memory alone. Every entry keeps the version of the
+// user it was read at, which GetUserVersion returns while the entry is
+// cached, so that an ETag made of them describes the cached segments even
+// if a notification comes late.
+type CachedStorage struct {
+	domain.SegmentStorage
+	size int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// recent has the most recently used entries in front.
+	recent *list.List
+	// epoch grows with every invalidation, so that a read that started
+	// before one doesn't cache what it read.
+	epoch uint64
+	// listening is false until notifications come in, the cache isn't
+	// used meanwhile.
+	listening bool
+
+	hits, misses, bypasses, invalidations, evictions atomic.Int64
+}
+
+// NewCachedStorage wraps storage with a cache of up to size users, which
+// listens for notifications through dbpool until ctx is done.
+func NewCachedStorage(ctx context.Context, dbpool *pgxpool.Pool, storage domain.SegmentStorage, size int) *CachedStorage {
+	cs := &CachedStorage{
+		SegmentStorage: storage,
+		size:           size,
+		entries:        map[cacheKey]*list.Element{},
+		recent:         list.New(),
+	}
+	go listen(ctx, dbpool, "user_segments", cs.startListening, cs.invalidate, cs.stopListening)
+	return cs
+}
+
+func (cs *CachedStorage) GetUserSegments(ctx context.Context, user int) ([]domain.Segment, error) {
+	if domain.CacheBypassed(ctx) {
+		cs.bypasses.Add(1)
+		return cs.SegmentStorage.GetUserSegments(ctx, user)
+	}
+
+	tenant, environment := scope(ctx)
+	key := cacheKey{tenant: tenant, environment: environment, user: user}
+
+	cs.mu.Lock()
+	if el, ok := cs.entries[key]; ok {
+		cs.recent.MoveToFront(el)
+		segments := el.Value.(*cacheEntry).segments
+		cs.mu.Unlock()
+		cs.hits.Add(1)
+		return segments, nil
+	}
+	epoch, listening := cs.epoch, cs.listening
+	cs.mu.Unlock()
+	cs.misses.Add(1)
+
+	if !listening {
+		return cs.SegmentStorage.GetUserSegments(ctx, user)
+	}
+
+	// The version is read before the segments, so that an entry is never
+	// newer than its version and a change made meanwhile only makes its
+	// ETag stale.
+	version, err := cs.SegmentStorage.GetUserVersion(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := cs.SegmentStorage.GetUserSegments(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.epoch == epoch && cs.listening {
+		cs.add(key, version, segments)
+	}
+	return segments, nil
+}
+
+// GetUserVersion returns the version the cached segments of the user were
+// read at, if they are cached.
+func (cs *CachedStorage) GetUserVersion(ctx context.Context, user int) (domain.UserVersion, error) {
+	if !domain.CacheBypassed(ctx) {
+		tenant, environment := scope(ctx)
+		cs.mu.Lock()
+		el, ok := cs.entries[cacheKey{tenant: tenant, environment: environment, user: user}]
+		var version domain.UserVersion
+		if ok {
+			version = el.Value.(*cacheEntry).version
+		}
+		cs.mu.Unlock()
+		if ok {
+			return version, nil
+		}
+	}
+	return cs.SegmentStorage.GetUserVersion(ctx, user)
+}
+
+// AddUserToSegment drops the user from the cache right away, as the other
+// writes do, so that the replica that made the change doesn't wait for the
+// notification to see it.
+func (cs *CachedStorage) AddUserToSegment(ctx context.Context, user int, segments []string) error {
+	defer cs.forget(ctx, user)
+	return cs.SegmentStorage.AddUserToSegment(ctx, user, segments)
+}
+
+func (cs *CachedStorage) DeleteUserFromSegment(ctx context.Context, user int, segments []string) error {
+	defer cs.forget(ctx, user)
+	return cs.SegmentStorage.DeleteUserFromSegment(ctx, user, segments)
+}
+
+func (cs *CachedStorage) ChangeUsersSegments(ctx context.Context, changes []domain.UserSegmentsChange, atomic bool) ([]error, error) {
+	defer func() {
+		for _, change := range changes {
+			cs.forget(ctx, change.User)
+		}
+	}()
+	return cs.SegmentStorage.ChangeUsersSegments(ctx, changes, atomic)
+}
+
+func (cs *CachedStorage) DeleteSegment(ctx context.Context, name string) error {
+	defer cs.forgetTenant(domain.TenantFromContext(ctx))
+	return cs.SegmentStorage.DeleteSegment(ctx, name)
+}
+
+func (cs *CachedStorage) SetSegmentSchedule(ctx context.Context, name string, activeFrom, activeUntil *time.Time) error {
+	defer cs.forgetTenant(domain.TenantFromContext(ctx))
+	return cs.SegmentStorage.SetSegmentSchedule(ctx, name, activeFrom, activeUntil)
+}
+
+func (cs *CachedStorage) ImportState(ctx context.Context, state domain.State, replace bool, validate func(current domain.State, protected []string) error) error {
+	defer cs.forgetTenant(domain.TenantFromContext(ctx))
+	return cs.SegmentStorage.ImportState(ctx, state, replace, validate)
+}
+
+func (cs *CachedStorage) PromoteEnvironment(ctx context.Context, from, to string, segments []string, withMembers bool) error {
+	defer cs.forgetTenant(domain.TenantFromContext(ctx))
+	return cs.SegmentStorage.PromoteEnvironment(ctx, from, to, segments, withMembers)
+}
+
+// Stats returns the counters since the cache was created.
+func (cs *CachedStorage) Stats() CacheStats {
+	cs.mu.Lock()
+	size := cs.recent.Len()
+	cs.mu.Unlock()
+
+	return CacheStats{
+		Hits:          cs.hits.Load(),
+		Misses:        cs.misses.Load(),
+		Bypasses:      cs.bypasses.Load(),
+		Invalidations: cs.invalidations.Load(),
+		Evictions:     cs.evictions.Load(),
+		Size:          size,
+	}
+}
+
+// add caches the segments read at version, the caller holds mu.
+func (cs *CachedStorage) add(key cacheKey, version domain.UserVersion, segments []domain.Segment) {
+	if cs.size <= 0 {
+		return
+	}
+	if el, ok := cs.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.version, entry.segments = version, segments
+		cs.recent.MoveToFront(el)
+		return
+	}
+
+	cs.entries[key] = cs.recent.PushFront(&cacheEntry{key: key, version: version, segments: segments})
+	for cs.recent.Len() > cs.size {
+		oldest := cs.recent.Back()
+		cs.recent.Remove(oldest)
+		delete(cs.entries, oldest.Value.(*cacheEntry).key)
+		cs.evictions.Add(1)
+	}
+}
+
+// invalidate handles a notification, which names a user of an environment,
+// or only a tenant when all of its users are affected.
+func (cs *CachedStorage) invalidate(payload string) {
+	var n struct {
+		Tenant      string `json:"tenant"`
+		Environment string `json:"environment"`
+		User        *int   `json:"user_id"`
+	}
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		cs.clear()
+		return
+	}
+
+	cs.invalidations.Add(1)
+	if n.User == nil {
+		cs.forgetTenant(n.Tenant)
+		return
+	}
+	cs.dropKey(cacheKey{tenant: n.Tenant, environment: n.Environment, user: *n.User})
+}
+
+func (cs *CachedStorage) forget(ctx context.Context, user int) {
+	tenant, environment := scope(ctx)
+	cs.dropKey(cacheKey{tenant: tenant, environment: environment, user: user})
+}
+
+func (cs *CachedStorage) forgetTenant(tenant string) {
+	cs.drop(func(key cacheKey) bool {
+		return key.tenant == tenant
+	})
+}
+
+func (cs *CachedStorage) clear() {
+	cs.drop(func(cacheKey) bool { return true })
+}
+
+func (cs *CachedStorage) dropKey(key cacheKey) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.epoch++
+	if el, ok := cs.entries[key]; ok {
+		cs.recent.Remove(el)
+		delete(cs.entries, key)
+	}
+}
+
+func (cs *CachedStorage) drop(match func(key cacheKey) bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.epoch++
+	for key, el := range cs.entries {
+		if match(key) {
+			cs.recent.Remove(el)
+			delete(cs.entries, key)
+		}
+	}
+}
+
+func (cs *CachedStorage) startListening() {
+	cs.clear()
+	cs.mu.Lock()
+	cs.listening = true
+	cs.mu.Unlock()
+}
+
+// stopListening empties the cache, as notifications may be missed until
+// listening starts again.
+func (cs *CachedStorage) stopListening() {
+	cs.mu.Lock()
+	cs.listening = false
+	cs.mu.Unlock()
+	cs.clear()
+}
@@ -5,4 +5,330 @@ CREATE TABLE IF NOT EXISTS users_in_segment (
    user_id integer NOT NULL,
    segment character varying(200) NOT NULL REFERENCES segment(name) ON DELETE CASCADE,
    UNIQUE (user_id, segment)
-);
\ No newline at end of file
+);
+ALTER TABLE segment ADD COLUMN IF NOT EXISTS active_from timestamp with time zone;
+ALTER TABLE segment ADD COLUMN IF NOT EXISTS active_until timestamp with time zone;
+ALTER TABLE segment ADD COLUMN IF NOT EXISTS max_members integer CHECK (max_members > 0);
+CREATE TABLE IF NOT EXISTS segment_prerequisite (
+   segment character varying(200) NOT NULL REFERENCES segment(name) ON DELETE CASCADE,
+   prerequisite character varying(200) NOT NULL REFERENCES segment(name) ON DELETE CASCADE,
+   cascade_removal boolean NOT NULL DEFAULT false,
+   PRIMARY KEY (segment, prerequisite),
+   CHECK (segment <> prerequisite)
+);
+CREATE TABLE IF NOT EXISTS segment_size (
+   segment character varying(200) NOT NULL REFERENCES segment(name) ON DELETE CASCADE,
+   taken_at timestamp with time zone NOT NULL,
+   members integer NOT NULL,
+   PRIMARY KEY (segment, taken_at)
+);
+ALTER TABLE segment ADD COLUMN IF NOT EXISTS tenant character varying(200) NOT NULL DEFAULT 'default';
+ALTER TABLE users_in_segment ADD COLUMN IF NOT EXISTS tenant character varying(200) NOT NULL DEFAULT 'default';
+ALTER TABLE segment_prerequisite ADD COLUMN IF NOT EXISTS tenant character varying(200) NOT NULL DEFAULT 'default';
+ALTER TABLE segment_size ADD COLUMN IF NOT EXISTS tenant character varying(200) NOT NULL DEFAULT 'default';
+DO $$
+BEGIN
+   -- Segment names are unique per tenant, so every key and reference to a
+   -- segment is extended with the tenant. Constraint names are kept as they
+   -- are used to tell errors apart.
+   IF NOT EXISTS (
+      SELECT 1 FROM pg_constraint
+      JOIN pg_attribute ON pg_attribute.attrelid = pg_constraint.conrelid AND pg_attribute.attnum = ANY (pg_constraint.conkey)
+      WHERE pg_constraint.conname = 'segment_pkey' AND pg_attribute.attname = 'tenant'
+   ) THEN
+      ALTER TABLE users_in_segment DROP CONSTRAINT users_in_segment_segment_fkey;
+      ALTER TABLE users_in_segment DROP CONSTRAINT users_in_segment_user_id_segment_key;
+      ALTER TABLE segment_prerequisite DROP CONSTRAINT segment_prerequisite_segment_fkey;
+      ALTER TABLE segment_prerequisite DROP CONSTRAINT segment_prerequisite_prerequisite_fkey;
+      ALTER TABLE segment_prerequisite DROP CONSTRAINT segment_prerequisite_pkey;
+      ALTER TABLE segment_size DROP CONSTRAINT segment_size_segment_fkey;
+      ALTER TABLE segment_size DROP CONSTRAINT segment_size_pkey;
+      ALTER TABLE segment DROP CONSTRAINT segment_pkey;
+
+      ALTER TABLE segment ADD CONSTRAINT segment_pkey PRIMARY KEY (tenant, name);
+      ALTER TABLE users_in_segment ADD CONSTRAINT users_in_segment_user_id_segment_key UNIQUE (tenant, user_id, segment);
+      ALTER TABLE users_in_segment ADD CONSTRAINT users_in_segment_segment_fkey
+         FOREIGN KEY (tenant, segment) REFERENCES segment (tenant, name) ON DELETE CASCADE;
+      ALTER TABLE segment_prerequisite ADD CONSTRAINT segment_prerequisite_pkey PRIMARY KEY (tenant, segment, prerequisite);
+      ALTER TABLE segment_prerequisite ADD CONSTRAINT segment_prerequisite_segment_fkey
+         FOREIGN KEY (tenant, segment) REFERENCES segment (tenant, name) ON DELETE CASCADE;
+      ALTER TABLE segment_prerequisite ADD CONSTRAINT segment_prerequisite_prerequisite_fkey
+         FOREIGN KEY (tenant, prerequisite) REFERENCES segment (tenant, name) ON DELETE CASCADE;
+      ALTER TABLE segment_size ADD CONSTRAINT segment_size_pkey PRIMARY KEY (tenant, segment, taken_at);
+      ALTER TABLE segment_size ADD CONSTRAINT segment_size_segment_fkey
+         FOREIGN KEY (tenant, segment) REFERENCES segment (tenant, name) ON DELETE CASCADE;
+   END IF;
+END $$;
+ALTER TABLE users_in_segment ADD COLUMN IF NOT EXISTS environment character varying(200) NOT NULL DEFAULT 'production';
+ALTER TABLE segment_size ADD COLUMN IF NOT EXISTS environment character varying(200) NOT NULL DEFAULT 'production';
+CREATE TABLE IF NOT EXISTS segment_environment (
+   tenant character varying(200) NOT NULL,
+   segment character varying(200) NOT NULL,
+   environment character varying(200) NOT NULL,
+   percentage integer CHECK (percentage BETWEEN 0 AND 100),
+   PRIMARY KEY (tenant, segment, environment),
+   CONSTRAINT segment_environment_segment_fkey
+      FOREIGN KEY (tenant, segment) REFERENCES segment (tenant, name) ON DELETE CASCADE
+);
+DO $$
+BEGIN
+   -- Memberships and sizes are kept per environment.
+   IF NOT EXISTS (
+      SELECT 1 FROM pg_constraint
+      JOIN pg_attribute ON pg_attribute.attrelid = pg_constraint.conrelid AND pg_attribute.attnum = ANY (pg_constraint.conkey)
+      WHERE pg_constraint.conname = 'users_in_segment_user_id_segment_key' AND pg_attribute.attname = 'environment'
+   ) THEN
+      ALTER TABLE users_in_segment DROP CONSTRAINT users_in_segment_user_id_segment_key;
+      ALTER TABLE users_in_segment ADD CONSTRAINT users_in_segment_user_id_segment_key
+         UNIQUE (tenant, environment, user_id, segment);
+      ALTER TABLE segment_size DROP CONSTRAINT segment_size_pkey;
+      ALTER TABLE segment_size ADD CONSTRAINT segment_size_pkey PRIMARY KEY (tenant, environment, segment, taken_at);
+   END IF;
+END $$;
+ALTER TABLE segment ADD COLUMN IF NOT EXISTS protected boolean NOT NULL DEFAULT false;
+CREATE TABLE IF NOT EXISTS change_request (
+   id bigserial PRIMARY KEY,
+   tenant character varying(200) NOT NULL,
+   environment character varying(200) NOT NULL,
+   kind character varying(50) NOT NULL,
+   segment character varying(200),
+   user_id integer,
+   segments_to_add character varying(200)[],
+   segments_to_delete character varying(200)[],
+   author character varying(200) NOT NULL,
+   status character varying(20) NOT NULL,
+   reviewer character varying(200),
+   error text,
+   created_at timestamp with time zone NOT NULL,
+   reviewed_at timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS change_request_tenant_status_idx ON change_request (tenant, status, id);
+CREATE INDEX IF NOT EXISTS users_in_segment_segment_idx ON users_in_segment (tenant, environment, segment, user_id);
+CREATE TABLE IF NOT EXISTS change_log (
+   seq bigserial PRIMARY KEY,
+   tenant character varying(200) NOT NULL,
+   -- NULL for changes of segment definitions, which are shared by all environments.
+   environment character varying(200),
+   type character varying(50) NOT NULL,
+   segment character varying(200) NOT NULL,
+   user_id integer,
+   created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS change_log_tenant_seq_idx ON change_log (tenant, seq);
+-- Changes wait here until their transaction commits, see publish_changes.
+CREATE TABLE IF NOT EXISTS change_log_pending (
+   id bigserial PRIMARY KEY,
+   txid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+   tenant character varying(200) NOT NULL,
+   environment character varying(200),
+   type character varying(50) NOT NULL,
+   segment character varying(200) NOT NULL,
+   user_id integer,
+   created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS change_log_pending_txid_idx ON change_log_pending (txid);
+-- The actor is taken from the segments.actor setting of the transaction
+-- that made the change, NULL if it isn't set.
+ALTER TABLE change_log ADD COLUMN IF NOT EXISTS actor character varying(200);
+ALTER TABLE change_log_pending ADD COLUMN IF NOT EXISTS actor character varying(200);
+-- The operation is taken from the segments.operation setting the same way,
+-- see the operation table.
+ALTER TABLE change_log ADD COLUMN IF NOT EXISTS operation_id bigint;
+ALTER TABLE change_log_pending ADD COLUMN IF NOT EXISTS operation_id bigint;
+CREATE OR REPLACE FUNCTION publish_changes() RETURNS trigger AS $$
+BEGIN
+   -- Seqs are given out right before the commit and one transaction at a
+   -- time, so a reader never sees a seq while a smaller one is yet to be
+   -- committed and can safely resume after the last seq it has seen.
+   PERFORM pg_advisory_xact_lock(hashtext('change_log'));
+   WITH published AS (
+      DELETE FROM change_log_pending WHERE txid = pg_current_xact_id() RETURNING *
+   )
+   INSERT INTO change_log (tenant, environment, type, segment, user_id, actor, operation_id, created_at)
+   SELECT tenant, environment, type, segment, user_id, actor, operation_id, created_at FROM published ORDER BY id;
+   PERFORM pg_notify('change_log', '');
+   RETURN NULL;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS change_log_pending_publish ON change_log_pending;
+CREATE CONSTRAINT TRIGGER change_log_pending_publish AFTER INSERT ON change_log_pending
+   DEFERRABLE INITIALLY DEFERRED FOR EACH ROW EXECUTE FUNCTION publish_changes();
+CREATE OR REPLACE FUNCTION log_member_change() RETURNS trigger AS $$
+BEGIN
+   IF TG_OP = 'INSERT' THEN
+      INSERT INTO change_log_pending (tenant, environment, type, segment, user_id, actor, operation_id)
+      VALUES (NEW.tenant, NEW.environment, 'member_added', NEW.segment, NEW.user_id,
+         NULLIF(current_setting('segments.actor', true), ''),
+         NULLIF(current_setting('segments.operation', true), '')::bigint);
+   ELSE
+      INSERT INTO change_log_pending (tenant, environment, type, segment, user_id, actor, operation_id)
+      VALUES (OLD.tenant, OLD.environment, 'member_removed', OLD.segment, OLD.user_id,
+         NULLIF(current_setting('segments.actor', true), ''),
+         NULLIF(current_setting('segments.operation', true), '')::bigint);
+   END IF;
+   RETURN NULL;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS users_in_segment_change_log ON users_in_segment;
+CREATE TRIGGER users_in_segment_change_log AFTER INSERT OR DELETE ON users_in_segment
+   FOR EACH ROW EXECUTE FUNCTION log_member_change();
+CREATE OR REPLACE FUNCTION log_segment_change() RETURNS trigger AS $$
+BEGIN
+   IF TG_OP = 'INSERT' THEN
+      INSERT INTO change_log_pending (tenant, type, segment, actor)
+      VALUES (NEW.tenant, 'segment_created', NEW.name, NULLIF(current_setting('segments.actor', true), ''));
+   ELSIF TG_OP = 'UPDATE' THEN
+      INSERT INTO change_log_pending (tenant, type, segment, actor)
+      VALUES (NEW.tenant, 'segment_updated', NEW.name, NULLIF(current_setting('segments.actor', true), ''));
+   ELSE
+      INSERT INTO change_log_pending (tenant, type, segment, actor)
+      VALUES (OLD.tenant, 'segment_deleted', OLD.name, NULLIF(current_setting('segments.actor', true), ''));
+   END IF;
+   RETURN NULL;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS segment_change_log ON segment;
+CREATE TRIGGER segment_change_log AFTER INSERT OR DELETE ON segment
+   FOR EACH ROW EXECUTE FUNCTION log_segment_change();
+DROP TRIGGER IF EXISTS segment_update_change_log ON segment;
+CREATE TRIGGER segment_update_change_log AFTER UPDATE ON segment
+   FOR EACH ROW WHEN (OLD IS DISTINCT FROM NEW) EXECUTE FUNCTION log_segment_change();
+CREATE OR REPLACE FUNCTION log_percentage_change() RETURNS trigger AS $$
+DECLARE
+   changed segment_environment;
+BEGIN
+   IF TG_OP = 'DELETE' THEN
+      changed := OLD;
+      -- The segment itself is being deleted.
+      IF NOT EXISTS (SELECT 1 FROM segment WHERE tenant = OLD.tenant AND name = OLD.segment) THEN
+         RETURN NULL;
+      END IF;
+   ELSE
+      changed := NEW;
+   END IF;
+   INSERT INTO change_log_pending (tenant, environment, type, segment)
+   VALUES (changed.tenant, changed.environment, 'segment_updated', changed.segment);
+   RETURN NULL;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS segment_environment_change_log ON segment_environment;
+CREATE TRIGGER segment_environment_change_log AFTER INSERT OR UPDATE OR DELETE ON segment_environment
+   FOR EACH ROW EXECUTE FUNCTION log_percentage_change();
+-- Replicas caching segments of users learn which users to drop, see CachedStorage.
+CREATE OR REPLACE FUNCTION notify_user_segments() RETURNS trigger AS $$
+BEGIN
+   IF TG_TABLE_NAME = 'segment' THEN
+      PERFORM pg_notify('user_segments', json_build_object('tenant', NEW.tenant)::text);
+   ELSIF TG_OP = 'INSERT' THEN
+      PERFORM pg_notify('user_segments',
+         json_build_object('tenant', NEW.tenant, 'environment', NEW.environment, 'user_id', NEW.user_id)::text);
+   ELSE
+      PERFORM pg_notify('user_segments',
+         json_build_object('tenant', OLD.tenant, 'environment', OLD.environment, 'user_id', OLD.user_id)::text);
+   END IF;
+   RETURN NULL;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS users_in_segment_notify ON users_in_segment;
+CREATE TRIGGER users_in_segment_notify AFTER INSERT OR DELETE ON users_in_segment
+   FOR EACH ROW EXECUTE FUNCTION notify_user_segments();
+DROP TRIGGER IF EXISTS segment_schedule_notify ON segment;
+CREATE TRIGGER segment_schedule_notify AFTER UPDATE ON segment
+   FOR EACH ROW WHEN (OLD.active_from IS DISTINCT FROM NEW.active_from OR OLD.active_until IS DISTINCT FROM NEW.active_until)
+   EXECUTE FUNCTION notify_user_segments();
+-- Versions are bumped by every change that affects segments of a user, they
+-- make ETags of get_user_segments.
+CREATE TABLE IF NOT EXISTS user_version (
+   tenant character varying(200) NOT NULL,
+   environment character varying(200) NOT NULL,
+   user_id integer NOT NULL,
+   version bigint NOT NULL,
+   PRIMARY KEY (tenant, environment, user_id)
+);
+CREATE TABLE IF NOT EXISTS segments_version (
+   tenant character varying(200) PRIMARY KEY,
+   version bigint NOT NULL
+);
+CREATE OR REPLACE FUNCTION bump_user_version() RETURNS trigger AS $$
+BEGIN
+   INSERT INTO user_version (tenant, environment, user_id, version)
+   SELECT DISTINCT tenant, environment, user_id, 1 FROM changed
+   ON CONFLICT (tenant, environment, user_id) DO UPDATE SET version = user_version.version + 1;
+   RETURN NULL;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS users_in_segment_insert_version ON users_in_segment;
+CREATE TRIGGER users_in_segment_insert_version AFTER INSERT ON users_in_segment
+   REFERENCING NEW TABLE AS changed FOR EACH STATEMENT EXECUTE FUNCTION bump_user_version();
+DROP TRIGGER IF EXISTS users_in_segment_delete_version ON users_in_segment;
+CREATE TRIGGER users_in_segment_delete_version AFTER DELETE ON users_in_segment
+   REFERENCING OLD TABLE AS changed FOR EACH STATEMENT EXECUTE FUNCTION bump_user_version();
+CREATE OR REPLACE FUNCTION bump_segments_version() RETURNS trigger AS $$
+BEGIN
+   INSERT INTO segments_version (tenant, version)
+   VALUES (CASE WHEN TG_OP = 'DELETE' THEN OLD.tenant ELSE NEW.tenant END, 1)
+   ON CONFLICT (tenant) DO UPDATE SET version = segments_version.version + 1;
+   RETURN NULL;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS segment_version ON segment;
+CREATE TRIGGER segment_version AFTER UPDATE OR DELETE ON segment
+   FOR EACH ROW EXECUTE FUNCTION bump_segments_version();
+DROP TRIGGER IF EXISTS segment_environment_version ON segment_environment;
+CREATE TRIGGER segment_environment_version AFTER INSERT OR UPDATE OR DELETE ON segment_environment
+   FOR EACH ROW EXECUTE FUNCTION bump_segments_version();
+-- Background jobs, claimed by workers of any replica. A job is running while
+-- locked_until is ahead, after that another worker takes it over.
+CREATE TABLE IF NOT EXISTS job (
+   id bigserial PRIMARY KEY,
+   tenant character varying(200) NOT NULL,
+   environment character varying(200) NOT NULL,
+   kind character varying(50) NOT NULL,
+   actor character varying(200) NOT NULL,
+   status character varying(20) NOT NULL,
+   input jsonb NOT NULL,
+   state jsonb,
+   result jsonb NOT NULL,
+   error text,
+   attempt integer NOT NULL DEFAULT 0,
+   locked_until timestamp with time zone,
+   created_at timestamp with time zone NOT NULL,
+   started_at timestamp with time zone,
+   finished_at timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS job_tenant_kind_idx ON job (tenant, kind, id);
+-- Users a job works through, stored once rather than with every save of its
+-- state.
+CREATE TABLE IF NOT EXISTS job_user (
+   job_id bigint NOT NULL REFERENCES job (id) ON DELETE CASCADE,
+   position integer NOT NULL,
+   user_id integer NOT NULL,
+   PRIMARY KEY (job_id, position)
+);
+CREATE INDEX IF NOT EXISTS job_unfinished_idx ON job (id) WHERE status IN ('pending', 'running');
+CREATE INDEX IF NOT EXISTS change_log_tenant_created_at_idx ON change_log (tenant, created_at);
+CREATE INDEX IF NOT EXISTS change_log_user_idx ON change_log (tenant, user_id, seq) WHERE user_id IS NOT NULL;
+-- Operations are changes of a user's segments by change_user_segments, the
+-- memberships they changed are the rows of change_log with their id.
+CREATE TABLE IF NOT EXISTS operation (
+   id bigserial PRIMARY KEY,
+   tenant character varying(200) NOT NULL,
+   environment character varying(200) NOT NULL,
+   user_id integer NOT NULL,
+   actor character varying(200),
+   undone_by bigint REFERENCES operation (id),
+   created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS change_log_operation_idx ON change_log (operation_id) WHERE operation_id IS NOT NULL;
+ALTER TABLE users_in_segment ADD COLUMN IF NOT EXISTS added_at timestamp with time zone;
+ALTER TABLE users_in_segment ALTER COLUMN added_at SET DEFAULT now();
+-- Memberships added before the column existed get the time they were last
+-- added as recorded in the change log, or the time of the backfill.
+UPDATE users_in_segment SET added_at = coalesce((
+      SELECT max(change_log.created_at) FROM change_log
+      WHERE change_log.tenant = users_in_segment.tenant AND change_log.environment = users_in_segment.environment
+         AND change_log.user_id = users_in_segment.user_id AND change_log.segment = users_in_segment.segment
+         AND change_log.type = 'member_added'
+   ), now())
+   WHERE added_at IS NULL;
+ALTER TABLE users_in_segment ALTER COLUMN added_at SET NOT NULL;
+-- Settings proposed by change requests of the kinds that set them.
+ALTER TABLE change_request ADD COLUMN IF NOT EXISTS active_from timestamp with time zone;
+ALTER TABLE change_request ADD COLUMN IF NOT EXISTS active_until timestamp with time zone;
+ALTER TABLE change_request ADD COLUMN IF NOT EXISTS max_members integer;
+ALTER TABLE change_request ADD COLUMN IF NOT EXISTS percentage integer;
+-- The operation that applied an approved change_user_segments request.
+ALTER TABLE change_request ADD COLUMN IF NOT EXISTS operation_id bigint REFERENCES operation (id);
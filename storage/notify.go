@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// listenRetryDelay is the pause before listening again after a failure.
+const listenRetryDelay = time.Second
+
+// listen calls notify with the payload of every notification on the
+// channel until ctx is done. It calls listening once LISTEN succeeds and
+// lost when the connection fails, as notifications may have been missed
+// until the next listening.
+func listen(ctx context.Context, dbpool *pgxpool.Pool, channel string, listening func(), notify func(payload string), lost func()) {
+	for ctx.Err() == nil {
+		listenOnce(ctx, dbpool, channel, listening, notify)
+		lost()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func listenOnce(ctx context.Context, dbpool *pgxpool.Pool, channel string, listening func(), notify func(payload string)) {
+	pooled, err := dbpool.Acquire(ctx)
+	if err != nil {
+		return
+	}
+	// The connection is closed rather than returned to the pool, it may
+	// still be listening.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+channel+";"); err != nil {
+		return
+	}
+	listening()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return
+		}
+		notify(n.Payload)
+	}
+}
+
+// notifier wakes up readers of the change feed when changes are committed.
+// It listens on a single connection however many readers are waiting.
+type notifier struct {
+	dbpool *pgxpool.Pool
+	start  sync.Once
+	ready  chan struct{}
+
+	mu sync.Mutex
+	// ch is closed and replaced on every notification.
+	ch chan struct{}
+}
+
+func newNotifier(dbpool *pgxpool.Pool) *notifier {
+	return &notifier{
+		dbpool: dbpool,
+		ready:  make(chan struct{}),
+		ch:     make(chan struct{}),
+	}
+}
+
+// NotifyChanges returns a channel that is closed once the next changes are
+// committed. Notifications aren't filtered by tenant, so readers have to
+// check whether the changes are theirs.
+func (sql *Sql) NotifyChanges(ctx context.Context) (<-chan struct{}, error) {
+	n := sql.changes
+	n.start.Do(func() {
+		var ready sync.Once
+		listening := func() {
+			ready.Do(func() { close(n.ready) })
+			// Changes may have been committed before LISTEN.
+			n.broadcast()
+		}
+		go listen(context.Background(), n.dbpool, "change_log", listening, func(string) { n.broadcast() }, n.broadcast)
+	})
+
+	select {
+	case <-n.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch, nil
+}
+
+func (n *notifier) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"assignment/domain"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is sent instead of the hash of the body, so that blobs
+// are streamed without being read twice.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3BlobStore keeps blobs in a bucket of S3 or of a compatible store, like
+// MinIO. Objects are addressed path-style, as in http://minio:9000/bucket/key,
+// and requests are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+func NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey string) (*S3BlobStore, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("endpoint must be an http or https URL, got %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+
+	return &S3BlobStore{
+		endpoint:   u,
+		region:     region,
+		bucket:     bucket,
+		accessKey:  accessKey,
+		secretKey:  secretKey,
+		httpClient: http.DefaultClient,
+		now:        time.Now,
+	}, nil
+}
+
+func (sb *S3BlobStore) objectURL(key string) *url.URL {
+	u := *sb.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + sb.bucket + "/" + key
+	u.RawPath = ""
+	return &u
+}
+
+func (sb *S3BlobStore) PutBlob(ctx context.Context, key string, r io.Reader, size int64) error {
+	// A body of unknown length would be sent chunked, which S3 refuses.
+	body := io.NopCloser(r)
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, sb.objectURL(key).String(), body)
+	if err != nil {
+		return fmt.Errorf("creating request: %v", err)
+	}
+	req.ContentLength = size
+	sb.sign(req)
+
+	resp, err := sb.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("putting object: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+func (sb *S3BlobStore) OpenBlob(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sb.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	sb.sign(req)
+
+	resp, err := sb.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting object: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, domain.ErrBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+
+	return resp.Body, nil
+}
+
+// BlobURL returns a presigned link, which is valid for at most a week.
+func (sb *S3BlobStore) BlobURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	u := sb.objectURL(key)
+	now := sb.now().UTC()
+	scope := sb.scope(now)
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {sb.accessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + sb.signature(now, scope, canonical)
+	return u.String(), nil
+}
+
+// sign adds the Authorization header to the request.
+func (sb *S3BlobStore) sign(req *http.Request) {
+	now := sb.now().UTC()
+	scope := sb.scope(now)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + unsignedPayload + "\n" +
+			"x-amz-date:" + req.Header.Get("X-Amz-Date") + "\n",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sb.accessKey, scope, signedHeaders, sb.signature(now, scope, canonical)))
+}
+
+func (sb *S3BlobStore) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + sb.region + "/s3/aws4_request"
+}
+
+func (sb *S3BlobStore) signature(now time.Time, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + sb.secretKey)
+	for _, part := range []string{now.Format("20060102"), sb.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+// canonicalQuery encodes the query sorted by keys, with spaces as %20 as
+// signatures require.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := slices.Clone(query[key])
+		slices.Sort(values)
+		for _, value := range values {
+			pairs = append(pairs, url.QueryEscape(key)+"="+strings.ReplaceAll(url.QueryEscape(value), "+", "%20"))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -6,6 +6,9 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -16,15 +19,105 @@ import (
 var initialSql string
 
 type Sql struct {
-	dbpool *pgxpool.Pool
+	dbpool  *pgxpool.Pool
+	changes *notifier
 }
 
 func NewSqlStorage(dbpool *pgxpool.Pool) (sql *Sql) {
-	return &Sql{dbpool: dbpool}
+	return &Sql{dbpool: dbpool, changes: newNotifier(dbpool)}
+}
+
+// scope returns the tenant and the environment the context belongs to.
+func scope(ctx context.Context) (tenant, environment string) {
+	return domain.TenantFromContext(ctx), domain.EnvironmentFromContext(ctx)
+}
+
+// conn is what queries run on, the pool or the transaction of a dry run.
+type conn interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+type dryRunKey struct{}
+
+// conn returns the transaction of the dry run ctx belongs to, if any, so
+// that its changes are rolled back, or the pool otherwise. Transactions
+// started within a dry run become its savepoints.
+func (sql *Sql) conn(ctx context.Context) conn {
+	if tx, ok := ctx.Value(dryRunKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return sql.dbpool
+}
+
+// DryRun runs f in a transaction that is always rolled back. The changes f
+// would make are read from change_log_pending, where they wait for the
+// commit. If a statement of f fails outside of a savepoint, the transaction
+// can't be read anymore and only the error of f is returned.
+func (sql *Sql) DryRun(ctx context.Context, f func(ctx context.Context) error) (domain.DryRunResult, error) {
+	tx, err := sql.conn(ctx).Begin(ctx)
+	if err != nil {
+		return domain.DryRunResult{}, fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	fErr := f(context.WithValue(ctx, dryRunKey{}, tx))
+
+	_, environment := scope(ctx)
+	var result domain.DryRunResult
+	err = tx.QueryRow(ctx, `SELECT count(*) FROM change_log_pending
+		WHERE txid = pg_current_xact_id() AND (environment IS NULL OR environment = $1);`, environment).Scan(&result.Total)
+	if err == nil {
+		var rows pgx.Rows
+		rows, err = tx.Query(ctx, `SELECT 0, type, segment, user_id, coalesce(actor, ''), created_at FROM change_log_pending
+			WHERE txid = pg_current_xact_id() AND (environment IS NULL OR environment = $1)
+			ORDER BY id LIMIT $2;`, environment, domain.MaxDryRunChanges)
+		if err == nil {
+			result.Changes, err = pgx.CollectRows(rows, scanChange)
+		}
+	}
+	if fErr != nil {
+		if err != nil {
+			return domain.DryRunResult{}, fErr
+		}
+		return result, fErr
+	}
+	if err != nil {
+		return domain.DryRunResult{}, fmt.Errorf("reading changes: %v", err)
+	}
+
+	return result, nil
+}
+
+// settingsQuery sets the actor and the operation of the transaction, which
+// triggers record with the changes, see log_member_change.
+const settingsQuery = "SELECT set_config('segments.actor', $1, true), set_config('segments.operation', $2, true);"
+
+// settings returns the arguments of settingsQuery for ctx.
+func settings(ctx context.Context) []any {
+	operation := ""
+	if id := domain.OperationFromContext(ctx); id != 0 {
+		operation = strconv.FormatInt(id, 10)
+	}
+	return []any{domain.ActorFromContext(ctx), operation}
+}
+
+// begin runs f in a transaction that records the actor and the operation of
+// ctx with the changes it makes.
+func (sql *Sql) begin(ctx context.Context, f func(tx pgx.Tx) error) error {
+	return pgx.BeginFunc(ctx, sql.conn(ctx), func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, settingsQuery, settings(ctx)...); err != nil {
+			return fmt.Errorf("setting actor: %v", err)
+		}
+		return f(tx)
+	})
 }
 
 func (sql *Sql) InitDb(ctx context.Context) error {
-	if _, err := sql.dbpool.Exec(ctx, initialSql); err != nil {
+	if _, err := sql.conn(ctx).Exec(ctx, initialSql); err != nil {
 		return fmt.Errorf("failed to init db: %v", err)
 	}
 
@@ -32,9 +125,9 @@ func (sql *Sql) InitDb(ctx context.Context) error {
 }
 
 func (sql *Sql) CreateSegment(ctx context.Context, name string) error {
-	query := "INSERT INTO segment (name) VALUES ($1);"
+	query := "INSERT INTO segment (tenant, name) VALUES ($1, $2);"
 
-	_, err := sql.dbpool.Exec(ctx, query, name)
+	_, err := sql.conn(ctx).Exec(ctx, query, domain.TenantFromContext(ctx), name)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
@@ -49,10 +142,59 @@ func (sql *Sql) CreateSegment(ctx context.Context, name string) error {
 	return nil
 }
 
+// CloneSegment copies the members of source, picked at random with
+// ORDER BY random() when sampling, while source is locked against deletion.
+func (sql *Sql) CloneSegment(ctx context.Context, source, name string, opts domain.CloneOptions) (int, error) {
+	tenant, environment := scope(ctx)
+	var members int
+
+	err := sql.begin(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT 1 FROM segment WHERE tenant = $1 AND name = $2 FOR SHARE;", tenant, source).Scan(new(int))
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return domain.ErrSegmentNotFound
+			}
+			return fmt.Errorf("locking segment: %v", err)
+		}
+
+		_, err = tx.Exec(ctx, "INSERT INTO segment (tenant, name) VALUES ($1, $2);", tenant, name)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.ConstraintName == "segment_pkey" {
+				return domain.ErrSegmentAlreadyExists
+			}
+			return fmt.Errorf("creating segment: %v", err)
+		}
+
+		ct, err := tx.Exec(ctx, `INSERT INTO users_in_segment (tenant, environment, user_id, segment)
+			SELECT tenant, environment, user_id, $4 FROM users_in_segment
+			WHERE tenant = $1 AND environment = $2 AND segment = $3 AND ($5::timestamptz IS NULL OR added_at > $5)
+			ORDER BY CASE WHEN $6::integer > 0 THEN random() END, user_id
+			LIMIT NULLIF($6::integer, 0);`,
+			tenant, environment, source, name, opts.JoinedAfter, opts.SampleSize)
+		if err != nil {
+			return fmt.Errorf("copying members: %v", err)
+		}
+		members = int(ct.RowsAffected())
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cloning segment: %w", err)
+	}
+
+	return members, nil
+}
+
 func (sql *Sql) DeleteSegment(ctx context.Context, name string) error {
-	query := "DELETE FROM segment WHERE name = $1;"
+	query := "DELETE FROM segment WHERE tenant = $1 AND name = $2;"
 
-	comTag, err := sql.dbpool.Exec(ctx, query, name)
+	// Members removed with the segment are logged with the actor.
+	var comTag pgconn.CommandTag
+	err := sql.begin(ctx, func(tx pgx.Tx) error {
+		var err error
+		comTag, err = tx.Exec(ctx, query, domain.TenantFromContext(ctx), name)
+		return err
+	})
 	if comTag.RowsAffected() == 0 {
 		return domain.ErrSegmentNotFound
 	}
@@ -63,64 +205,1639 @@ func (sql *Sql) DeleteSegment(ctx context.Context, name string) error {
 	return nil
 }
 
-func (sql *Sql) AddUserToSegment(ctx context.Context, user int, segments []string) error {
-	batch := &pgx.Batch{}
-	for i := range segments {
-		batch.Queue("INSERT INTO users_in_segment (user_id, segment) VALUES ($1, $2);", user, segments[i])
+func (sql *Sql) SetSegmentSchedule(ctx context.Context, name string, activeFrom, activeUntil *time.Time) error {
+	query := "UPDATE segment SET active_from = $3, active_until = $4 WHERE tenant = $1 AND name = $2;"
+
+	comTag, err := sql.conn(ctx).Exec(ctx, query, domain.TenantFromContext(ctx), name, activeFrom, activeUntil)
+	if err != nil {
+		return fmt.Errorf("setting segment schedule: %v", err)
+	}
+	if comTag.RowsAffected() == 0 {
+		return domain.ErrSegmentNotFound
 	}
-	b := sql.dbpool.SendBatch(ctx, batch)
-	defer b.Close()
 
-	_, err := b.Exec()
+	return nil
+}
+
+func (sql *Sql) SetSegmentMaxMembers(ctx context.Context, name string, maxMembers *int) error {
+	query := "UPDATE segment SET max_members = $3 WHERE tenant = $1 AND name = $2;"
+
+	comTag, err := sql.conn(ctx).Exec(ctx, query, domain.TenantFromContext(ctx), name, maxMembers)
 	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			if pgErr.ConstraintName == "users_in_segment_segment_fkey" {
+		return fmt.Errorf("setting segment max members: %v", err)
+	}
+	if comTag.RowsAffected() == 0 {
+		return domain.ErrSegmentNotFound
+	}
+
+	return nil
+}
+
+// segmentDetailsQuery selects segments of tenant $1 with their settings and
+// members in environment $2.
+const segmentDetailsQuery = `SELECT segment.name, segment.active_from, segment.active_until, segment.max_members,
+		segment_environment.percentage, segment.protected, (SELECT count(*) FROM users_in_segment
+			WHERE users_in_segment.tenant = segment.tenant AND users_in_segment.environment = $2
+				AND users_in_segment.segment = segment.name)
+	FROM segment LEFT JOIN segment_environment ON segment_environment.tenant = segment.tenant
+		AND segment_environment.segment = segment.name AND segment_environment.environment = $2
+	WHERE segment.tenant = $1`
+
+func scanSegmentDetails(row pgx.CollectableRow) (domain.SegmentDetails, error) {
+	var s domain.SegmentDetails
+	err := row.Scan(&s.Name, &s.ActiveFrom, &s.ActiveUntil, &s.MaxMembers, &s.Percentage, &s.Protected, &s.Members)
+	return s, err
+}
+
+func (sql *Sql) GetSegment(ctx context.Context, name string) (domain.SegmentDetails, error) {
+	tenant, environment := scope(ctx)
+
+	rows, err := sql.conn(ctx).Query(ctx, segmentDetailsQuery+" AND segment.name = $3", tenant, environment, name)
+	if err != nil {
+		return domain.SegmentDetails{}, fmt.Errorf("querying segment: %v", err)
+	}
+
+	s, err := pgx.CollectOneRow(rows, scanSegmentDetails)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.SegmentDetails{}, domain.ErrSegmentNotFound
+		}
+		return domain.SegmentDetails{}, fmt.Errorf("collecting segment: %v", err)
+	}
+
+	return s, nil
+}
+
+func (sql *Sql) GetSegments(ctx context.Context) ([]domain.SegmentDetails, error) {
+	tenant, environment := scope(ctx)
+
+	rows, err := sql.conn(ctx).Query(ctx, segmentDetailsQuery+" ORDER BY segment.name", tenant, environment)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	segments, err := pgx.CollectRows(rows, scanSegmentDetails)
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return segments, nil
+}
+
+func (sql *Sql) GetSegmentMembers(ctx context.Context, segment string, after, limit int) ([]int, error) {
+	tenant, environment := scope(ctx)
+	var members []int
+
+	err := pgx.BeginTxFunc(ctx, sql.dbpool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		var exists bool
+		err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM segment WHERE tenant = $1 AND name = $2);", tenant, segment).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("checking segment: %v", err)
+		}
+		if !exists {
+			return domain.ErrSegmentNotFound
+		}
+
+		rows, err := tx.Query(ctx, `SELECT user_id FROM users_in_segment
+			WHERE tenant = $1 AND environment = $2 AND segment = $3 AND user_id > $4
+			ORDER BY user_id LIMIT $5;`, tenant, environment, segment, after, limit)
+		if err != nil {
+			return fmt.Errorf("querying members: %v", err)
+		}
+		members, err = pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			return fmt.Errorf("collecting members: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting segment members: %w", err)
+	}
+
+	return members, nil
+}
+
+func (sql *Sql) AddUserToSegment(ctx context.Context, user int, segments []string) error {
+	err := sql.begin(ctx, func(tx pgx.Tx) error {
+		return addUserToSegments(ctx, tx, user, segments)
+	})
+	if err != nil {
+		return fmt.Errorf("adding user to segment: %w", err)
+	}
+	return nil
+}
+
+// addUserToSegments inserts the memberships while holding a lock on every
+// segment row, so that concurrent additions can't push a segment over its
+// max_members limit. Segments are locked in sorted order to avoid deadlocks.
+// The locks also keep prerequisites from being added to the segments until
+// the transaction ends, as adding one takes a key share lock on the
+// segment, so the prerequisites are checked after them.
+func addUserToSegments(ctx context.Context, tx pgx.Tx, user int, segments []string) error {
+	tenant, environment := scope(ctx)
+	sorted := slices.Clone(segments)
+	slices.Sort(sorted)
+
+	for _, segment := range sorted {
+		var maxMembers *int
+		err := tx.QueryRow(ctx, "SELECT max_members FROM segment WHERE tenant = $1 AND name = $2 FOR UPDATE;", tenant, segment).Scan(&maxMembers)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
 				return domain.ErrSegmentNotFound
 			}
-			if pgErr.ConstraintName == "users_in_segment_user_id_segment_key" {
-				return domain.ErrUserIsAlreadyHasThisSegment
-			}
+			return fmt.Errorf("locking segment: %v", err)
+		}
 
+		if maxMembers != nil {
+			var members int
+			err := tx.QueryRow(ctx, "SELECT count(*) FROM users_in_segment WHERE tenant = $1 AND environment = $2 AND segment = $3;",
+				tenant, environment, segment).Scan(&members)
+			if err != nil {
+				return fmt.Errorf("counting segment members: %v", err)
+			}
+			if members >= *maxMembers {
+				return domain.ErrSegmentIsFull
+			}
 		}
+	}
+
+	if err := checkPrerequisites(ctx, tx, user, sorted); err != nil {
+		return err
+	}
 
-		return fmt.Errorf("adding user to segment: %v", err)
+	for _, segment := range sorted {
+		_, err := tx.Exec(ctx, "INSERT INTO users_in_segment (tenant, environment, user_id, segment) VALUES ($1, $2, $3, $4);",
+			tenant, environment, user, segment)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				if pgErr.ConstraintName == "users_in_segment_segment_fkey" {
+					return domain.ErrSegmentNotFound
+				}
+				if pgErr.ConstraintName == "users_in_segment_user_id_segment_key" {
+					return domain.ErrUserIsAlreadyHasThisSegment
+				}
+			}
+
+			return fmt.Errorf("inserting user into segment: %v", err)
+		}
 	}
+
 	return nil
 }
 
-func (sql *Sql) DeleteUserFromSegment(ctx context.Context, user int, segments []string) error {
-	batch := &pgx.Batch{}
-	for i := range segments {
-		batch.Queue("DELETE FROM users_in_segment WHERE user_id = $1 AND segment = $2;", user, segments[i])
+// checkPrerequisites fails with domain.ErrPrerequisiteMissing if the user
+// isn't in a prerequisite of the segments they are added to, other than
+// these segments themselves. The memberships that satisfy prerequisites
+// are locked until the transaction ends, so that they can't be removed
+// before the new ones commit, see cascadeRemovals.
+func checkPrerequisites(ctx context.Context, tx pgx.Tx, user int, segments []string) error {
+	tenant, environment := scope(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT segment FROM users_in_segment
+		WHERE tenant = $1 AND environment = $2 AND user_id = $3
+			AND segment IN (SELECT prerequisite FROM segment_prerequisite WHERE tenant = $1 AND segment = ANY($4))
+		ORDER BY segment FOR SHARE;`, tenant, environment, user, segments)
+	if err != nil {
+		return fmt.Errorf("locking prerequisites: %v", err)
+	}
+	held, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("collecting prerequisites: %v", err)
 	}
-	b := sql.dbpool.SendBatch(ctx, batch)
-	defer b.Close()
 
-	ct, err := b.Exec()
-	if ct.RowsAffected() == 0 {
-		return domain.ErrUserHaveNotThisSegment
+	rows, err = tx.Query(ctx, `SELECT segment, prerequisite FROM segment_prerequisite
+		WHERE tenant = $1 AND segment = ANY($2) ORDER BY segment, prerequisite;`, tenant, segments)
+	if err != nil {
+		return fmt.Errorf("querying prerequisites: %v", err)
+	}
+	var errs error
+	var segment, prerequisite string
+	_, err = pgx.ForEachRow(rows, []any{&segment, &prerequisite}, func() error {
+		if !slices.Contains(held, prerequisite) && !slices.Contains(segments, prerequisite) {
+			errs = errors.Join(errs, fmt.Errorf("%w: %s requires %s", domain.ErrPrerequisiteMissing, segment, prerequisite))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading prerequisites: %v", err)
 	}
+
+	return errs
+}
+
+func (sql *Sql) DeleteUserFromSegment(ctx context.Context, user int, segments []string) error {
+	tenant, environment := scope(ctx)
+
+	err := sql.begin(ctx, func(tx pgx.Tx) error {
+		for _, segment := range segments {
+			ct, err := tx.Exec(ctx, "DELETE FROM users_in_segment WHERE tenant = $1 AND environment = $2 AND user_id = $3 AND segment = $4;",
+				tenant, environment, user, segment)
+			if err != nil {
+				return fmt.Errorf("deleting users: %v", err)
+			}
+			if ct.RowsAffected() == 0 {
+				return domain.ErrUserHaveNotThisSegment
+			}
+		}
+		return cascadeRemovals(ctx, tx, user, segments)
+	})
 	if err != nil {
-		return fmt.Errorf("deleting users: %v", err)
+		return fmt.Errorf("deleting user from segment: %w", err)
+	}
+
+	return nil
+}
+
+// cascadeRemovals removes the user from the segments that depend with
+// cascade_removal on the removed ones, and from their dependents in turn.
+// The domain adds the dependents to the removals in advance, this catches
+// the memberships added by transactions the removals have waited for, see
+// checkPrerequisites. Such dependents that are protected can't be removed
+// without approval, so the removal fails instead.
+func cascadeRemovals(ctx context.Context, tx pgx.Tx, user int, removed []string) error {
+	tenant, environment := scope(ctx)
+
+	for len(removed) > 0 {
+		rows, err := tx.Query(ctx, `DELETE FROM users_in_segment membership USING segment_prerequisite p
+			WHERE membership.tenant = $1 AND membership.environment = $2 AND membership.user_id = $3
+				AND p.tenant = $1 AND p.segment = membership.segment AND p.prerequisite = ANY($4) AND p.cascade_removal
+			RETURNING membership.segment;`, tenant, environment, user, removed)
+		if err != nil {
+			return fmt.Errorf("deleting dependent memberships: %v", err)
+		}
+		removed, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("collecting dependent memberships: %v", err)
+		}
+		if len(removed) == 0 {
+			return nil
+		}
+
+		var protected string
+		err = tx.QueryRow(ctx, "SELECT name FROM segment WHERE tenant = $1 AND name = ANY($2) AND protected LIMIT 1;",
+			tenant, removed).Scan(&protected)
+		if err == nil {
+			return fmt.Errorf("%w: %s", domain.ErrSegmentProtected, protected)
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("checking protected segments: %v", err)
+		}
 	}
 
 	return nil
 }
 
-func (sql *Sql) GetUserSegments(ctx context.Context, user int) ([]string, error) {
-	query := "SELECT users_in_segment.segment FROM users_in_segment WHERE user_id=$1"
+// ChangeUsersSegments applies many changes of memberships in a transaction.
+// The changes are copied into a temporary table and checked all at once,
+// then the ones that didn't fail are applied with a single INSERT and a
+// single DELETE. Segments with a members limit are filled in the order of
+// the changes. Prerequisites are checked and removals cascaded in the same
+// transaction. In atomic mode nothing is applied if any change fails.
+func (sql *Sql) ChangeUsersSegments(ctx context.Context, changes []domain.UserSegmentsChange, atomic bool) ([]error, error) {
+	tenant, environment := scope(ctx)
+	errs := make([]error, len(changes))
+
+	type row struct {
+		entry   int
+		user    int
+		segment string
+		adding  bool
+	}
+	var rows []row
+	for i, change := range changes {
+		for _, segment := range change.SegmentsToAdd {
+			rows = append(rows, row{entry: i, user: change.User, segment: segment, adding: true})
+		}
+		for _, segment := range change.SegmentsToDelete {
+			rows = append(rows, row{entry: i, user: change.User, segment: segment})
+		}
+	}
+	if len(rows) == 0 {
+		return errs, nil
+	}
+
+	err := sql.begin(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `CREATE TEMPORARY TABLE bulk_change (entry integer, user_id integer, segment character varying(200), adding boolean)
+			ON COMMIT DROP;`)
+		if err != nil {
+			return fmt.Errorf("creating temporary table: %v", err)
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"bulk_change"}, []string{"entry", "user_id", "segment", "adding"},
+			pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+				return []any{rows[i].entry, rows[i].user, rows[i].segment, rows[i].adding}, nil
+			}))
+		if err != nil {
+			return fmt.Errorf("copying changes: %v", err)
+		}
+
+		// Segments are locked as AddUserToSegment locks them, so that
+		// concurrent additions don't exceed the limits and prerequisites
+		// aren't added meanwhile.
+		locked, err := tx.Query(ctx, `SELECT segment.name, segment.max_members, CASE WHEN segment.max_members IS NULL THEN 0 ELSE
+					(SELECT count(*) FROM users_in_segment WHERE tenant = $1 AND environment = $2 AND segment = segment.name)
+				END
+			FROM segment
+			WHERE tenant = $1 AND name IN (SELECT segment FROM bulk_change WHERE adding)
+			ORDER BY name FOR UPDATE;`, tenant, environment)
+		if err != nil {
+			return fmt.Errorf("locking segments: %v", err)
+		}
+		type limit struct{ max, members int }
+		limits := map[string]*limit{}
+		var name string
+		var maxMembers *int
+		var members int
+		_, err = pgx.ForEachRow(locked, []any{&name, &maxMembers, &members}, func() error {
+			if maxMembers != nil {
+				limits[name] = &limit{max: *maxMembers, members: members}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading limits: %v", err)
+		}
+
+		// The memberships to delete and the ones that satisfy prerequisites
+		// of the additions are locked too, as checkPrerequisites locks
+		// them, so that dependents added concurrently are seen by the
+		// cascade below and prerequisites can't be removed before the
+		// additions commit.
+		_, err = tx.Exec(ctx, `SELECT 1 FROM users_in_segment membership JOIN bulk_change change
+				ON membership.user_id = change.user_id AND membership.segment = change.segment
+			WHERE membership.tenant = $1 AND membership.environment = $2 AND NOT change.adding
+			ORDER BY membership.user_id, membership.segment FOR UPDATE OF membership;`, tenant, environment)
+		if err != nil {
+			return fmt.Errorf("locking memberships: %v", err)
+		}
+		_, err = tx.Exec(ctx, `SELECT 1 FROM users_in_segment membership
+				JOIN bulk_change change ON membership.user_id = change.user_id
+				JOIN segment_prerequisite p ON p.segment = change.segment AND p.prerequisite = membership.segment
+			WHERE membership.tenant = $1 AND membership.environment = $2 AND p.tenant = $1 AND change.adding
+			ORDER BY membership.user_id, membership.segment FOR SHARE OF membership;`, tenant, environment)
+		if err != nil {
+			return fmt.Errorf("locking prerequisites: %v", err)
+		}
+
+		// The domain adds the dependents to the deletions in advance, this
+		// adds the ones it couldn't see, so that they are checked and
+		// deleted along with the rest.
+		_, err = tx.Exec(ctx, `WITH RECURSIVE cascaded (entry, user_id, segment) AS (
+				SELECT entry, user_id, segment FROM bulk_change WHERE NOT adding
+				UNION
+				SELECT cascaded.entry, cascaded.user_id, membership.segment FROM cascaded
+				JOIN segment_prerequisite p ON p.tenant = $1 AND p.prerequisite = cascaded.segment AND p.cascade_removal
+				JOIN users_in_segment membership ON membership.tenant = $1 AND membership.environment = $2
+					AND membership.user_id = cascaded.user_id AND membership.segment = p.segment
+			)
+			INSERT INTO bulk_change (entry, user_id, segment, adding)
+			SELECT entry, user_id, segment, false FROM cascaded
+			WHERE NOT EXISTS (
+				SELECT 1 FROM bulk_change deleted WHERE deleted.entry = cascaded.entry AND NOT deleted.adding AND deleted.segment = cascaded.segment
+			);`, tenant, environment)
+		if err != nil {
+			return fmt.Errorf("cascading deletions: %v", err)
+		}
+
+		failed, err := tx.Query(ctx, `SELECT change.entry, change.segment, CASE
+					WHEN segment.protected THEN 'protected'
+					WHEN NOT change.adding THEN 'missing'
+					WHEN segment.name IS NULL THEN 'not_found'
+					ELSE 'exists'
+				END
+			FROM bulk_change change
+			LEFT JOIN segment ON segment.tenant = $1 AND segment.name = change.segment
+			LEFT JOIN users_in_segment membership ON membership.tenant = $1 AND membership.environment = $2
+				AND membership.user_id = change.user_id AND membership.segment = change.segment
+			WHERE segment.protected
+				OR (change.adding AND (segment.name IS NULL OR membership.user_id IS NOT NULL))
+				OR (NOT change.adding AND membership.user_id IS NULL AND NOT EXISTS (
+					SELECT 1 FROM bulk_change added WHERE added.entry = change.entry AND added.adding AND added.segment = change.segment
+				))
+			ORDER BY change.entry, change.segment;`, tenant, environment)
+		if err != nil {
+			return fmt.Errorf("checking changes: %v", err)
+		}
+		reasons := map[string]error{
+			"protected": domain.ErrSegmentProtected,
+			"missing":   domain.ErrUserHaveNotThisSegment,
+			"not_found": domain.ErrSegmentNotFound,
+			"exists":    domain.ErrUserIsAlreadyHasThisSegment,
+		}
+		var entry int
+		var segment, reason string
+		_, err = pgx.ForEachRow(failed, []any{&entry, &segment, &reason}, func() error {
+			errs[entry] = errors.Join(errs[entry], fmt.Errorf("%w: %s", reasons[reason], segment))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading failed changes: %v", err)
+		}
+
+		// A prerequisite is satisfied by a membership that isn't deleted by
+		// the same change or by an addition of the same change.
+		missing, err := tx.Query(ctx, `SELECT change.entry, p.segment, p.prerequisite
+			FROM bulk_change change JOIN segment_prerequisite p ON p.tenant = $1 AND p.segment = change.segment
+			WHERE change.adding
+				AND NOT EXISTS (
+					SELECT 1 FROM bulk_change added WHERE added.entry = change.entry AND added.adding AND added.segment = p.prerequisite
+				)
+				AND (NOT EXISTS (
+					SELECT 1 FROM users_in_segment membership WHERE membership.tenant = $1 AND membership.environment = $2
+						AND membership.user_id = change.user_id AND membership.segment = p.prerequisite
+				) OR EXISTS (
+					SELECT 1 FROM bulk_change deleted WHERE deleted.entry = change.entry AND NOT deleted.adding AND deleted.segment = p.prerequisite
+				))
+			ORDER BY change.entry, p.segment, p.prerequisite;`, tenant, environment)
+		if err != nil {
+			return fmt.Errorf("checking prerequisites: %v", err)
+		}
+		var prerequisite string
+		_, err = pgx.ForEachRow(missing, []any{&entry, &segment, &prerequisite}, func() error {
+			errs[entry] = errors.Join(errs[entry], fmt.Errorf("%w: %s requires %s", domain.ErrPrerequisiteMissing, segment, prerequisite))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading missing prerequisites: %v", err)
+		}
+
+		for i, change := range changes {
+			if errs[i] != nil {
+				continue
+			}
+			for _, segment := range change.SegmentsToAdd {
+				if l := limits[segment]; l != nil && l.members >= l.max {
+					errs[i] = errors.Join(errs[i], fmt.Errorf("%w: %s", domain.ErrSegmentIsFull, segment))
+				}
+			}
+			if errs[i] != nil {
+				continue
+			}
+			for _, segment := range change.SegmentsToAdd {
+				if l := limits[segment]; l != nil {
+					l.members++
+				}
+			}
+			for _, segment := range change.SegmentsToDelete {
+				if l := limits[segment]; l != nil {
+					l.members--
+				}
+			}
+		}
+
+		// skipped isn't nil, as NULL wouldn't match any entry.
+		skipped := []int{}
+		for i, err := range errs {
+			if err != nil {
+				skipped = append(skipped, i)
+			}
+		}
+		if atomic && len(skipped) > 0 {
+			return nil
+		}
+
+		_, err = tx.Exec(ctx, `INSERT INTO users_in_segment (tenant, environment, user_id, segment)
+			SELECT $1, $2, user_id, segment FROM bulk_change WHERE adding AND NOT (entry = ANY($3));`,
+			tenant, environment, skipped)
+		if err != nil {
+			return fmt.Errorf("inserting memberships: %v", err)
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM users_in_segment membership USING bulk_change change
+			WHERE membership.tenant = $1 AND membership.environment = $2 AND membership.user_id = change.user_id
+				AND membership.segment = change.segment AND NOT change.adding AND NOT (change.entry = ANY($3));`,
+			tenant, environment, skipped)
+		if err != nil {
+			return fmt.Errorf("deleting memberships: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("changing users segments: %w", err)
+	}
+
+	return errs, nil
+}
+
+func (sql *Sql) GetUserSegments(ctx context.Context, user int) ([]domain.Segment, error) {
+	query := `SELECT segment.name, segment.active_from, segment.active_until
+		FROM users_in_segment JOIN segment ON segment.tenant = users_in_segment.tenant AND segment.name = users_in_segment.segment
+		WHERE users_in_segment.tenant = $1 AND users_in_segment.environment = $2 AND users_in_segment.user_id = $3`
 
-	rows, err := sql.dbpool.Query(ctx, query, user)
+	tenant, environment := scope(ctx)
+	rows, err := sql.conn(ctx).Query(ctx, query, tenant, environment, user)
 	if err != nil {
 		return nil, fmt.Errorf("querying rows: %v", err)
 	}
 	defer rows.Close()
 
-	segments, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	segments, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (domain.Segment, error) {
+		var s domain.Segment
+		err := row.Scan(&s.Name, &s.ActiveFrom, &s.ActiveUntil)
+		return s, err
+	})
+	if err != nil {
+		return []domain.Segment{}, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return segments, nil
+}
+
+// GetUsersSegments returns the segments of many users with one query. Users
+// without segments aren't in the map.
+func (sql *Sql) GetUsersSegments(ctx context.Context, users []int) (map[int][]domain.Segment, error) {
+	query := `SELECT users_in_segment.user_id, segment.name, segment.active_from, segment.active_until
+		FROM users_in_segment JOIN segment ON segment.tenant = users_in_segment.tenant AND segment.name = users_in_segment.segment
+		WHERE users_in_segment.tenant = $1 AND users_in_segment.environment = $2 AND users_in_segment.user_id = ANY($3)`
+
+	tenant, environment := scope(ctx)
+	rows, err := sql.conn(ctx).Query(ctx, query, tenant, environment, users)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	segments := map[int][]domain.Segment{}
+	var user int
+	var s domain.Segment
+	_, err = pgx.ForEachRow(rows, []any{&user, &s.Name, &s.ActiveFrom, &s.ActiveUntil}, func() error {
+		segments[user] = append(segments[user], s)
+		return nil
+	})
 	if err != nil {
-		return []string{}, fmt.Errorf("collecting rows: %v", err)
+		return nil, fmt.Errorf("collecting rows: %v", err)
 	}
 
 	return segments, nil
 }
+
+func (sql *Sql) AddSegmentPrerequisite(ctx context.Context, p domain.Prerequisite) error {
+	query := `INSERT INTO segment_prerequisite (tenant, segment, prerequisite, cascade_removal) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant, segment, prerequisite) DO UPDATE SET cascade_removal = EXCLUDED.cascade_removal;`
+
+	_, err := sql.conn(ctx).Exec(ctx, query, domain.TenantFromContext(ctx), p.Segment, p.Prerequisite, p.Cascade)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.ConstraintName == "segment_prerequisite_segment_fkey" ||
+				pgErr.ConstraintName == "segment_prerequisite_prerequisite_fkey" {
+				return domain.ErrSegmentNotFound
+			}
+		}
+
+		return fmt.Errorf("adding prerequisite: %v", err)
+	}
+
+	return nil
+}
+
+func (sql *Sql) DeleteSegmentPrerequisite(ctx context.Context, segment, prerequisite string) error {
+	query := "DELETE FROM segment_prerequisite WHERE tenant = $1 AND segment = $2 AND prerequisite = $3;"
+
+	comTag, err := sql.conn(ctx).Exec(ctx, query, domain.TenantFromContext(ctx), segment, prerequisite)
+	if err != nil {
+		return fmt.Errorf("deleting prerequisite: %v", err)
+	}
+	if comTag.RowsAffected() == 0 {
+		return domain.ErrPrerequisiteNotFound
+	}
+
+	return nil
+}
+
+func (sql *Sql) GetPrerequisites(ctx context.Context) ([]domain.Prerequisite, error) {
+	query := "SELECT segment, prerequisite, cascade_removal FROM segment_prerequisite WHERE tenant = $1;"
+
+	rows, err := sql.conn(ctx).Query(ctx, query, domain.TenantFromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+	defer rows.Close()
+
+	prerequisites, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (domain.Prerequisite, error) {
+		var p domain.Prerequisite
+		err := row.Scan(&p.Segment, &p.Prerequisite, &p.Cascade)
+		return p, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return prerequisites, nil
+}
+
+func (sql *Sql) GetSegmentsOverlap(ctx context.Context, segments []string) ([]domain.SegmentOverlap, error) {
+	tenant, environment := scope(ctx)
+	var overlaps []domain.SegmentOverlap
+
+	// Sizes and intersections are read from the same snapshot so that the
+	// counts agree with each other.
+	err := pgx.BeginTxFunc(ctx, sql.dbpool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		sizesQuery := `SELECT segment.name, count(users_in_segment.user_id)
+			FROM segment LEFT JOIN users_in_segment ON users_in_segment.tenant = segment.tenant
+				AND users_in_segment.environment = $3 AND users_in_segment.segment = segment.name
+			WHERE segment.tenant = $1 AND segment.name = ANY($2)
+			GROUP BY segment.name`
+
+		rows, err := tx.Query(ctx, sizesQuery, tenant, segments, environment)
+		if err != nil {
+			return fmt.Errorf("querying segment sizes: %v", err)
+		}
+
+		sizes := make(map[string]int, len(segments))
+		var name string
+		var members int
+		_, err = pgx.ForEachRow(rows, []any{&name, &members}, func() error {
+			sizes[name] = members
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("collecting segment sizes: %v", err)
+		}
+		if len(sizes) != len(segments) {
+			return domain.ErrSegmentNotFound
+		}
+
+		intersectionsQuery := `SELECT a.segment, b.segment, count(*)
+			FROM users_in_segment a JOIN users_in_segment b ON a.tenant = b.tenant
+				AND a.environment = b.environment AND a.user_id = b.user_id AND a.segment < b.segment
+			WHERE a.tenant = $1 AND a.environment = $3 AND a.segment = ANY($2) AND b.segment = ANY($2)
+			GROUP BY a.segment, b.segment`
+
+		rows, err = tx.Query(ctx, intersectionsQuery, tenant, segments, environment)
+		if err != nil {
+			return fmt.Errorf("querying segment intersections: %v", err)
+		}
+
+		both := make(map[[2]string]int)
+		var first, second string
+		var count int
+		_, err = pgx.ForEachRow(rows, []any{&first, &second, &count}, func() error {
+			// Postgres orders the pair by its own collation, so remember both.
+			both[[2]string{first, second}] = count
+			both[[2]string{second, first}] = count
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("collecting segment intersections: %v", err)
+		}
+
+		for i := range segments {
+			for j := i + 1; j < len(segments); j++ {
+				a, b := segments[i], segments[j]
+				overlaps = append(overlaps, domain.SegmentOverlap{
+					First:         a,
+					Second:        b,
+					FirstMembers:  sizes[a],
+					SecondMembers: sizes[b],
+					Both:          both[[2]string{a, b}],
+				})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting segments overlap: %w", err)
+	}
+
+	return overlaps, nil
+}
+
+// SnapshotSegmentSizes records sizes of segments of all tenants at once, in
+// the default environment and in every environment the segment is used in.
+func (sql *Sql) SnapshotSegmentSizes(ctx context.Context, at time.Time) error {
+	query := `INSERT INTO segment_size (tenant, environment, segment, taken_at, members)
+		SELECT segment.tenant, environments.environment, segment.name, $1, count(users_in_segment.user_id)
+		FROM segment
+		CROSS JOIN LATERAL (
+			SELECT $2::character varying AS environment
+			UNION SELECT environment FROM users_in_segment
+				WHERE users_in_segment.tenant = segment.tenant AND users_in_segment.segment = segment.name
+			UNION SELECT environment FROM segment_environment
+				WHERE segment_environment.tenant = segment.tenant AND segment_environment.segment = segment.name
+		) environments
+		LEFT JOIN users_in_segment ON users_in_segment.tenant = segment.tenant
+			AND users_in_segment.environment = environments.environment AND users_in_segment.segment = segment.name
+		GROUP BY segment.tenant, environments.environment, segment.name
+		ON CONFLICT (tenant, environment, segment, taken_at) DO NOTHING;`
+
+	if _, err := sql.conn(ctx).Exec(ctx, query, at, domain.DefaultEnvironment); err != nil {
+		return fmt.Errorf("inserting segment sizes: %v", err)
+	}
+
+	return nil
+}
+
+func (sql *Sql) GetSegmentSizeHistory(ctx context.Context, segment string, from, to time.Time, granularity domain.Granularity) ([]domain.SegmentSize, error) {
+	tenant, environment := scope(ctx)
+
+	var exists bool
+	err := sql.conn(ctx).QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM segment WHERE tenant = $1 AND name = $2);", tenant, segment).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("checking segment: %v", err)
+	}
+	if !exists {
+		return nil, domain.ErrSegmentNotFound
+	}
+
+	// Buckets are cut in UTC whatever the time zone of the session is.
+	query := `SELECT DISTINCT ON (bucket) date_trunc($3, taken_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS bucket, members
+		FROM segment_size
+		WHERE tenant = $1 AND environment = $6 AND segment = $2 AND taken_at >= $4 AND taken_at < $5
+		ORDER BY bucket, taken_at DESC`
+
+	rows, err := sql.conn(ctx).Query(ctx, query, tenant, segment, string(granularity), from, to, environment)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+	defer rows.Close()
+
+	sizes, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (domain.SegmentSize, error) {
+		var s domain.SegmentSize
+		err := row.Scan(&s.At, &s.Members)
+		return s, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return sizes, nil
+}
+
+func (sql *Sql) ExportState(ctx context.Context) (domain.State, error) {
+	var state domain.State
+
+	err := pgx.BeginTxFunc(ctx, sql.dbpool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		var err error
+		state, err = readState(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return domain.State{}, fmt.Errorf("exporting state: %w", err)
+	}
+
+	return state, nil
+}
+
+// readState reads the state of the tenant and environment of ctx.
+func readState(ctx context.Context, tx pgx.Tx) (domain.State, error) {
+	tenant, environment := scope(ctx)
+	var state domain.State
+
+	rows, err := tx.Query(ctx, `SELECT segment.name, segment.active_from, segment.active_until, segment.max_members, segment_environment.percentage
+		FROM segment LEFT JOIN segment_environment ON segment_environment.tenant = segment.tenant
+			AND segment_environment.segment = segment.name AND segment_environment.environment = $2
+		WHERE segment.tenant = $1 ORDER BY segment.name;`, tenant, environment)
+	if err != nil {
+		return domain.State{}, fmt.Errorf("querying segments: %v", err)
+	}
+	state.Segments, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (domain.SegmentDetails, error) {
+		var s domain.SegmentDetails
+		err := row.Scan(&s.Name, &s.ActiveFrom, &s.ActiveUntil, &s.MaxMembers, &s.Percentage)
+		return s, err
+	})
+	if err != nil {
+		return domain.State{}, fmt.Errorf("collecting segments: %v", err)
+	}
+
+	rows, err = tx.Query(ctx, `SELECT segment, prerequisite, cascade_removal FROM segment_prerequisite
+		WHERE tenant = $1 ORDER BY segment, prerequisite;`, tenant)
+	if err != nil {
+		return domain.State{}, fmt.Errorf("querying prerequisites: %v", err)
+	}
+	state.Prerequisites, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (domain.Prerequisite, error) {
+		var p domain.Prerequisite
+		err := row.Scan(&p.Segment, &p.Prerequisite, &p.Cascade)
+		return p, err
+	})
+	if err != nil {
+		return domain.State{}, fmt.Errorf("collecting prerequisites: %v", err)
+	}
+
+	rows, err = tx.Query(ctx, `SELECT user_id, segment FROM users_in_segment
+		WHERE tenant = $1 AND environment = $2 ORDER BY segment, user_id;`, tenant, environment)
+	if err != nil {
+		return domain.State{}, fmt.Errorf("querying memberships: %v", err)
+	}
+	state.Memberships, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (domain.Membership, error) {
+		var m domain.Membership
+		err := row.Scan(&m.User, &m.Segment)
+		return m, err
+	})
+	if err != nil {
+		return domain.State{}, fmt.Errorf("collecting memberships: %v", err)
+	}
+
+	return state, nil
+}
+
+// ImportState writes the state in a single transaction. In replace mode
+// everything that's not in the state is removed first, segments that stay
+// keep their size history. Memberships and percentages are only replaced in
+// the environment of ctx, but removed segments are gone from all of them.
+//
+// Before writing, validate is given the current state, which is empty in
+// replace mode, and the protected segments, and nothing is written if it
+// fails. The segments of the tenant are locked meanwhile, which holds off
+// changes of their settings, prerequisites and additions of members, and
+// so are the memberships of the imported users, which holds off removals
+// the archive may rely on as prerequisites.
+func (sql *Sql) ImportState(ctx context.Context, state domain.State, replace bool, validate func(current domain.State, protected []string) error) error {
+	tenant, environment := scope(ctx)
+
+	err := sql.begin(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT name, protected FROM segment WHERE tenant = $1 ORDER BY name FOR UPDATE;", tenant)
+		if err != nil {
+			return fmt.Errorf("locking segments: %v", err)
+		}
+		var protected []string
+		var name string
+		var isProtected bool
+		_, err = pgx.ForEachRow(rows, []any{&name, &isProtected}, func() error {
+			if isProtected {
+				protected = append(protected, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading segments: %v", err)
+		}
+
+		users := make([]int, 0, len(state.Memberships))
+		for _, m := range state.Memberships {
+			users = append(users, m.User)
+		}
+		_, err = tx.Exec(ctx, `SELECT 1 FROM users_in_segment WHERE tenant = $1 AND environment = $2 AND user_id = ANY($3)
+			ORDER BY user_id, segment FOR SHARE;`, tenant, environment, users)
+		if err != nil {
+			return fmt.Errorf("locking memberships: %v", err)
+		}
+
+		var current domain.State
+		if !replace {
+			current, err = readState(ctx, tx)
+			if err != nil {
+				return err
+			}
+		}
+		if err := validate(current, protected); err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(state.Segments))
+		for _, s := range state.Segments {
+			names = append(names, s.Name)
+		}
+
+		if replace {
+			_, err = tx.Exec(ctx, "DELETE FROM users_in_segment WHERE tenant = $1 AND environment = $2;", tenant, environment)
+			if err != nil {
+				return fmt.Errorf("clearing memberships: %v", err)
+			}
+			_, err = tx.Exec(ctx, "DELETE FROM segment_environment WHERE tenant = $1 AND environment = $2;", tenant, environment)
+			if err != nil {
+				return fmt.Errorf("clearing percentages: %v", err)
+			}
+			if _, err := tx.Exec(ctx, "DELETE FROM segment_prerequisite WHERE tenant = $1;", tenant); err != nil {
+				return fmt.Errorf("clearing prerequisites: %v", err)
+			}
+			if _, err := tx.Exec(ctx, "DELETE FROM segment WHERE tenant = $1 AND NOT (name = ANY($2));", tenant, names); err != nil {
+				return fmt.Errorf("deleting segments: %v", err)
+			}
+		}
+
+		batch := &pgx.Batch{}
+		for _, s := range state.Segments {
+			batch.Queue(`INSERT INTO segment (tenant, name, active_from, active_until, max_members) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (tenant, name) DO UPDATE SET active_from = EXCLUDED.active_from,
+					active_until = EXCLUDED.active_until, max_members = EXCLUDED.max_members;`,
+				tenant, s.Name, s.ActiveFrom, s.ActiveUntil, s.MaxMembers)
+			if s.Percentage != nil {
+				batch.Queue(`INSERT INTO segment_environment (tenant, segment, environment, percentage) VALUES ($1, $2, $3, $4)
+					ON CONFLICT (tenant, segment, environment) DO UPDATE SET percentage = EXCLUDED.percentage;`,
+					tenant, s.Name, environment, s.Percentage)
+			}
+		}
+		for _, p := range state.Prerequisites {
+			batch.Queue(`INSERT INTO segment_prerequisite (tenant, segment, prerequisite, cascade_removal) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (tenant, segment, prerequisite) DO UPDATE SET cascade_removal = EXCLUDED.cascade_removal;`,
+				tenant, p.Segment, p.Prerequisite, p.Cascade)
+		}
+		if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+			return fmt.Errorf("inserting segments: %v", err)
+		}
+
+		// Memberships are copied into a temporary table first, COPY itself
+		// can't skip the ones that already exist.
+		_, err = tx.Exec(ctx, "CREATE TEMPORARY TABLE imported_membership (user_id integer, segment character varying(200)) ON COMMIT DROP;")
+		if err != nil {
+			return fmt.Errorf("creating temporary table: %v", err)
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"imported_membership"}, []string{"user_id", "segment"},
+			pgx.CopyFromSlice(len(state.Memberships), func(i int) ([]any, error) {
+				return []any{state.Memberships[i].User, state.Memberships[i].Segment}, nil
+			}))
+		if err != nil {
+			return fmt.Errorf("copying memberships: %v", err)
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO users_in_segment (tenant, environment, user_id, segment)
+			SELECT DISTINCT $1, $2, user_id, segment FROM imported_membership
+			ON CONFLICT (tenant, environment, user_id, segment) DO NOTHING;`, tenant, environment)
+		if err != nil {
+			return fmt.Errorf("inserting memberships: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("importing state: %w", err)
+	}
+
+	return nil
+}
+
+func (sql *Sql) SetSegmentPercentage(ctx context.Context, name string, percentage *int) error {
+	tenant, environment := scope(ctx)
+
+	if percentage == nil {
+		var exists bool
+		err := sql.conn(ctx).QueryRow(ctx, `WITH deleted AS (
+				DELETE FROM segment_environment WHERE tenant = $1 AND segment = $2 AND environment = $3
+			)
+			SELECT EXISTS (SELECT 1 FROM segment WHERE tenant = $1 AND name = $2);`, tenant, name, environment).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("deleting segment percentage: %v", err)
+		}
+		if !exists {
+			return domain.ErrSegmentNotFound
+		}
+		return nil
+	}
+
+	query := `INSERT INTO segment_environment (tenant, segment, environment, percentage) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant, segment, environment) DO UPDATE SET percentage = EXCLUDED.percentage;`
+
+	_, err := sql.conn(ctx).Exec(ctx, query, tenant, name, environment, percentage)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgErr.ConstraintName == "segment_environment_segment_fkey" {
+				return domain.ErrSegmentNotFound
+			}
+		}
+
+		return fmt.Errorf("setting segment percentage: %v", err)
+	}
+
+	return nil
+}
+
+func (sql *Sql) GetRolloutSegments(ctx context.Context) ([]domain.RolloutSegment, error) {
+	query := `SELECT segment.name, segment.active_from, segment.active_until, segment_environment.percentage
+		FROM segment JOIN segment_environment ON segment_environment.tenant = segment.tenant
+			AND segment_environment.segment = segment.name
+		WHERE segment.tenant = $1 AND segment_environment.environment = $2 AND segment_environment.percentage > 0`
+
+	tenant, environment := scope(ctx)
+	rows, err := sql.conn(ctx).Query(ctx, query, tenant, environment)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+	defer rows.Close()
+
+	segments, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (domain.RolloutSegment, error) {
+		var s domain.RolloutSegment
+		err := row.Scan(&s.Name, &s.ActiveFrom, &s.ActiveUntil, &s.Percentage)
+		return s, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return segments, nil
+}
+
+func (sql *Sql) PromoteEnvironment(ctx context.Context, from, to string, segments []string, withMembers bool) error {
+	tenant := domain.TenantFromContext(ctx)
+
+	err := sql.begin(ctx, func(tx pgx.Tx) error {
+		if len(segments) == 0 {
+			rows, err := tx.Query(ctx, "SELECT name FROM segment WHERE tenant = $1 FOR SHARE;", tenant)
+			if err != nil {
+				return fmt.Errorf("querying segments: %v", err)
+			}
+			segments, err = pgx.CollectRows(rows, pgx.RowTo[string])
+			if err != nil {
+				return fmt.Errorf("collecting segments: %v", err)
+			}
+		} else {
+			segments = slices.Clone(segments)
+			slices.Sort(segments)
+			segments = slices.Compact(segments)
+
+			var found int
+			err := tx.QueryRow(ctx, `SELECT count(*) FROM (
+					SELECT 1 FROM segment WHERE tenant = $1 AND name = ANY($2) FOR SHARE
+				) AS locked;`, tenant, segments).Scan(&found)
+			if err != nil {
+				return fmt.Errorf("checking segments: %v", err)
+			}
+			if found != len(segments) {
+				return domain.ErrSegmentNotFound
+			}
+		}
+
+		_, err := tx.Exec(ctx, "DELETE FROM segment_environment WHERE tenant = $1 AND environment = $2 AND segment = ANY($3);",
+			tenant, to, segments)
+		if err != nil {
+			return fmt.Errorf("deleting percentages: %v", err)
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO segment_environment (tenant, segment, environment, percentage)
+			SELECT tenant, segment, $3, percentage FROM segment_environment
+			WHERE tenant = $1 AND environment = $2 AND segment = ANY($4);`, tenant, from, to, segments)
+		if err != nil {
+			return fmt.Errorf("copying percentages: %v", err)
+		}
+
+		if !withMembers {
+			return nil
+		}
+
+		_, err = tx.Exec(ctx, "DELETE FROM users_in_segment WHERE tenant = $1 AND environment = $2 AND segment = ANY($3);",
+			tenant, to, segments)
+		if err != nil {
+			return fmt.Errorf("deleting members: %v", err)
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO users_in_segment (tenant, environment, user_id, segment)
+			SELECT tenant, $3, user_id, segment FROM users_in_segment
+			WHERE tenant = $1 AND environment = $2 AND segment = ANY($4);`, tenant, from, to, segments)
+		if err != nil {
+			return fmt.Errorf("copying members: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("promoting environment: %w", err)
+	}
+
+	return nil
+}
+
+func (sql *Sql) SetSegmentProtected(ctx context.Context, name string, protected bool) error {
+	query := "UPDATE segment SET protected = $3 WHERE tenant = $1 AND name = $2;"
+
+	comTag, err := sql.conn(ctx).Exec(ctx, query, domain.TenantFromContext(ctx), name, protected)
+	if err != nil {
+		return fmt.Errorf("setting segment protection: %v", err)
+	}
+	if comTag.RowsAffected() == 0 {
+		return domain.ErrSegmentNotFound
+	}
+
+	return nil
+}
+
+func (sql *Sql) GetProtectedSegments(ctx context.Context) ([]string, error) {
+	rows, err := sql.conn(ctx).Query(ctx, "SELECT name FROM segment WHERE tenant = $1 AND protected;", domain.TenantFromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	segments, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return segments, nil
+}
+
+func (sql *Sql) CreateChangeRequest(ctx context.Context, cr domain.ChangeRequest) (int64, error) {
+	query := `INSERT INTO change_request (tenant, environment, kind, segment, user_id, segments_to_add, segments_to_delete,
+			active_from, active_until, max_members, percentage, author, status, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING id;`
+
+	var id int64
+	err := sql.conn(ctx).QueryRow(ctx, query, domain.TenantFromContext(ctx), cr.Environment, string(cr.Kind), cr.Segment, cr.User,
+		cr.SegmentsToAdd, cr.SegmentsToDelete, cr.ActiveFrom, cr.ActiveUntil, cr.MaxMembers, cr.Percentage,
+		cr.Author, string(cr.Status), cr.CreatedAt).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("inserting change request: %v", err)
+	}
+
+	return id, nil
+}
+
+const changeRequestColumns = `id, kind, environment, coalesce(segment, ''), user_id, segments_to_add, segments_to_delete,
+	active_from, active_until, max_members, percentage,
+	author, status, coalesce(reviewer, ''), coalesce(error, ''), created_at, reviewed_at, operation_id`
+
+func scanChangeRequest(row pgx.CollectableRow) (domain.ChangeRequest, error) {
+	var cr domain.ChangeRequest
+	err := row.Scan(&cr.ID, &cr.Kind, &cr.Environment, &cr.Segment, &cr.User, &cr.SegmentsToAdd, &cr.SegmentsToDelete,
+		&cr.ActiveFrom, &cr.ActiveUntil, &cr.MaxMembers, &cr.Percentage,
+		&cr.Author, &cr.Status, &cr.Reviewer, &cr.Error, &cr.CreatedAt, &cr.ReviewedAt, &cr.Operation)
+	return cr, err
+}
+
+func (sql *Sql) GetChangeRequest(ctx context.Context, id int64) (domain.ChangeRequest, error) {
+	query := "SELECT " + changeRequestColumns + " FROM change_request WHERE tenant = $1 AND id = $2;"
+
+	rows, err := sql.conn(ctx).Query(ctx, query, domain.TenantFromContext(ctx), id)
+	if err != nil {
+		return domain.ChangeRequest{}, fmt.Errorf("querying change request: %v", err)
+	}
+
+	cr, err := pgx.CollectOneRow(rows, scanChangeRequest)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.ChangeRequest{}, domain.ErrChangeRequestNotFound
+		}
+		return domain.ChangeRequest{}, fmt.Errorf("collecting change request: %v", err)
+	}
+
+	return cr, nil
+}
+
+// GetChangeRequests returns the newest change requests first, an empty
+// status means requests in any status.
+func (sql *Sql) GetChangeRequests(ctx context.Context, status domain.ChangeStatus) ([]domain.ChangeRequest, error) {
+	query := "SELECT " + changeRequestColumns + ` FROM change_request
+		WHERE tenant = $1 AND ($2 = '' OR status = $2)
+		ORDER BY id DESC;`
+
+	rows, err := sql.conn(ctx).Query(ctx, query, domain.TenantFromContext(ctx), string(status))
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	requests, err := pgx.CollectRows(rows, scanChangeRequest)
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return requests, nil
+}
+
+// ReviewChangeRequest moves the change request from the given status, so
+// that concurrent reviews can't both succeed.
+func (sql *Sql) ReviewChangeRequest(ctx context.Context, id int64, from domain.ChangeStatus, review domain.Review) error {
+	query := `UPDATE change_request SET status = $4, reviewer = $5, error = NULLIF($6, ''), reviewed_at = $7, operation_id = $8
+		WHERE tenant = $1 AND id = $2 AND status = $3;`
+
+	comTag, err := sql.conn(ctx).Exec(ctx, query, domain.TenantFromContext(ctx), id, string(from),
+		string(review.Status), review.Reviewer, review.Error, review.At, review.Operation)
+	if err != nil {
+		return fmt.Errorf("updating change request: %v", err)
+	}
+	if comTag.RowsAffected() == 0 {
+		return domain.ErrChangeRequestNotPending
+	}
+
+	return nil
+}
+
+const changeColumns = "seq, type, segment, user_id, coalesce(actor, ''), created_at"
+
+func scanChange(row pgx.CollectableRow) (domain.Change, error) {
+	var c domain.Change
+	err := row.Scan(&c.Seq, &c.Type, &c.Segment, &c.User, &c.Actor, &c.At)
+	return c, err
+}
+
+func (sql *Sql) GetChanges(ctx context.Context, after int64, limit int) ([]domain.Change, error) {
+	query := "SELECT " + changeColumns + ` FROM change_log
+		WHERE tenant = $1 AND (environment = $2 OR environment IS NULL) AND seq > $3
+		ORDER BY seq LIMIT $4;`
+
+	tenant, environment := scope(ctx)
+	rows, err := sql.conn(ctx).Query(ctx, query, tenant, environment, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	changes, err := pgx.CollectRows(rows, scanChange)
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return changes, nil
+}
+
+// GetChangesBetween returns changes made in [from, to) after the seq,
+// oldest first.
+func (sql *Sql) GetChangesBetween(ctx context.Context, from, to time.Time, after int64, limit int) ([]domain.Change, error) {
+	query := "SELECT " + changeColumns + ` FROM change_log
+		WHERE tenant = $1 AND (environment = $2 OR environment IS NULL) AND created_at >= $3 AND created_at < $4 AND seq > $5
+		ORDER BY seq LIMIT $6;`
+
+	tenant, environment := scope(ctx)
+	rows, err := sql.conn(ctx).Query(ctx, query, tenant, environment, from, to, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	changes, err := pgx.CollectRows(rows, scanChange)
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return changes, nil
+}
+
+// GetUserSegmentsAsOf replays the last change of every membership of the
+// user made up to the moment.
+func (sql *Sql) GetUserSegmentsAsOf(ctx context.Context, user int, at time.Time) ([]string, error) {
+	query := `SELECT segment FROM (
+			SELECT DISTINCT ON (segment) segment, type FROM change_log
+			WHERE tenant = $1 AND environment = $2 AND user_id = $3 AND created_at <= $4
+				AND type IN ('member_added', 'member_removed')
+			ORDER BY segment, seq DESC
+		) last_change
+		WHERE type = 'member_added'
+		ORDER BY segment;`
+
+	tenant, environment := scope(ctx)
+	rows, err := sql.conn(ctx).Query(ctx, query, tenant, environment, user, at)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	segments, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return segments, nil
+}
+
+// GetUserChanges returns changes of the user's memberships made in
+// (from, to], oldest first.
+func (sql *Sql) GetUserChanges(ctx context.Context, user int, from, to time.Time) ([]domain.Change, error) {
+	query := "SELECT " + changeColumns + ` FROM change_log
+		WHERE tenant = $1 AND environment = $2 AND user_id = $3 AND created_at > $4 AND created_at <= $5
+			AND type IN ('member_added', 'member_removed')
+		ORDER BY seq;`
+
+	tenant, environment := scope(ctx)
+	rows, err := sql.conn(ctx).Query(ctx, query, tenant, environment, user, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	changes, err := pgx.CollectRows(rows, scanChange)
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return changes, nil
+}
+
+func (sql *Sql) GetChangesCursor(ctx context.Context) (int64, error) {
+	query := "SELECT coalesce(max(seq), 0) FROM change_log WHERE tenant = $1;"
+
+	var cursor int64
+	err := sql.conn(ctx).QueryRow(ctx, query, domain.TenantFromContext(ctx)).Scan(&cursor)
+	if err != nil {
+		return 0, fmt.Errorf("querying cursor: %v", err)
+	}
+
+	return cursor, nil
+}
+
+func (sql *Sql) GetUserVersion(ctx context.Context, user int) (domain.UserVersion, error) {
+	query := `SELECT
+		coalesce((SELECT version FROM user_version WHERE tenant = $1 AND environment = $2 AND user_id = $3), 0),
+		coalesce((SELECT version FROM segments_version WHERE tenant = $1), 0);`
+
+	tenant, environment := scope(ctx)
+	var v domain.UserVersion
+	err := sql.conn(ctx).QueryRow(ctx, query, tenant, environment, user).Scan(&v.Memberships, &v.Segments)
+	if err != nil {
+		return domain.UserVersion{}, fmt.Errorf("querying user version: %v", err)
+	}
+
+	return v, nil
+}
+
+func (sql *Sql) CreateJob(ctx context.Context, job domain.Job) (int64, error) {
+	query := `INSERT INTO job (tenant, environment, kind, actor, status, input, result, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id;`
+
+	var id int64
+	err := sql.conn(ctx).QueryRow(ctx, query, job.Tenant, job.Environment, string(job.Kind), job.Actor, string(job.Status),
+		[]byte(job.Input), []byte(job.Result), job.CreatedAt).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("inserting job: %v", err)
+	}
+
+	return id, nil
+}
+
+const jobColumns = `id, kind, tenant, environment, actor, status, input, state, result, coalesce(error, ''), attempt,
+	created_at, started_at, finished_at`
+
+func scanJob(row pgx.CollectableRow) (domain.Job, error) {
+	var job domain.Job
+	err := row.Scan(&job.ID, &job.Kind, &job.Tenant, &job.Environment, &job.Actor, &job.Status,
+		(*[]byte)(&job.Input), (*[]byte)(&job.State), (*[]byte)(&job.Result), &job.Error, &job.Attempt, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+	return job, err
+}
+
+func (sql *Sql) GetJob(ctx context.Context, id int64) (domain.Job, error) {
+	query := "SELECT " + jobColumns + " FROM job WHERE tenant = $1 AND id = $2;"
+
+	rows, err := sql.conn(ctx).Query(ctx, query, domain.TenantFromContext(ctx), id)
+	if err != nil {
+		return domain.Job{}, fmt.Errorf("querying job: %v", err)
+	}
+
+	job, err := pgx.CollectOneRow(rows, scanJob)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.Job{}, domain.ErrJobNotFound
+		}
+		return domain.Job{}, fmt.Errorf("collecting job: %v", err)
+	}
+
+	return job, nil
+}
+
+// GetJobs returns the newest jobs first, an empty kind means jobs of any
+// kind.
+func (sql *Sql) GetJobs(ctx context.Context, kind domain.JobKind, limit int) ([]domain.Job, error) {
+	query := "SELECT " + jobColumns + ` FROM job
+		WHERE tenant = $1 AND ($2 = '' OR kind = $2)
+		ORDER BY id DESC LIMIT $3;`
+
+	rows, err := sql.conn(ctx).Query(ctx, query, domain.TenantFromContext(ctx), string(kind), limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	jobs, err := pgx.CollectRows(rows, scanJob)
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return jobs, nil
+}
+
+// ClaimJob takes the job with the id, or the oldest one of any tenant if
+// the id is zero, if it's pending or its lease has passed. It returns nil if
+// there is no such job. Jobs locked by other claims are skipped, so workers
+// never wait for each other.
+func (sql *Sql) ClaimJob(ctx context.Context, id int64, lease time.Duration) (*domain.Job, error) {
+	query := `UPDATE job SET status = 'running', attempt = attempt + 1, locked_until = now() + $2::interval,
+			started_at = coalesce(started_at, now())
+		WHERE id = (
+			SELECT id FROM job
+			WHERE ($1::bigint = 0 OR id = $1) AND (status = 'pending' OR (status = 'running' AND locked_until < now()))
+			ORDER BY id LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + jobColumns + ";"
+
+	rows, err := sql.conn(ctx).Query(ctx, query, id, lease)
+	if err != nil {
+		return nil, fmt.Errorf("claiming job: %v", err)
+	}
+
+	job, err := pgx.CollectOneRow(rows, scanJob)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("collecting job: %v", err)
+	}
+
+	return &job, nil
+}
+
+// SaveJob stores the progress of a claimed job and extends its lease, or
+// releases it once the job is finished. It fails with domain.ErrJobLost if
+// the job was claimed again since.
+func (sql *Sql) SaveJob(ctx context.Context, job domain.Job, lease time.Duration) error {
+	query := `UPDATE job SET status = $3, state = $4, result = $5, error = NULLIF($6, ''), finished_at = $7,
+			locked_until = CASE WHEN $3 = 'running' THEN now() + $8::interval END
+		WHERE id = $1 AND attempt = $2;`
+
+	comTag, err := sql.conn(ctx).Exec(ctx, query, job.ID, job.Attempt, string(job.Status), []byte(job.State), []byte(job.Result), job.Error,
+		job.FinishedAt, lease)
+	if err != nil {
+		return fmt.Errorf("updating job: %v", err)
+	}
+	if comTag.RowsAffected() == 0 {
+		return domain.ErrJobLost
+	}
+
+	return nil
+}
+
+// SetJobUsers stores the users of the job in their order, in place of any
+// stored before.
+func (sql *Sql) SetJobUsers(ctx context.Context, job int64, users []int) error {
+	return pgx.BeginFunc(ctx, sql.conn(ctx), func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "DELETE FROM job_user WHERE job_id = $1;", job); err != nil {
+			return fmt.Errorf("deleting job users: %v", err)
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO job_user (job_id, position, user_id)
+			SELECT $1, u.position - 1, u.user_id FROM unnest($2::integer[]) WITH ORDINALITY AS u (user_id, position);`, job, users)
+		if err != nil {
+			return fmt.Errorf("inserting job users: %v", err)
+		}
+		return nil
+	})
+}
+
+// GetJobUsers returns up to limit users of the job, starting from the one at
+// offset.
+func (sql *Sql) GetJobUsers(ctx context.Context, job int64, offset, limit int) ([]int, error) {
+	query := `SELECT user_id FROM job_user WHERE job_id = $1 AND position >= $2
+		ORDER BY position LIMIT $3;`
+
+	rows, err := sql.conn(ctx).Query(ctx, query, job, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying rows: %v", err)
+	}
+
+	users, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, fmt.Errorf("collecting rows: %v", err)
+	}
+
+	return users, nil
+}
+
+func (sql *Sql) CreateOperation(ctx context.Context, user int) (int64, error) {
+	query := `INSERT INTO operation (tenant, environment, user_id, actor)
+		VALUES ($1, $2, $3, NULLIF($4, '')) RETURNING id;`
+
+	tenant, environment := scope(ctx)
+	var id int64
+	err := sql.conn(ctx).QueryRow(ctx, query, tenant, environment, user, domain.ActorFromContext(ctx)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("inserting operation: %v", err)
+	}
+
+	return id, nil
+}
+
+// DeleteOperation deletes an operation that changed nothing.
+func (sql *Sql) DeleteOperation(ctx context.Context, id int64) error {
+	tenant, environment := scope(ctx)
+	_, err := sql.conn(ctx).Exec(ctx, "DELETE FROM operation WHERE tenant = $1 AND environment = $2 AND id = $3;", tenant, environment, id)
+	if err != nil {
+		return fmt.Errorf("deleting operation: %v", err)
+	}
+
+	return nil
+}
+
+// GetOperation returns the operation with its net changes of memberships: a
+// segment the user was added to and then removed from is in neither list.
+func (sql *Sql) GetOperation(ctx context.Context, id int64) (domain.Operation, error) {
+	tenant, environment := scope(ctx)
+
+	var op domain.Operation
+	err := sql.conn(ctx).QueryRow(ctx, `SELECT id, user_id, coalesce(actor, ''), created_at, undone_by FROM operation
+		WHERE tenant = $1 AND environment = $2 AND id = $3;`, tenant, environment, id).
+		Scan(&op.ID, &op.User, &op.Actor, &op.CreatedAt, &op.UndoneBy)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.Operation{}, domain.ErrOperationNotFound
+		}
+		return domain.Operation{}, fmt.Errorf("querying operation: %v", err)
+	}
+
+	rows, err := sql.conn(ctx).Query(ctx, "SELECT segment, type FROM change_log WHERE operation_id = $1 ORDER BY seq;", id)
+	if err != nil {
+		return domain.Operation{}, fmt.Errorf("querying changes: %v", err)
+	}
+	type change struct {
+		segment    string
+		changeType domain.ChangeType
+	}
+	changes, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (change, error) {
+		var c change
+		err := row.Scan(&c.segment, &c.changeType)
+		return c, err
+	})
+	if err != nil {
+		return domain.Operation{}, fmt.Errorf("collecting changes: %v", err)
+	}
+
+	// A segment is changed if its first change differs from the last.
+	first := map[string]domain.ChangeType{}
+	last := map[string]domain.ChangeType{}
+	var segments []string
+	for _, c := range changes {
+		if _, ok := first[c.segment]; !ok {
+			first[c.segment] = c.changeType
+			segments = append(segments, c.segment)
+		}
+		last[c.segment] = c.changeType
+	}
+	for _, segment := range segments {
+		switch {
+		case first[segment] == domain.ChangeMemberAdded && last[segment] == domain.ChangeMemberAdded:
+			op.Added = append(op.Added, segment)
+		case first[segment] == domain.ChangeMemberRemoved && last[segment] == domain.ChangeMemberRemoved:
+			op.Removed = append(op.Removed, segment)
+		}
+	}
+
+	return op, nil
+}
+
+// UndoOperation reverts the changes of the operation within a new one. The
+// operation row is locked first, so that it's undone only once.
+func (sql *Sql) UndoOperation(ctx context.Context, op domain.Operation) (int64, error) {
+	tenant, environment := scope(ctx)
+	var undo int64
+
+	err := sql.begin(ctx, func(tx pgx.Tx) error {
+		var undoneBy *int64
+		err := tx.QueryRow(ctx, "SELECT undone_by FROM operation WHERE tenant = $1 AND environment = $2 AND id = $3 FOR UPDATE;",
+			tenant, environment, op.ID).Scan(&undoneBy)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return domain.ErrOperationNotFound
+			}
+			return fmt.Errorf("locking operation: %v", err)
+		}
+		if undoneBy != nil {
+			return domain.ErrOperationUndone
+		}
+
+		var changedLater bool
+		err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM change_log
+			WHERE tenant = $1 AND environment = $2 AND user_id = $3 AND segment = ANY($4)
+				AND seq > (SELECT max(seq) FROM change_log WHERE operation_id = $5));`,
+			tenant, environment, op.User, append(slices.Clone(op.Added), op.Removed...), op.ID).Scan(&changedLater)
+		if err != nil {
+			return fmt.Errorf("checking later changes: %v", err)
+		}
+		if changedLater {
+			return domain.ErrUndoConflict
+		}
+
+		err = tx.QueryRow(ctx, `INSERT INTO operation (tenant, environment, user_id, actor)
+			VALUES ($1, $2, $3, NULLIF($4, '')) RETURNING id;`, tenant, environment, op.User, domain.ActorFromContext(ctx)).Scan(&undo)
+		if err != nil {
+			return fmt.Errorf("inserting operation: %v", err)
+		}
+		if _, err := tx.Exec(ctx, settingsQuery, settings(domain.WithOperation(ctx, undo))...); err != nil {
+			return fmt.Errorf("setting operation: %v", err)
+		}
+
+		// Changes that aren't committed yet don't show in change_log, so
+		// every membership is checked again as it's reverted.
+		for _, segment := range op.Added {
+			ct, err := tx.Exec(ctx, "DELETE FROM users_in_segment WHERE tenant = $1 AND environment = $2 AND user_id = $3 AND segment = $4;",
+				tenant, environment, op.User, segment)
+			if err != nil {
+				return fmt.Errorf("deleting user from segment: %v", err)
+			}
+			if ct.RowsAffected() == 0 {
+				return domain.ErrUndoConflict
+			}
+		}
+		if err := addUserToSegments(ctx, tx, op.User, op.Removed); err != nil {
+			if errors.Is(err, domain.ErrSegmentNotFound) || errors.Is(err, domain.ErrUserIsAlreadyHasThisSegment) ||
+				errors.Is(err, domain.ErrPrerequisiteMissing) {
+				return domain.ErrUndoConflict
+			}
+			return err
+		}
+
+		// Segments added later may require the ones the operation added.
+		// Reverting can't remove the user from them, as they aren't a part
+		// of the operation, so it conflicts instead of leaving them without
+		// their prerequisites.
+		var dependent bool
+		err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users_in_segment membership
+			JOIN segment_prerequisite p ON p.tenant = membership.tenant AND p.segment = membership.segment
+			WHERE membership.tenant = $1 AND membership.environment = $2 AND membership.user_id = $3 AND p.prerequisite = ANY($4));`,
+			tenant, environment, op.User, op.Added).Scan(&dependent)
+		if err != nil {
+			return fmt.Errorf("checking dependent segments: %v", err)
+		}
+		if dependent {
+			return domain.ErrUndoConflict
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE operation SET undone_by = $1 WHERE id = $2;", undo, op.ID)
+		if err != nil {
+			return fmt.Errorf("marking operation undone: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("undoing operation: %w", err)
+	}
+
+	return undo, nil
+}
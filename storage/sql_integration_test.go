@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -551,6 +553,112 @@ func TestSql_DeleteUserFromSegment(t *testing.T) {
 		})
 }
 
+func TestSql_Prerequisites(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	setup := func(t *testing.T, cascade bool) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		for _, name := range []string{"P", "S", "T"} {
+			if err := storage.CreateSegment(ctx, name); err != nil {
+				t.Fatalf("Could not create test segment: %v", err)
+			}
+		}
+		for _, p := range []domain.Prerequisite{{Segment: "S", Prerequisite: "P", Cascade: cascade}, {Segment: "T", Prerequisite: "S", Cascade: cascade}} {
+			if err := storage.AddSegmentPrerequisite(ctx, p); err != nil {
+				t.Fatalf("Could not add prerequisite: %v", err)
+			}
+		}
+	}
+
+	userSegments := func(t *testing.T) []string {
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Could not get user segments: %v", err)
+		}
+		names := make([]string, 0, len(segments))
+		for _, s := range segments {
+			names = append(names, s.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	t.Run("given user without prerequisite, expect ErrPrerequisiteMissing", func(t *testing.T) {
+		setup(t, false)
+
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"S"}); !errors.Is(err, domain.ErrPrerequisiteMissing) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrPrerequisiteMissing, err)
+		}
+		if segments := userSegments(t); len(segments) != 0 {
+			t.Errorf("Expected user to have no segments, but got %v", segments)
+		}
+	})
+
+	t.Run("given prerequisite added with the segment, expect user added to both", func(t *testing.T) {
+		setup(t, false)
+
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"S", "P"}); err != nil {
+			t.Fatalf("Expected to add user to segments, but got error: %v", err)
+		}
+		if segments := userSegments(t); !slices.Equal(segments, []string{"P", "S"}) {
+			t.Errorf("Expected user to be in P and S, but got %v", segments)
+		}
+	})
+
+	t.Run("given cascading prerequisites, expect removal to cascade", func(t *testing.T) {
+		setup(t, true)
+
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"P", "S", "T"}); err != nil {
+			t.Fatalf("Expected to add user to segments, but got error: %v", err)
+		}
+		if err := storage.DeleteUserFromSegment(ctx, 1000, []string{"P"}); err != nil {
+			t.Fatalf("Expected to delete user from segment, but got error: %v", err)
+		}
+		if segments := userSegments(t); len(segments) != 0 {
+			t.Errorf("Expected user to have no segments, but got %v", segments)
+		}
+	})
+
+	t.Run("given protected dependent, expect removal rejected", func(t *testing.T) {
+		setup(t, true)
+
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"P", "S"}); err != nil {
+			t.Fatalf("Expected to add user to segments, but got error: %v", err)
+		}
+		if err := storage.SetSegmentProtected(ctx, "S", true); err != nil {
+			t.Fatalf("Could not protect test segment: %v", err)
+		}
+		if err := storage.DeleteUserFromSegment(ctx, 1000, []string{"P"}); !errors.Is(err, domain.ErrSegmentProtected) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrSegmentProtected, err)
+		}
+		if segments := userSegments(t); !slices.Equal(segments, []string{"P", "S"}) {
+			t.Errorf("Expected user to stay in P and S, but got %v", segments)
+		}
+	})
+
+	t.Run("given prerequisite without cascade, expect dependent kept", func(t *testing.T) {
+		setup(t, false)
+
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"P", "S"}); err != nil {
+			t.Fatalf("Expected to add user to segments, but got error: %v", err)
+		}
+		if err := storage.DeleteUserFromSegment(ctx, 1000, []string{"P"}); err != nil {
+			t.Fatalf("Expected to delete user from segment, but got error: %v", err)
+		}
+		if segments := userSegments(t); !slices.Equal(segments, []string{"S"}) {
+			t.Errorf("Expected user to stay in S, but got %v", segments)
+		}
+	})
+}
+
 func TestSql_GetUserSegments(t *testing.T) {
 	ctx := context.Background()
 	storage := NewSqlStorage(pgPool)
@@ -595,3 +703,1603 @@ func TestSql_GetUserSegments(t *testing.T) {
 		}
 	})
 }
+
+func TestSql_SetSegmentSchedule(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given database with test segment, when setting its schedule, expect user segments to carry it", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"TEST_SEGMENT"}); err != nil {
+			t.Fatalf("Could not add test segment to a user: %v", err)
+		}
+
+		from := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+		if err := storage.SetSegmentSchedule(ctx, "TEST_SEGMENT", &from, nil); err != nil {
+			t.Fatalf("Expected to set segment schedule, but got error: %v", err)
+		}
+
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Expected to get user segments, but got error: %v", err)
+		}
+
+		if len(segments) != 1 {
+			t.Fatalf("Expected user to have one test segment, but got %d", len(segments))
+		}
+
+		if segments[0].ActiveFrom == nil || !segments[0].ActiveFrom.Equal(from) {
+			t.Errorf("Expected active_from to be %s, but got %v", from, segments[0].ActiveFrom)
+		}
+
+		if segments[0].ActiveUntil != nil {
+			t.Errorf("Expected active_until to be empty, but got %s", segments[0].ActiveUntil)
+		}
+	})
+
+	t.Run("when setting schedule of a missing segment, expect ErrSegmentNotFound", func(t *testing.T) {
+		err := storage.SetSegmentSchedule(ctx, "DIFFERENT_SEGMENT", nil, nil)
+		if !errors.Is(err, domain.ErrSegmentNotFound) {
+			t.Errorf(
+				"Expected to have error domain.ErrSegmentNotFound, but instead got:\n"+
+					"\tType=%[1]T,\n"+
+					"\tErr=\"%[1]s\"",
+				err,
+			)
+		}
+	})
+}
+
+func TestSql_SetSegmentMaxMembers(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given segment limited to 5 members, when 20 users are added concurrently, expect exactly 5 to succeed", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+
+		maxMembers := 5
+		if err := storage.SetSegmentMaxMembers(ctx, "TEST_SEGMENT", &maxMembers); err != nil {
+			t.Fatalf("Expected to set segment max members, but got error: %v", err)
+		}
+
+		errs := make(chan error, 20)
+		for user := 1000; user < 1020; user++ {
+			go func(user int) {
+				errs <- storage.AddUserToSegment(ctx, user, []string{"TEST_SEGMENT"})
+			}(user)
+		}
+
+		added := 0
+		for i := 0; i < 20; i++ {
+			err := <-errs
+			if err == nil {
+				added++
+			} else if !errors.Is(err, domain.ErrSegmentIsFull) {
+				t.Errorf(
+					"Expected to have error domain.ErrSegmentIsFull, but instead got:\n"+
+						"\tType=%[1]T,\n"+
+						"\tErr=\"%[1]s\"",
+					err,
+				)
+			}
+		}
+
+		if added != maxMembers {
+			t.Errorf("Expected %d users to be added, but got %d", maxMembers, added)
+		}
+
+		segment, err := storage.GetSegment(ctx, "TEST_SEGMENT")
+		if err != nil {
+			t.Fatalf("Expected to get segment, but got error: %v", err)
+		}
+
+		if segment.Members != maxMembers {
+			t.Errorf("Expected segment to have %d members, but got %d", maxMembers, segment.Members)
+		}
+
+		if segment.MaxMembers == nil || *segment.MaxMembers != maxMembers {
+			t.Errorf("Expected segment max members to be %d, but got %v", maxMembers, segment.MaxMembers)
+		}
+	})
+}
+
+func TestSql_GetSegmentsOverlap(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given two segments sharing one of three users, expect overlap of one", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		for _, segment := range []string{"DISCOUNT_30", "DISCOUNT_50"} {
+			if err := storage.CreateSegment(ctx, segment); err != nil {
+				t.Fatalf("Could not create segment %s: %v", segment, err)
+			}
+		}
+		for user, segments := range map[int][]string{
+			1000: {"DISCOUNT_30"},
+			1001: {"DISCOUNT_30", "DISCOUNT_50"},
+			1002: {"DISCOUNT_50"},
+		} {
+			if err := storage.AddUserToSegment(ctx, user, segments); err != nil {
+				t.Fatalf("Could not add user %d to segments: %v", user, err)
+			}
+		}
+
+		overlaps, err := storage.GetSegmentsOverlap(ctx, []string{"DISCOUNT_30", "DISCOUNT_50"})
+		if err != nil {
+			t.Fatalf("Expected to get segments overlap, but got error: %v", err)
+		}
+
+		if len(overlaps) != 1 {
+			t.Fatalf("Expected one pair, but got %d", len(overlaps))
+		}
+
+		want := domain.SegmentOverlap{First: "DISCOUNT_30", Second: "DISCOUNT_50", FirstMembers: 2, SecondMembers: 2, Both: 1}
+		if overlaps[0] != want {
+			t.Errorf("Expected overlap %+v, but got %+v", want, overlaps[0])
+		}
+	})
+
+	t.Run("when one of segments is missing, expect ErrSegmentNotFound", func(t *testing.T) {
+		_, err := storage.GetSegmentsOverlap(ctx, []string{"DISCOUNT_30", "DIFFERENT_SEGMENT"})
+		if !errors.Is(err, domain.ErrSegmentNotFound) {
+			t.Errorf(
+				"Expected to have error domain.ErrSegmentNotFound, but instead got:\n"+
+					"\tType=%[1]T,\n"+
+					"\tErr=\"%[1]s\"",
+				err,
+			)
+		}
+	})
+}
+
+func TestSql_GetSegmentSizeHistory(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given snapshots taken within two days, expect the last one of each day", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+
+		day := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+		snapshots := []struct {
+			at   time.Time
+			user int
+		}{
+			{at: day.Add(1 * time.Hour), user: 1000},
+			{at: day.Add(2 * time.Hour), user: 1001},
+			{at: day.Add(25 * time.Hour), user: 1002},
+		}
+		for _, s := range snapshots {
+			if err := storage.AddUserToSegment(ctx, s.user, []string{"TEST_SEGMENT"}); err != nil {
+				t.Fatalf("Could not add user to test segment: %v", err)
+			}
+			if err := storage.SnapshotSegmentSizes(ctx, s.at); err != nil {
+				t.Fatalf("Expected to snapshot segment sizes, but got error: %v", err)
+			}
+		}
+
+		sizes, err := storage.GetSegmentSizeHistory(ctx, "TEST_SEGMENT", day, day.Add(48*time.Hour), domain.GranularityDay)
+		if err != nil {
+			t.Fatalf("Expected to get segment size history, but got error: %v", err)
+		}
+
+		want := []domain.SegmentSize{
+			{At: day, Members: 2},
+			{At: day.Add(24 * time.Hour), Members: 3},
+		}
+		if len(sizes) != len(want) {
+			t.Fatalf("Expected %d points, but got %d: %+v", len(want), len(sizes), sizes)
+		}
+		for i := range want {
+			if !sizes[i].At.Equal(want[i].At) || sizes[i].Members != want[i].Members {
+				t.Errorf("Expected point %d to be %+v, but got %+v", i, want[i], sizes[i])
+			}
+		}
+	})
+}
+
+func TestSql_ImportState(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	accept := func(domain.State, []string) error { return nil }
+
+	t.Run("given database with two segments, when replacing state with its export minus one segment, expect the segment to be gone", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		for _, segment := range []string{"TEST_SEGMENT", "DIFFERENT_SEGMENT"} {
+			if err := storage.CreateSegment(ctx, segment); err != nil {
+				t.Fatalf("Could not create segment %s: %v", segment, err)
+			}
+			if err := storage.AddUserToSegment(ctx, 1000, []string{segment}); err != nil {
+				t.Fatalf("Could not add user to segment %s: %v", segment, err)
+			}
+		}
+
+		state, err := storage.ExportState(ctx)
+		if err != nil {
+			t.Fatalf("Expected to export state, but got error: %v", err)
+		}
+		if len(state.Segments) != 2 || len(state.Memberships) != 2 {
+			t.Fatalf("Expected 2 segments and 2 memberships, but got %+v", state)
+		}
+
+		state.Segments = state.Segments[1:]
+		state.Memberships = state.Memberships[1:]
+		if err := storage.ImportState(ctx, state, true, accept); err != nil {
+			t.Fatalf("Expected to import state, but got error: %v", err)
+		}
+
+		got, err := storage.ExportState(ctx)
+		if err != nil {
+			t.Fatalf("Expected to export state, but got error: %v", err)
+		}
+		if len(got.Segments) != 1 || got.Segments[0].Name != "TEST_SEGMENT" {
+			t.Errorf("Expected only TEST_SEGMENT to remain, but got %+v", got.Segments)
+		}
+		if len(got.Memberships) != 1 || got.Memberships[0] != (domain.Membership{User: 1000, Segment: "TEST_SEGMENT"}) {
+			t.Errorf("Expected only membership in TEST_SEGMENT to remain, but got %+v", got.Memberships)
+		}
+	})
+
+	t.Run("when merging memberships that already exist, expect no duplicates", func(t *testing.T) {
+		state, err := storage.ExportState(ctx)
+		if err != nil {
+			t.Fatalf("Expected to export state, but got error: %v", err)
+		}
+
+		if err := storage.ImportState(ctx, state, false, accept); err != nil {
+			t.Fatalf("Expected to import state, but got error: %v", err)
+		}
+
+		got, err := storage.ExportState(ctx)
+		if err != nil {
+			t.Fatalf("Expected to export state, but got error: %v", err)
+		}
+		if len(got.Memberships) != len(state.Memberships) {
+			t.Errorf("Expected %d memberships, but got %d", len(state.Memberships), len(got.Memberships))
+		}
+	})
+
+	t.Run("given validation fails, expect nothing to be imported", func(t *testing.T) {
+		if err := storage.SetSegmentProtected(ctx, "TEST_SEGMENT", true); err != nil {
+			t.Fatalf("Could not protect test segment: %v", err)
+		}
+		defer storage.SetSegmentProtected(ctx, "TEST_SEGMENT", false)
+
+		var current domain.State
+		var protected []string
+		state := domain.State{Segments: []domain.SegmentDetails{{Segment: domain.Segment{Name: "NEW_SEGMENT"}}}}
+		err := storage.ImportState(ctx, state, false, func(c domain.State, p []string) error {
+			current, protected = c, p
+			return domain.ErrImportConflicts
+		})
+		if !errors.Is(err, domain.ErrImportConflicts) {
+			t.Fatalf("Expected error %v, but got %v", domain.ErrImportConflicts, err)
+		}
+		if len(current.Segments) != 1 || len(current.Memberships) != 1 {
+			t.Errorf("Expected the current state to be validated, but got %+v", current)
+		}
+		if !slices.Equal(protected, []string{"TEST_SEGMENT"}) {
+			t.Errorf("Expected TEST_SEGMENT to be protected, but got %v", protected)
+		}
+
+		got, err := storage.ExportState(ctx)
+		if err != nil {
+			t.Fatalf("Expected to export state, but got error: %v", err)
+		}
+		if len(got.Segments) != 1 {
+			t.Errorf("Expected no segments to be imported, but got %+v", got.Segments)
+		}
+	})
+}
+
+func TestSql_Tenants(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given two tenants with segments of the same name, expect their memberships to be separate", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		teamA := domain.WithTenant(ctx, "team_a")
+		teamB := domain.WithTenant(ctx, "team_b")
+
+		for _, tenantCtx := range []context.Context{teamA, teamB} {
+			if err := storage.CreateSegment(tenantCtx, "TEST_SEGMENT"); err != nil {
+				t.Fatalf("Could not create test segment for %s: %v", domain.TenantFromContext(tenantCtx), err)
+			}
+		}
+
+		if err := storage.AddUserToSegment(teamA, 1000, []string{"TEST_SEGMENT"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		segments, err := storage.GetUserSegments(teamB, 1000)
+		if err != nil {
+			t.Fatalf("Expected to get user segments, but got error: %v", err)
+		}
+		if len(segments) != 0 {
+			t.Errorf("Expected user to have no segments in another tenant, but got %+v", segments)
+		}
+
+		if err := storage.DeleteSegment(teamB, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Expected to delete test segment of team_b, but got error: %v", err)
+		}
+
+		segments, err = storage.GetUserSegments(teamA, 1000)
+		if err != nil {
+			t.Fatalf("Expected to get user segments, but got error: %v", err)
+		}
+		if len(segments) != 1 {
+			t.Errorf("Expected user to keep the segment of team_a, but got %+v", segments)
+		}
+	})
+}
+
+func TestSql_Environments(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given user added in staging, when promoting staging with members, expect user in production", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		staging := domain.WithEnvironment(ctx, "staging")
+
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+		if err := storage.AddUserToSegment(staging, 1000, []string{"TEST_SEGMENT"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		percentage := 20
+		if err := storage.SetSegmentPercentage(staging, "TEST_SEGMENT", &percentage); err != nil {
+			t.Fatalf("Could not set segment percentage: %v", err)
+		}
+
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Expected to get user segments, but got error: %v", err)
+		}
+		if len(segments) != 0 {
+			t.Errorf("Expected user to have no segments in production, but got %+v", segments)
+		}
+
+		err = storage.PromoteEnvironment(ctx, "staging", domain.DefaultEnvironment, nil, true)
+		if err != nil {
+			t.Fatalf("Expected to promote staging, but got error: %v", err)
+		}
+
+		segment, err := storage.GetSegment(ctx, "TEST_SEGMENT")
+		if err != nil {
+			t.Fatalf("Expected to get test segment, but got error: %v", err)
+		}
+		if segment.Members != 1 || segment.Percentage == nil || *segment.Percentage != percentage {
+			t.Errorf("Expected 1 member and %d%% in production, but got %+v", percentage, segment)
+		}
+	})
+
+	t.Run("when promoting a missing segment, expect ErrSegmentNotFound", func(t *testing.T) {
+		err := storage.PromoteEnvironment(ctx, "staging", domain.DefaultEnvironment, []string{"MISSING_SEGMENT"}, false)
+		if !errors.Is(err, domain.ErrSegmentNotFound) {
+			t.Errorf(
+				"Expected to have error domain.ErrSegmentNotFound, but instead got:\n\tType=%[1]T,\n\tErr=\"%[1]s\"",
+				err,
+			)
+		}
+	})
+}
+
+func TestSql_ChangeRequests(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given pending change request, when reviewing it twice, expect ErrChangeRequestNotPending", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM change_request;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		user := 1000
+		id, err := storage.CreateChangeRequest(ctx, domain.ChangeRequest{
+			Kind:          domain.ChangeUserSegments,
+			Environment:   domain.DefaultEnvironment,
+			User:          &user,
+			SegmentsToAdd: []string{"TEST_SEGMENT"},
+			Author:        "alice",
+			Status:        domain.ChangePending,
+			CreatedAt:     time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("Expected to create change request, but got error: %v", err)
+		}
+
+		cr, err := storage.GetChangeRequest(ctx, id)
+		if err != nil {
+			t.Fatalf("Expected to get change request, but got error: %v", err)
+		}
+		if cr.User == nil || *cr.User != user || len(cr.SegmentsToAdd) != 1 || cr.Segment != "" {
+			t.Errorf("Expected change request to be read back as written, but got %+v", cr)
+		}
+
+		review := domain.Review{Status: domain.ChangeRejected, Reviewer: "bob", At: time.Now()}
+		if err := storage.ReviewChangeRequest(ctx, id, domain.ChangePending, review); err != nil {
+			t.Fatalf("Expected to review change request, but got error: %v", err)
+		}
+
+		err = storage.ReviewChangeRequest(ctx, id, domain.ChangePending, review)
+		if !errors.Is(err, domain.ErrChangeRequestNotPending) {
+			t.Errorf(
+				"Expected to have error domain.ErrChangeRequestNotPending, but instead got:\n\tType=%[1]T,\n\tErr=\"%[1]s\"",
+				err,
+			)
+		}
+
+		pending, err := storage.GetChangeRequests(ctx, domain.ChangePending)
+		if err != nil {
+			t.Fatalf("Expected to get change requests, but got error: %v", err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("Expected no pending change requests, but got %+v", pending)
+		}
+	})
+
+	t.Run("when getting change request of another tenant, expect ErrChangeRequestNotFound", func(t *testing.T) {
+		id, err := storage.CreateChangeRequest(ctx, domain.ChangeRequest{
+			Kind:        domain.ChangeDeleteSegment,
+			Environment: domain.DefaultEnvironment,
+			Segment:     "TEST_SEGMENT",
+			Author:      "alice",
+			Status:      domain.ChangePending,
+			CreatedAt:   time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("Expected to create change request, but got error: %v", err)
+		}
+
+		_, err = storage.GetChangeRequest(domain.WithTenant(ctx, "team_b"), id)
+		if !errors.Is(err, domain.ErrChangeRequestNotFound) {
+			t.Errorf(
+				"Expected to have error domain.ErrChangeRequestNotFound, but instead got:\n\tType=%[1]T,\n\tErr=\"%[1]s\"",
+				err,
+			)
+		}
+	})
+}
+
+func TestSql_GetSegmentMembers(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given segment with three users, when reading pages of two, expect users in order", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+		for _, user := range []int{1003, 1001, 1002} {
+			if err := storage.AddUserToSegment(ctx, user, []string{"TEST_SEGMENT"}); err != nil {
+				t.Fatalf("Could not add user to test segment: %v", err)
+			}
+		}
+
+		members, err := storage.GetSegmentMembers(ctx, "TEST_SEGMENT", 0, 2)
+		if err != nil {
+			t.Fatalf("Expected to get segment members, but got error: %v", err)
+		}
+		if len(members) != 2 || members[0] != 1001 || members[1] != 1002 {
+			t.Errorf("Expected first page [1001 1002], but got %v", members)
+		}
+
+		members, err = storage.GetSegmentMembers(ctx, "TEST_SEGMENT", 1002, 2)
+		if err != nil {
+			t.Fatalf("Expected to get segment members, but got error: %v", err)
+		}
+		if len(members) != 1 || members[0] != 1003 {
+			t.Errorf("Expected second page [1003], but got %v", members)
+		}
+	})
+
+	t.Run("when segment is missing, expect ErrSegmentNotFound", func(t *testing.T) {
+		_, err := storage.GetSegmentMembers(ctx, "MISSING_SEGMENT", 0, 10)
+		if !errors.Is(err, domain.ErrSegmentNotFound) {
+			t.Errorf(
+				"Expected to have error domain.ErrSegmentNotFound, but instead got:\n\tType=%[1]T,\n\tErr=\"%[1]s\"",
+				err,
+			)
+		}
+	})
+}
+
+func TestSql_GetChanges(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given changes of a segment and its members, expect them in order after the cursor", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		cursor, err := storage.GetChangesCursor(ctx)
+		if err != nil {
+			t.Fatalf("Expected to get changes cursor, but got error: %v", err)
+		}
+
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"TEST_SEGMENT"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		staging := domain.WithEnvironment(ctx, "staging")
+		if err := storage.AddUserToSegment(staging, 1001, []string{"TEST_SEGMENT"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		if err := storage.DeleteSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not delete test segment: %v", err)
+		}
+
+		changes, err := storage.GetChanges(ctx, cursor, 10)
+		if err != nil {
+			t.Fatalf("Expected to get changes, but got error: %v", err)
+		}
+
+		want := []domain.ChangeType{
+			domain.ChangeSegmentCreated,
+			domain.ChangeMemberAdded,
+			domain.ChangeMemberRemoved,
+			domain.ChangeSegmentDeleted,
+		}
+		if len(changes) != len(want) {
+			t.Fatalf("Expected %d changes of the production environment, but got %+v", len(want), changes)
+		}
+		for i, c := range changes {
+			if c.Type != want[i] || c.Segment != "TEST_SEGMENT" {
+				t.Errorf("Expected change %d to be %s of TEST_SEGMENT, but got %+v", i, want[i], c)
+			}
+			if i > 0 && c.Seq <= changes[i-1].Seq {
+				t.Errorf("Expected changes ordered by seq, but got %+v", changes)
+			}
+		}
+		if changes[1].User == nil || *changes[1].User != 1000 {
+			t.Errorf("Expected user 1000 to be added, but got %+v", changes[1])
+		}
+
+		rest, err := storage.GetChanges(ctx, changes[1].Seq, 10)
+		if err != nil {
+			t.Fatalf("Expected to get changes, but got error: %v", err)
+		}
+		if len(rest) != 2 {
+			t.Errorf("Expected 2 changes after the cursor, but got %+v", rest)
+		}
+	})
+}
+
+func TestSql_ChangesCommitOrder(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given a transaction committed after a later one, expect its changes after the later one's", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+
+		cursor, err := storage.GetChangesCursor(ctx)
+		if err != nil {
+			t.Fatalf("Expected to get changes cursor, but got error: %v", err)
+		}
+		notified, err := storage.NotifyChanges(ctx)
+		if err != nil {
+			t.Fatalf("Expected to wait for changes, but got error: %v", err)
+		}
+
+		tx, err := pgPool.Begin(ctx)
+		if err != nil {
+			t.Fatalf("Could not begin transaction: %v", err)
+		}
+		defer tx.Rollback(ctx)
+		_, err = tx.Exec(ctx, "INSERT INTO users_in_segment (tenant, user_id, segment) VALUES ('default', 1000, 'TEST_SEGMENT');")
+		if err != nil {
+			t.Fatalf("Could not add user in transaction: %v", err)
+		}
+
+		if err := storage.AddUserToSegment(ctx, 1001, []string{"TEST_SEGMENT"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		select {
+		case <-notified:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected to be notified about committed changes")
+		}
+
+		changes, err := storage.GetChanges(ctx, cursor, 10)
+		if err != nil {
+			t.Fatalf("Expected to get changes, but got error: %v", err)
+		}
+		if len(changes) != 1 || *changes[0].User != 1001 {
+			t.Fatalf("Expected only the committed change of user 1001, but got %+v", changes)
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatalf("Could not commit transaction: %v", err)
+		}
+
+		rest, err := storage.GetChanges(ctx, changes[0].Seq, 10)
+		if err != nil {
+			t.Fatalf("Expected to get changes, but got error: %v", err)
+		}
+		if len(rest) != 1 || *rest[0].User != 1000 {
+			t.Errorf("Expected the change of user 1000 after the cursor, but got %+v", rest)
+		}
+	})
+}
+
+func TestCachedStorage_GetUserSegments(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storage := NewSqlStorage(pgPool)
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	// waitFor polls until the condition holds, notifications are delivered
+	// in the background.
+	waitFor := func(condition func() bool) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if condition() {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("given user changed through another replica, expect the cached segments to be dropped", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		for _, name := range []string{"A", "B"} {
+			if err := storage.CreateSegment(ctx, name); err != nil {
+				t.Fatalf("Could not create test segment: %v", err)
+			}
+		}
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"A"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		cached := NewCachedStorage(ctx, pgPool, storage, 10)
+		if !waitFor(func() bool { cached.mu.Lock(); defer cached.mu.Unlock(); return cached.listening }) {
+			t.Fatalf("Expected cache to start listening")
+		}
+
+		for i := 0; i < 2; i++ {
+			segments, err := cached.GetUserSegments(ctx, 1000)
+			if err != nil || len(segments) != 1 {
+				t.Fatalf("Expected user to be in segment A, but got %v, %v", segments, err)
+			}
+		}
+		if stats := cached.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+			t.Errorf("Expected one miss and one hit, but got %+v", stats)
+		}
+
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"B"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		if !waitFor(func() bool { return cached.Stats().Invalidations > 0 }) {
+			t.Fatalf("Expected cache to be notified about the change")
+		}
+
+		segments, err := cached.GetUserSegments(ctx, 1000)
+		if err != nil || len(segments) != 2 {
+			t.Errorf("Expected user to be in segments A and B, but got %v, %v", segments, err)
+		}
+
+		if _, err := cached.GetUserSegments(domain.WithCacheBypass(ctx), 1000); err != nil {
+			t.Fatalf("Expected to get user segments, but got error: %v", err)
+		}
+		if stats := cached.Stats(); stats.Bypasses != 1 {
+			t.Errorf("Expected one bypass, but got %+v", stats)
+		}
+	})
+
+	t.Run("given user changed before the notification came, expect the cached segments served with their version", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		for _, name := range []string{"A", "B"} {
+			if err := storage.CreateSegment(ctx, name); err != nil {
+				t.Fatalf("Could not create test segment: %v", err)
+			}
+		}
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"A"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		cached := NewCachedStorage(ctx, pgPool, storage, 10)
+		if !waitFor(func() bool { cached.mu.Lock(); defer cached.mu.Unlock(); return cached.listening }) {
+			t.Fatalf("Expected cache to start listening")
+		}
+		if _, err := cached.GetUserSegments(ctx, 1000); err != nil {
+			t.Fatalf("Expected to get user segments, but got error: %v", err)
+		}
+		version, err := cached.GetUserVersion(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Expected to get user version, but got error: %v", err)
+		}
+
+		// Put the stale entry back once the notification is handled, as if
+		// it hadn't been delivered yet.
+		cached.mu.Lock()
+		stale := *cached.entries[cacheKey{tenant: domain.DefaultTenant, environment: domain.DefaultEnvironment, user: 1000}].Value.(*cacheEntry)
+		cached.mu.Unlock()
+		invalidations := cached.Stats().Invalidations
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"B"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		if !waitFor(func() bool { return cached.Stats().Invalidations > invalidations }) {
+			t.Fatalf("Expected cache to be notified about the change")
+		}
+		cached.mu.Lock()
+		cached.add(stale.key, stale.version, stale.segments)
+		cached.mu.Unlock()
+
+		segments, err := cached.GetUserSegments(ctx, 1000)
+		if err != nil || len(segments) != 1 {
+			t.Errorf("Expected the cached segment A, but got %v, %v", segments, err)
+		}
+		if got, err := cached.GetUserVersion(ctx, 1000); err != nil || got != version {
+			t.Errorf("Expected the cached version %+v, but got %+v, %v", version, got, err)
+		}
+		if got, err := cached.GetUserVersion(domain.WithCacheBypass(ctx), 1000); err != nil || got == version {
+			t.Errorf("Expected a newer version than %+v, but got %+v, %v", version, got, err)
+		}
+	})
+}
+
+func TestSql_GetUserVersion(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given changes of the user and of a segment, expect versions to grow", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment; DELETE FROM user_version;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+
+		before, err := storage.GetUserVersion(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Expected to get user version, but got error: %v", err)
+		}
+
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"TEST_SEGMENT"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		until := time.Now().Add(time.Hour)
+		if err := storage.SetSegmentSchedule(ctx, "TEST_SEGMENT", nil, &until); err != nil {
+			t.Fatalf("Could not set schedule of test segment: %v", err)
+		}
+
+		after, err := storage.GetUserVersion(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Expected to get user version, but got error: %v", err)
+		}
+		if after.Memberships != before.Memberships+1 || after.Segments <= before.Segments {
+			t.Errorf("Expected versions to grow from %+v, but got %+v", before, after)
+		}
+
+		other, err := storage.GetUserVersion(ctx, 1001)
+		if err != nil {
+			t.Fatalf("Expected to get user version, but got error: %v", err)
+		}
+		if other.Memberships != 0 {
+			t.Errorf("Expected memberships version of another user to stay 0, but got %+v", other)
+		}
+	})
+}
+
+func TestSql_ChangeUsersSegments(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	setup := func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		for _, name := range []string{"A", "B", "LIMITED"} {
+			if err := storage.CreateSegment(ctx, name); err != nil {
+				t.Fatalf("Could not create test segment: %v", err)
+			}
+		}
+		limit := 1
+		if err := storage.SetSegmentMaxMembers(ctx, "LIMITED", &limit); err != nil {
+			t.Fatalf("Could not limit test segment: %v", err)
+		}
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"A"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+	}
+	changes := []domain.UserSegmentsChange{
+		{User: 1000, SegmentsToAdd: []string{"B"}, SegmentsToDelete: []string{"A"}},
+		{User: 1001, SegmentsToAdd: []string{"A", "UNKNOWN"}},
+		{User: 1002, SegmentsToDelete: []string{"A"}},
+		{User: 1003, SegmentsToAdd: []string{"LIMITED"}},
+		{User: 1004, SegmentsToAdd: []string{"LIMITED"}},
+	}
+	wantErrs := []error{nil, domain.ErrSegmentNotFound, domain.ErrUserHaveNotThisSegment, nil, domain.ErrSegmentIsFull}
+
+	t.Run("given best effort mode, expect changes that fail to be skipped", func(t *testing.T) {
+		setup(t)
+
+		errs, err := storage.ChangeUsersSegments(ctx, changes, false)
+		if err != nil {
+			t.Fatalf("Expected to change users segments, but got error: %v", err)
+		}
+		for i, want := range wantErrs {
+			if want == nil && errs[i] != nil || !errors.Is(errs[i], want) {
+				t.Errorf("Expected change %d to fail with %v, but got %v", i, want, errs[i])
+			}
+		}
+
+		for user, want := range map[int][]string{1000: {"B"}, 1001: {}, 1003: {"LIMITED"}, 1004: {}} {
+			segments, err := storage.GetUserSegments(ctx, user)
+			if err != nil {
+				t.Fatalf("Expected to get user segments, but got error: %v", err)
+			}
+			if len(segments) != len(want) || len(want) == 1 && segments[0].Name != want[0] {
+				t.Errorf("Expected user %d to be in %v, but got %v", user, want, segments)
+			}
+		}
+	})
+
+	t.Run("given atomic mode and a failing change, expect nothing to be changed", func(t *testing.T) {
+		setup(t)
+
+		errs, err := storage.ChangeUsersSegments(ctx, changes, true)
+		if err != nil {
+			t.Fatalf("Expected to change users segments, but got error: %v", err)
+		}
+		if !errors.Is(errs[1], domain.ErrSegmentNotFound) {
+			t.Errorf("Expected change 1 to fail with %v, but got %v", domain.ErrSegmentNotFound, errs[1])
+		}
+
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Expected to get user segments, but got error: %v", err)
+		}
+		if len(segments) != 1 || segments[0].Name != "A" {
+			t.Errorf("Expected user to stay in segment A, but got %v", segments)
+		}
+	})
+
+	t.Run("given prerequisites, expect them checked and removals cascaded", func(t *testing.T) {
+		setup(t)
+		if err := storage.AddSegmentPrerequisite(ctx, domain.Prerequisite{Segment: "B", Prerequisite: "A", Cascade: true}); err != nil {
+			t.Fatalf("Could not add prerequisite: %v", err)
+		}
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"B"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		errs, err := storage.ChangeUsersSegments(ctx, []domain.UserSegmentsChange{
+			{User: 1000, SegmentsToDelete: []string{"A"}},
+			{User: 1001, SegmentsToAdd: []string{"B"}},
+			{User: 1002, SegmentsToAdd: []string{"A", "B"}},
+		}, false)
+		if err != nil {
+			t.Fatalf("Expected to change users segments, but got error: %v", err)
+		}
+		for i, want := range []error{nil, domain.ErrPrerequisiteMissing, nil} {
+			if want == nil && errs[i] != nil || !errors.Is(errs[i], want) {
+				t.Errorf("Expected change %d to fail with %v, but got %v", i, want, errs[i])
+			}
+		}
+
+		segments, err := storage.GetUsersSegments(ctx, []int{1000, 1001, 1002})
+		if err != nil {
+			t.Fatalf("Expected to get users segments, but got error: %v", err)
+		}
+		if len(segments) != 1 || len(segments[1002]) != 2 {
+			t.Errorf("Expected only user 1002 to be in A and B, but got %v", segments)
+		}
+	})
+}
+
+func TestSql_ClaimJob(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+	if _, err := pgPool.Exec(ctx, "DELETE FROM job;"); err != nil {
+		t.Fatalf("Could not clean database: %v", err)
+	}
+
+	id, err := storage.CreateJob(ctx, domain.Job{
+		Kind:        domain.JobSegmentUpload,
+		Tenant:      domain.TenantFromContext(ctx),
+		Environment: domain.DefaultEnvironment,
+		Status:      domain.JobPending,
+		Input:       []byte(`{"segment":"A"}`),
+		Result:      []byte(`{}`),
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create job: %v", err)
+	}
+
+	t.Run("given pending job, expect it to be claimed once", func(t *testing.T) {
+		job, err := storage.ClaimJob(ctx, 0, time.Minute)
+		if err != nil {
+			t.Fatalf("Expected to claim job, but got error: %v", err)
+		}
+		if job == nil || job.ID != id || job.Status != domain.JobRunning || job.Attempt != 1 {
+			t.Fatalf("Expected job %d to be running, but got %+v", id, job)
+		}
+
+		again, err := storage.ClaimJob(ctx, id, time.Minute)
+		if err != nil {
+			t.Fatalf("Expected to claim job, but got error: %v", err)
+		}
+		if again != nil {
+			t.Errorf("Expected leased job not to be claimed, but got %+v", again)
+		}
+	})
+
+	t.Run("given expired lease, expect job to be taken over", func(t *testing.T) {
+		job, err := storage.GetJob(ctx, id)
+		if err != nil {
+			t.Fatalf("Expected to get job, but got error: %v", err)
+		}
+		job.State = []byte(`{"done":1}`)
+		if err := storage.SaveJob(ctx, job, -time.Second); err != nil {
+			t.Fatalf("Expected to save job, but got error: %v", err)
+		}
+
+		resumed, err := storage.ClaimJob(ctx, 0, time.Minute)
+		if err != nil {
+			t.Fatalf("Expected to claim job, but got error: %v", err)
+		}
+		if resumed == nil || resumed.Attempt != 2 || string(resumed.State) != `{"done": 1}` {
+			t.Fatalf("Expected job to be resumed from its state, but got %+v", resumed)
+		}
+
+		if err := storage.SaveJob(ctx, job, time.Minute); !errors.Is(err, domain.ErrJobLost) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrJobLost, err)
+		}
+	})
+}
+
+func TestSql_GetJobUsers(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	id, err := storage.CreateJob(ctx, domain.Job{
+		Kind:        domain.JobSegmentUpload,
+		Tenant:      domain.TenantFromContext(ctx),
+		Environment: domain.DefaultEnvironment,
+		Status:      domain.JobPending,
+		Input:       []byte(`{"segment":"A"}`),
+		Result:      []byte(`{}`),
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create job: %v", err)
+	}
+
+	t.Run("given users stored twice, expect the last ones in their order", func(t *testing.T) {
+		if err := storage.SetJobUsers(ctx, id, []int{1, 2, 3}); err != nil {
+			t.Fatalf("Expected to store job users, but got error: %v", err)
+		}
+		if err := storage.SetJobUsers(ctx, id, []int{1003, 1001, 1002}); err != nil {
+			t.Fatalf("Expected to store job users, but got error: %v", err)
+		}
+
+		users, err := storage.GetJobUsers(ctx, id, 1, 10)
+		if err != nil {
+			t.Fatalf("Expected to get job users, but got error: %v", err)
+		}
+		if !slices.Equal(users, []int{1001, 1002}) {
+			t.Errorf("Expected users [1001 1002], but got %v", users)
+		}
+	})
+}
+
+func TestSql_GetChangesBetween(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given changes before and within the range, expect only the ones within", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		if err := storage.CreateSegment(ctx, "TEST_SEGMENT"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+		if _, err := pgPool.Exec(ctx, "UPDATE change_log SET created_at = created_at - interval '1 day';"); err != nil {
+			t.Fatalf("Could not backdate changes: %v", err)
+		}
+		from := time.Now().Add(-time.Hour)
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"TEST_SEGMENT"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		changes, err := storage.GetChangesBetween(ctx, from, time.Now().Add(time.Hour), 0, 10)
+		if err != nil {
+			t.Fatalf("Expected to get changes, but got error: %v", err)
+		}
+		if len(changes) != 1 || changes[0].Type != domain.ChangeMemberAdded || changes[0].User == nil || *changes[0].User != 1000 {
+			t.Errorf("Expected user 1000 to be added, but got %+v", changes)
+		}
+	})
+}
+
+func TestSql_GetUserSegmentsAsOf(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given segment deleted later, expect it in the past segments", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		// The user is only used here, so that changes of other tests don't count.
+		user := 424242
+		for _, name := range []string{"A", "B"} {
+			if err := storage.CreateSegment(ctx, name); err != nil {
+				t.Fatalf("Could not create test segment: %v", err)
+			}
+		}
+		if err := storage.AddUserToSegment(ctx, user, []string{"A", "B"}); err != nil {
+			t.Fatalf("Could not add user to test segments: %v", err)
+		}
+		if _, err := pgPool.Exec(ctx, "UPDATE change_log SET created_at = '2023-03-01' WHERE user_id = $1;", user); err != nil {
+			t.Fatalf("Could not backdate changes: %v", err)
+		}
+		if err := storage.DeleteSegment(ctx, "A"); err != nil {
+			t.Fatalf("Could not delete test segment: %v", err)
+		}
+		if _, err := pgPool.Exec(ctx, "UPDATE change_log SET created_at = '2023-03-05' WHERE user_id = $1 AND created_at > '2023-03-02';", user); err != nil {
+			t.Fatalf("Could not backdate changes: %v", err)
+		}
+
+		for at, want := range map[string][]string{"2023-02-28": {}, "2023-03-03": {"A", "B"}, "2023-03-06": {"B"}} {
+			asOf, _ := time.Parse(time.DateOnly, at)
+			segments, err := storage.GetUserSegmentsAsOf(ctx, user, asOf)
+			if err != nil {
+				t.Fatalf("Expected to get user segments, but got error: %v", err)
+			}
+			if !slices.Equal(segments, want) {
+				t.Errorf("Expected user to be in %v on %s, but got %v", want, at, segments)
+			}
+		}
+	})
+}
+
+func TestSql_GetUserChanges(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	t.Run("given changes made by actors, expect them with the actors", func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+
+		// The user is only used here, so that changes of other tests don't count.
+		user := 434343
+		if _, err := pgPool.Exec(ctx, "DELETE FROM change_log WHERE user_id = $1;", user); err != nil {
+			t.Fatalf("Could not clean change log: %v", err)
+		}
+		if err := storage.CreateSegment(ctx, "A"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+		if err := storage.AddUserToSegment(domain.WithActor(ctx, "alice"), user, []string{"A"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		if err := storage.DeleteUserFromSegment(domain.WithActor(ctx, "bob"), user, []string{"A"}); err != nil {
+			t.Fatalf("Could not delete user from test segment: %v", err)
+		}
+		if err := storage.AddUserToSegment(ctx, user, []string{"A"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		changes, err := storage.GetUserChanges(ctx, user, time.Time{}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Expected to get user changes, but got error: %v", err)
+		}
+		want := []struct {
+			typ   domain.ChangeType
+			actor string
+		}{{domain.ChangeMemberAdded, "alice"}, {domain.ChangeMemberRemoved, "bob"}, {domain.ChangeMemberAdded, ""}}
+		if len(changes) != len(want) {
+			t.Fatalf("Expected %d changes, but got %+v", len(want), changes)
+		}
+		for i, c := range changes {
+			if c.Type != want[i].typ || c.Actor != want[i].actor || c.Segment != "A" {
+				t.Errorf("Expected change %d to be %s of A by %q, but got %+v", i, want[i].typ, want[i].actor, c)
+			}
+		}
+	})
+}
+
+func TestSql_UndoOperation(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	setup := func(t *testing.T) int64 {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		for _, name := range []string{"A", "B"} {
+			if err := storage.CreateSegment(ctx, name); err != nil {
+				t.Fatalf("Could not create test segment: %v", err)
+			}
+		}
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"B"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		id, err := storage.CreateOperation(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Could not create operation: %v", err)
+		}
+		opCtx := domain.WithOperation(ctx, id)
+		if err := storage.AddUserToSegment(opCtx, 1000, []string{"A"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+		if err := storage.DeleteUserFromSegment(opCtx, 1000, []string{"B"}); err != nil {
+			t.Fatalf("Could not delete user from test segment: %v", err)
+		}
+		return id
+	}
+
+	t.Run("given operation, expect its changes reverted once", func(t *testing.T) {
+		id := setup(t)
+
+		op, err := storage.GetOperation(ctx, id)
+		if err != nil {
+			t.Fatalf("Expected to get operation, but got error: %v", err)
+		}
+		if !slices.Equal(op.Added, []string{"A"}) || !slices.Equal(op.Removed, []string{"B"}) {
+			t.Fatalf("Expected operation to add A and remove B, but got %+v", op)
+		}
+
+		undo, err := storage.UndoOperation(ctx, op)
+		if err != nil {
+			t.Fatalf("Expected to undo operation, but got error: %v", err)
+		}
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Could not get user segments: %v", err)
+		}
+		if len(segments) != 1 || segments[0].Name != "B" {
+			t.Errorf("Expected user to be back in B only, but got %+v", segments)
+		}
+
+		reverting, err := storage.GetOperation(ctx, undo)
+		if err != nil {
+			t.Fatalf("Expected to get undoing operation, but got error: %v", err)
+		}
+		if !slices.Equal(reverting.Added, []string{"B"}) || !slices.Equal(reverting.Removed, []string{"A"}) {
+			t.Errorf("Expected undoing operation to add B and remove A, but got %+v", reverting)
+		}
+
+		if _, err := storage.UndoOperation(ctx, op); !errors.Is(err, domain.ErrOperationUndone) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrOperationUndone, err)
+		}
+	})
+
+	t.Run("given membership changed after the operation, expect conflict", func(t *testing.T) {
+		id := setup(t)
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"B"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		op, err := storage.GetOperation(ctx, id)
+		if err != nil {
+			t.Fatalf("Expected to get operation, but got error: %v", err)
+		}
+		if _, err := storage.UndoOperation(ctx, op); !errors.Is(err, domain.ErrUndoConflict) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrUndoConflict, err)
+		}
+
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Could not get user segments: %v", err)
+		}
+		if len(segments) != 2 {
+			t.Errorf("Expected user to stay in A and B, but got %+v", segments)
+		}
+	})
+
+	t.Run("given dependent added after the operation added its prerequisite, expect conflict", func(t *testing.T) {
+		id := setup(t)
+		if err := storage.CreateSegment(ctx, "C"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+		if err := storage.AddSegmentPrerequisite(ctx, domain.Prerequisite{Segment: "C", Prerequisite: "A"}); err != nil {
+			t.Fatalf("Could not add prerequisite: %v", err)
+		}
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"C"}); err != nil {
+			t.Fatalf("Could not add user to test segment: %v", err)
+		}
+
+		op, err := storage.GetOperation(ctx, id)
+		if err != nil {
+			t.Fatalf("Expected to get operation, but got error: %v", err)
+		}
+		if _, err := storage.UndoOperation(ctx, op); !errors.Is(err, domain.ErrUndoConflict) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrUndoConflict, err)
+		}
+
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Could not get user segments: %v", err)
+		}
+		if len(segments) != 2 {
+			t.Errorf("Expected user to stay in A and C, but got %+v", segments)
+		}
+	})
+
+	t.Run("given prerequisite of removed segment removed after the operation, expect conflict", func(t *testing.T) {
+		if _, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;"); err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		for _, name := range []string{"P", "S"} {
+			if err := storage.CreateSegment(ctx, name); err != nil {
+				t.Fatalf("Could not create test segment: %v", err)
+			}
+		}
+		if err := storage.AddSegmentPrerequisite(ctx, domain.Prerequisite{Segment: "S", Prerequisite: "P"}); err != nil {
+			t.Fatalf("Could not add prerequisite: %v", err)
+		}
+		if err := storage.AddUserToSegment(ctx, 1000, []string{"P", "S"}); err != nil {
+			t.Fatalf("Could not add user to test segments: %v", err)
+		}
+
+		id, err := storage.CreateOperation(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Could not create operation: %v", err)
+		}
+		if err := storage.DeleteUserFromSegment(domain.WithOperation(ctx, id), 1000, []string{"S"}); err != nil {
+			t.Fatalf("Could not delete user from test segment: %v", err)
+		}
+		if err := storage.DeleteUserFromSegment(ctx, 1000, []string{"P"}); err != nil {
+			t.Fatalf("Could not delete user from test segment: %v", err)
+		}
+
+		op, err := storage.GetOperation(ctx, id)
+		if err != nil {
+			t.Fatalf("Expected to get operation, but got error: %v", err)
+		}
+		if _, err := storage.UndoOperation(ctx, op); !errors.Is(err, domain.ErrUndoConflict) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrUndoConflict, err)
+		}
+
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Could not get user segments: %v", err)
+		}
+		if len(segments) != 0 {
+			t.Errorf("Expected user to have no segments, but got %+v", segments)
+		}
+	})
+}
+
+func TestSql_DryRun(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	setup := func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		if err := storage.CreateSegment(ctx, "A"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+		for _, user := range []int{1000, 1001} {
+			if err := storage.AddUserToSegment(ctx, user, []string{"A"}); err != nil {
+				t.Fatalf("Could not add user to test segment: %v", err)
+			}
+		}
+	}
+
+	t.Run("given segment deleted in a dry run, expect its members removed and nothing changed", func(t *testing.T) {
+		setup(t)
+
+		result, err := storage.DryRun(ctx, func(ctx context.Context) error {
+			return storage.DeleteSegment(ctx, "A")
+		})
+		if err != nil {
+			t.Fatalf("Expected dry run to succeed, but got error: %v", err)
+		}
+		if result.Total != 3 || len(result.Changes) != 3 {
+			t.Fatalf("Expected 3 changes, but got %+v", result)
+		}
+		var removed []int
+		for _, c := range result.Changes {
+			if c.Type == domain.ChangeMemberRemoved && c.User != nil {
+				removed = append(removed, *c.User)
+			}
+		}
+		slices.Sort(removed)
+		if !slices.Equal(removed, []int{1000, 1001}) {
+			t.Errorf("Expected users 1000 and 1001 to be removed, but got %v", removed)
+		}
+
+		if _, err := storage.GetSegment(ctx, "A"); err != nil {
+			t.Errorf("Expected segment to stay after the dry run, but got error: %v", err)
+		}
+	})
+
+	t.Run("given change failing in part, expect the rest of it with the error", func(t *testing.T) {
+		setup(t)
+
+		result, err := storage.DryRun(ctx, func(ctx context.Context) error {
+			if err := storage.DeleteUserFromSegment(ctx, 1000, []string{"A"}); err != nil {
+				return err
+			}
+			return storage.AddUserToSegment(ctx, 1000, []string{"MISSING"})
+		})
+		if !errors.Is(err, domain.ErrSegmentNotFound) {
+			t.Fatalf("Expected error %v, but got %v", domain.ErrSegmentNotFound, err)
+		}
+		if len(result.Changes) != 1 || result.Changes[0].Type != domain.ChangeMemberRemoved {
+			t.Errorf("Expected the removal from A, but got %+v", result.Changes)
+		}
+
+		segments, err := storage.GetUserSegments(ctx, 1000)
+		if err != nil {
+			t.Fatalf("Could not get user segments: %v", err)
+		}
+		if len(segments) != 1 {
+			t.Errorf("Expected user to stay in A, but got %+v", segments)
+		}
+	})
+}
+
+func TestSql_CloneSegment(t *testing.T) {
+	ctx := context.Background()
+	storage := NewSqlStorage(pgPool)
+
+	if err := storage.InitDb(ctx); err != nil {
+		t.Fatalf("Could not init database: %v", err)
+	}
+
+	setup := func(t *testing.T) {
+		_, err := pgPool.Exec(ctx, "DELETE FROM users_in_segment; DELETE FROM segment;")
+		if err != nil {
+			t.Fatalf("Could not clean database: %v", err)
+		}
+		if err := storage.CreateSegment(ctx, "SOURCE"); err != nil {
+			t.Fatalf("Could not create test segment: %v", err)
+		}
+		for user := 1000; user < 1010; user++ {
+			if err := storage.AddUserToSegment(ctx, user, []string{"SOURCE"}); err != nil {
+				t.Fatalf("Could not add user to test segment: %v", err)
+			}
+		}
+	}
+	members := func(t *testing.T, segment string) []int {
+		users, err := storage.GetSegmentMembers(ctx, segment, 0, 100)
+		if err != nil {
+			t.Fatalf("Could not get segment members: %v", err)
+		}
+		return users
+	}
+
+	t.Run("given no options, expect every member copied", func(t *testing.T) {
+		setup(t)
+
+		copied, err := storage.CloneSegment(ctx, "SOURCE", "CLONE", domain.CloneOptions{})
+		if err != nil {
+			t.Fatalf("Expected to clone segment, but got error: %v", err)
+		}
+		if copied != 10 || !slices.Equal(members(t, "CLONE"), members(t, "SOURCE")) {
+			t.Errorf("Expected all 10 members copied, but got %d: %v", copied, members(t, "CLONE"))
+		}
+	})
+
+	t.Run("given sample size, expect that many of the members", func(t *testing.T) {
+		setup(t)
+
+		copied, err := storage.CloneSegment(ctx, "SOURCE", "CLONE", domain.CloneOptions{SampleSize: 3})
+		if err != nil {
+			t.Fatalf("Expected to clone segment, but got error: %v", err)
+		}
+		clone := members(t, "CLONE")
+		if copied != 3 || len(clone) != 3 {
+			t.Fatalf("Expected 3 members copied, but got %d: %v", copied, clone)
+		}
+		for _, user := range clone {
+			if user < 1000 || user >= 1010 {
+				t.Errorf("Expected only members of the source, but got %d", user)
+			}
+		}
+	})
+
+	t.Run("given join date, expect only members who joined after it", func(t *testing.T) {
+		setup(t)
+		_, err := pgPool.Exec(ctx, "UPDATE users_in_segment SET added_at = '2023-03-01' WHERE segment = 'SOURCE' AND user_id < 1005;")
+		if err != nil {
+			t.Fatalf("Could not backdate members: %v", err)
+		}
+
+		after := time.Date(2023, time.March, 2, 0, 0, 0, 0, time.UTC)
+		copied, err := storage.CloneSegment(ctx, "SOURCE", "CLONE", domain.CloneOptions{JoinedAfter: &after})
+		if err != nil {
+			t.Fatalf("Expected to clone segment, but got error: %v", err)
+		}
+		if want := []int{1005, 1006, 1007, 1008, 1009}; copied != 5 || !slices.Equal(members(t, "CLONE"), want) {
+			t.Errorf("Expected members %v copied, but got %d: %v", want, copied, members(t, "CLONE"))
+		}
+	})
+
+	t.Run("given members added before join dates were recorded, expect them dated by the change log", func(t *testing.T) {
+		setup(t)
+		// The members look as they did before the column existed: 1000-1004
+		// were added long ago, 1009 has no record of being added.
+		_, err := pgPool.Exec(ctx, `ALTER TABLE users_in_segment ALTER COLUMN added_at DROP NOT NULL;
+			UPDATE users_in_segment SET added_at = NULL WHERE segment = 'SOURCE';
+			UPDATE change_log SET created_at = '2023-03-01' WHERE segment = 'SOURCE' AND type = 'member_added' AND user_id < 1005;
+			DELETE FROM change_log WHERE segment = 'SOURCE' AND user_id = 1009;`)
+		if err != nil {
+			t.Fatalf("Could not drop join dates: %v", err)
+		}
+		if err := storage.InitDb(ctx); err != nil {
+			t.Fatalf("Could not init database: %v", err)
+		}
+
+		after := time.Date(2023, time.March, 2, 0, 0, 0, 0, time.UTC)
+		copied, err := storage.CloneSegment(ctx, "SOURCE", "CLONE", domain.CloneOptions{JoinedAfter: &after})
+		if err != nil {
+			t.Fatalf("Expected to clone segment, but got error: %v", err)
+		}
+		if want := []int{1005, 1006, 1007, 1008, 1009}; copied != 5 || !slices.Equal(members(t, "CLONE"), want) {
+			t.Errorf("Expected members %v copied, but got %d: %v", want, copied, members(t, "CLONE"))
+		}
+	})
+
+	t.Run("given missing source or taken name, expect error and nothing created", func(t *testing.T) {
+		setup(t)
+
+		if _, err := storage.CloneSegment(ctx, "MISSING", "CLONE", domain.CloneOptions{}); !errors.Is(err, domain.ErrSegmentNotFound) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrSegmentNotFound, err)
+		}
+		if _, err := storage.GetSegment(ctx, "CLONE"); !errors.Is(err, domain.ErrSegmentNotFound) {
+			t.Errorf("Expected no segment created, but got %v", err)
+		}
+		if _, err := storage.CloneSegment(ctx, "SOURCE", "SOURCE", domain.CloneOptions{}); !errors.Is(err, domain.ErrSegmentAlreadyExists) {
+			t.Errorf("Expected error %v, but got %v", domain.ErrSegmentAlreadyExists, err)
+		}
+	})
+}
@@ -0,0 +1,245 @@
+"use strict";
+
+const settings = JSON.parse(localStorage.getItem("settings") || "{}");
+
+function csrfToken() {
+  const cookie = document.cookie.split("; ").find((c) => c.startsWith("csrf_token="));
+  return cookie ? cookie.slice("csrf_token=".length) : "";
+}
+
+// api calls an endpoint of the service. GET parameters are sent in the query
+// string as JSON values, everything else as a JSON body.
+async function api(method, path, params) {
+  const headers = { "X-CSRF-Token": csrfToken() };
+  if (settings.tenant) headers["X-Tenant"] = settings.tenant;
+  if (settings.apiKey) headers["X-Api-Key"] = settings.apiKey;
+  if (settings.environment) headers["X-Environment"] = settings.environment;
+  if (settings.actor) headers["X-Actor"] = settings.actor;
+
+  let url = "/api/" + path;
+  const init = { method, headers, credentials: "same-origin" };
+  if (method === "GET") {
+    const query = new URLSearchParams();
+    for (const [key, value] of Object.entries(params || {})) {
+      query.set(key, JSON.stringify(value));
+    }
+    if ([...query].length > 0) url += "?" + query;
+  } else {
+    headers["Content-Type"] = "application/json";
+    init.body = JSON.stringify(params || {});
+  }
+
+  const resp = await fetch(url, init);
+  const text = await resp.text();
+  const body = text ? JSON.parse(text) : {};
+  if (resp.status === 202 && body.change_request) {
+    show(`Сегмент защищён: создана заявка №${body.change_request.id}, её должен одобрить другой человек.`);
+    return body;
+  }
+  if (!resp.ok || body.error || body.errors) {
+    const reason = body.error || (body.errors || []).join(", ") || resp.statusText;
+    throw new Error(reason);
+  }
+  return body;
+}
+
+function show(text, isError) {
+  const message = document.getElementById("message");
+  message.textContent = text;
+  message.className = isError ? "error" : "";
+  message.hidden = false;
+}
+
+function guard(fn) {
+  return async (...args) => {
+    try {
+      await fn(...args);
+    } catch (err) {
+      show(err.message, true);
+    }
+  };
+}
+
+function el(tag, text) {
+  const node = document.createElement(tag);
+  if (text !== undefined) node.textContent = text;
+  return node;
+}
+
+function splitList(value) {
+  return value.split(",").map((s) => s.trim()).filter(Boolean);
+}
+
+async function loadSegments() {
+  const { segments } = await api("GET", "get_segments");
+  const list = document.getElementById("segment-list");
+  list.replaceChildren();
+  for (const s of segments) {
+    const row = el("tr");
+    const name = el("td");
+    const link = el("a", s.segment);
+    link.addEventListener("click", guard(() => openSegment(s.segment)));
+    name.append(link);
+    row.append(
+      name,
+      el("td", String(s.members)),
+      el("td", s.max_members == null ? "—" : String(s.max_members)),
+      el("td", s.percentage == null ? "—" : s.percentage + "%"),
+      el("td", s.protected ? "защищён" : ""),
+    );
+    list.append(row);
+  }
+}
+
+let current = { segment: null, after: null };
+
+async function openSegment(name) {
+  const s = await api("GET", "get_segment", { segment: name });
+  current = { segment: name, after: null };
+
+  document.getElementById("segment").hidden = false;
+  document.getElementById("segment-name").textContent = name;
+
+  const details = document.getElementById("segment-details");
+  details.replaceChildren();
+  const rows = [
+    ["Пользователей", s.members],
+    ["Лимит", s.max_members ?? "нет"],
+    ["Процент раскатки", s.percentage == null ? "нет" : s.percentage + "%"],
+    ["Активен с", s.active_from ?? "—"],
+    ["Активен до", s.active_until ?? "—"],
+    ["Защищён", s.protected ? "да" : "нет"],
+  ];
+  for (const [term, value] of rows) {
+    details.append(el("dt", term), el("dd", String(value)));
+  }
+
+  document.getElementById("segment-members").replaceChildren();
+  await Promise.all([loadMembers(), loadHistory(name)]);
+}
+
+async function loadMembers() {
+  const params = { segment: current.segment };
+  if (current.after != null) params.after = current.after;
+  const page = await api("GET", "get_segment_members", params);
+
+  const list = document.getElementById("segment-members");
+  for (const user of page.members) {
+    const item = el("li");
+    const link = el("a", String(user));
+    link.href = "#";
+    link.addEventListener("click", guard((e) => {
+      e.preventDefault();
+      return openUser(user);
+    }));
+    item.append(link);
+    list.append(item);
+  }
+  current.after = page.after ?? null;
+  document.getElementById("more-members").hidden = current.after == null;
+}
+
+async function loadHistory(name) {
+  const to = new Date();
+  const from = new Date(to.getTime() - 30 * 24 * 60 * 60 * 1000);
+  const { sizes } = await api("GET", "get_segment_size_history", {
+    segment: name,
+    from: from.toISOString(),
+    to: to.toISOString(),
+    granularity: "day",
+  });
+
+  const svg = document.getElementById("segment-history");
+  svg.replaceChildren();
+  document.getElementById("segment-history-empty").hidden = sizes.length > 0;
+  if (sizes.length === 0) return;
+
+  const top = Math.max(1, ...sizes.map((s) => s.members));
+  const span = to.getTime() - from.getTime();
+  const points = sizes.map((s) => {
+    const x = ((new Date(s.at).getTime() - from.getTime()) / span) * 600;
+    const y = 145 - (s.members / top) * 140;
+    return `${x.toFixed(1)},${y.toFixed(1)}`;
+  });
+
+  const line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+  line.setAttribute("points", points.join(" "));
+  const title = document.createElementNS("http://www.w3.org/2000/svg", "title");
+  title.textContent = sizes.map((s) => `${s.at.slice(0, 10)}: ${s.members}`).join("\n");
+  line.append(title);
+  svg.append(line);
+}
+
+async function openUser(user) {
+  const resp = await api("GET", "get_user_segments", { user_id: user });
+  document.getElementById("user-details").hidden = false;
+  document.getElementById("user-id").textContent = String(resp.user_id);
+  document.querySelector("#find-user [name=user]").value = String(resp.user_id);
+
+  const list = document.getElementById("user-segments");
+  list.replaceChildren();
+  for (const name of resp.user_segments || []) {
+    list.append(el("li", name));
+  }
+  if (list.children.length === 0) list.append(el("li", "нет сегментов"));
+}
+
+function init() {
+  const form = document.getElementById("settings");
+  for (const input of form.elements) {
+    if (input.name) input.value = settings[input.name] || "";
+  }
+  form.addEventListener("submit", guard(async (e) => {
+    e.preventDefault();
+    for (const input of form.elements) {
+      if (input.name) settings[input.name] = input.value.trim();
+    }
+    localStorage.setItem("settings", JSON.stringify(settings));
+    show("Настройки сохранены.");
+    await loadSegments();
+  }));
+
+  document.getElementById("create-segment").addEventListener("submit", guard(async (e) => {
+    e.preventDefault();
+    const name = e.target.elements.segment.value.trim();
+    await api("POST", "create_segment", { segment: name });
+    e.target.reset();
+    show(`Сегмент ${name} создан.`);
+    await loadSegments();
+  }));
+
+  document.getElementById("delete-segment").addEventListener("click", guard(async () => {
+    const name = current.segment;
+    if (!name || !confirm(`Удалить сегмент ${name}?`)) return;
+    const resp = await api("POST", "delete_segment", { segment: name });
+    if (!resp.change_request) {
+      show(`Сегмент ${name} удалён.`);
+      document.getElementById("segment").hidden = true;
+    }
+    await loadSegments();
+  }));
+
+  document.getElementById("more-members").addEventListener("click", guard(loadMembers));
+
+  document.getElementById("find-user").addEventListener("submit", guard(async (e) => {
+    e.preventDefault();
+    await openUser(Number(e.target.elements.user.value));
+  }));
+
+  document.getElementById("change-user").addEventListener("submit", guard(async (e) => {
+    e.preventDefault();
+    const user = Number(document.getElementById("user-id").textContent);
+    const resp = await api("POST", "change_user_segments", {
+      user_id: user,
+      segments_to_add: splitList(e.target.elements.add.value),
+      segments_to_delete: splitList(e.target.elements.delete.value),
+    });
+    e.target.reset();
+    if (!resp.change_request) show(`Сегменты пользователя изменены, операция №${resp.operation_id}.`);
+    await Promise.all([openUser(user), loadSegments()]);
+  }));
+
+  guard(loadSegments)();
+}
+
+init();
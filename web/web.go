@@ -0,0 +1,38 @@
+// Package web serves the admin UI. The UI is a static page that works
+// through the same /api endpoints as any other client.
+package web
+
+import (
+	"assignment/api"
+	"embed"
+	"io/fs"
+	"log/slog"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the UI files, it's meant to be mounted with
+// http.StripPrefix. Every response hands out the CSRF token the UI needs to
+// call the API.
+func Handler(log *slog.Logger) http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := api.SetCSRFCookie(w, req); err != nil {
+			log.ErrorContext(req.Context(), "failed to set csrf cookie", slog.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, req)
+	})
+}